@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSubsystemNotFound = errors.New("subsystem not found")
+	ErrDependency        = errors.New("dependency check failed")
+)
+
+// Subsystem is a part of ng-monitoring that can be stopped and started at
+// runtime for maintenance and debugging.
+type Subsystem struct {
+	Name string
+	// DependsOn lists subsystems which must be running while this one is running.
+	DependsOn []string
+	Start     func() error
+	Stop      func() error
+}
+
+type SubsystemStatus struct {
+	Name      string   `json:"name"`
+	Running   bool     `json:"running"`
+	DependsOn []string `json:"depends_on"`
+}
+
+type subsystem struct {
+	Subsystem
+	running bool
+}
+
+var (
+	mu         sync.Mutex
+	subsystems []*subsystem
+)
+
+// Register registers a subsystem which is already running.
+func Register(s Subsystem) {
+	mu.Lock()
+	defer mu.Unlock()
+	subsystems = append(subsystems, &subsystem{Subsystem: s, running: true})
+}
+
+func Subsystems() []SubsystemStatus {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res := make([]SubsystemStatus, 0, len(subsystems))
+	for _, s := range subsystems {
+		res = append(res, SubsystemStatus{
+			Name:      s.Name,
+			Running:   s.running,
+			DependsOn: s.DependsOn,
+		})
+	}
+	return res
+}
+
+// StartSubsystem starts the subsystem if all its dependencies are running.
+func StartSubsystem(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := find(name)
+	if s == nil {
+		return fmt.Errorf("%w: %s", ErrSubsystemNotFound, name)
+	}
+	if s.running {
+		return nil
+	}
+	for _, dep := range s.DependsOn {
+		if d := find(dep); d != nil && !d.running {
+			return fmt.Errorf("%w: %s depends on %s which is stopped", ErrDependency, name, dep)
+		}
+	}
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+	s.running = true
+	log.Info("subsystem started", zap.String("name", name))
+	return nil
+}
+
+// StopSubsystem stops the subsystem if no running subsystem depends on it.
+func StopSubsystem(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := find(name)
+	if s == nil {
+		return fmt.Errorf("%w: %s", ErrSubsystemNotFound, name)
+	}
+	if !s.running {
+		return nil
+	}
+	for _, other := range subsystems {
+		if !other.running {
+			continue
+		}
+		for _, dep := range other.DependsOn {
+			if dep == name {
+				return fmt.Errorf("%w: %s is running and depends on %s", ErrDependency, other.Name, name)
+			}
+		}
+	}
+
+	if err := s.Stop(); err != nil {
+		return err
+	}
+	s.running = false
+	log.Info("subsystem stopped", zap.String("name", name))
+	return nil
+}
+
+func find(name string) *subsystem {
+	for _, s := range subsystems {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
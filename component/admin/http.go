@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/zhongzc/ng_monitoring/component/featureflag"
+
+	"github.com/gin-gonic/gin"
+)
+
+func HTTPService(g *gin.RouterGroup) {
+	g.GET("/subsystems", handleSubsystems)
+	g.POST("/subsystems/:name/start", handleStartSubsystem)
+	g.POST("/subsystems/:name/stop", handleStopSubsystem)
+	g.GET("/feature_flags", handleFeatureFlags)
+	g.POST("/feature_flags/:name", handleSetFeatureFlag)
+	g.DELETE("/feature_flags/:name", handleResetFeatureFlag)
+}
+
+func handleSubsystems(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   Subsystems(),
+	})
+}
+
+func handleStartSubsystem(c *gin.Context) {
+	respond(c, StartSubsystem(c.Param("name")))
+}
+
+func handleStopSubsystem(c *gin.Context) {
+	respond(c, StopSubsystem(c.Param("name")))
+}
+
+func handleFeatureFlags(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   featureflag.Flags(),
+	})
+}
+
+// handleSetFeatureFlag overrides the flag by the body, e.g. `{"value": true}`.
+func handleSetFeatureFlag(c *gin.Context) {
+	var body struct {
+		Value json.RawMessage `json:"value" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	respond(c, featureflag.Set(c.Param("name"), body.Value))
+}
+
+func handleResetFeatureFlag(c *gin.Context) {
+	respond(c, featureflag.Reset(c.Param("name")))
+}
+
+func respond(c *gin.Context, err error) {
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+		return
+	}
+
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrSubsystemNotFound), errors.Is(err, featureflag.ErrFlagNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrDependency):
+		code = http.StatusConflict
+	case errors.Is(err, featureflag.ErrInvalidValue):
+		code = http.StatusBadRequest
+	}
+	c.JSON(code, gin.H{
+		"status":  "error",
+		"message": err.Error(),
+	})
+}
@@ -2,6 +2,7 @@ package conprof
 
 import (
 	"github.com/genjidb/genji"
+	"github.com/zhongzc/ng_monitoring/component/admin"
 	"github.com/zhongzc/ng_monitoring/component/conprof/scrape"
 	"github.com/zhongzc/ng_monitoring/component/conprof/store"
 	"github.com/zhongzc/ng_monitoring/component/topology"
@@ -20,6 +21,12 @@ func Init(db *genji.DB, subscriber topology.Subscriber) error {
 	}
 	manager = scrape.NewManager(storage, subscriber)
 	manager.Start()
+
+	admin.Register(admin.Subsystem{
+		Name:  "conprof-retention",
+		Start: func() error { storage.StartGC(); return nil },
+		Stop:  func() error { storage.StopGC(); return nil },
+	})
 	return nil
 }
 
@@ -2,6 +2,7 @@ package http
 
 import (
 	"archive/zip"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -13,18 +14,26 @@ import (
 	"github.com/pingcap/log"
 	"github.com/zhongzc/ng_monitoring/component/conprof"
 	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/scrape"
 	"github.com/zhongzc/ng_monitoring/component/topology"
 	"github.com/zhongzc/ng_monitoring/config"
 	"go.uber.org/zap"
 )
 
 func HTTPService(g *gin.RouterGroup) {
+	g.GET("/list", handleList)
 	g.GET("/group_profiles", handleGroupProfiles)
 	g.GET("/group_profile/detail", handleGroupProfileDetail)
 	g.GET("/single_profile/view", handleSingleProfileView)
+	g.GET("/single_profile/download", handleSingleProfileDownload)
+	g.GET("/single_profile/diff", handleDiff)
+	g.GET("/single_profile/merged", handleMergedProfile)
 	g.GET("/download", handleDownload)
 	g.GET("/components", handleComponents)
+	g.GET("/status", handleStatus)
 	g.GET("/estimate_size", handleEstimateSize)
+	g.POST("/manual_profiling", handleTriggerProfiling)
+	g.GET("/manual_profiling", handleManualProfilingTask)
 }
 
 func handleGroupProfiles(c *gin.Context) {
@@ -39,6 +48,18 @@ func handleGroupProfiles(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
+func handleList(c *gin.Context) {
+	result, err := queryList(c)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func handleGroupProfileDetail(c *gin.Context) {
 	result, err := queryGroupProfileDetail(c)
 	if err != nil {
@@ -52,7 +73,7 @@ func handleGroupProfileDetail(c *gin.Context) {
 }
 
 func handleSingleProfileView(c *gin.Context) {
-	result, err := querySingleProfileView(c)
+	result, dataFormat, err := querySingleProfileView(c)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"status":  "error",
@@ -60,8 +81,104 @@ func handleSingleProfileView(c *gin.Context) {
 		})
 		return
 	}
-	c.Writer.WriteHeader(http.StatusOK)
-	c.Writer.Write(result)
+	c.Data(http.StatusOK, contentTypeOf(dataFormat), result)
+}
+
+// handleSingleProfileDownload downloads a profile as stored, e.g. pprof
+// pb.gz of Go components, protobuf or SVG of TiKV.
+func handleSingleProfileDownload(c *gin.Context) {
+	param, err := getTsAndTargetParam(c.Request)
+	if err == nil {
+		err = getLimitParam(c.Request, param)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	found := false
+	var fileName, dataFormat string
+	var profileData []byte
+	err = conprof.GetStorage().QueryProfileData(param, func(pt meta.ProfileTarget, ts int64, format string, data []byte) error {
+		found = true
+		fileName, dataFormat, profileData = profileFileName(pt, ts, format, data), format, data
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": "profile not found",
+		})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	c.Data(http.StatusOK, contentTypeOf(dataFormat), profileData)
+}
+
+// profileFileName names the profile with the extension of its data format.
+func profileFileName(pt meta.ProfileTarget, ts int64, dataFormat string, data []byte) string {
+	fileName := fmt.Sprintf("%v_%v_%v_%v", pt.Kind, pt.Component, pt.Address, ts)
+	fileName = strings.ReplaceAll(fileName, ":", "_")
+	switch dataFormat {
+	case meta.ProfileDataFormatSVG:
+		return fileName + ".svg"
+	case meta.ProfileDataFormatText:
+		return fileName + ".txt"
+	case meta.ProfileDataFormatSpeedscope:
+		return fileName + ".speedscope.json"
+	}
+	// Go components respond gzipped protobuf
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return fileName + ".pb.gz"
+	}
+	return fileName + ".pb"
+}
+
+func contentTypeOf(dataFormat string) string {
+	switch dataFormat {
+	case meta.ProfileDataFormatSVG:
+		return "image/svg+xml"
+	case meta.ProfileDataFormatText:
+		return "text/plain; charset=utf-8"
+	case meta.ProfileDataFormatSpeedscope:
+		return "application/json"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// convertDataFormat converts protobuf profiles into the data format,
+// otherwise they are kept as stored, e.g. SVG flamegraphs of TiKV or
+// goroutine dumps.
+func convertDataFormat(data []byte, from, to string) ([]byte, string) {
+	if from != meta.ProfileDataFormatProtobuf {
+		return data, from
+	}
+	switch to {
+	case meta.ProfileDataFormatSVG:
+		if svg, err := ConvertToSVG(data); err == nil {
+			return svg, meta.ProfileDataFormatSVG
+		}
+	case meta.ProfileDataFormatFlameGraph:
+		if svg, err := ConvertToFlameGraph(data); err == nil {
+			return svg, meta.ProfileDataFormatSVG
+		}
+	case meta.ProfileDataFormatSpeedscope:
+		if speedscope, err := ConvertToSpeedscope(data); err == nil {
+			return speedscope, meta.ProfileDataFormatSpeedscope
+		}
+	}
+	return data, from
 }
 
 func handleDownload(c *gin.Context) {
@@ -80,44 +197,86 @@ func handleComponents(c *gin.Context) {
 	c.JSON(http.StatusOK, components)
 }
 
+// handleStatus responds results of the last scrapes of targets being
+// scraped, optionally filtered by `component`, `address`, `profile_type` and
+// `state`, e.g. `state=failed` for failing targets.
+func handleStatus(c *gin.Context) {
+	component, address, kind, state := c.Query("component"), c.Query("address"), c.Query("profile_type"), c.Query("state")
+	statuses := make([]scrape.ScrapeStatus, 0)
+	for _, status := range conprof.GetManager().ScrapeStatuses() {
+		if (len(component) == 0 || status.Component == component) &&
+			(len(address) == 0 || status.Address == address) &&
+			(len(kind) == 0 || status.Kind == kind) &&
+			(len(state) == 0 || status.State == state) {
+			statuses = append(statuses, status)
+		}
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
 type EstimateSize struct {
 	InstanceCount int `json:"instance_count"`
 	ProfileSize   int `json:"profile_size"`
 }
 
+// handleEstimateSize estimates the size of profiles stored per day, by
+// sizes observed of profiles lastly stored, or built-in ones of profiles not
+// stored yet, and by schedules of profile kinds.
 func handleEstimateSize(c *gin.Context) {
 	components := topology.GetCurrentComponent()
+	observedSizes := conprof.GetManager().ObservedProfileSizes()
 	totalSize := 0
+	instanceCount := 0
 	for _, comp := range components {
-		size := getProfileEstimateSize(comp)
-		totalSize += size
+		if !comp.IsUp() {
+			continue
+		}
+		for kind, schedule := range conprof.GetManager().ProfileSchedules(comp) {
+			size, ok := observedSizes[comp.Name][kind]
+			if !ok {
+				size = getProfileEstimateSize(comp.Name, kind)
+			}
+			totalSize += (24 * 60 * 60 / schedule.IntervalSeconds) * size
+		}
+		instanceCount++
 	}
-	cfg := config.GetGlobalConfig().ContinueProfiling
-	estimateSize := (24 * 60 * 60 / cfg.IntervalSeconds) * totalSize
 	c.JSON(http.StatusOK, EstimateSize{
-		InstanceCount: len(components),
-		ProfileSize:   estimateSize,
+		InstanceCount: instanceCount,
+		ProfileSize:   totalSize,
 	})
 }
 
-var defaultProfileSize = 128 * 1024
-
-func getProfileEstimateSize(component topology.Component) int {
-	switch component.Name {
-	case topology.ComponentPD:
-		return 20*1024 + // profile size
-			25*1024 + // goroutine size
-			100*1024 + // heap size
-			30*1024 // mutex size
-	case topology.ComponentTiDB:
-		return 100*1024 + // profile size
-			100*1024 + // goroutine size
-			400*1024 + // heap size
-			30*1024 // mutex size
-	case topology.ComponentTiKV:
-		return 200 * 1024 // profile size
-	case topology.ComponentTiFlash:
-		return 200 * 1024 // profile size
+var (
+	defaultProfileSize = 128 * 1024
+	// defaultProfileSizes are sizes of profile kinds by component, which are
+	// used until profiles are stored.
+	defaultProfileSizes = map[string]map[string]int{
+		topology.ComponentPD: {
+			meta.ProfileKindProfile:   20 * 1024,
+			meta.ProfileKindGoroutine: 25 * 1024,
+			meta.ProfileKindHeap:      100 * 1024,
+			meta.ProfileKindMutex:     30 * 1024,
+			meta.ProfileKindBlock:     30 * 1024,
+		},
+		topology.ComponentTiDB: {
+			meta.ProfileKindProfile:   100 * 1024,
+			meta.ProfileKindGoroutine: 100 * 1024,
+			meta.ProfileKindHeap:      400 * 1024,
+			meta.ProfileKindMutex:     30 * 1024,
+			meta.ProfileKindBlock:     30 * 1024,
+		},
+		topology.ComponentTiKV: {
+			meta.ProfileKindProfile: 200 * 1024,
+		},
+		topology.ComponentTiFlash: {
+			meta.ProfileKindProfile: 200 * 1024,
+		},
+	}
+)
+
+func getProfileEstimateSize(component, kind string) int {
+	if size, ok := defaultProfileSizes[component][kind]; ok {
+		return size
 	}
 	return defaultProfileSize
 }
@@ -161,6 +320,62 @@ type Target struct {
 	Address   string `json:"address"`
 }
 
+// ProfileItem is a stored profile, which can be viewed by its fields as
+// the params of /single_profile/view.
+type ProfileItem struct {
+	Ts     int64  `json:"ts"`
+	Type   string `json:"profile_type"`
+	Target Target `json:"target"`
+}
+
+// queryList lists stored profiles within the time range, optionally
+// filtered by `component`, `address` and `profile_type`. The limit is of
+// each target.
+func queryList(c *gin.Context) ([]ProfileItem, error) {
+	param, err := getBeginAndEndTimeParam(c.Request)
+	if err != nil {
+		return nil, err
+	}
+	err = getLimitParam(c.Request, param)
+	if err != nil {
+		return nil, err
+	}
+
+	getTargetFilterParam(c.Request, param)
+	items := make([]ProfileItem, 0)
+	// no targets means all targets
+	if len(param.Targets) == 0 {
+		return items, nil
+	}
+
+	profileLists, err := conprof.GetStorage().QueryGroupProfiles(param)
+	if err != nil {
+		return nil, err
+	}
+	for _, plist := range profileLists {
+		for _, ts := range plist.TsList {
+			items = append(items, ProfileItem{
+				Ts:   ts,
+				Type: plist.Target.Kind,
+				Target: Target{
+					Component: plist.Target.Component,
+					Address:   plist.Target.Address,
+				},
+			})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Ts != items[j].Ts {
+			return items[i].Ts > items[j].Ts
+		}
+		if items[i].Target.Address != items[j].Target.Address {
+			return items[i].Target.Address < items[j].Target.Address
+		}
+		return items[i].Type < items[j].Type
+	})
+	return items, nil
+}
+
 func queryGroupProfiles(c *gin.Context) ([]GroupProfiles, error) {
 	param, err := getBeginAndEndTimeParam(c.Request)
 	if err != nil {
@@ -259,38 +474,59 @@ func queryGroupProfileDetail(c *gin.Context) (*GroupProfileDetail, error) {
 	}, nil
 }
 
-func querySingleProfileView(c *gin.Context) ([]byte, error) {
+func querySingleProfileView(c *gin.Context) ([]byte, string, error) {
 	param, err := getTsAndTargetParam(c.Request)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	err = getLimitParam(c.Request, param)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	err = getDataFormatParam(c.Request, param)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	var profileData []byte
-	err = conprof.GetStorage().QueryProfileData(param, func(target meta.ProfileTarget, ts int64, data []byte) error {
-		profileData = data
+	var profileDataFormat string
+	err = conprof.GetStorage().QueryProfileData(param, func(target meta.ProfileTarget, ts int64, dataFormat string, data []byte) error {
+		profileData, profileDataFormat = data, dataFormat
 		return nil
 	})
 	if err != nil {
-		return nil, err
-	}
-	if param.DataFormat == meta.ProfileDataFormatSVG {
-		if svg, err := ConvertToSVG(profileData); err == nil {
-			return svg, nil
-		}
+		return nil, "", err
 	}
-	return profileData, nil
+	profileData, profileDataFormat = convertDataFormat(profileData, profileDataFormat, param.DataFormat)
+	return profileData, profileDataFormat, nil
 }
 
+// Manifest lists profiles in the zip of /download.
+type Manifest struct {
+	Begin    int64           `json:"begin_time"`
+	End      int64           `json:"end_time"`
+	Profiles []ManifestEntry `json:"profiles"`
+}
+
+type ManifestEntry struct {
+	File       string `json:"file"`
+	DataFormat string `json:"data_format"`
+	ProfileItem
+}
+
+const manifestFileName = "manifest.json"
+
+// queryAndDownload zips profiles at `ts`, or within `begin_time` and
+// `end_time`, e.g. of the whole cluster during an incident, along with a
+// manifest. They can be filtered like queryList.
 func queryAndDownload(c *gin.Context) error {
-	param, err := getTsParam(c.Request)
+	var param *meta.BasicQueryParam
+	var err error
+	if len(c.Query(tsParamStr)) != 0 {
+		param, err = getTsParam(c.Request)
+	} else {
+		param, err = getBeginAndEndTimeParam(c.Request)
+	}
 	if err != nil {
 		return err
 	}
@@ -302,28 +538,32 @@ func queryAndDownload(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	// no targets means all targets
+	if getTargetFilterParam(c.Request, param) && len(param.Targets) == 0 {
+		return fmt.Errorf("no profiles matched")
+	}
 
 	c.Writer.Header().
 		Set("Content-Disposition",
-			fmt.Sprintf(`attachment; filename="profile"`+time.Unix(param.Begin, 0).Format("2006-01-02_15-04-05")+".zip"))
+			fmt.Sprintf(`attachment; filename="profile_%s.zip"`, time.Unix(param.Begin, 0).Format("2006-01-02_15-04-05")))
 	zw := zip.NewWriter(c.Writer)
-	fn := func(pt meta.ProfileTarget, ts int64, data []byte) error {
-		fileName := fmt.Sprintf("%v_%v_%v_%v", pt.Kind, pt.Component, pt.Address, ts)
-		fileName = strings.ReplaceAll(fileName, ":", "_")
-		if param.DataFormat == meta.ProfileDataFormatSVG {
-			svg, err := ConvertToSVG(data)
-			if err == nil {
-				data = svg
-				fileName += ".svg"
-			}
-		}
-		if pt.Kind == meta.ProfileKindGoroutine {
-			fileName += ".txt"
-		}
+	manifest := Manifest{Begin: param.Begin, End: param.End, Profiles: make([]ManifestEntry, 0)}
+	fn := func(pt meta.ProfileTarget, ts int64, dataFormat string, data []byte) error {
+		data, dataFormat = convertDataFormat(data, dataFormat, param.DataFormat)
+		fileName := profileFileName(pt, ts, dataFormat, data)
 		fw, err := zw.Create(fileName)
 		if err != nil {
 			return err
 		}
+		manifest.Profiles = append(manifest.Profiles, ManifestEntry{
+			File:       fileName,
+			DataFormat: dataFormat,
+			ProfileItem: ProfileItem{
+				Ts:     ts,
+				Type:   pt.Kind,
+				Target: Target{Component: pt.Component, Address: pt.Address},
+			},
+		})
 		_, err = fw.Write(data)
 		return err
 	}
@@ -332,7 +572,18 @@ func queryAndDownload(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	err = zw.Close()
+	sort.Slice(manifest.Profiles, func(i, j int) bool {
+		return manifest.Profiles[i].File < manifest.Profiles[j].File
+	})
+	fw, err := zw.Create(manifestFileName)
+	if err == nil {
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
 	if err != nil {
 		log.Error("handle download request failed", zap.Error(err))
 	}
@@ -398,11 +649,11 @@ func getLimitParam(r *http.Request, param *meta.BasicQueryParam) error {
 func getDataFormatParam(r *http.Request, param *meta.BasicQueryParam) error {
 	if v := r.FormValue(dataFormatParamStr); len(v) > 0 {
 		switch v {
-		case meta.ProfileDataFormatSVG, meta.ProfileDataFormatProtobuf:
+		case meta.ProfileDataFormatSVG, meta.ProfileDataFormatProtobuf, meta.ProfileDataFormatFlameGraph, meta.ProfileDataFormatSpeedscope:
 			param.DataFormat = v
 		default:
-			return fmt.Errorf("invalid param %v value %v, expected: %v, %v",
-				dataFormatParamStr, v, meta.ProfileDataFormatSVG, meta.ProfileDataFormatProtobuf)
+			return fmt.Errorf("invalid param %v value %v, expected: %v, %v, %v, %v",
+				dataFormatParamStr, v, meta.ProfileDataFormatSVG, meta.ProfileDataFormatProtobuf, meta.ProfileDataFormatFlameGraph, meta.ProfileDataFormatSpeedscope)
 		}
 	} else {
 		param.DataFormat = defdataFormatParam
@@ -410,25 +661,75 @@ func getDataFormatParam(r *http.Request, param *meta.BasicQueryParam) error {
 	return nil
 }
 
+// getTargetFilterParam sets targets filtered by `component`, `address` and
+// `profile_type`, and tells if any filter is given.
+func getTargetFilterParam(r *http.Request, param *meta.BasicQueryParam) bool {
+	component, address, kind := r.FormValue("component"), r.FormValue("address"), r.FormValue("profile_type")
+	for _, pt := range conprof.GetStorage().Targets() {
+		if (len(component) == 0 || pt.Component == component) &&
+			(len(address) == 0 || pt.Address == address) &&
+			(len(kind) == 0 || pt.Kind == kind) {
+			param.Targets = append(param.Targets, pt)
+		}
+	}
+	return len(component) != 0 || len(address) != 0 || len(kind) != 0
+}
+
 func getTsAndTargetParam(r *http.Request) (*meta.BasicQueryParam, error) {
 	queryParam, err := getTsParam(r)
 	if err != nil {
 		return nil, err
 	}
+	if err = getTargetParam(r, queryParam); err != nil {
+		return nil, err
+	}
+	return queryParam, nil
+}
+
+// getTargetParam sets the target given by `profile_type`, `component` and
+// `address`, which are all required.
+func getTargetParam(r *http.Request, param *meta.BasicQueryParam) error {
 	params := []string{"profile_type", "component", "address"}
 	values := make([]string, len(params))
-	for i, param := range params {
-		if v := r.FormValue(param); len(v) > 0 {
+	for i, p := range params {
+		if v := r.FormValue(p); len(v) > 0 {
 			values[i] = v
 		} else {
-			return nil, fmt.Errorf("need param %v", param)
+			return fmt.Errorf("need param %v", p)
 		}
 	}
-	queryParam.Targets = append(queryParam.Targets, meta.ProfileTarget{
+	param.Targets = append(param.Targets, meta.ProfileTarget{
 		Kind:      values[0],
 		Component: values[1],
 		Address:   values[2],
 	})
+	return nil
+}
+
+// getWindowParam gets the time range of a timestamp, or of begin and end
+// time, by the names of params.
+func getWindowParam(r *http.Request, tsParam, beginParam, endParam string) (*meta.BasicQueryParam, error) {
+	queryParam := &meta.BasicQueryParam{}
+	if ts, ok, err := parseIntParamFromRequest(r, tsParam); err != nil {
+		return nil, fmt.Errorf("invalid param %v value, error: %v", tsParam, err)
+	} else if ok {
+		queryParam.Begin, queryParam.End = ts, ts
+		return queryParam, nil
+	}
+	for _, field := range []string{beginParam, endParam} {
+		v, ok, err := parseIntParamFromRequest(r, field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid param %v value, error: %v", field, err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("need param %v, or %v and %v", tsParam, beginParam, endParam)
+		}
+		if field == beginParam {
+			queryParam.Begin = v
+		} else {
+			queryParam.End = v
+		}
+	}
 	return queryParam, nil
 }
 
@@ -0,0 +1,283 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof"
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/pprof/profile"
+)
+
+const defDiffTop = 20
+
+// ProfileDiff lists functions whose values changed most from the base
+// profile, by the default sample type, e.g. cpu or inuse_space.
+type ProfileDiff struct {
+	SampleType string         `json:"sample_type"`
+	Unit       string         `json:"unit"`
+	BaseTotal  int64          `json:"base_total"`
+	Total      int64          `json:"total"`
+	Functions  []FunctionDiff `json:"functions"`
+}
+
+type FunctionDiff struct {
+	Function  string `json:"function"`
+	BaseFlat  int64  `json:"base_flat"`
+	Flat      int64  `json:"flat"`
+	FlatDelta int64  `json:"flat_delta"`
+	BaseCum   int64  `json:"base_cum"`
+	Cum       int64  `json:"cum"`
+	CumDelta  int64  `json:"cum_delta"`
+}
+
+// handleDiff diffs profiles of a target at `ts`, or merged within
+// `begin_time` and `end_time`, against those at `base_ts`, or within
+// `base_begin_time` and `base_end_time`. It responds top functions by
+// default, the diff profile with `data_format=protobuf` which can be viewed
+// by pprof, or a diff flamegraph with `data_format=flamegraph`.
+func handleDiff(c *gin.Context) {
+	base, p, err := queryDiffProfiles(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	switch c.Query(dataFormatParamStr) {
+	case meta.ProfileDataFormatProtobuf:
+		diff, err := diffProfile(base, p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+		var buf bytes.Buffer
+		if err = diff.Write(&buf); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+		c.Data(http.StatusOK, contentTypeOf(meta.ProfileDataFormatProtobuf), buf.Bytes())
+	case meta.ProfileDataFormatFlameGraph:
+		c.Data(http.StatusOK, contentTypeOf(meta.ProfileDataFormatSVG), ConvertToDiffFlameGraph(base, p))
+	case "":
+		top := defDiffTop
+		if v := c.Query("top"); len(v) != 0 {
+			top, err = strconv.Atoi(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  "error",
+					"message": fmt.Sprintf("invalid param top value, error: %v", err),
+				})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, diffFunctions(base, p, top))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"message": fmt.Sprintf("invalid param %v value %v, expected: %v, %v",
+				dataFormatParamStr, c.Query(dataFormatParamStr), meta.ProfileDataFormatProtobuf, meta.ProfileDataFormatFlameGraph),
+		})
+	}
+}
+
+func queryDiffProfiles(r *http.Request) (base, p *profile.Profile, err error) {
+	baseParam, err := getWindowParam(r, "base_ts", "base_begin_time", "base_end_time")
+	if err != nil {
+		return nil, nil, err
+	}
+	param, err := getWindowParam(r, tsParamStr, beginTimeParamStr, endTimeParamStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = getTargetParam(r, baseParam); err != nil {
+		return nil, nil, err
+	}
+	param.Targets = baseParam.Targets
+
+	base, err = queryMergedProfile(baseParam)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query base profile failed: %v", err)
+	}
+	p, err = queryMergedProfile(param)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sameSampleTypes(base, p) {
+		return nil, nil, fmt.Errorf("profiles of different sample types can't be diffed")
+	}
+	return base, p, nil
+}
+
+// handleMergedProfile merges profiles of a target within `begin_time` and
+// `end_time`, e.g. CPU profiles showing sustained hotspots rather than
+// those of a single profiling. It responds protobuf by default, or another
+// data format by `data_format`.
+func handleMergedProfile(c *gin.Context) {
+	param, err := getBeginAndEndTimeParam(c.Request)
+	if err == nil {
+		err = getTargetParam(c.Request, param)
+	}
+	if err == nil {
+		err = getLimitParam(c.Request, param)
+	}
+	if err == nil {
+		err = getDataFormatParam(c.Request, param)
+		if len(c.Query(dataFormatParamStr)) == 0 {
+			param.DataFormat = meta.ProfileDataFormatProtobuf
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	p, err := queryMergedProfile(param)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	var buf bytes.Buffer
+	if err = p.Write(&buf); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	data, dataFormat := convertDataFormat(buf.Bytes(), meta.ProfileDataFormatProtobuf, param.DataFormat)
+	c.Data(http.StatusOK, contentTypeOf(dataFormat), data)
+}
+
+// queryMergedProfile merges protobuf profiles of the target within the time
+// range into one, at most `limit` of them.
+func queryMergedProfile(param *meta.BasicQueryParam) (*profile.Profile, error) {
+	var profiles []*profile.Profile
+	err := conprof.GetStorage().QueryProfileData(param, func(pt meta.ProfileTarget, ts int64, dataFormat string, data []byte) error {
+		if dataFormat != meta.ProfileDataFormatProtobuf {
+			return fmt.Errorf("profiles of data format %v can't be merged", dataFormat)
+		}
+		p, err := profile.ParseData(data)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("profile not found")
+	}
+	return profile.Merge(profiles)
+}
+
+func sameSampleTypes(p1, p2 *profile.Profile) bool {
+	if len(p1.SampleType) != len(p2.SampleType) {
+		return false
+	}
+	for i := range p1.SampleType {
+		if p1.SampleType[i].Type != p2.SampleType[i].Type || p1.SampleType[i].Unit != p2.SampleType[i].Unit {
+			return false
+		}
+	}
+	return true
+}
+
+// diffProfile subtracts the base profile from the profile, like
+// `pprof -diff_base`.
+func diffProfile(base, p *profile.Profile) (*profile.Profile, error) {
+	base = base.Copy()
+	base.Scale(-1)
+	return profile.Merge([]*profile.Profile{base, p})
+}
+
+func diffFunctions(base, p *profile.Profile, top int) ProfileDiff {
+	index := defaultSampleIndex(p)
+	diffs := make(map[string]*FunctionDiff)
+	addSamples := func(p *profile.Profile, flatOf, cumOf func(*FunctionDiff) *int64) int64 {
+		var total int64
+		for _, s := range p.Sample {
+			value := s.Value[index]
+			total += value
+			frames := sampleFrames(s)
+			seen := make(map[string]struct{}, len(frames))
+			for i, name := range frames {
+				diff, ok := diffs[name]
+				if !ok {
+					diff = &FunctionDiff{Function: name}
+					diffs[name] = diff
+				}
+				if i == len(frames)-1 {
+					*flatOf(diff) += value
+				}
+				// recursive functions are counted once
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					*cumOf(diff) += value
+				}
+			}
+		}
+		return total
+	}
+	result := ProfileDiff{
+		SampleType: p.SampleType[index].Type,
+		Unit:       p.SampleType[index].Unit,
+		Functions:  make([]FunctionDiff, 0),
+	}
+	result.BaseTotal = addSamples(base,
+		func(d *FunctionDiff) *int64 { return &d.BaseFlat },
+		func(d *FunctionDiff) *int64 { return &d.BaseCum })
+	result.Total = addSamples(p,
+		func(d *FunctionDiff) *int64 { return &d.Flat },
+		func(d *FunctionDiff) *int64 { return &d.Cum })
+
+	for _, diff := range diffs {
+		diff.FlatDelta = diff.Flat - diff.BaseFlat
+		diff.CumDelta = diff.Cum - diff.BaseCum
+		if diff.FlatDelta != 0 || diff.CumDelta != 0 {
+			result.Functions = append(result.Functions, *diff)
+		}
+	}
+	sort.Slice(result.Functions, func(i, j int) bool {
+		fi, fj := result.Functions[i], result.Functions[j]
+		if abs(fi.FlatDelta) != abs(fj.FlatDelta) {
+			return abs(fi.FlatDelta) > abs(fj.FlatDelta)
+		}
+		if abs(fi.CumDelta) != abs(fj.CumDelta) {
+			return abs(fi.CumDelta) > abs(fj.CumDelta)
+		}
+		return fi.Function < fj.Function
+	})
+	if top > 0 && len(result.Functions) > top {
+		result.Functions = result.Functions[:top]
+	}
+	return result
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
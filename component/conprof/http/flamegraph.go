@@ -0,0 +1,267 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+const (
+	flameGraphWidth       = 1200
+	flameGraphFrameHeight = 16
+	flameGraphPadding     = 24
+	// frames narrower than it are left out, which can't be seen anyway
+	flameGraphMinFrameWidth = 0.1
+	// flameGraphCharWidth approximates the width of a character of 12px
+	// monospace, to truncate names within frames.
+	flameGraphCharWidth = 7.2
+)
+
+type flameNode struct {
+	name  string
+	value int64
+	// base is the value in the base profile of diff flamegraphs.
+	base     int64
+	children map[string]*flameNode
+}
+
+func (n *flameNode) add(value int64, base bool) {
+	if base {
+		n.base += value
+	} else {
+		n.value += value
+	}
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	c, ok := n.children[name]
+	if !ok {
+		c = &flameNode{name: name, children: make(map[string]*flameNode)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// sortedChildren orders children by name, as flamegraphs do, so that frames
+// of the same stack line up across profiles.
+func (n *flameNode) sortedChildren() []*flameNode {
+	children := make([]*flameNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+func (n *flameNode) depth() int {
+	d := 0
+	for _, c := range n.children {
+		if cd := c.depth(); cd > d {
+			d = cd
+		}
+	}
+	return d + 1
+}
+
+// ConvertToFlameGraph renders the pprof profile as a standalone SVG
+// flamegraph, which shows the value of each frame on hover and zooms into
+// it on click, so that it can be inspected by a browser without pprof.
+func ConvertToFlameGraph(protoData []byte) ([]byte, error) {
+	p, err := profile.ParseData(protoData)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.SampleType) == 0 {
+		return nil, fmt.Errorf("profile has no sample types")
+	}
+
+	index := defaultSampleIndex(p)
+	root := &flameNode{name: "all", children: make(map[string]*flameNode)}
+	addFlameSamples(root, p, index, false)
+	return renderFlameGraph(root, p.SampleType[index], false), nil
+}
+
+// ConvertToDiffFlameGraph renders the flamegraph of the profile, in which
+// frames grown since the base profile are red and shrunk ones are blue.
+// Frames only in the base profile aren't shown.
+func ConvertToDiffFlameGraph(base, p *profile.Profile) []byte {
+	index := defaultSampleIndex(p)
+	root := &flameNode{name: "all", children: make(map[string]*flameNode)}
+	addFlameSamples(root, base, index, true)
+	addFlameSamples(root, p, index, false)
+	return renderFlameGraph(root, p.SampleType[index], true)
+}
+
+// defaultSampleIndex returns the index of the sample type shown by default,
+// e.g. cpu of CPU profiles or inuse_space of heap profiles.
+func defaultSampleIndex(p *profile.Profile) int {
+	index := len(p.SampleType) - 1
+	for i, st := range p.SampleType {
+		if st.Type == p.DefaultSampleType {
+			index = i
+		}
+	}
+	return index
+}
+
+// sampleFrames returns names of frames of the sample from the root.
+func sampleFrames(s *profile.Sample) []string {
+	var frames []string
+	// locations and lines are ordered from the leaf
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		if len(loc.Line) == 0 {
+			frames = append(frames, fmt.Sprintf("0x%x", loc.Address))
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			name := "?"
+			if fn := loc.Line[j].Function; fn != nil {
+				name = fn.Name
+			}
+			frames = append(frames, name)
+		}
+	}
+	return frames
+}
+
+func addFlameSamples(root *flameNode, p *profile.Profile, index int, base bool) {
+	for _, s := range p.Sample {
+		value := s.Value[index]
+		if value <= 0 {
+			continue
+		}
+		node := root
+		node.add(value, base)
+		for _, name := range sampleFrames(s) {
+			node = node.child(name)
+			node.add(value, base)
+		}
+	}
+}
+
+func renderFlameGraph(root *flameNode, sampleType *profile.ValueType, diff bool) []byte {
+	title := fmt.Sprintf("%s (%s)", sampleType.Type, sampleType.Unit)
+	if diff {
+		title += ", red: grown, blue: shrunk"
+	}
+	unit := html.EscapeString(sampleType.Unit)
+	depth := root.depth()
+	height := depth*flameGraphFrameHeight + 2*flameGraphPadding
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg" font-family="monospace" font-size="12">
+<style>.f:hover rect{stroke:#000;stroke-width:0.5;cursor:pointer}</style>
+<rect width="100%%" height="100%%" fill="#fff"/>
+<text x="%d" y="16" font-size="14">%s</text>
+<text id="reset" x="%d" y="16" text-anchor="end" style="cursor:pointer;display:none" onclick="zoom(null)">Reset Zoom</text>
+`, flameGraphWidth, height, flameGraphWidth, height, flameGraphPadding, html.EscapeString(title), flameGraphWidth-flameGraphPadding)
+
+	graphWidth := float64(flameGraphWidth - 2*flameGraphPadding)
+	var render func(n *flameNode, x float64, d int)
+	render = func(n *flameNode, x float64, d int) {
+		if root.value == 0 {
+			return
+		}
+		w := float64(n.value) / float64(root.value) * graphWidth
+		if w < flameGraphMinFrameWidth {
+			return
+		}
+		y := height - flameGraphPadding - (d+1)*flameGraphFrameHeight
+		name := html.EscapeString(n.name)
+		info := fmt.Sprintf("%d %s, %.2f%%", n.value, unit, float64(n.value)/float64(root.value)*100)
+		color := flameColor(n.name)
+		if diff {
+			info += fmt.Sprintf(", %+d %s since base", n.value-n.base, unit)
+			color = diffFlameColor(n.value-n.base, root.value)
+		}
+		fmt.Fprintf(&buf, `<g class="f" data-x="%.2f" data-w="%.2f" data-n="%s" onclick="zoom(this)"><title>%s (%s)</title><rect x="%.2f" y="%d" width="%.2f" height="%d" fill="%s" rx="2"/><text x="%.2f" y="%d">%s</text></g>
+`,
+			x, w, name,
+			name, info,
+			flameGraphPadding+x, y, w, flameGraphFrameHeight-1, color,
+			flameGraphPadding+x+3, y+flameGraphFrameHeight-4, html.EscapeString(truncateFrameName(n.name, w)))
+
+		for _, c := range n.sortedChildren() {
+			render(c, x, d+1)
+			x += float64(c.value) / float64(root.value) * graphWidth
+		}
+	}
+	render(root, 0, 0)
+
+	fmt.Fprintf(&buf, `<script><![CDATA[
+var W = %f, P = %d, C = %f;
+function fit(n, w) {
+  var max = Math.floor((w - 6) / C);
+  if (max < 3) return "";
+  return n.length <= max ? n : n.substring(0, max - 2) + "..";
+}
+function zoom(g) {
+  var x0 = 0, w0 = W;
+  if (g) { x0 = parseFloat(g.dataset.x); w0 = parseFloat(g.dataset.w); }
+  var y0 = g ? parseFloat(g.querySelector("rect").getAttribute("y")) : Infinity;
+  document.getElementById("reset").style.display = g ? "" : "none";
+  document.querySelectorAll("g.f").forEach(function (f) {
+    var x = parseFloat(f.dataset.x), w = parseFloat(f.dataset.w);
+    var r = f.querySelector("rect"), t = f.querySelector("text");
+    var y = parseFloat(r.getAttribute("y"));
+    // frames out of the zoomed one, except its callers, are hidden
+    var within = x >= x0 - 0.01 && x + w <= x0 + w0 + 0.01;
+    var caller = y > y0 && x <= x0 + 0.01 && x + w >= x0 + w0 - 0.01;
+    if (!within && !caller) { f.style.display = "none"; return; }
+    f.style.display = "";
+    var nx = caller ? 0 : (x - x0) / w0 * W, nw = caller ? W : w / w0 * W;
+    r.setAttribute("x", P + nx); r.setAttribute("width", nw);
+    t.setAttribute("x", P + nx + 3); t.textContent = fit(f.dataset.n, nw);
+  });
+}
+]]></script>
+</svg>
+`, graphWidth, flameGraphPadding, flameGraphCharWidth)
+	return buf.Bytes()
+}
+
+func truncateFrameName(name string, width float64) string {
+	max := int((width - 6) / flameGraphCharWidth)
+	if max < 3 {
+		return ""
+	}
+	if len(name) <= max {
+		return name
+	}
+	return name[:max-2] + ".."
+}
+
+// flameColor picks a warm color by the name, so that a function has the same
+// color across renderings.
+func flameColor(name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	v := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+v%50, 80+(v>>8)%130, 30+(v>>16)%50)
+}
+
+// diffFlameColor saturates red or blue by the delta relative to the total,
+// and a delta of 10% of the total saturates fully.
+func diffFlameColor(delta, total int64) string {
+	if delta == 0 || total == 0 {
+		return "rgb(250,250,250)"
+	}
+	ratio := float64(delta) / float64(total) * 10
+	if ratio < 0 {
+		ratio = -ratio
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	c := 250 - int(ratio*200)
+	if delta > 0 {
+		return fmt.Sprintf("rgb(250,%d,%d)", c, c)
+	}
+	return fmt.Sprintf("rgb(%d,%d,250)", c, c)
+}
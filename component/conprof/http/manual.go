@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof"
+	"github.com/zhongzc/ng_monitoring/component/conprof/scrape"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleTriggerProfiling profiles instances once, out of the schedule, and
+// responds the task to poll. Once it finishes, each profile can be
+// downloaded by /download with the `ts` of its target, which is the `ts` of
+// the task, or a few seconds before if a scheduled scrape has taken it.
+func handleTriggerProfiling(c *gin.Context) {
+	var req scrape.ManualRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	task, err := conprof.GetManager().TriggerProfiling(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+func handleManualProfilingTask(c *gin.Context) {
+	task, err := conprof.GetManager().GetManualTask(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
@@ -0,0 +1,127 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/pprof/profile"
+)
+
+const speedscopeSchema = "https://www.speedscope.app/file-format-schema.json"
+
+// Speedscope is the file format of speedscope, see speedscopeSchema.
+type Speedscope struct {
+	Schema             string              `json:"$schema"`
+	Shared             SpeedscopeShared    `json:"shared"`
+	Profiles           []SpeedscopeProfile `json:"profiles"`
+	ActiveProfileIndex int                 `json:"activeProfileIndex"`
+	Exporter           string              `json:"exporter"`
+}
+
+type SpeedscopeShared struct {
+	Frames []SpeedscopeFrame `json:"frames"`
+}
+
+type SpeedscopeFrame struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	Line int64  `json:"line,omitempty"`
+}
+
+// SpeedscopeProfile is a sampled profile, whose samples are stacks of
+// indexes of frames from the root.
+type SpeedscopeProfile struct {
+	Type       string  `json:"type"`
+	Name       string  `json:"name"`
+	Unit       string  `json:"unit"`
+	StartValue int64   `json:"startValue"`
+	EndValue   int64   `json:"endValue"`
+	Samples    [][]int `json:"samples"`
+	Weights    []int64 `json:"weights"`
+}
+
+// ConvertToSpeedscope converts the pprof profile into speedscope JSON, with a
+// profile of each sample type, e.g. alloc_space and inuse_space of heap
+// profiles, in which the default one is active.
+func ConvertToSpeedscope(protoData []byte) ([]byte, error) {
+	p, err := profile.ParseData(protoData)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.SampleType) == 0 {
+		return nil, fmt.Errorf("profile has no sample types")
+	}
+
+	res := Speedscope{
+		Schema:             speedscopeSchema,
+		Shared:             SpeedscopeShared{Frames: make([]SpeedscopeFrame, 0)},
+		Profiles:           make([]SpeedscopeProfile, 0, len(p.SampleType)),
+		ActiveProfileIndex: defaultSampleIndex(p),
+		Exporter:           "ng-monitoring",
+	}
+	frameIndexes := make(map[SpeedscopeFrame]int)
+	frameIndex := func(frame SpeedscopeFrame) int {
+		i, ok := frameIndexes[frame]
+		if !ok {
+			i = len(res.Shared.Frames)
+			frameIndexes[frame] = i
+			res.Shared.Frames = append(res.Shared.Frames, frame)
+		}
+		return i
+	}
+	stacks := make([][]int, len(p.Sample))
+	for i, s := range p.Sample {
+		stacks[i] = speedscopeStack(s, frameIndex)
+	}
+
+	for index, st := range p.SampleType {
+		sp := SpeedscopeProfile{
+			Type:    "sampled",
+			Name:    fmt.Sprintf("%s (%s)", st.Type, st.Unit),
+			Unit:    speedscopeUnit(st.Unit),
+			Samples: make([][]int, 0, len(p.Sample)),
+			Weights: make([]int64, 0, len(p.Sample)),
+		}
+		for i, s := range p.Sample {
+			if s.Value[index] <= 0 {
+				continue
+			}
+			sp.Samples = append(sp.Samples, stacks[i])
+			sp.Weights = append(sp.Weights, s.Value[index])
+			sp.EndValue += s.Value[index]
+		}
+		res.Profiles = append(res.Profiles, sp)
+	}
+	return json.Marshal(res)
+}
+
+// speedscopeStack returns indexes of frames of the sample from the root.
+func speedscopeStack(s *profile.Sample, frameIndex func(SpeedscopeFrame) int) []int {
+	var stack []int
+	// locations and lines are ordered from the leaf
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		if len(loc.Line) == 0 {
+			stack = append(stack, frameIndex(SpeedscopeFrame{Name: fmt.Sprintf("0x%x", loc.Address)}))
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			frame := SpeedscopeFrame{Name: "?"}
+			if fn := loc.Line[j].Function; fn != nil {
+				frame = SpeedscopeFrame{Name: fn.Name, File: fn.Filename, Line: fn.StartLine}
+			}
+			stack = append(stack, frameIndex(frame))
+		}
+	}
+	return stack
+}
+
+// speedscopeUnit maps pprof units to those of speedscope, e.g. count is none.
+func speedscopeUnit(unit string) string {
+	switch unit {
+	case "nanoseconds", "microseconds", "milliseconds", "seconds", "bytes":
+		return unit
+	default:
+		return "none"
+	}
+}
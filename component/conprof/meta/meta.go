@@ -5,8 +5,16 @@ const (
 	ProfileKindGoroutine      = "goroutine"
 	ProfileKindHeap           = "heap"
 	ProfileKindMutex          = "mutex"
+	ProfileKindBlock          = "block"
 	ProfileDataFormatSVG      = "svg"
 	ProfileDataFormatProtobuf = "protobuf"
+	// ProfileDataFormatText is only stored, e.g. goroutine dumps.
+	ProfileDataFormatText = "text"
+	// ProfileDataFormatFlameGraph is only converted into, as an SVG.
+	ProfileDataFormatFlameGraph = "flamegraph"
+	// ProfileDataFormatSpeedscope is only converted into, to be opened by
+	// speedscope.
+	ProfileDataFormatSpeedscope = "speedscope"
 )
 
 type ProfileTarget struct {
@@ -3,6 +3,7 @@ package scrape
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sort"
 	"strconv"
 	"sync"
@@ -28,30 +29,45 @@ type Manager struct {
 	curComponents  map[topology.Component]struct{}
 	lastComponents map[topology.Component]struct{}
 
+	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
 	mu           sync.Mutex
 	scrapeSuites map[meta.ProfileTarget]*ScrapeSuite
 	ticker       *Ticker
+	// scheduleTickers tick by intervals of schedules other than the global
+	// one, shared by suites of the same interval.
+	scheduleTickers map[int]*Ticker
+	// limiter bounds scrapes running at the same time, which is replaced
+	// once the concurrency is changed.
+	limiter *utils.RateLimit
+
+	manualTasks manualTasks
 }
 
 // NewManager is the Manager constructor
 func NewManager(store *store.ProfileStorage, topoSubScribe topology.Subscriber) *Manager {
+	// the context is created here rather than in Start, since manual
+	// profiling may be triggered before the manager starts.
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Manager{
-		store:          store,
-		topoSubScribe:  topoSubScribe,
-		configChangeCh: config.SubscribeConfigChange(),
-		curComponents:  map[topology.Component]struct{}{},
-		lastComponents: map[topology.Component]struct{}{},
-		scrapeSuites:   make(map[meta.ProfileTarget]*ScrapeSuite),
-		ticker:         NewTicker(time.Duration(config.GetGlobalConfig().ContinueProfiling.IntervalSeconds) * time.Second),
+		ctx:             ctx,
+		cancel:          cancel,
+		store:           store,
+		topoSubScribe:   topoSubScribe,
+		configChangeCh:  config.SubscribeConfigChange(),
+		curComponents:   map[topology.Component]struct{}{},
+		lastComponents:  map[topology.Component]struct{}{},
+		scrapeSuites:    make(map[meta.ProfileTarget]*ScrapeSuite),
+		scheduleTickers: make(map[int]*Ticker),
+		ticker:          NewTicker(time.Duration(config.GetGlobalConfig().ContinueProfiling.IntervalSeconds) * time.Second),
+		manualTasks:     manualTasks{tasks: make(map[string]*ManualTask)},
 	}
 }
 
 func (m *Manager) Start() {
-	ctx, cancel := context.WithCancel(context.Background())
-	m.cancel = cancel
+	ctx := m.ctx
 	go utils.GoWithRecovery(func() {
 		m.run(ctx)
 	}, nil)
@@ -119,6 +135,9 @@ func (m *Manager) run(ctx context.Context) {
 	buildMap := func(components []topology.Component) map[topology.Component]struct{} {
 		m := make(map[topology.Component]struct{}, len(components))
 		for _, comp := range components {
+			if !comp.IsUp() {
+				continue
+			}
 			m[comp] = struct{}{}
 		}
 		return m
@@ -129,7 +148,10 @@ func (m *Manager) run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case components := <-m.topoSubScribe:
+			// also read by manual profiling
+			m.mu.Lock()
 			m.lastComponents = buildMap(components)
+			m.mu.Unlock()
 		case <-m.configChangeCh:
 			break
 		}
@@ -142,7 +164,11 @@ func (m *Manager) run(ctx context.Context) {
 
 func (m *Manager) isProfilingConfigChanged(oldCfg, newCfg config.ContinueProfilingConfig) bool {
 	return oldCfg.Enable != newCfg.Enable ||
-		oldCfg.ProfileSeconds != newCfg.ProfileSeconds
+		oldCfg.ProfileSeconds != newCfg.ProfileSeconds ||
+		oldCfg.BlockProfile != newCfg.BlockProfile ||
+		// schedules overriding the global interval depend on it
+		(len(newCfg.Schedules) != 0 && oldCfg.IntervalSeconds != newCfg.IntervalSeconds) ||
+		!reflect.DeepEqual(oldCfg.Schedules, newCfg.Schedules)
 }
 
 func (m *Manager) reload(ctx context.Context, oldCfg, newCfg config.ContinueProfilingConfig) {
@@ -159,6 +185,9 @@ func (m *Manager) reload(ctx context.Context, oldCfg, newCfg config.ContinueProf
 		}
 		m.stopScrape(comp)
 	}
+	if needReload {
+		m.stopScheduleTickers()
+	}
 
 	// close for old components
 	if !newCfg.Enable {
@@ -189,13 +218,25 @@ func (m *Manager) startScrape(ctx context.Context, component topology.Component,
 	httpCfg := cfg.Security.GetHTTPClientConfig()
 	addr := fmt.Sprintf("%v:%v", component.IP, component.StatusPort)
 	for profileName, profileConfig := range profilingConfig.PprofConfig {
+		schedule := continueProfilingCfg.Schedule(component.Name, profileName)
+		if schedule.Disable {
+			continue
+		}
+		if profileConfig.Seconds > 0 {
+			c := *profileConfig
+			c.Seconds = schedule.ProfileSeconds
+			profileConfig = &c
+		}
+		ticker := m.scheduleTicker(schedule.IntervalSeconds, continueProfilingCfg.IntervalSeconds)
 		target := NewTarget(component.Name, addr, profileName, cfg.GetHTTPScheme(), profileConfig)
+		target.setBuild(component)
 		client, err := commonconfig.NewClientFromConfig(httpCfg, component.Name)
 		if err != nil {
 			return err
 		}
 		scrape := newScraper(target, client)
 		scrapeSuite := newScrapeSuite(ctx, scrape, m.store)
+		scrapeSuite.limiter = m.scrapeLimiter
 		pt := meta.ProfileTarget{
 			Kind:      profileName,
 			Component: component.Name,
@@ -205,7 +246,7 @@ func (m *Manager) startScrape(ctx context.Context, component topology.Component,
 		m.wg.Add(1)
 		go utils.GoWithRecovery(func() {
 			defer m.wg.Done()
-			scrapeSuite.run(m.ticker.Subscribe())
+			scrapeSuite.run(ticker.Subscribe())
 		}, nil)
 		m.addScrapeSuite(pt, scrapeSuite)
 	}
@@ -216,23 +257,53 @@ func (m *Manager) startScrape(ctx context.Context, component topology.Component,
 	return nil
 }
 
+// scrapeLimiter returns the limiter of the configured concurrency. Tokens
+// must be put back into the limiter they are got from.
+func (m *Manager) scrapeLimiter() *utils.RateLimit {
+	concurrency := config.GetGlobalConfig().ContinueProfiling.ScrapeConcurrency
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limiter == nil || m.limiter.GetCapacity() != concurrency {
+		m.limiter = utils.NewRateLimit(concurrency)
+	}
+	return m.limiter
+}
+
+// scheduleTicker returns the ticker of the interval, which is the global
+// ticker for the global interval.
+func (m *Manager) scheduleTicker(intervalSeconds, globalIntervalSeconds int) *Ticker {
+	if intervalSeconds == globalIntervalSeconds {
+		return m.ticker
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ticker, ok := m.scheduleTickers[intervalSeconds]
+	if !ok {
+		ticker = NewTicker(time.Duration(intervalSeconds) * time.Second)
+		m.scheduleTickers[intervalSeconds] = ticker
+	}
+	return ticker
+}
+
+// stopScheduleTickers stops tickers of schedules, after all suites are
+// stopped for reloading.
+func (m *Manager) stopScheduleTickers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for interval, ticker := range m.scheduleTickers {
+		ticker.Stop()
+		delete(m.scheduleTickers, interval)
+	}
+}
+
 func (m *Manager) stopScrape(component topology.Component) {
 	delete(m.curComponents, component)
 	addr := fmt.Sprintf("%v:%v", component.IP, component.StatusPort)
 	log.Info("stop component scrape",
 		zap.String("component", component.Name),
 		zap.String("address", addr))
-	profilingConfig := m.getProfilingConfig(component)
-	for profileName := range profilingConfig.PprofConfig {
-		key := meta.ProfileTarget{
-			Kind:      profileName,
-			Component: component.Name,
-			Address:   addr,
-		}
-		suite := m.deleteScrapeSuite(key)
-		if suite == nil {
-			continue
-		}
+	// profile kinds may have changed with the config since started
+	for _, suite := range m.deleteScrapeSuites(component.Name, addr) {
 		suite.stop()
 	}
 }
@@ -246,20 +317,66 @@ func (m *Manager) getProfilingConfig(component topology.Component) *config.Profi
 	}
 }
 
+// ProfileSchedules returns schedules of profile kinds scraped of the
+// component.
+func (m *Manager) ProfileSchedules(component topology.Component) map[string]config.ProfilingSchedule {
+	cfg := config.GetGlobalConfig().ContinueProfiling
+	schedules := make(map[string]config.ProfilingSchedule)
+	for kind := range m.getProfilingConfig(component).PprofConfig {
+		if schedule := cfg.Schedule(component.Name, kind); !schedule.Disable {
+			schedules[kind] = schedule
+		}
+	}
+	return schedules
+}
+
+// ObservedProfileSizes returns average sizes of profiles lastly stored by
+// component name and profile kind, which are absent until stored.
+func (m *Manager) ObservedProfileSizes() map[string]map[string]int {
+	type sum struct{ size, count int64 }
+	sums := make(map[meta.ProfileTarget]*sum)
+	targets, suites := m.GetAllCurrentScrapeSuite()
+	for i, suite := range suites {
+		size := suite.storedSize.Load()
+		if size <= 0 {
+			continue
+		}
+		key := meta.ProfileTarget{Kind: targets[i].Kind, Component: targets[i].Component}
+		if sums[key] == nil {
+			sums[key] = &sum{}
+		}
+		sums[key].size += size
+		sums[key].count++
+	}
+
+	sizes := make(map[string]map[string]int)
+	for key, sum := range sums {
+		if sizes[key.Component] == nil {
+			sizes[key.Component] = make(map[string]int)
+		}
+		sizes[key.Component][key.Kind] = int(sum.size / sum.count)
+	}
+	return sizes
+}
+
 func (m *Manager) addScrapeSuite(pt meta.ProfileTarget, suite *ScrapeSuite) {
 	m.mu.Lock()
 	m.scrapeSuites[pt] = suite
 	m.mu.Unlock()
 }
 
-func (m *Manager) deleteScrapeSuite(pt meta.ProfileTarget) *ScrapeSuite {
+// deleteScrapeSuites deletes suites of all profile kinds of the component.
+func (m *Manager) deleteScrapeSuites(component, addr string) []*ScrapeSuite {
 	m.mu.Lock()
-	suite := m.scrapeSuites[pt]
-	if suite != nil {
-		delete(m.scrapeSuites, pt)
+	defer m.mu.Unlock()
+	var suites []*ScrapeSuite
+	for pt, suite := range m.scrapeSuites {
+		if pt.Component == component && pt.Address == addr {
+			suites = append(suites, suite)
+			delete(m.scrapeSuites, pt)
+		}
 	}
-	m.mu.Unlock()
-	return suite
+	return suites
 }
 
 func (m *Manager) GetAllCurrentScrapeSuite() ([]meta.ProfileTarget, []*ScrapeSuite) {
@@ -275,16 +392,15 @@ func (m *Manager) GetAllCurrentScrapeSuite() ([]meta.ProfileTarget, []*ScrapeSui
 }
 
 func (m *Manager) Close() {
-	if m.cancel != nil {
-		m.cancel()
-	}
+	m.cancel()
+	m.stopScheduleTickers()
 	m.store.Close()
 	m.wg.Wait()
 }
 
 func goAppProfilingConfig() *config.ProfilingConfig {
 	cfg := config.GetGlobalConfig().ContinueProfiling
-	return &config.ProfilingConfig{
+	profilingConfig := &config.ProfilingConfig{
 		PprofConfig: config.PprofConfig{
 			"heap": &config.PprofProfilingConfig{
 				Path: "/debug/pprof/heap",
@@ -302,6 +418,12 @@ func goAppProfilingConfig() *config.ProfilingConfig {
 			},
 		},
 	}
+	if cfg.BlockProfile {
+		profilingConfig.PprofConfig[meta.ProfileKindBlock] = &config.PprofProfilingConfig{
+			Path: "/debug/pprof/block",
+		}
+	}
+	return profilingConfig
 }
 
 func nonGoAppProfilingConfig() *config.ProfilingConfig {
@@ -0,0 +1,275 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/util"
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	ManualStateRunning  = "running"
+	ManualStateFinished = "finished"
+	ManualStateSuccess  = "success"
+	ManualStateFailed   = "failed"
+
+	// maxManualTasks is the number of latest tasks kept to be polled.
+	maxManualTasks = 100
+)
+
+// ManualRequest asks for profiling instances once, out of the schedule.
+type ManualRequest struct {
+	// Instances are all components in the topology if empty.
+	Instances []ManualInstance `json:"instances"`
+	// Kinds are all profile kinds of each component if empty.
+	Kinds []string `json:"kinds"`
+	// Seconds is the duration of profiling, e.g. of CPU profiles, which is
+	// profile-seconds if 0. It's at most timeout-seconds, since it holds a
+	// scrape token shared with scheduled scrapes that long.
+	Seconds int `json:"seconds"`
+}
+
+type ManualInstance struct {
+	Component string `json:"component"`
+	Address   string `json:"address"`
+}
+
+// ManualTask is the handle of a manual profiling. Profiles are stored along
+// with scraped ones once the targets succeed, at Ts of the targets.
+type ManualTask struct {
+	ID      string         `json:"id"`
+	State   string         `json:"state"`
+	Ts      int64          `json:"ts"`
+	Seconds int            `json:"seconds"`
+	Targets []ManualTarget `json:"targets"`
+}
+
+type ManualTarget struct {
+	meta.ProfileTarget
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	// Ts is where the profile is stored, which is Ts of the task or a few
+	// seconds before if a scheduled scrape has taken it.
+	Ts int64 `json:"ts,omitempty"`
+}
+
+type manualTasks struct {
+	sync.Mutex
+	idAlloc int64
+	tasks   map[string]*ManualTask
+	// ids are ordered by creation to drop the oldest tasks.
+	ids []string
+}
+
+// TriggerProfiling starts profiling the instances once, and returns the task
+// which can be polled by GetManualTask. It works even if continuous
+// profiling is disabled.
+func (m *Manager) TriggerProfiling(req ManualRequest) (*ManualTask, error) {
+	cfg := config.GetGlobalConfig()
+	seconds := req.Seconds
+	if seconds < 0 {
+		return nil, fmt.Errorf("invalid seconds %v", seconds)
+	}
+	if seconds > cfg.ContinueProfiling.TimeoutSeconds {
+		return nil, fmt.Errorf("seconds %v should be at most timeout-seconds %v", seconds, cfg.ContinueProfiling.TimeoutSeconds)
+	}
+	if seconds == 0 {
+		seconds = cfg.ContinueProfiling.ProfileSeconds
+	}
+
+	components, err := m.manualComponents(req.Instances)
+	if err != nil {
+		return nil, err
+	}
+	var scrapers []Scraper
+	httpCfg := cfg.Security.GetHTTPClientConfig()
+	for _, comp := range components {
+		pprofConfig := m.getProfilingConfig(comp).PprofConfig
+		kinds := req.Kinds
+		if len(kinds) == 0 {
+			for kind := range pprofConfig {
+				kinds = append(kinds, kind)
+			}
+			sort.Strings(kinds)
+		}
+		addr := fmt.Sprintf("%v:%v", comp.IP, comp.StatusPort)
+		for _, kind := range kinds {
+			profileConfig, ok := pprofConfig[kind]
+			if !ok {
+				return nil, fmt.Errorf("profile kind %v of %v is not supported", kind, comp.Name)
+			}
+			if profileConfig.Seconds > 0 {
+				c := *profileConfig
+				c.Seconds = seconds
+				profileConfig = &c
+			}
+			client, err := commonconfig.NewClientFromConfig(httpCfg, comp.Name)
+			if err != nil {
+				return nil, err
+			}
+			target := NewTarget(comp.Name, addr, kind, cfg.GetHTTPScheme(), profileConfig)
+			target.setBuild(comp)
+			scrapers = append(scrapers, newScraper(target, client))
+		}
+	}
+
+	task := &ManualTask{
+		State:   ManualStateRunning,
+		Seconds: seconds,
+		Targets: make([]ManualTarget, len(scrapers)),
+	}
+	for i, s := range scrapers {
+		task.Targets[i] = ManualTarget{ProfileTarget: s.target.ProfileTarget, State: ManualStateRunning}
+	}
+	m.addManualTask(task)
+	log.Info("start manual profiling",
+		zap.String("id", task.ID),
+		zap.Int("target-count", len(scrapers)),
+		zap.Int("seconds", seconds))
+
+	var wg sync.WaitGroup
+	for i, s := range scrapers {
+		i, s := i, s
+		wg.Add(1)
+		m.wg.Add(1)
+		go utils.GoWithRecovery(func() {
+			defer func() {
+				wg.Done()
+				m.wg.Done()
+			}()
+			ts, err := m.manualScrape(s, task.Ts)
+			m.updateManualTarget(task, i, ts, err)
+		}, nil)
+	}
+	go utils.GoWithRecovery(func() {
+		wg.Wait()
+		m.manualTasks.Lock()
+		task.State = ManualStateFinished
+		m.manualTasks.Unlock()
+		log.Info("manual profiling finished", zap.String("id", task.ID))
+	}, nil)
+
+	return m.GetManualTask(task.ID)
+}
+
+// manualComponents returns components of the instances in the topology.
+func (m *Manager) manualComponents(instances []ManualInstance) ([]topology.Component, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var components []topology.Component
+	for comp := range m.lastComponents {
+		components = append(components, comp)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		if components[i].Name != components[j].Name {
+			return components[i].Name < components[j].Name
+		}
+		if components[i].IP != components[j].IP {
+			return components[i].IP < components[j].IP
+		}
+		return components[i].StatusPort < components[j].StatusPort
+	})
+	if len(instances) == 0 {
+		if len(components) == 0 {
+			return nil, fmt.Errorf("no instances to profile")
+		}
+		return components, nil
+	}
+
+	matched := make([]topology.Component, 0, len(instances))
+	for _, instance := range instances {
+		found := false
+		for _, comp := range components {
+			if comp.Name == instance.Component && fmt.Sprintf("%v:%v", comp.IP, comp.StatusPort) == instance.Address {
+				matched = append(matched, comp)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("instance %v %v is not found in the topology", instance.Component, instance.Address)
+		}
+	}
+	return matched, nil
+}
+
+func (m *Manager) manualScrape(scraper Scraper, ts int64) (int64, error) {
+	// bounded along with scheduled scrapes
+	limiter := m.scrapeLimiter()
+	if exit := limiter.GetToken(m.ctx.Done()); exit {
+		return 0, m.ctx.Err()
+	}
+	defer limiter.PutToken()
+
+	ctx, cancel := context.WithTimeout(m.ctx, scraper.target.timeout())
+	defer cancel()
+	var buf bytes.Buffer
+	dataFormat, err := scraper.scrape(ctx, &buf)
+	if err != nil {
+		return 0, err
+	}
+	if buf.Len() == 0 {
+		return 0, fmt.Errorf("empty profile")
+	}
+	ts, _, err = addProfile(m.store, scraper.target.ProfileTarget, ts, dataFormat, buf.Bytes())
+	return ts, err
+}
+
+func (m *Manager) addManualTask(task *ManualTask) {
+	m.manualTasks.Lock()
+	defer m.manualTasks.Unlock()
+	m.manualTasks.idAlloc++
+	task.ID = strconv.FormatInt(m.manualTasks.idAlloc, 10)
+	task.Ts = util.GetTimeStamp(time.Now())
+	m.manualTasks.tasks[task.ID] = task
+	m.manualTasks.ids = append(m.manualTasks.ids, task.ID)
+	if len(m.manualTasks.ids) > maxManualTasks {
+		delete(m.manualTasks.tasks, m.manualTasks.ids[0])
+		m.manualTasks.ids = m.manualTasks.ids[1:]
+	}
+}
+
+func (m *Manager) updateManualTarget(task *ManualTask, i int, ts int64, err error) {
+	m.manualTasks.Lock()
+	defer m.manualTasks.Unlock()
+	target := &task.Targets[i]
+	if err == nil {
+		target.State = ManualStateSuccess
+		target.Ts = ts
+		return
+	}
+	target.State = ManualStateFailed
+	target.Error = err.Error()
+	log.Error("manual profiling failed",
+		zap.String("id", task.ID),
+		zap.String("component", target.Component),
+		zap.String("address", target.Address),
+		zap.String("kind", target.Kind),
+		zap.Error(err))
+}
+
+// GetManualTask returns a copy of the task, or an error if it's unknown or
+// has been dropped as one of the oldest.
+func (m *Manager) GetManualTask(id string) (*ManualTask, error) {
+	m.manualTasks.Lock()
+	defer m.manualTasks.Unlock()
+	task, ok := m.manualTasks.tasks[id]
+	if !ok {
+		return nil, fmt.Errorf("manual profiling task %v not found", id)
+	}
+	res := *task
+	res.Targets = append([]ManualTarget{}, task.Targets...)
+	return &res, nil
+}
@@ -0,0 +1,102 @@
+package scrape
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/store"
+	"github.com/zhongzc/ng_monitoring/component/conprof/util"
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTriggerProfiling(t *testing.T) {
+	// manual profiling works even if continuous profiling is disabled
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{IntervalSeconds: 60, ProfileSeconds: 10, TimeoutSeconds: 5, ScrapeConcurrency: 2}})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/pprof/mutex" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer ts.Close()
+	port, err := strconv.Atoi(ts.URL[strings.LastIndex(ts.URL, ":")+1:])
+	require.NoError(t, err)
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := store.NewProfileStorage(db)
+	require.NoError(t, err)
+	defer s.StopGC()
+	m := NewManager(s, nil)
+	defer m.ticker.Stop()
+	// works before the manager starts
+	defer m.Close()
+	m.lastComponents[topology.Component{Name: "tidb", IP: "127.0.0.1", StatusPort: uint(port)}] = struct{}{}
+
+	_, err = m.TriggerProfiling(ManualRequest{Instances: []ManualInstance{{Component: "tikv", Address: addr}}})
+	require.Error(t, err)
+	_, err = m.TriggerProfiling(ManualRequest{Kinds: []string{"unknown"}})
+	require.Error(t, err)
+	// longer than timeout-seconds
+	_, err = m.TriggerProfiling(ManualRequest{Seconds: 6})
+	require.Error(t, err)
+
+	// a scheduled scrape has taken the ts
+	pt := meta.ProfileTarget{Kind: meta.ProfileKindProfile, Component: "tidb", Address: addr}
+	_, err = s.AddProfile(pt, util.GetTimeStamp(time.Now()), "", []byte("scheduled"))
+	require.NoError(t, err)
+
+	task1, err := m.TriggerProfiling(ManualRequest{Kinds: []string{meta.ProfileKindProfile, meta.ProfileKindMutex}, Seconds: 1})
+	require.NoError(t, err)
+	task2, err := m.TriggerProfiling(ManualRequest{Instances: []ManualInstance{{Component: "tidb", Address: addr}}, Kinds: []string{meta.ProfileKindProfile}})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		task, err := m.GetManualTask(task1.ID)
+		require.NoError(t, err)
+		return task.State == ManualStateFinished
+	}, 5*time.Second, 10*time.Millisecond)
+	task1, err = m.GetManualTask(task1.ID)
+	require.NoError(t, err)
+	require.Equal(t, ManualStateSuccess, task1.Targets[0].State)
+	require.Equal(t, ManualStateFailed, task1.Targets[1].State)
+	require.NotEmpty(t, task1.Targets[1].Error)
+
+	require.Eventually(t, func() bool {
+		task, err := m.GetManualTask(task2.ID)
+		require.NoError(t, err)
+		return task.State == ManualStateFinished
+	}, 5*time.Second, 10*time.Millisecond)
+	task2, err = m.GetManualTask(task2.ID)
+	require.NoError(t, err)
+	require.Equal(t, ManualStateSuccess, task2.Targets[0].State)
+	// stored before the ts taken by the other profiles
+	require.NotEqual(t, task1.Targets[0].Ts, task2.Targets[0].Ts)
+	require.LessOrEqual(t, task1.Targets[0].Ts, task1.Ts)
+	require.LessOrEqual(t, task2.Targets[0].Ts, task2.Ts)
+
+	param := &meta.BasicQueryParam{Begin: task1.Ts - maxTsShift, End: task2.Ts, Targets: []meta.ProfileTarget{pt}}
+	var data []string
+	err = s.QueryProfileData(param, func(_ meta.ProfileTarget, _ int64, _ string, d []byte) error {
+		data = append(data, string(d))
+		return nil
+	})
+	require.NoError(t, err)
+	// with the custom duration and profile-seconds
+	require.ElementsMatch(t, []string{"scheduled", "seconds=1", "seconds=10"}, data)
+
+	_, err = m.GetManualTask("unknown")
+	require.Error(t, err)
+}
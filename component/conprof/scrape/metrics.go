@@ -0,0 +1,104 @@
+package scrape
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+)
+
+// Results of scrapes, exported by the
+// `ng_monitoring_conprof_scrapes_total{component, address, kind, result}`
+// counter.
+const (
+	scrapeResultSuccess = "success"
+	scrapeResultFailure = "failure"
+)
+
+var (
+	suiteMetricsMu sync.Mutex
+	// suiteMetrics are suites by targets, of which the latest suite of a
+	// target owns its metrics, since suites are restarted on config changes
+	// and may stop after the new ones have started.
+	suiteMetrics = make(map[meta.ProfileTarget]*ScrapeSuite)
+	// targetMetrics are names of metrics by targets, to be unregistered once
+	// their suites stop.
+	targetMetrics = make(map[meta.ProfileTarget]map[string]struct{})
+)
+
+// targetMetric returns the name of the metric labeled by the target and
+// extra label pairs, and tracks it.
+func targetMetric(name string, pt meta.ProfileTarget, labels ...string) string {
+	metric := fmt.Sprintf("%s{component=%q,address=%q,kind=%q", name, pt.Component, pt.Address, pt.Kind)
+	for i := 0; i+1 < len(labels); i += 2 {
+		metric += fmt.Sprintf(",%s=%q", labels[i], labels[i+1])
+	}
+	metric += "}"
+
+	suiteMetricsMu.Lock()
+	defer suiteMetricsMu.Unlock()
+	names, ok := targetMetrics[pt]
+	if !ok {
+		names = make(map[string]struct{})
+		targetMetrics[pt] = names
+	}
+	names[metric] = struct{}{}
+	return metric
+}
+
+// trackMetrics makes the suite own metrics of its target, whose gauges read
+// the latest suite of the target.
+func (sl *ScrapeSuite) trackMetrics() {
+	pt := sl.scraper.target.ProfileTarget
+	suiteMetricsMu.Lock()
+	suiteMetrics[pt] = sl
+	suiteMetricsMu.Unlock()
+
+	gauge := func(name string, value func(owner *ScrapeSuite) float64) {
+		metrics.GetOrCreateGauge(targetMetric(name, pt), func() float64 {
+			suiteMetricsMu.Lock()
+			owner, ok := suiteMetrics[pt]
+			suiteMetricsMu.Unlock()
+			if !ok {
+				return 0
+			}
+			return value(owner)
+		})
+	}
+	gauge("ng_monitoring_conprof_stored_bytes", func(owner *ScrapeSuite) float64 {
+		return float64(owner.storedSize.Load())
+	})
+	gauge("ng_monitoring_conprof_last_success_timestamp_seconds", func(owner *ScrapeSuite) float64 {
+		return float64(owner.getStatus().LastSuccessTs)
+	})
+}
+
+// untrackMetrics unregisters metrics of the target once the suite stops,
+// unless a newer suite of the same target has taken over.
+func (sl *ScrapeSuite) untrackMetrics() {
+	pt := sl.scraper.target.ProfileTarget
+	suiteMetricsMu.Lock()
+	defer suiteMetricsMu.Unlock()
+	if suiteMetrics[pt] != sl {
+		return
+	}
+	delete(suiteMetrics, pt)
+	for metric := range targetMetrics[pt] {
+		metrics.UnregisterMetric(metric)
+	}
+	delete(targetMetrics, pt)
+}
+
+// observeScrape counts the scrape by its result, either of scraping or
+// storing, and observes the duration of both since start.
+func observeScrape(pt meta.ProfileTarget, start time.Time, storedBytes int, err error) {
+	metrics.GetOrCreateHistogram(targetMetric("ng_monitoring_conprof_scrape_duration_seconds", pt)).UpdateDuration(start)
+	if err != nil {
+		metrics.GetOrCreateCounter(targetMetric("ng_monitoring_conprof_scrapes_total", pt, "result", scrapeResultFailure)).Inc()
+		return
+	}
+	metrics.GetOrCreateCounter(targetMetric("ng_monitoring_conprof_scrapes_total", pt, "result", scrapeResultSuccess)).Inc()
+	metrics.GetOrCreateCounter(targetMetric("ng_monitoring_conprof_stored_bytes_total", pt)).Add(storedBytes)
+}
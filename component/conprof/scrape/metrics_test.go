@@ -0,0 +1,85 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/store"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/gozstd"
+	"go.uber.org/atomic"
+)
+
+func TestScrapeMetrics(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{Enable: true, IntervalSeconds: 60, TimeoutSeconds: 5}})
+	fail := atomic.NewBool(true)
+	// stored compressed
+	profileData := []byte(strings.Repeat("profile", 100))
+	storedSize := len(gozstd.Compress(nil, profileData))
+	require.Less(t, storedSize, len(profileData))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(profileData)
+	}))
+	defer ts.Close()
+
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := store.NewProfileStorage(db)
+	require.NoError(t, err)
+	defer s.StopGC()
+
+	target := NewTarget("tidb", strings.TrimPrefix(ts.URL, "http://"), meta.ProfileKindHeap, "http", &config.PprofProfilingConfig{Path: "/debug/pprof/heap"})
+	suite := newScrapeSuite(context.Background(), newScraper(target, ts.Client()), s)
+	tk := NewTicker(time.Hour)
+	defer tk.Stop()
+	ticker := tk.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		suite.run(ticker)
+		close(done)
+	}()
+
+	pt := target.ProfileTarget
+	failures := targetMetric("ng_monitoring_conprof_scrapes_total", pt, "result", scrapeResultFailure)
+	successes := targetMetric("ng_monitoring_conprof_scrapes_total", pt, "result", scrapeResultSuccess)
+	storedBytes := targetMetric("ng_monitoring_conprof_stored_bytes_total", pt)
+	exported := func() string {
+		var buf bytes.Buffer
+		metrics.WritePrometheus(&buf, false)
+		return buf.String()
+	}
+
+	ticker.ch <- time.Unix(100, 0)
+	require.Eventually(t, func() bool { return metrics.GetOrCreateCounter(failures).Get() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Contains(t, exported(), targetMetric("ng_monitoring_conprof_last_success_timestamp_seconds", pt)+" 0\n")
+
+	fail.Store(false)
+	ticker.ch <- time.Unix(200, 0)
+	require.Eventually(t, func() bool { return metrics.GetOrCreateCounter(successes).Get() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(storedSize), metrics.GetOrCreateCounter(storedBytes).Get())
+	out := exported()
+	require.Contains(t, out, strings.Replace(targetMetric("ng_monitoring_conprof_scrape_duration_seconds", pt), "{", "_count{", 1)+" 2\n")
+	require.Contains(t, out, targetMetric("ng_monitoring_conprof_last_success_timestamp_seconds", pt)+" 200\n")
+	require.Contains(t, out, targetMetric("ng_monitoring_conprof_stored_bytes", pt)+fmt.Sprintf(" %d\n", storedSize))
+
+	// metrics of the target are gone once its suite stops
+	suite.stop()
+	<-done
+	require.NotContains(t, exported(), target.Address)
+}
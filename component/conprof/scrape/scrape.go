@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pingcap/log"
@@ -18,6 +21,8 @@ import (
 	"github.com/zhongzc/ng_monitoring/component/conprof/store"
 	"github.com/zhongzc/ng_monitoring/component/conprof/util"
 	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"golang.org/x/net/context/ctxhttp"
 )
@@ -26,9 +31,17 @@ type ScrapeSuite struct {
 	scraper        Scraper
 	lastScrape     time.Time
 	lastScrapeSize int
-	store          *store.ProfileStorage
-	ctx            context.Context
-	cancel         func()
+	// storedSize is the size of the profile lastly stored, after it's
+	// compressed, which is read to estimate the storage size.
+	storedSize atomic.Int64
+	statusMu   sync.Mutex
+	status     ScrapeStatus
+	// limiter returns the limiter to get a token from before scraping, or
+	// scrapes are unbounded if nil.
+	limiter func() *utils.RateLimit
+	store   *store.ProfileStorage
+	ctx     context.Context
+	cancel  func()
 }
 
 func newScrapeSuite(ctx context.Context, sc Scraper, store *store.ProfileStorage) *ScrapeSuite {
@@ -55,6 +68,8 @@ func (sl *ScrapeSuite) run(ticker *TickerChan) {
 		zap.String("component", target.Component),
 		zap.String("address", target.Address),
 		zap.String("kind", target.Kind))
+	sl.trackMetrics()
+	defer sl.untrackMetrics()
 
 	buf := bytes.NewBuffer(make([]byte, 0, 1024))
 	sl.lastScrapeSize = 0
@@ -65,29 +80,49 @@ func (sl *ScrapeSuite) run(ticker *TickerChan) {
 			return
 		case start = <-ticker.ch:
 		}
+		if !config.GetGlobalConfig().ContinueProfiling.Enable {
+			continue
+		}
 
 		if sl.lastScrapeSize > 0 && buf.Cap() > 2*sl.lastScrapeSize {
 			// shrink the buffer size.
 			buf = bytes.NewBuffer(make([]byte, 0, sl.lastScrapeSize))
 		}
 
+		var limiter *utils.RateLimit
+		if sl.limiter != nil {
+			limiter = sl.limiter()
+			if exit := limiter.GetToken(sl.ctx.Done()); exit {
+				return
+			}
+		}
+
 		buf.Reset()
-		scrapeCtx, cancel := context.WithTimeout(sl.ctx, time.Second*time.Duration(config.GetGlobalConfig().ContinueProfiling.TimeoutSeconds))
-		scrapeErr := sl.scraper.scrape(scrapeCtx, buf)
+		scrapeStart := time.Now()
+		// the timeout starts after getting the token, so that waiting
+		// doesn't fail scrapes.
+		scrapeCtx, cancel := context.WithTimeout(sl.ctx, sl.scraper.target.timeout())
+		dataFormat, scrapeErr := sl.scraper.scrape(scrapeCtx, buf)
 		cancel()
+		if limiter != nil {
+			limiter.PutToken()
+		}
 
 		if scrapeErr == nil {
+			var err error
+			var size int
 			if buf.Len() > 0 {
 				sl.lastScrapeSize = buf.Len()
-				ts := util.GetTimeStamp(start)
-				err := sl.store.AddProfile(meta.ProfileTarget{
+				var ts int64
+				ts, size, err = addProfile(sl.store, meta.ProfileTarget{
 					Kind:      sl.scraper.target.Kind,
 					Component: sl.scraper.target.Component,
 					Address:   sl.scraper.target.Address,
-				}, ts, buf.Bytes())
+				}, util.GetTimeStamp(start), dataFormat, buf.Bytes())
 
 				if err == nil {
 					sl.lastScrape = start
+					sl.storedSize.Store(int64(size))
 				} else {
 					log.Error("save scrape data failed",
 						zap.String("component", target.Component),
@@ -95,9 +130,14 @@ func (sl *ScrapeSuite) run(ticker *TickerChan) {
 						zap.String("kind", target.Kind),
 						zap.Int64("ts", ts),
 						zap.Error(err))
+					err = errors.Wrap(err, "failed to save")
 				}
 			}
+			sl.setStatus(start, err)
+			observeScrape(target.ProfileTarget, scrapeStart, size, err)
 		} else {
+			sl.setStatus(start, scrapeErr)
+			observeScrape(target.ProfileTarget, scrapeStart, 0, scrapeErr)
 			log.Error("scrape failed",
 				zap.String("component", target.Component),
 				zap.String("address", target.Address),
@@ -107,6 +147,23 @@ func (sl *ScrapeSuite) run(ticker *TickerChan) {
 	}
 }
 
+// maxTsShift is the max seconds a profile is stored before its ts, once the
+// ts is taken, e.g. by a manual profiling and a scheduled scrape of the same
+// target in the same second.
+const maxTsShift = 10
+
+// addProfile stores the profile at ts, or at the latest free ts before it,
+// which never lands in the future. It returns the ts stored at and the size
+// stored.
+func addProfile(s *store.ProfileStorage, pt meta.ProfileTarget, ts int64, dataFormat string, data []byte) (int64, int, error) {
+	for shift := int64(0); ; shift++ {
+		size, err := s.AddProfile(pt, ts-shift, dataFormat, data)
+		if err != store.ErrProfileExists || shift == maxTsShift {
+			return ts - shift, size, err
+		}
+	}
+}
+
 // Stop the scraping. May still write data and stale markers after it has
 // returned. Cancel the context to stop all writes.
 func (sl *ScrapeSuite) stop() {
@@ -126,16 +183,13 @@ func newScraper(target *Target, client *http.Client) Scraper {
 	}
 }
 
-func (s *Scraper) scrape(ctx context.Context, w io.Writer) error {
-	cfg := config.GetGlobalConfig()
-	if !cfg.ContinueProfiling.Enable {
-		return nil
-	}
-
+// scrape writes the profile into w, and returns its data format told by
+// the content type.
+func (s *Scraper) scrape(ctx context.Context, w io.Writer) (string, error) {
 	if s.req == nil {
 		req, err := http.NewRequest("GET", s.target.GetURLString(), nil)
 		if err != nil {
-			return err
+			return "", err
 		}
 		if header := s.target.header; len(header) > 0 {
 			for k, v := range header {
@@ -148,21 +202,49 @@ func (s *Scraper) scrape(ctx context.Context, w io.Writer) error {
 
 	resp, err := ctxhttp.Do(ctx, s.client, s.req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+		return "", fmt.Errorf("server returned HTTP status %s", resp.Status)
 	}
 
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return errors.Wrap(err, "failed to read body")
+		return "", errors.Wrap(err, "failed to read body")
+	}
+
+	dataFormat := dataFormatOf(resp.Header.Get("Content-Type"))
+	if s.target.symbolize && dataFormat == meta.ProfileDataFormatProtobuf {
+		if symbolized, err := s.symbolize(ctx, b); err == nil {
+			b = symbolized
+		} else {
+			log.Warn("symbolize profile failed, stored as is",
+				zap.String("component", s.target.Component),
+				zap.String("address", s.target.Address),
+				zap.String("kind", s.target.Kind),
+				zap.Error(err))
+		}
 	}
 
 	_, err = w.Write(b)
-	return err
+	return dataFormat, err
+}
+
+// dataFormatOf tells the data format by the content type, e.g. Go responds
+// profiles in application/octet-stream and goroutine dumps in text/plain,
+// while TiKV responds protobuf or SVG flamegraphs.
+func dataFormatOf(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "image/svg+xml":
+		return meta.ProfileDataFormatSVG
+	case strings.HasPrefix(mediaType, "text/"):
+		return meta.ProfileDataFormatText
+	default:
+		return meta.ProfileDataFormatProtobuf
+	}
 }
 
 func (s *Scraper) tryUnzip(data []byte) []byte {
@@ -181,6 +263,13 @@ func (s *Scraper) tryUnzip(data []byte) []byte {
 type Target struct {
 	meta.ProfileTarget
 	header map[string]string
+	// seconds is the duration of profiling, 0 for snapshots.
+	seconds int
+	// gitHash is the build of the component, by which symbols are cached.
+	gitHash string
+	// symbolize is whether to resolve symbols missing in profiles, e.g.
+	// TiKV may respond addresses only.
+	symbolize bool
 	*url.URL
 }
 
@@ -201,6 +290,7 @@ func NewTarget(component, address, kind, schema string, cfg *config.PprofProfili
 	}
 
 	t.header = cfg.Header
+	t.seconds = cfg.Seconds
 	t.URL = &url.URL{
 		Scheme:   schema,
 		Host:     t.Address,
@@ -213,3 +303,17 @@ func NewTarget(component, address, kind, schema string, cfg *config.PprofProfili
 func (t *Target) GetURLString() string {
 	return t.URL.String()
 }
+
+// minProfilingTimeoutMargin is the minimum time left to respond after
+// profiling, e.g. TiKV symbolizes CPU profiles after profiling.
+const minProfilingTimeoutMargin = 10 * time.Second
+
+// timeout is the timeout of scraping, which is kept beyond the duration of
+// profiling.
+func (t *Target) timeout() time.Duration {
+	timeout := time.Second * time.Duration(config.GetGlobalConfig().ContinueProfiling.TimeoutSeconds)
+	if d := time.Second*time.Duration(t.seconds) + minProfilingTimeoutMargin; timeout < d {
+		timeout = d
+	}
+	return timeout
+}
@@ -0,0 +1,112 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/store"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestScrapeDataFormat(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{Enable: true, TimeoutSeconds: 5}})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") == "application/protobuf" {
+			w.Header().Set("Content-Type", "application/protobuf")
+			_, _ = w.Write([]byte{0x1})
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte("<svg></svg>"))
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	for _, c := range []struct {
+		header     map[string]string
+		dataFormat string
+	}{
+		{nil, meta.ProfileDataFormatSVG},
+		{map[string]string{"Content-Type": "application/protobuf"}, meta.ProfileDataFormatProtobuf},
+	} {
+		target := NewTarget("tikv", addr, meta.ProfileKindProfile, "http", &config.PprofProfilingConfig{Path: "/debug/pprof/profile", Header: c.header})
+		scraper := newScraper(target, ts.Client())
+		var buf bytes.Buffer
+		dataFormat, err := scraper.scrape(context.Background(), &buf)
+		require.NoError(t, err)
+		require.Equal(t, c.dataFormat, dataFormat)
+		require.NotZero(t, buf.Len())
+	}
+
+	require.Equal(t, meta.ProfileDataFormatText, dataFormatOf("text/plain; charset=utf-8"))
+	require.Equal(t, meta.ProfileDataFormatProtobuf, dataFormatOf("application/octet-stream"))
+	require.Equal(t, meta.ProfileDataFormatProtobuf, dataFormatOf(""))
+}
+
+func TestTargetTimeout(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{TimeoutSeconds: 30}})
+	snapshot := NewTarget("tidb", "127.0.0.1:10080", meta.ProfileKindHeap, "http", &config.PprofProfilingConfig{Path: "/debug/pprof/heap"})
+	require.Equal(t, 30*time.Second, snapshot.timeout())
+	// profiling longer than the timeout
+	profile := NewTarget("tikv", "127.0.0.1:20180", meta.ProfileKindProfile, "http", &config.PprofProfilingConfig{Path: "/debug/pprof/profile", Seconds: 60})
+	require.Equal(t, 60*time.Second+minProfilingTimeoutMargin, profile.timeout())
+}
+
+func TestScrapeConcurrency(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{Enable: true, IntervalSeconds: 60, TimeoutSeconds: 5, ScrapeConcurrency: 2}})
+	running, maxRunning, served := atomic.NewInt32(0), atomic.NewInt32(0), atomic.NewInt32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Inc()
+		defer running.Dec()
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CAS(max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		served.Inc()
+		_, _ = w.Write([]byte("profile"))
+	}))
+	defer ts.Close()
+
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := store.NewProfileStorage(db)
+	require.NoError(t, err)
+	defer s.StopGC()
+	m := NewManager(s, nil)
+	defer m.ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		target := NewTarget("tidb", strings.TrimPrefix(ts.URL, "http://"), meta.ProfileKindHeap+strconv.Itoa(i), "http", &config.PprofProfilingConfig{Path: "/debug/pprof/heap"})
+		suite := newScrapeSuite(ctx, newScraper(target, ts.Client()), s)
+		suite.limiter = m.scrapeLimiter
+		ticker := m.ticker.Subscribe()
+		ticker.ch <- time.Now()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			suite.run(ticker)
+		}()
+	}
+	require.Eventually(t, func() bool { return served.Load() == 6 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+	require.Equal(t, int32(2), maxRunning.Load())
+}
@@ -0,0 +1,74 @@
+package scrape
+
+import (
+	"sort"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/util"
+)
+
+const (
+	ScrapeStatePending = "pending"
+	ScrapeStateSuccess = "success"
+	ScrapeStateFailed  = "failed"
+)
+
+// ScrapeStatus is the result of the last scrape of a target, which is
+// pending until the first scrape finishes.
+type ScrapeStatus struct {
+	meta.ProfileTarget
+	State string `json:"state"`
+	// Error is the error of the last scrape if failed, either of scraping or
+	// storing.
+	Error          string `json:"error,omitempty"`
+	LastScrapeTs   int64  `json:"last_scrape_ts"`
+	LastSuccessTs  int64  `json:"last_success_ts"`
+	DurationMillis int64  `json:"duration_ms"`
+}
+
+func (sl *ScrapeSuite) setStatus(start time.Time, err error) {
+	sl.statusMu.Lock()
+	defer sl.statusMu.Unlock()
+	sl.status.LastScrapeTs = util.GetTimeStamp(start)
+	sl.status.DurationMillis = time.Since(start).Milliseconds()
+	if err != nil {
+		sl.status.State = ScrapeStateFailed
+		sl.status.Error = err.Error()
+		return
+	}
+	sl.status.State = ScrapeStateSuccess
+	sl.status.Error = ""
+	sl.status.LastSuccessTs = sl.status.LastScrapeTs
+}
+
+func (sl *ScrapeSuite) getStatus() ScrapeStatus {
+	sl.statusMu.Lock()
+	defer sl.statusMu.Unlock()
+	status := sl.status
+	status.ProfileTarget = sl.scraper.target.ProfileTarget
+	if len(status.State) == 0 {
+		status.State = ScrapeStatePending
+	}
+	return status
+}
+
+// ScrapeStatuses returns statuses of all targets being scraped, ordered by
+// component, address and kind.
+func (m *Manager) ScrapeStatuses() []ScrapeStatus {
+	_, suites := m.GetAllCurrentScrapeSuite()
+	statuses := make([]ScrapeStatus, 0, len(suites))
+	for _, suite := range suites {
+		statuses = append(statuses, suite.getStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Component != statuses[j].Component {
+			return statuses[i].Component < statuses[j].Component
+		}
+		if statuses[i].Address != statuses[j].Address {
+			return statuses[i].Address < statuses[j].Address
+		}
+		return statuses[i].Kind < statuses[j].Kind
+	})
+	return statuses
+}
@@ -0,0 +1,72 @@
+package scrape
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/conprof/store"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestScrapeStatus(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{Enable: true, IntervalSeconds: 60, TimeoutSeconds: 5}})
+	fail := atomic.NewBool(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("profile"))
+	}))
+	defer ts.Close()
+
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	s, err := store.NewProfileStorage(db)
+	require.NoError(t, err)
+	defer s.StopGC()
+	m := NewManager(s, nil)
+	defer m.ticker.Stop()
+
+	target := NewTarget("tidb", strings.TrimPrefix(ts.URL, "http://"), meta.ProfileKindHeap, "http", &config.PprofProfilingConfig{Path: "/debug/pprof/heap"})
+	suite := newScrapeSuite(context.Background(), newScraper(target, ts.Client()), s)
+	m.addScrapeSuite(target.ProfileTarget, suite)
+	require.Equal(t, ScrapeStatePending, m.ScrapeStatuses()[0].State)
+
+	ticker := m.ticker.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		suite.run(ticker)
+		close(done)
+	}()
+	defer func() {
+		suite.stop()
+		<-done
+	}()
+
+	ticker.ch <- time.Unix(100, 0)
+	require.Eventually(t, func() bool { return m.ScrapeStatuses()[0].State != ScrapeStatePending }, 5*time.Second, 10*time.Millisecond)
+	status := m.ScrapeStatuses()[0]
+	require.Equal(t, ScrapeStateFailed, status.State)
+	require.Contains(t, status.Error, "500")
+	require.Equal(t, int64(100), status.LastScrapeTs)
+	require.Zero(t, status.LastSuccessTs)
+
+	fail.Store(false)
+	ticker.ch <- time.Unix(200, 0)
+	require.Eventually(t, func() bool { return m.ScrapeStatuses()[0].State == ScrapeStateSuccess }, 5*time.Second, 10*time.Millisecond)
+	status = m.ScrapeStatuses()[0]
+	require.Empty(t, status.Error)
+	require.Equal(t, int64(200), status.LastSuccessTs)
+	require.Equal(t, target.ProfileTarget, status.ProfileTarget)
+}
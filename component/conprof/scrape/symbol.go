@@ -0,0 +1,198 @@
+package scrape
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/pprof/profile"
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	symbolPath = "/debug/pprof/symbol"
+	// maxSymbolCacheBuilds is the number of builds whose symbols are cached,
+	// e.g. builds before and after a rolling upgrade.
+	maxSymbolCacheBuilds = 8
+)
+
+// symbolBuild identifies a binary, or a library loaded by it, whose symbols
+// are shared by profiles of the same build.
+type symbolBuild struct {
+	gitHash string
+	buildID string
+}
+
+// symbolCache caches function names by offsets into mappings of builds.
+// Addresses aren't cached as is, since TiKV is position independent and
+// loaded at different addresses by processes of the same build.
+type symbolCache struct {
+	sync.Mutex
+	builds map[symbolBuild]map[uint64]string
+	// order is of caching to drop the oldest builds.
+	order []symbolBuild
+}
+
+var symbols = symbolCache{builds: make(map[symbolBuild]map[uint64]string)}
+
+// symbolOffset returns the build of the location and its offset into the
+// mapping, and false if symbols of the location can't be shared, i.e. the
+// build is unknown without a git hash, or the location isn't mapped.
+func symbolOffset(gitHash string, loc *profile.Location) (symbolBuild, uint64, bool) {
+	m := loc.Mapping
+	if len(gitHash) == 0 || m == nil || loc.Address < m.Start {
+		return symbolBuild{}, 0, false
+	}
+	return symbolBuild{gitHash: gitHash, buildID: m.BuildID}, loc.Address - m.Start + m.Offset, true
+}
+
+func (c *symbolCache) lookup(build symbolBuild, offset uint64) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	name, ok := c.builds[build][offset]
+	return name, ok
+}
+
+func (c *symbolCache) add(build symbolBuild, offset uint64, name string) {
+	c.Lock()
+	defer c.Unlock()
+	names, ok := c.builds[build]
+	if !ok {
+		names = make(map[uint64]string)
+		c.builds[build] = names
+		c.order = append(c.order, build)
+		if len(c.order) > maxSymbolCacheBuilds {
+			delete(c.builds, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	names[offset] = name
+}
+
+// symbolize resolves function names of locations without them, which are
+// responded by the symbol endpoint of the target, and returns the profile
+// as is if all locations have been symbolized, e.g. by TiKV itself.
+func (s *Scraper) symbolize(ctx context.Context, data []byte) ([]byte, error) {
+	p, err := profile.ParseData(data)
+	if err != nil {
+		return nil, err
+	}
+	var locs []*profile.Location
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 && loc.Address != 0 {
+			locs = append(locs, loc)
+		}
+	}
+	if len(locs) == 0 {
+		return data, nil
+	}
+
+	gitHash := s.target.gitHash
+	names := make(map[uint64]string, len(locs))
+	var missing []uint64
+	for _, loc := range locs {
+		if build, offset, ok := symbolOffset(gitHash, loc); ok {
+			if name, ok := symbols.lookup(build, offset); ok {
+				names[loc.Address] = name
+				continue
+			}
+		}
+		if _, ok := names[loc.Address]; !ok {
+			missing = append(missing, loc.Address)
+		}
+	}
+	if len(missing) != 0 {
+		// fetched by addresses of this process, and cached by offsets
+		resolved, err := s.fetchSymbols(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, loc := range locs {
+			if _, ok := names[loc.Address]; ok {
+				continue
+			}
+			// addresses not resolved are cached as themselves, so that
+			// they're not fetched again
+			name, ok := resolved[loc.Address]
+			if !ok {
+				name = fmt.Sprintf("0x%x", loc.Address)
+			}
+			names[loc.Address] = name
+			if build, offset, ok := symbolOffset(gitHash, loc); ok {
+				symbols.add(build, offset, name)
+			}
+		}
+	}
+
+	functions := make(map[string]*profile.Function)
+	for _, fn := range p.Function {
+		functions[fn.Name] = fn
+	}
+	for _, loc := range locs {
+		name := names[loc.Address]
+		fn, ok := functions[name]
+		if !ok {
+			fn = &profile.Function{ID: uint64(len(p.Function) + 1), Name: name, SystemName: name}
+			p.Function = append(p.Function, fn)
+			functions[name] = fn
+		}
+		loc.Line = []profile.Line{{Function: fn}}
+	}
+
+	var buf bytes.Buffer
+	if err = p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchSymbols resolves addresses by the pprof symbol protocol, which takes
+// addresses joined by "+" and responds lines of "<address> <name>".
+func (s *Scraper) fetchSymbols(ctx context.Context, addrs []uint64) (map[uint64]string, error) {
+	hexAddrs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		hexAddrs = append(hexAddrs, fmt.Sprintf("0x%x", addr))
+	}
+	u := url.URL{Scheme: s.target.Scheme, Host: s.target.Host, Path: symbolPath}
+	req, err := http.NewRequest("POST", u.String(), strings.NewReader(strings.Join(hexAddrs, "+")))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("symbol server returned HTTP status %s", resp.Status)
+	}
+
+	names := make(map[uint64]string, len(addrs))
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		// e.g. "num_symbols: 1" is skipped
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "0x") {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0][2:], 16, 64)
+		if err != nil {
+			continue
+		}
+		names[addr] = fields[1]
+	}
+	return names, scanner.Err()
+}
+
+// setBuild sets the build of the component to symbolize profiles of it.
+func (t *Target) setBuild(component topology.Component) {
+	t.gitHash = component.GitHash
+	t.symbolize = component.Name == topology.ComponentTiKV
+}
@@ -0,0 +1,99 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestSymbolize(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{ContinueProfiling: config.ContinueProfilingConfig{Enable: true, TimeoutSeconds: 5}})
+	symbolRequests := atomic.NewInt32(0)
+	// newProcess serves a TiKV process of the build loaded at start, which
+	// responds addresses only, and names them by offsets into the binary.
+	newProcess := func(start uint64, mapped bool) string {
+		mapping := &profile.Mapping{ID: 1, Start: start, Limit: start + 0x1000, BuildID: "build"}
+		locs := []*profile.Location{{ID: 1, Address: start + 0x10}, {ID: 2, Address: start + 0x20}}
+		p := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+			Sample:     []*profile.Sample{{Location: locs, Value: []int64{10}}},
+			Location:   locs,
+		}
+		if mapped {
+			p.Mapping = []*profile.Mapping{mapping}
+			for _, loc := range locs {
+				loc.Mapping = mapping
+			}
+		}
+		var data bytes.Buffer
+		require.NoError(t, p.Write(&data))
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == symbolPath {
+				symbolRequests.Inc()
+				body, _ := ioutil.ReadAll(r.Body)
+				_, _ = fmt.Fprintln(w, "num_symbols: 1")
+				for _, addr := range strings.Split(string(body), "+") {
+					a, err := strconv.ParseUint(strings.TrimPrefix(addr, "0x"), 16, 64)
+					require.NoError(t, err)
+					_, _ = fmt.Fprintf(w, "%s func_0x%x\n", addr, a-start)
+				}
+				return
+			}
+			_, _ = w.Write(data.Bytes())
+		}))
+		t.Cleanup(ts.Close)
+		return strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	scrape := func(addr, gitHash string) {
+		target := NewTarget(topology.ComponentTiKV, addr, meta.ProfileKindProfile, "http", &config.PprofProfilingConfig{Path: "/debug/pprof/profile"})
+		target.setBuild(topology.Component{Name: topology.ComponentTiKV, GitHash: gitHash})
+		scraper := newScraper(target, &http.Client{})
+		var buf bytes.Buffer
+		_, err := scraper.scrape(context.Background(), &buf)
+		require.NoError(t, err)
+		p, err := profile.ParseData(buf.Bytes())
+		require.NoError(t, err)
+		require.Len(t, p.Sample[0].Location, 2)
+		require.Equal(t, "func_0x10", p.Sample[0].Location[0].Line[0].Function.Name)
+		require.Equal(t, "func_0x20", p.Sample[0].Location[1].Line[0].Function.Name)
+	}
+
+	// the cache is shared by tests
+	gitHash := fmt.Sprint(time.Now().UnixNano())
+	process1 := newProcess(0x10000, true)
+	scrape(process1, gitHash)
+	scrape(process1, gitHash)
+	// profiles of the same build are symbolized by the cache
+	require.Equal(t, int32(1), symbolRequests.Load())
+	// even if the process of the build is loaded at another address
+	process2 := newProcess(0x50000, true)
+	scrape(process2, gitHash)
+	require.Equal(t, int32(1), symbolRequests.Load())
+
+	// unknown builds aren't cached
+	scrape(process1, "")
+	scrape(process1, "")
+	require.Equal(t, int32(3), symbolRequests.Load())
+	// neither are locations out of mappings
+	process3 := newProcess(0x10000, false)
+	scrape(process3, gitHash)
+	scrape(process3, gitHash)
+	require.Equal(t, int32(5), symbolRequests.Load())
+}
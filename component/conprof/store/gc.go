@@ -10,6 +10,7 @@ import (
 	"github.com/zhongzc/ng_monitoring/component/conprof/meta"
 	"github.com/zhongzc/ng_monitoring/component/conprof/util"
 	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
 	"go.uber.org/zap"
 )
 
@@ -17,13 +18,47 @@ const (
 	gcInterval = time.Second * 60
 )
 
-func (s *ProfileStorage) doGCLoop() {
+// StartGC starts the loop which deletes profiles beyond the retention. It's
+// a no-op if the loop is already running.
+func (s *ProfileStorage) StartGC() {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	if s.gcStopCh != nil {
+		return
+	}
+
+	stopCh := make(chan struct{})
+	s.gcStopCh = stopCh
+	s.gcWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer s.gcWG.Done()
+		s.doGCLoop(stopCh)
+	}, nil)
+}
+
+// StopGC stops the gc loop, profiles are kept beyond the retention until
+// the loop is started again.
+func (s *ProfileStorage) StopGC() {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	if s.gcStopCh == nil {
+		return
+	}
+
+	close(s.gcStopCh)
+	s.gcWG.Wait()
+	s.gcStopCh = nil
+}
+
+func (s *ProfileStorage) doGCLoop(stopCh chan struct{}) {
 	ticker := time.NewTicker(gcInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			s.runGC()
+		case <-stopCh:
+			return
 		}
 	}
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/genjidb/genji"
 	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
 	"github.com/genjidb/genji/types"
 	"github.com/pingcap/log"
 	"github.com/valyala/gozstd"
@@ -27,6 +28,10 @@ const (
 
 var ErrStoreIsClosed = errors.New("storage is closed")
 
+// ErrProfileExists is returned by AddProfile if the target already has a
+// profile at the ts.
+var ErrProfileExists = errors.New("profile already exists")
+
 type ProfileStorage struct {
 	closed atomic.Bool
 	sync.Mutex
@@ -34,6 +39,10 @@ type ProfileStorage struct {
 	metaCache    map[meta.ProfileTarget]*meta.TargetInfo
 	idAllocator  int64
 	aliveTargets []meta.ProfileTarget
+
+	gcMu     sync.Mutex
+	gcStopCh chan struct{}
+	gcWG     sync.WaitGroup
 }
 
 func NewProfileStorage(db *genji.DB) (*ProfileStorage, error) {
@@ -46,7 +55,7 @@ func NewProfileStorage(db *genji.DB) (*ProfileStorage, error) {
 		return nil, err
 	}
 
-	go utils.GoWithRecovery(store.doGCLoop, nil)
+	store.StartGC()
 
 	return store, nil
 }
@@ -119,30 +128,43 @@ func (s *ProfileStorage) UpdateProfileTargetInfo(pt meta.ProfileTarget, ts int64
 	return true, nil
 }
 
-func (s *ProfileStorage) AddProfile(pt meta.ProfileTarget, ts int64, profileData []byte) error {
+// AddProfile stores the profile in the data format as scraped, e.g. TiKV
+// may respond flamegraphs in SVG rather than protobuf. Profiles are stored
+// compressed by zstd unless it doesn't make them smaller. It returns the
+// size stored.
+func (s *ProfileStorage) AddProfile(pt meta.ProfileTarget, ts int64, dataFormat string, profileData []byte) (int, error) {
 	if s.isClose() {
-		return ErrStoreIsClosed
+		return 0, ErrStoreIsClosed
 	}
 	info, err := s.prepareProfileTable(pt)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if pt.Kind == meta.ProfileKindGoroutine {
-		profileData = gozstd.Compress(nil, profileData)
+	compression := compressionZstd
+	if compressed := gozstd.Compress(nil, profileData); len(compressed) < len(profileData) {
+		profileData = compressed
+	} else {
+		// e.g. gzipped profiles of Go components
+		compression = compressionNone
 	}
 
-	sql := fmt.Sprintf("INSERT INTO %v (ts, data) VALUES (?, ?)", s.getProfileDataTableName(info))
-	err = s.db.Exec(sql, ts, profileData)
-	if err != nil {
-		return err
+	// both in a transaction, so that a conflicting ts leaves neither.
+	err = s.db.Update(func(tx *genji.Tx) error {
+		sql := fmt.Sprintf("INSERT INTO %v (ts, data, data_format, compression) VALUES (?, ?, ?, ?)", s.getProfileDataTableName(info))
+		if err := tx.Exec(sql, ts, profileData, dataFormat, compression); err != nil {
+			return err
+		}
+		sql = fmt.Sprintf("INSERT INTO %v (ts) VALUES (?)", s.getProfileMetaTableName(info))
+		return tx.Exec(sql, ts)
+	})
+	if err == errs.ErrDuplicateDocument {
+		return 0, ErrProfileExists
 	}
-	sql = fmt.Sprintf("INSERT INTO %v (ts) VALUES (?)", s.getProfileMetaTableName(info))
-	err = s.db.Exec(sql, ts)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return len(profileData), nil
 }
 
 type QueryLimiter struct {
@@ -252,7 +274,7 @@ func (s *ProfileStorage) QueryTargetProfiles(pt meta.ProfileTarget, ptInfo *meta
 	return result, err
 }
 
-func (s *ProfileStorage) QueryProfileData(param *meta.BasicQueryParam, handleFn func(meta.ProfileTarget, int64, []byte) error) error {
+func (s *ProfileStorage) QueryProfileData(param *meta.BasicQueryParam, handleFn func(meta.ProfileTarget, int64, string, []byte) error) error {
 	if s.isClose() {
 		return ErrStoreIsClosed
 	}
@@ -268,10 +290,10 @@ func (s *ProfileStorage) QueryProfileData(param *meta.BasicQueryParam, handleFn
 	}
 
 	var fnMu sync.Mutex
-	safeHandleFn := func(pt meta.ProfileTarget, ts int64, data []byte) error {
+	safeHandleFn := func(pt meta.ProfileTarget, ts int64, dataFormat string, data []byte) error {
 		fnMu.Lock()
 		defer fnMu.Unlock()
-		return handleFn(pt, ts, data)
+		return handleFn(pt, ts, dataFormat, data)
 	}
 
 	errCh := make(chan error, len(targets))
@@ -307,10 +329,10 @@ func (s *ProfileStorage) QueryProfileData(param *meta.BasicQueryParam, handleFn
 	return nil
 }
 
-func (s *ProfileStorage) QueryTargetProfileData(pt meta.ProfileTarget, ptInfo *meta.TargetInfo, param *meta.BasicQueryParam, handleFn func(meta.ProfileTarget, int64, []byte) error) error {
+func (s *ProfileStorage) QueryTargetProfileData(pt meta.ProfileTarget, ptInfo *meta.TargetInfo, param *meta.BasicQueryParam, handleFn func(meta.ProfileTarget, int64, string, []byte) error) error {
 	queryLimiter := newQueryLimiter(param.Limit)
 	args := []interface{}{param.Begin, param.End}
-	query := fmt.Sprintf("SELECT ts, data FROM %v WHERE ts >= ? and ts <= ?", s.getProfileDataTableName(ptInfo))
+	query := fmt.Sprintf("SELECT ts, data, data_format, compression FROM %v WHERE ts >= ? and ts <= ?", s.getProfileDataTableName(ptInfo))
 	res, err := s.db.Query(query, args...)
 	if err != nil {
 		return err
@@ -319,19 +341,26 @@ func (s *ProfileStorage) QueryTargetProfileData(pt meta.ProfileTarget, ptInfo *m
 	err = res.Iterate(func(d types.Document) error {
 		var ts int64
 		var data []byte
-		err = document.Scan(d, &ts, &data)
+		var dataFormat, compression string
+		err = document.Scan(d, &ts, &data, &dataFormat, &compression)
 		if err != nil {
 			return err
 		}
+		if len(dataFormat) == 0 {
+			dataFormat = legacyDataFormat(pt)
+		}
+		if len(compression) == 0 {
+			compression = legacyCompression(pt)
+		}
 
-		if pt.Kind == meta.ProfileKindGoroutine {
+		if compression == compressionZstd {
 			data, err = gozstd.Decompress(nil, data)
 			if err != nil {
 				return err
 			}
 		}
 
-		err = handleFn(pt, ts, data)
+		err = handleFn(pt, ts, dataFormat, data)
 		if err != nil {
 			return err
 		}
@@ -347,6 +376,33 @@ func (s *ProfileStorage) QueryTargetProfileData(pt meta.ProfileTarget, ptInfo *m
 	return err
 }
 
+// legacyDataFormat is the data format of profiles stored without it.
+func legacyDataFormat(pt meta.ProfileTarget) string {
+	if pt.Kind == meta.ProfileKindGoroutine {
+		return meta.ProfileDataFormatText
+	}
+	return meta.ProfileDataFormatProtobuf
+}
+
+const (
+	compressionNone = "none"
+	compressionZstd = "zstd"
+)
+
+// legacyCompression is the compression of profiles stored without it, when
+// only goroutine dumps were compressed.
+func legacyCompression(pt meta.ProfileTarget) string {
+	if pt.Kind == meta.ProfileKindGoroutine {
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+// Targets returns all targets having profiles stored.
+func (s *ProfileStorage) Targets() []meta.ProfileTarget {
+	return s.getAllTargetsFromCache()
+}
+
 func (s *ProfileStorage) getTargetInfoFromCache(pt meta.ProfileTarget) *meta.TargetInfo {
 	s.Lock()
 	info := s.metaCache[pt]
@@ -0,0 +1,232 @@
+// Package featureflag gates risky capabilities behind flags, which are
+// toggled at runtime by the admin API and persisted in the document database,
+// so that they can be rolled out gradually without redeploying.
+//
+// A flag is declared by a package variable of the component it gates, e.g.
+//
+//	var columnarStore = featureflag.New("columnar-store", false, "store top SQL in columns")
+//
+// and read by columnarStore.Get(), which returns the default until it's
+// overridden.
+package featureflag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/database/table"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrFlagNotFound = errors.New("feature flag not found")
+	ErrInvalidValue = errors.New("invalid feature flag value")
+)
+
+// Value is the types of flags.
+type Value interface {
+	bool | int | float64 | string
+}
+
+// Flag is a feature flag of type T.
+type Flag[T Value] struct {
+	name        string
+	description string
+	def         T
+	value       atomic.Value // T
+}
+
+// New registers a flag with its default. It panics if the name is registered
+// twice, so that conflicting flags fail on startup.
+func New[T Value](name string, def T, description string) *Flag[T] {
+	f := &Flag[T]{name: name, description: description, def: def}
+	f.value.Store(def)
+	register(f)
+	return f
+}
+
+// Get returns the current value of the flag.
+func (f *Flag[T]) Get() T {
+	return f.value.Load().(T)
+}
+
+func (f *Flag[T]) Name() string {
+	return f.name
+}
+
+func (f *Flag[T]) parse(raw json.RawMessage) (interface{}, error) {
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("%w: %s expects %T: %v", ErrInvalidValue, f.name, v, err)
+	}
+	return v, nil
+}
+
+func (f *Flag[T]) set(v interface{}) {
+	f.value.Store(v.(T))
+}
+
+func (f *Flag[T]) reset() {
+	f.value.Store(f.def)
+}
+
+func (f *Flag[T]) info() Info {
+	return Info{
+		Name:        f.name,
+		Description: f.description,
+		Default:     f.def,
+		Value:       f.Get(),
+	}
+}
+
+// flag erases the type of Flag.
+type flag interface {
+	parse(raw json.RawMessage) (interface{}, error)
+	set(v interface{})
+	reset()
+	info() Info
+}
+
+// Info describes a flag and its current value.
+type Info struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Default     interface{} `json:"default"`
+	Value       interface{} `json:"value"`
+	// Overridden is set if the value is set by the admin API rather than
+	// the default.
+	Overridden  bool  `json:"overridden"`
+	UpdatedSecs int64 `json:"updated_secs,omitempty"`
+}
+
+type override struct {
+	Name        string
+	Value       string
+	UpdatedSecs int64
+}
+
+var overrideTable = table.New("feature_flag", []string{"name", "val", "updated_ts"}, func(o *override) []interface{} {
+	return []interface{}{&o.Name, &o.Value, &o.UpdatedSecs}
+})
+
+var (
+	mu    sync.Mutex
+	flags = make(map[string]flag)
+	// overrides are the overrides applied to flags by names
+	overrides  = make(map[string]override)
+	documentDB *genji.DB
+)
+
+func register(f flag) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name := f.info().Name
+	if _, ok := flags[name]; ok {
+		panic(fmt.Sprintf("feature flag %s is registered twice", name))
+	}
+	flags[name] = f
+}
+
+// Init loads overrides from the document database. Overrides of unknown flags,
+// e.g. those removed after upgrading, are kept but ignored.
+func Init(db *genji.DB) error {
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS feature_flag (name VARCHAR(255) PRIMARY KEY)"); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	documentDB = db
+	return overrideTable.Iterate(db, func(o override) error {
+		f, ok := flags[o.Name]
+		if !ok {
+			log.Info("ignore the override of an unknown feature flag", zap.String("name", o.Name))
+			return nil
+		}
+		v, err := f.parse(json.RawMessage(o.Value))
+		if err != nil {
+			log.Warn("ignore the invalid override of a feature flag", zap.String("name", o.Name), zap.Error(err))
+			return nil
+		}
+		f.set(v)
+		overrides[o.Name] = o
+		return nil
+	}, "")
+}
+
+// Flags returns all registered flags ordered by name.
+func Flags() []Info {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res := make([]Info, 0, len(flags))
+	for name, f := range flags {
+		info := f.info()
+		if o, ok := overrides[name]; ok {
+			info.Overridden = true
+			info.UpdatedSecs = o.UpdatedSecs
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Set overrides the flag by the JSON encoded value, which persists across
+// restarts.
+func Set(name string, raw json.RawMessage) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, ok := flags[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrFlagNotFound, name)
+	}
+	v, err := f.parse(raw)
+	if err != nil {
+		return err
+	}
+	// normalized, e.g. without spaces
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	o := override{Name: name, Value: string(value), UpdatedSecs: time.Now().Unix()}
+	if err := overrideTable.Upsert(documentDB, o); err != nil {
+		return err
+	}
+	f.set(v)
+	overrides[name] = o
+	log.Info("feature flag is set", zap.String("name", name), zap.String("value", o.Value))
+	return nil
+}
+
+// Reset restores the flag to its default.
+func Reset(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, ok := flags[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrFlagNotFound, name)
+	}
+	if err := documentDB.Exec("DELETE FROM feature_flag WHERE name = ?", name); err != nil {
+		return err
+	}
+	f.reset()
+	delete(overrides, name)
+	log.Info("feature flag is reset", zap.String("name", name))
+	return nil
+}
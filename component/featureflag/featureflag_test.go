@@ -0,0 +1,60 @@
+package featureflag
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSampling = New("test-sampling", false, "sample records")
+	testRatio    = New("test-ratio", 0.5, "sampling ratio")
+)
+
+func TestFlags(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, Init(db))
+
+	require.False(t, testSampling.Get())
+	require.Equal(t, 0.5, testRatio.Get())
+
+	require.NoError(t, Set("test-sampling", json.RawMessage("true")))
+	require.NoError(t, Set("test-ratio", json.RawMessage(" 0.1 ")))
+	require.True(t, testSampling.Get())
+	require.Equal(t, 0.1, testRatio.Get())
+
+	require.ErrorIs(t, Set("test-sampling", json.RawMessage(`"yes"`)), ErrInvalidValue)
+	require.ErrorIs(t, Set("unknown", json.RawMessage("true")), ErrFlagNotFound)
+	require.True(t, testSampling.Get())
+
+	infos := Flags()
+	require.Len(t, infos, 2)
+	require.Equal(t, "test-ratio", infos[0].Name)
+	require.True(t, infos[0].Overridden)
+	require.NotZero(t, infos[0].UpdatedSecs)
+	require.Equal(t, 0.5, infos[0].Default)
+	require.Equal(t, 0.1, infos[0].Value)
+
+	// overrides are loaded after restarting, including those of unknown flags
+	require.NoError(t, db.Exec(`INSERT INTO feature_flag(name, val, updated_ts) VALUES ("removed", "1", 1)`))
+	require.NoError(t, Reset("test-ratio"))
+	require.Equal(t, 0.5, testRatio.Get())
+	testSampling.reset()
+	overrides = make(map[string]override)
+	require.NoError(t, Init(db))
+	require.True(t, testSampling.Get())
+	require.Equal(t, 0.5, testRatio.Get())
+	infos = Flags()
+	require.True(t, infos[1].Overridden)
+	require.False(t, infos[0].Overridden)
+}
+
+func TestRegisterTwice(t *testing.T) {
+	require.Panics(t, func() {
+		New("test-sampling", true, "")
+	})
+}
@@ -0,0 +1,177 @@
+package topology
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	ChangeTypeAdded         = "added"
+	ChangeTypeRemoved       = "removed"
+	ChangeTypeStatusChanged = "status_changed"
+)
+
+type ChangeEvent struct {
+	Ts        int64  `json:"ts"`
+	Type      string `json:"type"`
+	Component string `json:"component"`
+	Address   string `json:"address"`
+	OldStatus string `json:"old_status,omitempty"`
+	NewStatus string `json:"new_status,omitempty"`
+}
+
+type componentKey struct {
+	name    string
+	address string
+}
+
+// AuditLog records every topology change into the document database.
+type AuditLog struct {
+	db *genji.DB
+	// the last known status of every component
+	last map[componentKey]string
+}
+
+func NewAuditLog(db *genji.DB) (*AuditLog, error) {
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS topology_change (ts INTEGER)"); err != nil {
+		return nil, err
+	}
+
+	a := &AuditLog{db: db, last: make(map[componentKey]string)}
+	if err := a.loadLastKnownComponents(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadLastKnownComponents replays the history so that changes happened while
+// ng-monitoring was not running are recorded on the first discovery. Documents
+// are iterated in insertion order, which is the order the changes happened.
+func (a *AuditLog) loadLastKnownComponents() error {
+	res, err := a.db.Query("SELECT type, component, address, new_status FROM topology_change")
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		var typ, component, address, status string
+		if err := document.Scan(d, &typ, &component, &address, &status); err != nil {
+			return err
+		}
+		key := componentKey{name: component, address: address}
+		if typ == ChangeTypeRemoved {
+			delete(a.last, key)
+		} else {
+			a.last[key] = status
+		}
+		return nil
+	})
+}
+
+func (a *AuditLog) Record(components []Component) error {
+	now := time.Now().Unix()
+	current := make(map[componentKey]string, len(components))
+	for _, comp := range components {
+		current[componentKey{name: comp.Name, address: fmt.Sprintf("%s:%d", comp.IP, comp.Port)}] = comp.Status
+	}
+
+	var events []ChangeEvent
+	for key, status := range current {
+		oldStatus, ok := a.last[key]
+		switch {
+		case !ok:
+			events = append(events, ChangeEvent{Ts: now, Type: ChangeTypeAdded, Component: key.name, Address: key.address, NewStatus: status})
+		case oldStatus != status:
+			events = append(events, ChangeEvent{Ts: now, Type: ChangeTypeStatusChanged, Component: key.name, Address: key.address, OldStatus: oldStatus, NewStatus: status})
+		}
+	}
+	for key, oldStatus := range a.last {
+		if _, ok := current[key]; !ok {
+			events = append(events, ChangeEvent{Ts: now, Type: ChangeTypeRemoved, Component: key.name, Address: key.address, OldStatus: oldStatus})
+		}
+	}
+
+	for _, e := range events {
+		err := a.db.Exec(
+			"INSERT INTO topology_change(ts, type, component, address, old_status, new_status) VALUES (?, ?, ?, ?, ?, ?)",
+			e.Ts, e.Type, e.Component, e.Address, e.OldStatus, e.NewStatus,
+		)
+		if err != nil {
+			return err
+		}
+		log.Info("topology changed", zap.Any("event", e))
+	}
+	a.last = current
+	return nil
+}
+
+// Changes fills changes happened within [startSecs, endSecs].
+func (a *AuditLog) Changes(startSecs, endSecs int64, fill *[]ChangeEvent) error {
+	res, err := a.db.Query(
+		"SELECT ts, type, component, address, old_status, new_status FROM topology_change WHERE ts >= ? AND ts <= ?",
+		startSecs, endSecs,
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		e := ChangeEvent{}
+		if err := document.Scan(d, &e.Ts, &e.Type, &e.Component, &e.Address, &e.OldStatus, &e.NewStatus); err != nil {
+			return err
+		}
+		*fill = append(*fill, e)
+		return nil
+	})
+}
+
+// Purge deletes changes happened before safePointSecs, except the latest
+// change of each component not removed, since the last known components are
+// replayed from the history on startup.
+func (a *AuditLog) Purge(safePointSecs int64) error {
+	return a.db.Update(func(tx *genji.Tx) error {
+		res, err := tx.Query("SELECT pk(), ts, type, component, address FROM topology_change")
+		if err != nil {
+			return err
+		}
+		type change struct {
+			pk  int64
+			ts  int64
+			typ string
+			key componentKey
+		}
+		var changes []change
+		latest := make(map[componentKey]int64)
+		err = res.Iterate(func(d types.Document) error {
+			var c change
+			if err := document.Scan(d, &c.pk, &c.ts, &c.typ, &c.key.name, &c.key.address); err != nil {
+				return err
+			}
+			changes = append(changes, c)
+			latest[c.key] = c.pk
+			return nil
+		})
+		res.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range changes {
+			if c.ts >= safePointSecs || (latest[c.key] == c.pk && c.typ != ChangeTypeRemoved) {
+				continue
+			}
+			if err := tx.Exec("DELETE FROM topology_change WHERE pk() = ?", c.pk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
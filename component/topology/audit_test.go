@@ -0,0 +1,43 @@
+package topology
+
+import (
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeChanges(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	a, err := NewAuditLog(db)
+	require.NoError(t, err)
+
+	insert := func(ts int64, typ, address, status string) {
+		require.NoError(t, db.Exec(
+			"INSERT INTO topology_change(ts, type, component, address, old_status, new_status) VALUES (?, ?, ?, ?, ?, ?)",
+			ts, typ, ComponentTiDB, address, "", status,
+		))
+	}
+	insert(1, ChangeTypeAdded, "a:4000", "up")
+	insert(2, ChangeTypeStatusChanged, "a:4000", "down")
+	insert(3, ChangeTypeAdded, "b:4000", "up")
+	insert(4, ChangeTypeRemoved, "b:4000", "")
+	insert(5, ChangeTypeAdded, "c:4000", "up")
+	insert(20, ChangeTypeStatusChanged, "c:4000", "down")
+
+	require.NoError(t, a.Purge(10))
+	var events []ChangeEvent
+	require.NoError(t, a.Changes(0, 100, &events))
+	// the latest changes of known components are kept to be replayed
+	require.Len(t, events, 2)
+	require.Equal(t, []int64{2, 20}, []int64{events[0].Ts, events[1].Ts})
+
+	replayed, err := NewAuditLog(db)
+	require.NoError(t, err)
+	require.Equal(t, map[componentKey]string{
+		{name: ComponentTiDB, address: "a:4000"}: "down",
+		{name: ComponentTiDB, address: "c:4000"}: "down",
+	}, replayed.last)
+}
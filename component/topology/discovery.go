@@ -24,14 +24,27 @@ const (
 	ComponentPD      = "pd"
 )
 
+const (
+	ComponentStatusUp          = "up"
+	ComponentStatusDown        = "down"
+	ComponentStatusOffline     = "offline"
+	ComponentStatusTombstone   = "tombstone"
+	ComponentStatusUnreachable = "unreachable"
+)
+
 type TopologyDiscoverer struct {
 	sync.Mutex
 	pdCli      *pdclient.APIClient
 	etcdCli    *clientv3.Client
 	subscriber []chan []Component
 	components []Component
+	audit      *AuditLog
 	notifyCh   chan struct{}
 	closed     chan struct{}
+
+	// loopStopCh is non-nil while the discovery loop is running.
+	loopStopCh chan struct{}
+	loopWG     sync.WaitGroup
 }
 
 type Component struct {
@@ -39,6 +52,9 @@ type Component struct {
 	IP         string `json:"ip"`
 	Port       uint   `json:"port"`
 	StatusPort uint   `json:"status_port"`
+	Version    string `json:"version"`
+	GitHash    string `json:"git_hash"`
+	Status     string `json:"status"`
 }
 
 type Subscriber = chan []Component
@@ -86,8 +102,36 @@ func (d *TopologyDiscoverer) Subscribe() chan []Component {
 	return ch
 }
 
+// Start starts the discovery loop. It's a no-op if the loop is already running.
 func (d *TopologyDiscoverer) Start() {
-	go utils.GoWithRecovery(d.loadTopologyLoop, nil)
+	d.Lock()
+	defer d.Unlock()
+	if d.loopStopCh != nil {
+		return
+	}
+
+	stopCh := make(chan struct{})
+	d.loopStopCh = stopCh
+	d.loopWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer d.loopWG.Done()
+		d.loadTopologyLoop(stopCh)
+	}, nil)
+}
+
+// Stop stops the discovery loop. Subscribers keep the last delivered
+// components until the loop is started again.
+func (d *TopologyDiscoverer) Stop() {
+	d.Lock()
+	stopCh := d.loopStopCh
+	d.loopStopCh = nil
+	d.Unlock()
+	if stopCh == nil {
+		return
+	}
+
+	close(stopCh)
+	d.loopWG.Wait()
 }
 
 func (d *TopologyDiscoverer) Close() error {
@@ -95,7 +139,7 @@ func (d *TopologyDiscoverer) Close() error {
 	return d.etcdCli.Close()
 }
 
-func (d *TopologyDiscoverer) loadTopologyLoop() {
+func (d *TopologyDiscoverer) loadTopologyLoop(stopCh chan struct{}) {
 	err := d.loadTopology()
 	log.Info("first load topology", zap.Reflect("component", d.components), zap.Error(err))
 	ticker := time.NewTicker(discoverInterval)
@@ -104,6 +148,8 @@ func (d *TopologyDiscoverer) loadTopologyLoop() {
 		select {
 		case <-d.closed:
 			return
+		case <-stopCh:
+			return
 		case <-ticker.C:
 			err = d.loadTopology()
 			if err != nil {
@@ -126,27 +172,63 @@ func (d *TopologyDiscoverer) loadTopology() error {
 		return err
 	}
 	d.components = components
+
+	if d.audit != nil {
+		if err := d.audit.Record(components); err != nil {
+			log.Warn("failed to record topology changes", zap.Error(err))
+		}
+	}
 	return nil
 }
 
 func (d *TopologyDiscoverer) notifySubscriber() {
+	d.Lock()
+	defer d.Unlock()
 	for _, ch := range d.subscriber {
-		select {
-		case ch <- d.components:
-		default:
-		}
+		deliverLatest(ch, d.components)
 	}
 }
 
-func (d *TopologyDiscoverer) getAllScrapeTargets(ctx context.Context) ([]Component, error) {
-	fns := []func(context.Context) ([]Component, error){
-		d.getTiDBComponents,
-		d.getPDComponents,
-		d.getStoreComponents,
+// deliverLatest sends components to a subscriber without blocking. If the
+// subscriber hasn't consumed the previous snapshot yet, the stale snapshot is
+// replaced by the latest one, so the subscriber always catches up eventually.
+func deliverLatest(ch Subscriber, components []Component) {
+	select {
+	case ch <- components:
+		return
+	default:
+	}
+
+	// The channel is full, drop the stale snapshot.
+	select {
+	case <-ch:
+	default:
+	}
+
+	// The discoverer is the only sender, so there must be room now.
+	select {
+	case ch <- components:
+	default:
 	}
+}
+
+type discoverySource struct {
+	name string
+	fn   func(context.Context) ([]Component, error)
+}
+
+func (d *TopologyDiscoverer) sources() []discoverySource {
+	return []discoverySource{
+		{name: "tidb", fn: d.getTiDBComponents},
+		{name: "pd", fn: d.getPDComponents},
+		{name: "store", fn: d.getStoreComponents},
+	}
+}
+
+func (d *TopologyDiscoverer) getAllScrapeTargets(ctx context.Context) ([]Component, error) {
 	components := make([]Component, 0, 8)
-	for _, fn := range fns {
-		nodes, err := fn(ctx)
+	for _, source := range d.sources() {
+		nodes, err := source.fn(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -155,6 +237,45 @@ func (d *TopologyDiscoverer) getAllScrapeTargets(ctx context.Context) ([]Compone
 	return components, nil
 }
 
+type ExcludedComponent struct {
+	Component Component `json:"component"`
+	Reason    string    `json:"reason"`
+}
+
+type DryRunResult struct {
+	Components []Component         `json:"components"`
+	Excluded   []ExcludedComponent `json:"excluded"`
+	Errors     map[string]string   `json:"errors"`
+}
+
+// DryRun performs a full discovery cycle and reports what would be scraped,
+// without touching the current topology and subscribers.
+func (d *TopologyDiscoverer) DryRun(ctx context.Context) DryRunResult {
+	result := DryRunResult{
+		Components: make([]Component, 0, 8),
+		Excluded:   make([]ExcludedComponent, 0),
+		Errors:     make(map[string]string),
+	}
+	for _, source := range d.sources() {
+		nodes, err := source.fn(ctx)
+		if err != nil {
+			result.Errors[source.name] = err.Error()
+			continue
+		}
+		for _, node := range nodes {
+			if !node.IsUp() {
+				result.Excluded = append(result.Excluded, ExcludedComponent{
+					Component: node,
+					Reason:    fmt.Sprintf("status is %s", node.Status),
+				})
+				continue
+			}
+			result.Components = append(result.Components, node)
+		}
+	}
+	return result
+}
+
 func (d *TopologyDiscoverer) getTiDBComponents(ctx context.Context) ([]Component, error) {
 	instances, err := topo.GetTiDBInstances(ctx, d.etcdCli)
 	if err != nil {
@@ -162,14 +283,14 @@ func (d *TopologyDiscoverer) getTiDBComponents(ctx context.Context) ([]Component
 	}
 	components := make([]Component, 0, len(instances))
 	for _, instance := range instances {
-		if instance.Status != topo.ComponentStatusUp {
-			continue
-		}
 		components = append(components, Component{
 			Name:       ComponentTiDB,
 			IP:         instance.IP,
 			Port:       instance.Port,
 			StatusPort: instance.StatusPort,
+			Version:    instance.Version,
+			GitHash:    instance.GitHash,
+			Status:     convertStatus(instance.Status),
 		})
 	}
 	return components, nil
@@ -182,14 +303,14 @@ func (d *TopologyDiscoverer) getPDComponents(ctx context.Context) ([]Component,
 	}
 	components := make([]Component, 0, len(instances))
 	for _, instance := range instances {
-		if instance.Status != topo.ComponentStatusUp {
-			continue
-		}
 		components = append(components, Component{
 			Name:       ComponentPD,
 			IP:         instance.IP,
 			Port:       instance.Port,
 			StatusPort: instance.Port,
+			Version:    instance.Version,
+			GitHash:    instance.GitHash,
+			Status:     convertStatus(instance.Status),
 		})
 	}
 	return components, nil
@@ -203,14 +324,14 @@ func (d *TopologyDiscoverer) getStoreComponents(ctx context.Context) ([]Componen
 	components := make([]Component, 0, len(tikvInstances)+len(tiflashInstances))
 	getComponents := func(instances []topo.StoreInfo, name string) {
 		for _, instance := range instances {
-			if instance.Status != topo.ComponentStatusUp {
-				continue
-			}
 			components = append(components, Component{
 				Name:       name,
 				IP:         instance.IP,
 				Port:       instance.Port,
 				StatusPort: instance.StatusPort,
+				Version:    instance.Version,
+				GitHash:    instance.GitHash,
+				Status:     convertStatus(instance.Status),
 			})
 		}
 	}
@@ -218,3 +339,23 @@ func (d *TopologyDiscoverer) getStoreComponents(ctx context.Context) ([]Componen
 	getComponents(tiflashInstances, ComponentTiFlash)
 	return components, nil
 }
+
+func convertStatus(status topo.ComponentStatus) string {
+	switch status {
+	case topo.ComponentStatusUp:
+		return ComponentStatusUp
+	case topo.ComponentStatusDown:
+		return ComponentStatusDown
+	case topo.ComponentStatusOffline:
+		return ComponentStatusOffline
+	case topo.ComponentStatusTombstone:
+		return ComponentStatusTombstone
+	default:
+		return ComponentStatusUnreachable
+	}
+}
+
+// IsUp reports whether the component is up and serving.
+func (c Component) IsUp() bool {
+	return c.Status == ComponentStatusUp
+}
@@ -0,0 +1,105 @@
+package topology
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func HTTPService(g *gin.RouterGroup) {
+	g.GET("/changes", handleChanges)
+	g.GET("/prometheus-sd", handlePrometheusSD)
+	g.POST("/dry-run", handleDryRun)
+}
+
+func handleChanges(c *gin.Context) {
+	if discover == nil || discover.audit == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": "topology discovery is not initialized",
+		})
+		return
+	}
+
+	now := time.Now().Unix()
+	startSecs, err := strconv.ParseInt(c.DefaultQuery("start", strconv.Itoa(int(now-7*24*60*60))), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	endSecs, err := strconv.ParseInt(c.DefaultQuery("end", strconv.Itoa(int(now))), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	events := make([]ChangeEvent, 0)
+	if err := discover.audit.Changes(startSecs, endSecs, &events); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   events,
+	})
+}
+
+// PrometheusTargetGroup is the target group format of Prometheus http_sd_config.
+// See https://prometheus.io/docs/prometheus/latest/http_sd/
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func handlePrometheusSD(c *gin.Context) {
+	components := GetCurrentComponent()
+	groups := make([]PrometheusTargetGroup, 0, len(components))
+	for _, comp := range components {
+		if !comp.IsUp() {
+			continue
+		}
+		groups = append(groups, PrometheusTargetGroup{
+			Targets: []string{fmt.Sprintf("%s:%d", comp.IP, comp.StatusPort)},
+			Labels: map[string]string{
+				"component": comp.Name,
+				"version":   comp.Version,
+				"git_hash":  comp.GitHash,
+			},
+		})
+	}
+
+	// The response must be a plain array rather than the {"status": ..., "data": ...} envelope.
+	c.JSON(http.StatusOK, groups)
+}
+
+func handleDryRun(c *gin.Context) {
+	if discover == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": "topology discovery is not initialized",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), discoverInterval)
+	defer cancel()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   discover.DryRun(ctx),
+	})
+}
@@ -1,6 +1,10 @@
 package topology
 
 import (
+	"fmt"
+
+	"github.com/genjidb/genji"
+	"github.com/zhongzc/ng_monitoring/component/admin"
 	"github.com/zhongzc/ng_monitoring/config"
 	"go.etcd.io/etcd/clientv3"
 )
@@ -10,15 +14,25 @@ var (
 	syncer   *TopologySyncer
 )
 
-func Init() error {
+func Init(db *genji.DB) error {
 	var err error
 	discover, err = NewTopologyDiscoverer(config.GetGlobalConfig())
 	if err != nil {
 		return err
 	}
+	discover.audit, err = NewAuditLog(db)
+	if err != nil {
+		return err
+	}
 	syncer = NewTopologySyncer(discover.etcdCli)
 	syncer.Start()
 	discover.Start()
+
+	admin.Register(admin.Subsystem{
+		Name:  "topology-discovery",
+		Start: StartDiscovery,
+		Stop:  StopDiscovery,
+	})
 	return err
 }
 
@@ -47,9 +61,36 @@ func Subscribe() Subscriber {
 	return discover.Subscribe()
 }
 
+// PurgeChanges deletes topology changes happened before safePointSecs.
+func PurgeChanges(safePointSecs int64) error {
+	if discover == nil || discover.audit == nil {
+		return nil
+	}
+	return discover.audit.Purge(safePointSecs)
+}
+
 func Stop() {
 	if syncer == nil {
 		return
 	}
 	syncer.Stop()
 }
+
+// StartDiscovery resumes discovering the topology after StopDiscovery.
+func StartDiscovery() error {
+	if discover == nil {
+		return fmt.Errorf("topology discoverer is not initialized")
+	}
+	discover.Start()
+	return nil
+}
+
+// StopDiscovery stops discovering the topology. Subscribers keep the last
+// known components meanwhile.
+func StopDiscovery() error {
+	if discover == nil {
+		return fmt.Errorf("topology discoverer is not initialized")
+	}
+	discover.Stop()
+	return nil
+}
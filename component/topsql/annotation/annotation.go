@@ -0,0 +1,153 @@
+// Package annotation keeps time markers written by external tools, such as
+// deployments and benchmark runs, to be overlaid on timelines.
+package annotation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/database/table"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxNameLen keeps names short enough to be shown on charts.
+	maxNameLen = 256
+	// UndeleteWindow is how long a deleted annotation can be undeleted before
+	// it's purged.
+	UndeleteWindow = 7 * 24 * time.Hour
+)
+
+// Annotation marks a point in time, or a period if EndSecs is after
+// StartSecs.
+type Annotation struct {
+	// ID is generated if it's empty. Writing an annotation with an existing ID
+	// replaces it, so that tools can retry writes.
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	StartSecs int64  `json:"start_secs"`
+	// EndSecs is the same as StartSecs for a point in time.
+	EndSecs int64 `json:"end_secs"`
+	// Source is the tool writing the annotation, e.g. `sysbench`.
+	Source string `json:"source"`
+	// DeletedSecs is when the annotation is deleted, 0 if it's not.
+	DeletedSecs int64 `json:"deleted_secs,omitempty"`
+}
+
+var (
+	documentDB *genji.DB
+
+	// Version 1 adds deleted_ts, which is missing and read as 0 in rows of
+	// version 0, i.e. they are not deleted. Filters on it are applied after
+	// reading rather than in statements, where missing is not 0.
+	annotations = table.New("annotation", []string{"id", "name", "ts", "end_ts", "source", "deleted_ts"}, func(a *Annotation) []interface{} {
+		return []interface{}{&a.ID, &a.Name, &a.StartSecs, &a.EndSecs, &a.Source, &a.DeletedSecs}
+	}).Versioned(1, nil)
+)
+
+func Init(db *genji.DB) error {
+	documentDB = db
+
+	createTableStmts := []string{
+		"CREATE TABLE IF NOT EXISTS annotation (id VARCHAR(255) PRIMARY KEY)",
+		"CREATE INDEX IF NOT EXISTS annotation_ts ON annotation (ts)",
+	}
+	for _, stmt := range createTableStmts {
+		if err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	annotations.ExportOutdated(db)
+	return nil
+}
+
+// Save writes the annotation and returns it with its ID.
+func Save(a Annotation) (Annotation, error) {
+	if len(a.Name) == 0 {
+		return a, fmt.Errorf("empty name")
+	}
+	if len(a.Name) > maxNameLen {
+		return a, fmt.Errorf("name longer than %d", maxNameLen)
+	}
+	if a.StartSecs <= 0 {
+		return a, fmt.Errorf("non-positive start: %d", a.StartSecs)
+	}
+	if a.EndSecs == 0 {
+		a.EndSecs = a.StartSecs
+	}
+	if a.EndSecs < a.StartSecs {
+		return a, fmt.Errorf("end %d before start %d", a.EndSecs, a.StartSecs)
+	}
+	// saving a deleted annotation undeletes it
+	a.DeletedSecs = 0
+	if len(a.ID) == 0 {
+		id, err := newID()
+		if err != nil {
+			return a, err
+		}
+		a.ID = id
+	}
+
+	if err := annotations.Upsert(documentDB, a); err != nil {
+		return a, err
+	}
+	log.Info("save annotation", zap.String("id", a.ID), zap.String("name", a.Name), zap.String("source", a.Source))
+	return a, nil
+}
+
+// Delete deletes the annotation, which can be undeleted within the
+// UndeleteWindow.
+func Delete(id string) error {
+	return documentDB.Exec("UPDATE annotation SET deleted_ts = ? WHERE id = ? AND (deleted_ts IS NULL OR deleted_ts = 0)", time.Now().Unix(), id)
+}
+
+// Undelete restores the deleted annotation.
+func Undelete(id string) error {
+	var deleted []Annotation
+	if err := annotations.Select(documentDB, &deleted, "WHERE id = ? AND deleted_ts > 0", id); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return fmt.Errorf("no deleted annotation: %s", id)
+	}
+	return documentDB.Exec("UPDATE annotation SET deleted_ts = 0 WHERE id = ?", id)
+}
+
+// Annotations fills annotations overlapping [startSecs, endSecs] ordered by
+// their start.
+func Annotations(startSecs, endSecs int, fill *[]Annotation) error {
+	return annotations.Iterate(documentDB, func(a Annotation) error {
+		if a.DeletedSecs == 0 {
+			*fill = append(*fill, a)
+		}
+		return nil
+	}, "WHERE ts <= ? AND end_ts >= ? ORDER BY ts", endSecs, startSecs)
+}
+
+// DeletedAnnotations fills annotations which can be undeleted, the latest
+// deleted first.
+func DeletedAnnotations(fill *[]Annotation) error {
+	return annotations.Select(documentDB, fill, "WHERE deleted_ts > 0 ORDER BY deleted_ts DESC")
+}
+
+// Purge deletes annotations ended before the safe point, and those deleted
+// before the UndeleteWindow.
+func Purge(now time.Time, safePointSecs int64) error {
+	if err := documentDB.Exec("DELETE FROM annotation WHERE end_ts < ?", safePointSecs); err != nil {
+		return err
+	}
+	return documentDB.Exec("DELETE FROM annotation WHERE deleted_ts > 0 AND deleted_ts < ?", now.Add(-UndeleteWindow).Unix())
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,91 @@
+package annotation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotations(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, Init(db))
+
+	release, err := Save(Annotation{Name: "release", StartSecs: 100, Source: "ci"})
+	require.NoError(t, err)
+	require.NotEmpty(t, release.ID)
+	require.Equal(t, int64(100), release.EndSecs)
+	_, err = Save(Annotation{ID: "bench", Name: "sysbench", StartSecs: 200, EndSecs: 300})
+	require.NoError(t, err)
+	_, err = Save(Annotation{Name: "reversed", StartSecs: 200, EndSecs: 100})
+	require.Error(t, err)
+
+	// saving with an existing id replaces it
+	_, err = Save(Annotation{ID: "bench", Name: "sysbench #2", StartSecs: 200, EndSecs: 300})
+	require.NoError(t, err)
+
+	var res []Annotation
+	require.NoError(t, Annotations(250, 400, &res))
+	require.Equal(t, []Annotation{{ID: "bench", Name: "sysbench #2", StartSecs: 200, EndSecs: 300}}, res)
+
+	res = nil
+	require.NoError(t, Annotations(0, 1000, &res))
+	require.Len(t, res, 2)
+	require.Equal(t, release, res[0])
+
+	require.NoError(t, Delete("bench"))
+	res = nil
+	require.NoError(t, Annotations(0, 1000, &res))
+	require.Equal(t, []Annotation{release}, res)
+	res = nil
+	require.NoError(t, DeletedAnnotations(&res))
+	require.Len(t, res, 1)
+	require.Equal(t, "bench", res[0].ID)
+	require.NotZero(t, res[0].DeletedSecs)
+
+	require.NoError(t, Undelete("bench"))
+	require.Error(t, Undelete("bench"))
+	res = nil
+	require.NoError(t, Annotations(0, 1000, &res))
+	require.Len(t, res, 2)
+
+	// deleted ones are purged after the undelete window
+	require.NoError(t, Delete("bench"))
+	require.NoError(t, Purge(time.Now(), 101))
+	res = nil
+	require.NoError(t, DeletedAnnotations(&res))
+	require.Len(t, res, 1)
+	require.NoError(t, Purge(time.Now().Add(UndeleteWindow+time.Minute), 101))
+	res = nil
+	require.NoError(t, DeletedAnnotations(&res))
+	require.Empty(t, res)
+	require.NoError(t, Annotations(0, 1000, &res))
+	require.Empty(t, res)
+}
+
+func TestAnnotationsBeforeDeletion(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, Init(db))
+
+	// written before annotations can be deleted
+	require.NoError(t, db.Exec("INSERT INTO annotation(id, name, ts, end_ts, source) VALUES ('old', 'release', 100, 100, 'ci')"))
+	outdated, err := annotations.Outdated(db)
+	require.NoError(t, err)
+	require.Equal(t, 1, outdated)
+
+	var res []Annotation
+	require.NoError(t, Annotations(0, 1000, &res))
+	require.Equal(t, []Annotation{{ID: "old", Name: "release", StartSecs: 100, EndSecs: 100, Source: "ci"}}, res)
+
+	require.NoError(t, Delete("old"))
+	res = nil
+	require.NoError(t, Annotations(0, 1000, &res))
+	require.Empty(t, res)
+	require.NoError(t, DeletedAnnotations(&res))
+	require.Len(t, res, 1)
+}
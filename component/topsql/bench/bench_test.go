@@ -0,0 +1,145 @@
+package bench
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/dataset"
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/database/timeseries"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/genjidb/genji"
+)
+
+// preloadWindows is the number of report windows loaded for query benchmarks.
+const preloadWindows = 10
+
+var now = uint64(time.Now().Unix())
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "topsql-bench")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Log:     config.Log{Path: dir, Level: config.LevelWarn},
+		Storage: config.Storage{Path: dir},
+		TopSQL:  config.TopSQL{RetentionDays: config.DefTopSQLRetentionDays},
+	}
+	config.StoreGlobalConfig(cfg)
+
+	// measure queries rather than the result cache
+	_ = flag.Set("search.disableCache", "true")
+	timeseries.Init(cfg)
+	defer timeseries.Stop()
+
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer db.Close()
+
+	masking.Init(db)
+	store.Init(timeseries.InsertHandler, db)
+	query.Init(timeseries.SelectHandler, db)
+
+	return m.Run()
+}
+
+func ingest(b *testing.B, shape dataset.Shape, startSecs uint64) {
+	records := shape.CPUTimeRecords(startSecs)
+	for i := 0; i < shape.Instances; i++ {
+		for _, record := range records {
+			if err := store.TopSQLRecord(shape.Instance(i), "tidb", record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	// writes are measured rather than queueing
+	store.FlushWrites()
+}
+
+func BenchmarkIngest(b *testing.B) {
+	for _, shape := range dataset.Shapes {
+		shape := shape
+		b.Run(shape.Name, func(b *testing.B) {
+			// a distinct range for every run, far from data of query benchmarks
+			base := now - 20*24*60*60 + uint64(time.Now().UnixNano()%1000)*60*60
+
+			b.ReportAllocs()
+			b.ReportMetric(float64(shape.PointsPerReport()), "points/op")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ingest(b, shape, base+uint64(i*shape.Points))
+			}
+		})
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	for idx, shape := range dataset.Shapes {
+		shape := shape
+		// every shape takes a distinct hour so that global queries only see the shape
+		startSecs := now - uint64(idx+2)*60*60
+		endSecs := startSecs + uint64(preloadWindows*shape.Points)
+
+		loaded := false
+		load := func(b *testing.B) {
+			if loaded {
+				return
+			}
+			for w := 0; w < preloadWindows; w++ {
+				ingest(b, shape, startSecs+uint64(w*shape.Points))
+			}
+			for _, meta := range shape.SQLMetas() {
+				_ = store.SQLMeta(meta)
+			}
+			if err := store.FlushMeta(); err != nil {
+				b.Fatal(err)
+			}
+			vmstorage.Storage.DebugFlush()
+			loaded = true
+		}
+
+		for _, instance := range []string{"", shape.Instance(0)} {
+			instance := instance
+			name := shape.Name + "/global"
+			if len(instance) != 0 {
+				name = shape.Name + "/instance"
+			}
+			b.Run(name, func(b *testing.B) {
+				load(b)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var items []query.TopSQLItem
+					_, err := query.TopSQL(int(startSecs), int(endSecs), 60, 5, instance, query.AggregationSum, query.TextFilter{}, query.Page{}, &items)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(items) == 0 {
+						b.Fatal("no data")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,3 @@
+// Package bench benchmarks topsql end to end against the embedded timeseries
+// database, e.g. `make bench`.
+package bench
@@ -0,0 +1,198 @@
+// Package clocksync records the clock state of the host along with ingested
+// data, so that analysts can discount periods with bad timekeeping. Agents
+// don't report their clock offsets yet, sources other than the host can be
+// added once they do.
+package clocksync
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const SourceHost = "host"
+
+const (
+	StateSynced   = "synced"
+	StateUnsynced = "unsynced"
+	// StateInaccurate is synced but with a too large error.
+	StateInaccurate = "inaccurate"
+	StateUnknown    = "unknown"
+)
+
+const (
+	sampleInterval = time.Minute
+	// maxErrorMillis is the largest error considered synced, since the
+	// finest window of topsql is a second.
+	maxErrorMillis = 500
+)
+
+type Sample struct {
+	Source         string
+	State          string
+	MaxErrorMillis int64
+}
+
+// Issue is a period in which samples of the source are bad.
+type Issue struct {
+	Source    string `json:"source"`
+	State     string `json:"state"`
+	StartSecs int64  `json:"start_secs"`
+	EndSecs   int64  `json:"end_secs"`
+	// MaxErrorMillis is the largest error sampled within the period.
+	MaxErrorMillis int64 `json:"max_error_millis"`
+}
+
+var (
+	documentDB *genji.DB
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+func Init(db *genji.DB) error {
+	documentDB = db
+
+	createTableStmts := []string{
+		"CREATE TABLE IF NOT EXISTS clock_sync (id VARCHAR(255) PRIMARY KEY)",
+		"CREATE INDEX IF NOT EXISTS clock_sync_ts ON clock_sync (ts)",
+	}
+	for _, stmt := range createTableStmts {
+		if err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	Start()
+	return nil
+}
+
+// Start starts sampling. It's a no-op if it's already running.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh != nil {
+		return
+	}
+
+	stopCh = make(chan struct{})
+	ch := stopCh
+	wg.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer wg.Done()
+		run(ch)
+	}, nil)
+}
+
+// Stop stops sampling. It's a no-op if it's not running.
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh == nil {
+		return
+	}
+
+	close(stopCh)
+	wg.Wait()
+	stopCh = nil
+}
+
+func run(stopCh chan struct{}) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := record(time.Now(), sampleHost()); err != nil {
+			log.Warn("failed to record clock sync state", zap.Error(err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func record(now time.Time, s Sample) error {
+	if s.State == StateSynced && s.MaxErrorMillis > maxErrorMillis {
+		s.State = StateInaccurate
+	}
+
+	ts := now.Unix()
+	return documentDB.Exec(
+		"INSERT INTO clock_sync(id, source, ts, state, max_error_ms) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO REPLACE",
+		fmt.Sprintf("%s_%d", s.Source, ts), s.Source, ts, s.State, s.MaxErrorMillis,
+	)
+}
+
+// Issues fills periods with bad samples within [startSecs, endSecs]. A period
+// ends one interval after its last bad sample.
+func Issues(startSecs, endSecs int, fill *[]Issue) error {
+	res, err := documentDB.Query(
+		"SELECT source, ts, state, max_error_ms FROM clock_sync WHERE ts >= ? AND ts <= ? ORDER BY ts",
+		startSecs, endSecs,
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	// the ongoing issue of every source
+	ongoing := make(map[string]*Issue)
+	err = res.Iterate(func(d types.Document) error {
+		var s Sample
+		var ts int64
+		if err := document.Scan(d, &s.Source, &ts, &s.State, &s.MaxErrorMillis); err != nil {
+			return err
+		}
+
+		issue := ongoing[s.Source]
+		if s.State == StateSynced {
+			if issue != nil {
+				*fill = append(*fill, *issue)
+				delete(ongoing, s.Source)
+			}
+			return nil
+		}
+
+		if issue == nil || issue.State != s.State {
+			if issue != nil {
+				*fill = append(*fill, *issue)
+			}
+			issue = &Issue{Source: s.Source, State: s.State, StartSecs: ts}
+			ongoing[s.Source] = issue
+		}
+		issue.EndSecs = ts + int64(sampleInterval/time.Second)
+		if s.MaxErrorMillis > issue.MaxErrorMillis {
+			issue.MaxErrorMillis = s.MaxErrorMillis
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range ongoing {
+		*fill = append(*fill, *issue)
+	}
+	sort.Slice(*fill, func(i, j int) bool {
+		return (*fill)[i].StartSecs < (*fill)[j].StartSecs
+	})
+	return nil
+}
+
+// Purge deletes samples before the safe point.
+func Purge(safePointSecs int64) error {
+	return documentDB.Exec("DELETE FROM clock_sync WHERE ts < ?", safePointSecs)
+}
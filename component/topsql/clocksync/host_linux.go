@@ -0,0 +1,25 @@
+package clocksync
+
+import "golang.org/x/sys/unix"
+
+// Not exported by x/sys, see adjtimex(2).
+const (
+	timeError = 5
+	staUnsync = 0x0040
+)
+
+// sampleHost reads the clock state maintained by the kernel, which is kept by
+// NTP daemons like chrony or ntpd.
+func sampleHost() Sample {
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		return Sample{Source: SourceHost, State: StateUnknown}
+	}
+
+	s := Sample{Source: SourceHost, State: StateSynced, MaxErrorMillis: int64(tx.Maxerror) / 1000}
+	if state == timeError || tx.Status&staUnsync != 0 {
+		s.State = StateUnsynced
+	}
+	return s
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package clocksync
+
+func sampleHost() Sample {
+	return Sample{Source: SourceHost, State: StateUnknown}
+}
@@ -0,0 +1,121 @@
+// Package dataset generates topsql reports of configurable shapes. It's shared
+// by benchmarks and load generators so that they measure the same data.
+package dataset
+
+import (
+	"fmt"
+
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// Shape describes the data reported within one report window.
+type Shape struct {
+	Name        string
+	Instances   int
+	SQLs        int
+	PlansPerSQL int
+	// Points is the number of seconds covered by each record.
+	Points int
+}
+
+var (
+	// FewSQLs is a cluster running a handful of hot queries.
+	FewSQLs = Shape{Name: "few-sqls", Instances: 3, SQLs: 10, PlansPerSQL: 1, Points: 60}
+	// ManySQLs is a cluster running diverse queries with unstable plans.
+	ManySQLs = Shape{Name: "many-sqls", Instances: 3, SQLs: 500, PlansPerSQL: 3, Points: 60}
+	// ManyInstances is a large cluster.
+	ManyInstances = Shape{Name: "many-instances", Instances: 50, SQLs: 50, PlansPerSQL: 1, Points: 60}
+
+	Shapes = []Shape{FewSQLs, ManySQLs, ManyInstances}
+)
+
+// RecordsPerReport is the number of records an instance reports per window.
+func (s Shape) RecordsPerReport() int {
+	return s.SQLs * s.PlansPerSQL
+}
+
+// PointsPerReport is the number of points all instances report per window.
+func (s Shape) PointsPerReport() int {
+	return s.Instances * s.RecordsPerReport() * s.Points
+}
+
+func (s Shape) Instance(i int) string {
+	return fmt.Sprintf("%s-%d:10080", s.Name, i)
+}
+
+func SQLDigest(sql int) []byte {
+	return []byte(fmt.Sprintf("sql-%08d", sql))
+}
+
+func PlanDigest(sql, plan int) []byte {
+	return []byte(fmt.Sprintf("plan-%08d-%d", sql, plan))
+}
+
+// CPUTimeRecords generates records reported by an instance for the window
+// starting from startSecs.
+func (s Shape) CPUTimeRecords(startSecs uint64) []*tipb.CPUTimeRecord {
+	records := make([]*tipb.CPUTimeRecord, 0, s.RecordsPerReport())
+	for sql := 0; sql < s.SQLs; sql++ {
+		for plan := 0; plan < s.PlansPerSQL; plan++ {
+			record := &tipb.CPUTimeRecord{
+				SqlDigest:              SQLDigest(sql),
+				PlanDigest:             PlanDigest(sql, plan),
+				RecordListTimestampSec: make([]uint64, 0, s.Points),
+				RecordListCpuTimeMs:    make([]uint32, 0, s.Points),
+			}
+			for p := 0; p < s.Points; p++ {
+				record.RecordListTimestampSec = append(record.RecordListTimestampSec, startSecs+uint64(p))
+				record.RecordListCpuTimeMs = append(record.RecordListCpuTimeMs, uint32(sql%100+plan+p%10))
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// ResourceUsageRecords is like CPUTimeRecords, but for TiKV.
+func (s Shape) ResourceUsageRecords(startSecs uint64) []*rsmetering.ResourceUsageRecord {
+	records := make([]*rsmetering.ResourceUsageRecord, 0, s.RecordsPerReport())
+	for sql := 0; sql < s.SQLs; sql++ {
+		for plan := 0; plan < s.PlansPerSQL; plan++ {
+			tag := tipb.ResourceGroupTag{SqlDigest: SQLDigest(sql), PlanDigest: PlanDigest(sql, plan)}
+			tagBytes, _ := tag.Marshal()
+			record := &rsmetering.ResourceUsageRecord{ResourceGroupTag: tagBytes}
+			for p := 0; p < s.Points; p++ {
+				record.RecordListTimestampSec = append(record.RecordListTimestampSec, startSecs+uint64(p))
+				record.RecordListCpuTimeMs = append(record.RecordListCpuTimeMs, uint32(sql%100+plan+p%10))
+				record.RecordListReadKeys = append(record.RecordListReadKeys, uint32(p))
+				record.RecordListWriteKeys = append(record.RecordListWriteKeys, uint32(p%2))
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// SQLMetas generates the meta of every sql of the shape.
+func (s Shape) SQLMetas() []*tipb.SQLMeta {
+	metas := make([]*tipb.SQLMeta, 0, s.SQLs)
+	for sql := 0; sql < s.SQLs; sql++ {
+		metas = append(metas, &tipb.SQLMeta{
+			SqlDigest:     SQLDigest(sql),
+			NormalizedSql: fmt.Sprintf("select * from t%d where a = ? and b in ( ... )", sql),
+		})
+	}
+	return metas
+}
+
+// PlanMetas generates the meta of every plan of the shape.
+func (s Shape) PlanMetas() []*tipb.PlanMeta {
+	metas := make([]*tipb.PlanMeta, 0, s.RecordsPerReport())
+	for sql := 0; sql < s.SQLs; sql++ {
+		for plan := 0; plan < s.PlansPerSQL; plan++ {
+			metas = append(metas, &tipb.PlanMeta{
+				PlanDigest:     PlanDigest(sql, plan),
+				NormalizedPlan: fmt.Sprintf("TableReader_%d root data:Selection_%d", plan, sql),
+			})
+		}
+	}
+	return metas
+}
@@ -0,0 +1,207 @@
+// Package detector detects plan regressions, i.e. SQLs getting more
+// expensive after their dominant plans changed.
+//
+// Records carry no execution count, so CPU time per execution can't be
+// computed. Instead, plans are compared by CPU time per sample, i.e. per
+// instance-second in which the plan reported CPU time, which isn't inflated
+// by more instances running the SQL or the SQL running in more seconds, but
+// still grows by more executions within a second.
+package detector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/database/table"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	detectInterval = 10 * time.Minute
+	detectWindow   = time.Hour
+
+	// A SQL is regressed if its cpu time per sample grows by this ratio after
+	// the dominant plan changed.
+	regressionRatio = 1.5
+	// Ignore SQLs that are too cheap to care about.
+	minCPUTimeMillis = 1000
+)
+
+var (
+	documentDB *genji.DB
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+var planRegressions = table.New("plan_regression",
+	[]string{"ts", "sql_digest", "old_plan_digest", "new_plan_digest", "old_cpu_time_ms", "new_cpu_time_ms", "old_cpu_time_ms_per_sample", "new_cpu_time_ms_per_sample"},
+	func(e *PlanRegressionEvent) []interface{} {
+		return []interface{}{&e.Ts, &e.SQLDigest, &e.OldPlanDigest, &e.NewPlanDigest, &e.OldCPUTimeMillis, &e.NewCPUTimeMillis, &e.OldCPUTimeMillisPerSample, &e.NewCPUTimeMillisPerSample}
+	})
+
+// PlanRegressionEvent compares the dominant plans of a SQL in two windows.
+// CPUTimeMillis are total cpu time of the SQL, while CPUTimeMillisPerSample
+// are of the dominant plans, see the package doc.
+type PlanRegressionEvent struct {
+	Ts                        int64   `json:"ts"`
+	SQLDigest                 string  `json:"sql_digest"`
+	OldPlanDigest             string  `json:"old_plan_digest"`
+	NewPlanDigest             string  `json:"new_plan_digest"`
+	OldCPUTimeMillis          uint64  `json:"old_cpu_time_millis"`
+	NewCPUTimeMillis          uint64  `json:"new_cpu_time_millis"`
+	OldCPUTimeMillisPerSample float64 `json:"old_cpu_time_millis_per_sample"`
+	NewCPUTimeMillisPerSample float64 `json:"new_cpu_time_millis_per_sample"`
+}
+
+func Init(db *genji.DB) {
+	documentDB = db
+	if err := documentDB.Exec("CREATE TABLE IF NOT EXISTS plan_regression (ts INTEGER, sql_digest TEXT)"); err != nil {
+		log.Fatal("failed to create tables", zap.Error(err))
+	}
+
+	stopCh = make(chan struct{})
+	wg.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer wg.Done()
+		d := detector{reported: make(map[string]string)}
+		d.run()
+	}, nil)
+}
+
+func Stop() {
+	close(stopCh)
+	wg.Wait()
+}
+
+// PlanRegressions fills events detected within [startSecs, endSecs].
+func PlanRegressions(startSecs, endSecs int, fill *[]PlanRegressionEvent) error {
+	return planRegressions.Select(documentDB, fill, "WHERE ts >= ? AND ts <= ?", startSecs, endSecs)
+}
+
+type detector struct {
+	// sql digest -> the plan digest that has been reported as regressed
+	reported map[string]string
+}
+
+func (d *detector) run() {
+	ticker := time.NewTicker(detectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.detect(time.Now()); err != nil {
+				log.Warn("failed to detect plan regressions", zap.Error(err))
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+type sqlStat struct {
+	dominantPlan    string
+	dominantCPUTime uint64
+	dominantSamples uint64
+	totalCPUTime    uint64
+}
+
+// cpuTimePerSample is of the dominant plan.
+func (s sqlStat) cpuTimePerSample() float64 {
+	if s.dominantSamples == 0 {
+		return 0
+	}
+	return float64(s.dominantCPUTime) / float64(s.dominantSamples)
+}
+
+func (d *detector) detect(now time.Time) error {
+	windowSecs := int(detectWindow.Seconds())
+	endSecs := int(now.Unix())
+
+	current, err := fetchSQLStats(endSecs, windowSecs)
+	if err != nil {
+		return err
+	}
+	previous, err := fetchSQLStats(endSecs-windowSecs, windowSecs)
+	if err != nil {
+		return err
+	}
+
+	for sqlDigest, cur := range current {
+		prev, ok := previous[sqlDigest]
+		if !ok || len(prev.dominantPlan) == 0 || len(cur.dominantPlan) == 0 {
+			continue
+		}
+		if prev.dominantPlan == cur.dominantPlan || d.reported[sqlDigest] == cur.dominantPlan {
+			continue
+		}
+		prevPerSample, curPerSample := prev.cpuTimePerSample(), cur.cpuTimePerSample()
+		if cur.totalCPUTime < minCPUTimeMillis || prevPerSample == 0 || curPerSample < prevPerSample*regressionRatio {
+			continue
+		}
+
+		event := PlanRegressionEvent{
+			Ts:                        int64(endSecs),
+			SQLDigest:                 sqlDigest,
+			OldPlanDigest:             prev.dominantPlan,
+			NewPlanDigest:             cur.dominantPlan,
+			OldCPUTimeMillis:          prev.totalCPUTime,
+			NewCPUTimeMillis:          cur.totalCPUTime,
+			OldCPUTimeMillisPerSample: prevPerSample,
+			NewCPUTimeMillisPerSample: curPerSample,
+		}
+		if err = writeEvent(event); err != nil {
+			return err
+		}
+		d.reported[sqlDigest] = cur.dominantPlan
+		log.Info("detected plan regression", zap.Any("event", event))
+	}
+
+	// forget SQLs gone or changed plans again, which may regress again later
+	for sqlDigest, plan := range d.reported {
+		if cur, ok := current[sqlDigest]; !ok || cur.dominantPlan != plan {
+			delete(d.reported, sqlDigest)
+		}
+	}
+	return nil
+}
+
+func fetchSQLStats(endSecs, windowSecs int) (map[string]sqlStat, error) {
+	var items []query.PlanCPUTimeItem
+	if err := query.PlanCPUTime(endSecs, windowSecs, &items); err != nil {
+		return nil, err
+	}
+
+	var samples []query.PlanSamplesItem
+	if err := query.PlanSamples(endSecs, windowSecs, &samples); err != nil {
+		return nil, err
+	}
+	type plan struct{ sqlDigest, planDigest string }
+	planSamples := make(map[plan]uint64, len(samples))
+	for _, item := range samples {
+		planSamples[plan{item.SQLDigest, item.PlanDigest}] = item.Samples
+	}
+
+	stats := make(map[string]sqlStat)
+	for _, item := range items {
+		stat := stats[item.SQLDigest]
+		stat.totalCPUTime += item.CPUTimeMillis
+		if len(item.PlanDigest) != 0 && item.CPUTimeMillis > stat.dominantCPUTime {
+			stat.dominantPlan = item.PlanDigest
+			stat.dominantCPUTime = item.CPUTimeMillis
+			stat.dominantSamples = planSamples[plan{item.SQLDigest, item.PlanDigest}]
+		}
+		stats[item.SQLDigest] = stat
+	}
+	return stats, nil
+}
+
+func writeEvent(e PlanRegressionEvent) error {
+	return planRegressions.Insert(documentDB, e)
+}
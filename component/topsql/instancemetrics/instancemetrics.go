@@ -0,0 +1,241 @@
+// Package instancemetrics collects key metrics of instances, i.e. cpu usage
+// and QPS, from their status ports into the timeseries database, so that top
+// SQL can be correlated with them.
+package instancemetrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/component/topsql/subscriber"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/pingcap/log"
+	dto "github.com/prometheus/client_model/go"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Names of the metrics collected from status ports.
+const (
+	processCPUSeconds = "process_cpu_seconds_total"
+	tidbQueries       = "tidb_server_query_total"
+)
+
+var (
+	vminsertHandler http.HandlerFunc
+	components      topology.Subscriber
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+func Init(vminsertHandler_ http.HandlerFunc, components_ topology.Subscriber) {
+	vminsertHandler = vminsertHandler_
+	components = components_
+	Start()
+}
+
+// Start collects metrics periodically. It's a no-op if it's already running.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh != nil {
+		return
+	}
+
+	stopCh = make(chan struct{})
+	ch := stopCh
+	wg.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer wg.Done()
+		run(ch)
+	}, nil)
+}
+
+// Stop waits for the ongoing collection to finish. It's a no-op if it's not
+// running.
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh == nil {
+		return
+	}
+
+	close(stopCh)
+	wg.Wait()
+	stopCh = nil
+}
+
+func run(stopCh chan struct{}) {
+	intervalSecs := config.GetGlobalConfig().TopSQL.InstanceMetricsSeconds
+	if intervalSecs <= 0 {
+		log.Info("collecting instance metrics is disabled")
+		return
+	}
+	interval := time.Duration(intervalSecs) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var latest []topology.Component
+	for {
+		select {
+		case coms := <-components:
+			// the topology is kept on failures, see topsql subscriber
+			if len(coms) != 0 {
+				latest = coms
+			}
+		case <-ticker.C:
+			collect(latest, interval)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// collect scrapes all up instances at the same time, and writes their
+// metrics at once.
+func collect(coms []topology.Component, timeout time.Duration) {
+	cfg := config.GetGlobalConfig()
+	client, err := commonconfig.NewClientFromConfig(cfg.Security.GetHTTPClientConfig(), "instance-metrics")
+	if err != nil {
+		log.Warn("failed to create instance metrics client", zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		bufMu sync.Mutex
+		buf   bytes.Buffer
+		wg    sync.WaitGroup
+	)
+	for _, com := range coms {
+		switch com.Name {
+		case topology.ComponentTiDB, topology.ComponentTiKV, topology.ComponentTiFlash:
+		default:
+			continue
+		}
+		instance := subscriber.InstanceOf(com)
+		if !com.IsUp() || store.IsPaused(instance) {
+			continue
+		}
+
+		com := com
+		wg.Add(1)
+		go utils.GoWithRecovery(func() {
+			defer wg.Done()
+			url := fmt.Sprintf("%s://%s:%d/metrics", cfg.GetHTTPScheme(), com.IP, com.StatusPort)
+			s, err := scrape(ctx, client, url)
+			if err != nil {
+				log.Debug("failed to collect instance metrics", zap.String("instance", instance), zap.Error(err))
+				return
+			}
+
+			bufMu.Lock()
+			defer bufMu.Unlock()
+			s.encode(&buf, instance, com.Name, time.Now())
+		}, nil)
+	}
+	wg.Wait()
+
+	if buf.Len() != 0 {
+		write(&buf)
+	}
+}
+
+type sample struct {
+	cpuSeconds float64
+	hasCPU     bool
+	queries    float64
+	hasQueries bool
+}
+
+func scrape(ctx context.Context, client *http.Client, url string) (sample, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return sample{}, err
+	}
+	resp, err := ctxhttp.Do(ctx, client, req)
+	if err != nil {
+		return sample{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return sample{}, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return parse(resp.Body)
+}
+
+// parse picks the metrics to collect from the text exposition format.
+func parse(r io.Reader) (sample, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return sample{}, err
+	}
+
+	var s sample
+	if f, ok := families[processCPUSeconds]; ok && len(f.Metric) != 0 {
+		s.cpuSeconds, s.hasCPU = value(f.Metric[0]), true
+	}
+	// queries are labeled by statement types and results
+	if f, ok := families[tidbQueries]; ok && len(f.Metric) != 0 {
+		for _, m := range f.Metric {
+			s.queries += value(m)
+		}
+		s.hasQueries = true
+	}
+	return s, nil
+}
+
+func value(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	default:
+		return 0
+	}
+}
+
+// encode appends the sample in the Prometheus text format with timestamps.
+func (s sample) encode(buf *bytes.Buffer, instance, instanceType string, now time.Time) {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	if s.hasCPU {
+		_, _ = fmt.Fprintf(buf, "%s{instance=%q,instance_type=%q} %g %d\n", store.MetricInstanceCPUSeconds, instance, instanceType, s.cpuSeconds, ts)
+	}
+	if s.hasQueries {
+		_, _ = fmt.Fprintf(buf, "%s{instance=%q,instance_type=%q} %g %d\n", store.MetricInstanceQueries, instance, instanceType, s.queries, ts)
+	}
+}
+
+func write(buf *bytes.Buffer) {
+	var bufResp bytes.Buffer
+	respR := utils.NewRespWriter(&bufResp, http.Header{})
+	req, err := http.NewRequest("POST", "/api/v1/import/prometheus", buf)
+	if err != nil {
+		log.Warn("failed to write instance metrics", zap.Error(err))
+		return
+	}
+	vminsertHandler(&respR, req)
+
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		log.Warn("failed to write instance metrics", zap.String("error", respR.Body.String()))
+	}
+}
@@ -0,0 +1,41 @@
+package instancemetrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	s, err := parse(strings.NewReader(`# HELP process_cpu_seconds_total Total user and system CPU time spent in seconds.
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 12.5
+# TYPE tidb_server_query_total counter
+tidb_server_query_total{result="OK",type="Select"} 100
+tidb_server_query_total{result="Error",type="Insert"} 3
+# TYPE go_goroutines gauge
+go_goroutines 42
+`))
+	require.NoError(t, err)
+	require.Equal(t, sample{cpuSeconds: 12.5, hasCPU: true, queries: 103, hasQueries: true}, s)
+
+	var buf bytes.Buffer
+	s.encode(&buf, "127.0.0.1:10080", "tidb", time.Unix(100, 0))
+	require.Equal(t, `instance_cpu_seconds_total{instance="127.0.0.1:10080",instance_type="tidb"} 12.5 100000
+instance_queries_total{instance="127.0.0.1:10080",instance_type="tidb"} 103 100000
+`, buf.String())
+
+	// TiKV doesn't serve queries
+	s, err = parse(strings.NewReader("process_cpu_seconds_total 1\n"))
+	require.NoError(t, err)
+	require.Equal(t, sample{cpuSeconds: 1, hasCPU: true}, s)
+	buf.Reset()
+	s.encode(&buf, "127.0.0.1:20160", "tikv", time.Unix(100, 0))
+	require.Equal(t, "instance_cpu_seconds_total{instance=\"127.0.0.1:20160\",instance_type=\"tikv\"} 1 100000\n", buf.String())
+
+	_, err = parse(strings.NewReader("<html>"))
+	require.Error(t, err)
+}
@@ -0,0 +1,187 @@
+package masking
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/zhongzc/ng_monitoring/database/table"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Stages a masking rule can be applied on.
+const (
+	ApplyOnIngest = "ingest"
+	ApplyOnQuery  = "query"
+	ApplyOnBoth   = "both"
+)
+
+type Rule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	ApplyOn     string `json:"apply_on"`
+	// Hits is the number of texts masked by the rule since startup.
+	Hits uint64 `json:"hits"`
+}
+
+type compiledRule struct {
+	Rule
+	re   *regexp.Regexp
+	hits *atomic.Uint64
+}
+
+var (
+	documentDB *genji.DB
+
+	ruleTable = table.New("masking_rule", []string{"name", "pattern", "replacement", "apply_on"}, func(r *Rule) []interface{} {
+		return []interface{}{&r.Name, &r.Pattern, &r.Replacement, &r.ApplyOn}
+	})
+
+	mu    sync.Mutex
+	rules atomic.Value // []*compiledRule
+)
+
+func Init(db *genji.DB) {
+	documentDB = db
+	if err := documentDB.Exec("CREATE TABLE IF NOT EXISTS masking_rule (name VARCHAR(255) PRIMARY KEY)"); err != nil {
+		log.Fatal("failed to create tables", zap.Error(err))
+	}
+	if err := loadRules(); err != nil {
+		log.Fatal("failed to load masking rules", zap.Error(err))
+	}
+}
+
+func loadRules() error {
+	var loaded []*compiledRule
+	err := ruleTable.Iterate(documentDB, func(r Rule) error {
+		cr, err := compile(r)
+		if err != nil {
+			log.Warn("ignore invalid masking rule", zap.String("name", r.Name), zap.Error(err))
+			return nil
+		}
+		loaded = append(loaded, cr)
+		return nil
+	}, "")
+	if err != nil {
+		return err
+	}
+
+	rules.Store(loaded)
+	log.Info("load masking rules", zap.Int("count", len(loaded)))
+	return nil
+}
+
+func compile(r Rule) (*compiledRule, error) {
+	if len(r.Name) == 0 {
+		return nil, fmt.Errorf("empty rule name")
+	}
+	switch r.ApplyOn {
+	case ApplyOnIngest, ApplyOnQuery, ApplyOnBoth:
+	default:
+		return nil, fmt.Errorf("apply_on should be %s, %s or %s", ApplyOnIngest, ApplyOnQuery, ApplyOnBoth)
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledRule{Rule: r, re: re, hits: atomic.NewUint64(0)}, nil
+}
+
+func currentRules() []*compiledRule {
+	rs, _ := rules.Load().([]*compiledRule)
+	return rs
+}
+
+func Rules() []Rule {
+	rs := currentRules()
+	res := make([]Rule, 0, len(rs))
+	for _, r := range rs {
+		rule := r.Rule
+		rule.Hits = r.hits.Load()
+		res = append(res, rule)
+	}
+	return res
+}
+
+// SaveRule creates a rule or replaces the rule with the same name.
+func SaveRule(r Rule) error {
+	cr, err := compile(r)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err = ruleTable.Upsert(documentDB, r); err != nil {
+		return err
+	}
+
+	old := currentRules()
+	updated := make([]*compiledRule, 0, len(old)+1)
+	for _, o := range old {
+		if o.Name != r.Name {
+			updated = append(updated, o)
+		}
+	}
+	rules.Store(append(updated, cr))
+	log.Info("save masking rule", zap.String("name", r.Name), zap.String("pattern", r.Pattern), zap.String("apply-on", r.ApplyOn))
+	return nil
+}
+
+func DeleteRule(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := documentDB.Exec("DELETE FROM masking_rule WHERE name = ?", name); err != nil {
+		return err
+	}
+
+	old := currentRules()
+	updated := make([]*compiledRule, 0, len(old))
+	for _, o := range old {
+		if o.Name != name {
+			updated = append(updated, o)
+		}
+	}
+	rules.Store(updated)
+	log.Info("delete masking rule", zap.String("name", name))
+	return nil
+}
+
+// MaskOnIngest masks text before it's persisted.
+func MaskOnIngest(text string) string {
+	return mask(text, ApplyOnIngest, true)
+}
+
+// MaskOnQuery masks text before it's returned to clients.
+func MaskOnQuery(text string) string {
+	return mask(text, ApplyOnQuery, true)
+}
+
+// MaskForFilter masks text as MaskOnQuery does, to filter texts as they are
+// shown. Hits of rules aren't counted, since the text isn't returned.
+func MaskForFilter(text string) string {
+	return mask(text, ApplyOnQuery, false)
+}
+
+func mask(text string, stage string, countHits bool) string {
+	for _, r := range currentRules() {
+		if r.ApplyOn != stage && r.ApplyOn != ApplyOnBoth {
+			continue
+		}
+		if !r.re.MatchString(text) {
+			continue
+		}
+		text = r.re.ReplaceAllString(text, r.Replacement)
+		if countHits {
+			r.hits.Inc()
+		}
+	}
+	return text
+}
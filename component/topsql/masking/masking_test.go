@@ -0,0 +1,24 @@
+package masking
+
+import (
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleHits(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	Init(db)
+	require.NoError(t, SaveRule(Rule{Name: "phone", Pattern: `\d{11}`, Replacement: "?", ApplyOn: ApplyOnQuery}))
+
+	// filtering masks texts as they are shown, without counting hits
+	require.Equal(t, "select ?", MaskForFilter("select 13800000000"))
+	require.Equal(t, uint64(0), Rules()[0].Hits)
+
+	require.Equal(t, "select ?", MaskOnQuery("select 13800000000"))
+	require.Equal(t, "select 1", MaskOnQuery("select 1"))
+	require.Equal(t, uint64(1), Rules()[0].Hits)
+}
@@ -0,0 +1,63 @@
+package masking
+
+import "strings"
+
+// RedactLiterals replaces string and numeric literals of the sql with `?`,
+// so that parameters never reach the disk even if the agent doesn't
+// normalize them. Quoted identifiers are kept as is.
+func RedactLiterals(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '`':
+			j := skipQuoted(sql, i)
+			b.WriteString(sql[i:j])
+			i = j
+		case c == '\'' || c == '"':
+			b.WriteByte('?')
+			i = skipQuoted(sql, i)
+		case isDigit(c) && (i == 0 || !isIdentChar(sql[i-1])):
+			// covers integers, decimals, exponents and hex like 0x1F
+			j := i + 1
+			for j < len(sql) && (isIdentChar(sql[j]) || sql[j] == '.') {
+				j++
+			}
+			b.WriteByte('?')
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// skipQuoted returns the position right after the quoted part starting at i.
+// Both backslash escapes and doubled quotes are recognized.
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case quote:
+			if j+1 < len(s) && s[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c >= 0x80
+}
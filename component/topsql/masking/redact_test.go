@@ -0,0 +1,23 @@
+package masking
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactLiterals(t *testing.T) {
+	cases := []struct {
+		sql      string
+		redacted string
+	}{
+		{"select ?", "select ?"},
+		{"select * from t1 where a = 1", "select * from t1 where a = ?"},
+		{"select * from t where name = 'it''s' and b = \"x\\\"y\"", "select * from t where name = ? and b = ?"},
+		{"select `col 1`, c2 from `t'1` where c2 in (1.5, -2e10, 0x1F)", "select `col 1`, c2 from `t'1` where c2 in (?, -?, ?)"},
+		{"insert into t values ('unterminated", "insert into t values (?"},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.redacted, RedactLiterals(c.sql))
+	}
+}
@@ -0,0 +1,79 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+)
+
+// InstanceCorrelation fills the top SQLs of the instance within the range,
+// along with its timeline of cpu time of all SQLs, cpu usage and QPS, so
+// that they can be correlated.
+func InstanceCorrelation(startSecs, endSecs, windowSecs, top int, instance string, fill *InstanceCorrelationItem) error {
+	fill.Instance = instance
+	fill.TopSQL = make([]TopSQLItem, 0)
+	if _, err := TopSQL(startSecs, endSecs, windowSecs, top, instance, AggregationSum, TextFilter{}, Page{}, &fill.TopSQL); err != nil {
+		return err
+	}
+
+	// aligned with the windows of fetchTimeseriesDB
+	fill.TimestampSecs = WindowTimestamps(startSecs, endSecs, windowSecs)
+	fill.SQLCPUTimeMillis = make([]float64, len(fill.TimestampSecs))
+	fill.CPUUsage = make([]float64, len(fill.TimestampSecs))
+	fill.QPS = make([]float64, len(fill.TimestampSecs))
+
+	for _, series := range []struct {
+		query string
+		fill  []float64
+	}{
+		{query: fmt.Sprintf(`sum(sum_over_time(%s{instance=%q}[%d]))`, store.MetricCPUTime, instance, windowSecs), fill: fill.SQLCPUTimeMillis},
+		{query: fmt.Sprintf(`sum(rate(%s{instance=%q}[%d]))`, store.MetricInstanceCPUSeconds, instance, windowSecs), fill: fill.CPUUsage},
+		{query: fmt.Sprintf(`sum(rate(%s{instance=%q}[%d]))`, store.MetricInstanceQueries, instance, windowSecs), fill: fill.QPS},
+	} {
+		if err := fetchAligned(series.query, startSecs, endSecs, windowSecs, fill.TimestampSecs, series.fill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchAligned fills values of the query at the timestamps, which are left 0
+// without points.
+func fetchAligned(query string, startSecs, endSecs, windowSecs int, timestamps []uint64, fill []float64) error {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return err
+	}
+
+	index := make(map[uint64]int, len(timestamps))
+	for i, ts := range timestamps {
+		index[ts] = i
+	}
+	for _, r := range metricResponse.Data.Results {
+		for _, v := range r.Values {
+			if len(v) != 2 {
+				continue
+			}
+			ts, ok := v[0].(float64)
+			if !ok {
+				continue
+			}
+			i, ok := index[uint64(ts)]
+			if !ok {
+				continue
+			}
+			s, ok := v[1].(string)
+			if !ok {
+				continue
+			}
+			value, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			fill[i] = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+)
+
+const (
+	DiffNew       = "new"
+	DiffVanished  = "vanished"
+	DiffRegressed = "regressed"
+	DiffImproved  = "improved"
+)
+
+// DigestDiffs fills sql digests whose cpu time changed from the base range to
+// the target range, the most changed first. Ranges may differ in length, in
+// which case the base cpu time is scaled to the length of the target range
+// before comparing. An empty instance means all instances.
+func DigestDiffs(baseStartSecs, baseEndSecs, targetStartSecs, targetEndSecs int, instance string, fill *[]DigestDiffItem) error {
+	base := make(map[string]uint64)
+	baseSecs, err := digestCPUTime(baseStartSecs, baseEndSecs, instance, base)
+	if err != nil {
+		return err
+	}
+	target := make(map[string]uint64)
+	targetSecs, err := digestCPUTime(targetStartSecs, targetEndSecs, instance, target)
+	if err != nil {
+		return err
+	}
+	scale := float64(targetSecs) / float64(baseSecs)
+
+	for digest, targetCPU := range target {
+		item := DigestDiffItem{SQLDigest: digest, TargetCPUTimeMillis: targetCPU}
+		baseCPU, ok := base[digest]
+		if ok {
+			item.BaseCPUTimeMillis = baseCPU
+		}
+		item.DeltaCPUTimeMillis = int64(targetCPU) - int64(float64(item.BaseCPUTimeMillis)*scale)
+		switch {
+		case !ok:
+			item.Change = DiffNew
+		case item.DeltaCPUTimeMillis > 0:
+			item.Change = DiffRegressed
+		case item.DeltaCPUTimeMillis < 0:
+			item.Change = DiffImproved
+		default:
+			continue
+		}
+		*fill = append(*fill, item)
+	}
+	for digest, baseCPU := range base {
+		if _, ok := target[digest]; ok {
+			continue
+		}
+		*fill = append(*fill, DigestDiffItem{
+			SQLDigest:          digest,
+			Change:             DiffVanished,
+			BaseCPUTimeMillis:  baseCPU,
+			DeltaCPUTimeMillis: -int64(float64(baseCPU) * scale),
+		})
+	}
+
+	sort.Slice(*fill, func(i, j int) bool {
+		a, b := abs((*fill)[i].DeltaCPUTimeMillis), abs((*fill)[j].DeltaCPUTimeMillis)
+		if a != b {
+			return a > b
+		}
+		return (*fill)[i].SQLDigest < (*fill)[j].SQLDigest
+	})
+	return nil
+}
+
+// digestCPUTime fills the total cpu time of every sql digest within
+// (endSecs-rangeSecs, endSecs] and returns rangeSecs.
+func digestCPUTime(startSecs, endSecs int, instance string, fill map[string]uint64) (int, error) {
+	rangeSecs := endSecs - startSecs
+	if rangeSecs < 1 {
+		rangeSecs = 1
+	}
+
+	rollup, err := buildRollupQuery(store.MetricCPUTime, instance, "", AggregationSum, rangeSecs)
+	if err != nil {
+		return 0, err
+	}
+	var resp vectorResp
+	if err = fetchInstantTimeseriesDB(fmt.Sprintf("sum by (sql_digest) (%s)", rollup), endSecs, &resp); err != nil {
+		return 0, err
+	}
+
+	for _, r := range resp.Data.Results {
+		if len(r.Value) != 2 {
+			continue
+		}
+		cpu, err := strconv.ParseFloat(r.Value[1].(string), 64)
+		if err != nil || cpu <= 0 {
+			continue
+		}
+		fill[r.Metric.SQLDigest] = uint64(cpu)
+	}
+	return rangeSecs, nil
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
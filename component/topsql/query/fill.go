@@ -0,0 +1,100 @@
+package query
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+)
+
+// Fills of windows without points in timelines, so that charts don't draw
+// lines across them. By default timelines are left sparse.
+const (
+	FillNone     = ""
+	FillZero     = "zero"
+	FillNull     = "null"
+	FillPrevious = "previous"
+)
+
+func IsValidFill(fill string) bool {
+	switch fill {
+	case FillNone, FillZero, FillNull, FillPrevious:
+		return true
+	default:
+		return false
+	}
+}
+
+// Missing marks values of windows filled by FillNull.
+const Missing = math.MaxUint64
+
+// Values are values of a timeline, in which Missing is marshaled as null.
+type Values []uint64
+
+func (v Values) MarshalJSON() ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, value := range v {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		if value == Missing {
+			buf.WriteString("null")
+		} else {
+			buf.WriteString(strconv.FormatUint(value, 10))
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// WindowTimestamps returns timestamps of all windows within [startSecs,
+// endSecs], aligned as those of timelines.
+func WindowTimestamps(startSecs, endSecs, windowSecs int) []uint64 {
+	var timestamps []uint64
+	for ts := startSecs - startSecs%windowSecs; ts <= endSecs-endSecs%windowSecs+windowSecs; ts += windowSecs {
+		timestamps = append(timestamps, uint64(ts))
+	}
+	return timestamps
+}
+
+// FillTimeline returns the timeline with a point at every window of
+// windowTimestamps. With FillPrevious, windows before the first point are
+// filled as FillNull.
+func FillTimeline(timestamps []uint64, values Values, windowTimestamps []uint64, fill string) ([]uint64, Values) {
+	if fill == FillNone {
+		return timestamps, values
+	}
+
+	filledTimestamps := make([]uint64, 0, len(windowTimestamps))
+	filledValues := make(Values, 0, len(windowTimestamps))
+	i := 0
+	var previous uint64 = Missing
+	for _, ts := range windowTimestamps {
+		// keep points out of windows, though there should be none
+		for i < len(timestamps) && timestamps[i] < ts {
+			filledTimestamps = append(filledTimestamps, timestamps[i])
+			filledValues = append(filledValues, values[i])
+			previous = values[i]
+			i++
+		}
+		if i < len(timestamps) && timestamps[i] == ts {
+			continue
+		}
+
+		filledTimestamps = append(filledTimestamps, ts)
+		switch fill {
+		case FillZero:
+			filledValues = append(filledValues, 0)
+		case FillNull:
+			filledValues = append(filledValues, Missing)
+		case FillPrevious:
+			filledValues = append(filledValues, previous)
+		}
+	}
+	filledTimestamps = append(filledTimestamps, timestamps[i:]...)
+	filledValues = append(filledValues, values[i:]...)
+	return filledTimestamps, filledValues
+}
@@ -0,0 +1,113 @@
+package query
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/genjidb/genji/types"
+)
+
+// deleteSeriesBatch is the number of digests deleted per request.
+const deleteSeriesBatch = 100
+
+// RecordDigestQuery counts a query on the sql digest, which makes it hot once
+// it's queried often enough.
+func RecordDigestQuery(sqlDigest string) error {
+	return documentDB.Update(func(tx *genji.Tx) error {
+		var queries int64
+		r, err := tx.QueryDocument("SELECT queries FROM digest_heat WHERE digest = ?", sqlDigest)
+		switch {
+		case err == errs.ErrDocumentNotFound:
+		case err != nil:
+			return err
+		default:
+			_ = document.Scan(r, &queries)
+		}
+
+		return tx.Exec(
+			"INSERT INTO digest_heat(digest, queries, ts) VALUES (?, ?, ?) ON CONFLICT DO REPLACE",
+			sqlDigest, queries+1, time.Now().Unix(),
+		)
+	})
+}
+
+// QueriedDigests fills the sql digests queried at least minQueries times.
+func QueriedDigests(minQueries int, fill *[]string) error {
+	res, err := documentDB.Query("SELECT digest FROM digest_heat WHERE queries >= ?", minQueries)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		var digest string
+		if err := document.Scan(d, &digest); err != nil {
+			return err
+		}
+		*fill = append(*fill, digest)
+		return nil
+	})
+}
+
+// DeleteSQLSeries deletes all timeseries of the sql digests.
+func DeleteSQLSeries(sqlDigests []string) error {
+	if vmselectHandler == nil {
+		return fmt.Errorf("empty query handler")
+	}
+
+	for i := 0; i < len(sqlDigests); i += deleteSeriesBatch {
+		j := i + deleteSeriesBatch
+		if j > len(sqlDigests) {
+			j = len(sqlDigests)
+		}
+
+		form := url.Values{}
+		for _, digest := range sqlDigests[i:j] {
+			form.Add("match[]", fmt.Sprintf("{sql_digest=%q}", digest))
+		}
+		if err := deleteSeries(form); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteInstanceSeries deletes all timeseries of the instance.
+func DeleteInstanceSeries(instance string) error {
+	if vmselectHandler == nil {
+		return fmt.Errorf("empty query handler")
+	}
+
+	form := url.Values{}
+	form.Add("match[]", fmt.Sprintf("{instance=%q}", instance))
+	return deleteSeries(form)
+}
+
+func deleteSeries(form url.Values) error {
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	req, err := http.NewRequest("POST", "/api/v1/admin/tsdb/delete_series", nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = form.Encode()
+
+	respR := utils.NewRespWriter(bufResp, header)
+	vmselectHandler(&respR, req)
+
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return fmt.Errorf("failed to delete series: %s", respR.Body.String())
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
+
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// SQLTextHistory fills every version of the sql text of the digest in time
+// order, each with the word-level diff from its previous version.
+func SQLTextHistory(digest string, fill *[]SQLTextVersion) error {
+	res, err := documentDB.Query("SELECT ts, sql_text FROM sql_digest_history WHERE digest = ? ORDER BY ts", digest)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	var prev []string
+	return res.Iterate(func(d types.Document) error {
+		v := SQLTextVersion{}
+		if err := document.Scan(d, &v.Ts, &v.SQLText); err != nil {
+			return err
+		}
+		v.SQLText = masking.MaskOnQuery(v.SQLText)
+
+		words := strings.Fields(v.SQLText)
+		if prev != nil {
+			v.Diff = diffWords(prev, words)
+		}
+		prev = words
+
+		*fill = append(*fill, v)
+		return nil
+	})
+}
+
+func diffWords(a, b []string) []TextDiff {
+	var diffs []TextDiff
+	for _, op := range difflib.NewMatcher(a, b).GetOpCodes() {
+		d := TextDiff{
+			OldText: strings.Join(a[op.I1:op.I2], " "),
+			NewText: strings.Join(b[op.J1:op.J2], " "),
+		}
+		switch op.Tag {
+		case 'e':
+			d.Op = "equal"
+			d.NewText = ""
+		case 'i':
+			d.Op = "insert"
+		case 'd':
+			d.Op = "delete"
+		case 'r':
+			d.Op = "replace"
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
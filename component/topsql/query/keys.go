@@ -0,0 +1,42 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+)
+
+// TopKeys is like TopSQL, but orders by keys read or written, i.e.
+// store.MetricReadKeys or store.MetricWriteKeys. Only TiKV reports keys.
+func TopKeys(metric string, startSecs, endSecs, windowSecs, top int, instance, aggregation string, text TextFilter, page Page, fill *[]TopKeysItem) (int, error) {
+	switch metric {
+	case store.MetricReadKeys, store.MetricWriteKeys:
+	default:
+		return 0, fmt.Errorf("unknown keys metric: %s", metric)
+	}
+
+	var items []TopSQLItem
+	total, err := topSQLByMetric(metric, startSecs, endSecs, windowSecs, top, instance, aggregation, text, page, &items)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range items {
+		keysItem := TopKeysItem{
+			SQLDigest: item.SQLDigest,
+			SQLText:   item.SQLText,
+			IsOther:   item.IsOther,
+			Plans:     make([]KeysPlanItem, 0, len(item.Plans)),
+		}
+		for _, plan := range item.Plans {
+			keysItem.Plans = append(keysItem.Plans, KeysPlanItem{
+				PlanDigest:    plan.PlanDigest,
+				PlanText:      plan.PlanText,
+				TimestampSecs: plan.TimestampSecs,
+				Keys:          plan.CPUTimeMillis,
+			})
+		}
+		*fill = append(*fill, keysItem)
+	}
+	return total, nil
+}
@@ -1,21 +1,89 @@
 package query
 
+import "github.com/zhongzc/ng_monitoring/component/topsql/store"
+
 type TopSQLItem struct {
-	SQLDigest string     `json:"sql_digest"`
-	SQLText   string     `json:"sql_text"`
-	Plans     []PlanItem `json:"plans"`
+	SQLDigest string `json:"sql_digest"`
+	SQLText   string `json:"sql_text"`
+	// IsOther marks the sum of SQLs beyond the top N, which has no digest.
+	IsOther bool       `json:"is_other"`
+	Plans   []PlanItem `json:"plans"`
 }
 
 type PlanItem struct {
 	PlanDigest    string   `json:"plan_digest"`
 	PlanText      string   `json:"plan_text"`
 	TimestampSecs []uint64 `json:"timestamp_secs"`
-	CPUTimeMillis []uint32 `json:"cpu_time_millis"`
+	CPUTimeMillis Values   `json:"cpu_time_millis"`
+}
+
+// TopKeysItem is like TopSQLItem, but of keys read or written.
+type TopKeysItem struct {
+	SQLDigest string         `json:"sql_digest"`
+	SQLText   string         `json:"sql_text"`
+	IsOther   bool           `json:"is_other"`
+	Plans     []KeysPlanItem `json:"plans"`
+}
+
+type KeysPlanItem struct {
+	PlanDigest    string   `json:"plan_digest"`
+	PlanText      string   `json:"plan_text"`
+	TimestampSecs []uint64 `json:"timestamp_secs"`
+	Keys          Values   `json:"keys"`
+}
+
+// TopPlanItem is the timeline of a plan digest summed up across SQLs.
+type TopPlanItem struct {
+	PlanDigest string `json:"plan_digest"`
+	PlanText   string `json:"plan_text"`
+	// IsOther marks the sum of plans beyond the top N, which has no digest.
+	IsOther bool `json:"is_other"`
+	// SQLDigests are the SQLs sharing the plan.
+	SQLDigests    []string `json:"sql_digests"`
+	TimestampSecs []uint64 `json:"timestamp_secs"`
+	CPUTimeMillis Values   `json:"cpu_time_millis"`
+}
+
+// SQLInstanceItem is the timeline of a sql digest on an instance.
+type SQLInstanceItem struct {
+	Instance      string   `json:"instance"`
+	InstanceType  string   `json:"instance_type"`
+	PlanDigests   []string `json:"plan_digests"`
+	TimestampSecs []uint64 `json:"timestamp_secs"`
+	CPUTimeMillis Values   `json:"cpu_time_millis"`
+}
+
+// CPUTimeRecord is a flattened point of a timeline, tagged for parquet export.
+type CPUTimeRecord struct {
+	Instance      string `json:"instance" parquet:"name=instance, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	InstanceType  string `json:"instance_type" parquet:"name=instance_type, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SQLDigest     string `json:"sql_digest" parquet:"name=sql_digest, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	PlanDigest    string `json:"plan_digest" parquet:"name=plan_digest, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TimestampSecs int64  `json:"timestamp_secs" parquet:"name=timestamp_secs, type=INT64"`
+	CPUTimeMillis int64  `json:"cpu_time_millis" parquet:"name=cpu_time_millis, type=INT64"`
 }
 
 type InstanceItem struct {
 	Instance     string `json:"instance"`
 	InstanceType string `json:"instance_type"`
+	// Alive is whether the instance is in the latest topology.
+	Alive bool `json:"alive"`
+	// Decommission is set if the instance is being decommissioned.
+	Decommission *store.Decommission `json:"decommission,omitempty"`
+}
+
+type InstanceSummaryItem struct {
+	Instance      string `json:"instance"`
+	InstanceType  string `json:"instance_type"`
+	CPUTimeMillis uint64 `json:"cpu_time_millis"`
+	// SQLDigests is the number of distinct sql digests.
+	SQLDigests int `json:"sql_digests"`
+	// LastTimestampSecs is the timestamp of the latest point, 0 if there is none.
+	LastTimestampSecs int64 `json:"last_timestamp_secs"`
+	// Alive is whether the instance is in the latest topology.
+	Alive bool `json:"alive"`
+	// Decommission is set if the instance is being decommissioned.
+	Decommission *store.Decommission `json:"decommission,omitempty"`
 }
 
 type metricResp struct {
@@ -41,3 +109,82 @@ type metricRespDataResultMetric struct {
 }
 
 type metricRespDataResultValue = []interface{}
+
+type PlanCPUTimeItem struct {
+	SQLDigest     string
+	PlanDigest    string
+	CPUTimeMillis uint64
+}
+
+type PlanSamplesItem struct {
+	SQLDigest  string
+	PlanDigest string
+	Samples    uint64
+}
+
+type vectorResp struct {
+	Status string         `json:"status"`
+	Data   vectorRespData `json:"data"`
+}
+
+type vectorRespData struct {
+	ResultType string                 `json:"resultType"`
+	Results    []vectorRespDataResult `json:"result"`
+}
+
+type vectorRespDataResult struct {
+	Metric metricRespDataResultMetric `json:"metric"`
+	Value  metricRespDataResultValue  `json:"value"`
+}
+
+type SQLTextItem struct {
+	SQLDigest  string `json:"sql_digest"`
+	SQLText    string `json:"sql_text"`
+	IsInternal bool   `json:"is_internal"`
+}
+
+type PlanTextItem struct {
+	PlanDigest string `json:"plan_digest"`
+	PlanText   string `json:"plan_text"`
+}
+
+type SQLTextVersion struct {
+	Ts      int64  `json:"ts"`
+	SQLText string `json:"sql_text"`
+	// Diff is the change from the previous version, empty for the first version.
+	Diff []TextDiff `json:"diff,omitempty"`
+}
+
+type TextDiff struct {
+	// Op is one of "equal", "insert", "delete" and "replace".
+	Op      string `json:"op"`
+	OldText string `json:"old_text,omitempty"`
+	NewText string `json:"new_text,omitempty"`
+}
+
+// DigestDiffItem is the change of a sql digest between two time ranges.
+type DigestDiffItem struct {
+	SQLDigest string `json:"sql_digest"`
+	SQLText   string `json:"sql_text"`
+	// Change is one of new, vanished, regressed and improved.
+	Change              string `json:"change"`
+	BaseCPUTimeMillis   uint64 `json:"base_cpu_time_millis"`
+	TargetCPUTimeMillis uint64 `json:"target_cpu_time_millis"`
+	// DeltaCPUTimeMillis is the target cpu time minus the base cpu time scaled
+	// to the length of the target range.
+	DeltaCPUTimeMillis int64 `json:"delta_cpu_time_millis"`
+}
+
+// InstanceCorrelationItem is the top SQLs of an instance, and its timeline of
+// metrics aligned by TimestampSecs. Metrics are 0 at timestamps without
+// points, e.g. QPS of components other than TiDB.
+type InstanceCorrelationItem struct {
+	Instance      string       `json:"instance"`
+	TopSQL        []TopSQLItem `json:"top_sql"`
+	TimestampSecs []uint64     `json:"timestamp_secs"`
+	// SQLCPUTimeMillis is the cpu time of all SQLs within each window.
+	SQLCPUTimeMillis []float64 `json:"sql_cpu_time_millis"`
+	// CPUUsage is the cpu usage of the process in cores.
+	CPUUsage []float64 `json:"cpu_usage"`
+	QPS      []float64 `json:"qps"`
+}
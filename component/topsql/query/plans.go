@@ -0,0 +1,135 @@
+package query
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+)
+
+// planGroup is the cpu time of a plan digest summed up across SQLs.
+type planGroup struct {
+	planDigest string
+	sqlDigests []string
+	isOther    bool
+	cpuTimeSum uint64
+	// sums are cpu time by timestamp.
+	sums map[uint64]uint64
+}
+
+// TopPlans fills the page of top plans ordered by cpu time summed up across
+// the SQLs sharing them, e.g. a common index scan, followed by the others
+// item summing up the rest, and returns the total number of items. Since cpu
+// time of different SQLs is summed up, it's always aggregated by sum.
+func TopPlans(startSecs, endSecs, windowSecs, top int, instance string, text TextFilter, page Page, fill *[]TopPlanItem) (int, error) {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	query, err := buildQuery(store.MetricCPUTime, instance, "", AggregationSum, windowSecs)
+	if err != nil {
+		return 0, err
+	}
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return 0, err
+	}
+	if err := filterByText(&metricResponse.Data.Results, text); err != nil {
+		return 0, err
+	}
+
+	groups := groupByPlanDigest(metricResponse.Data.Results)
+	// sort to make pages stable across requests
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].cpuTimeSum != groups[j].cpuTimeSum {
+			return groups[i].cpuTimeSum > groups[j].cpuTimeSum
+		}
+		return groups[i].planDigest > groups[j].planDigest
+	})
+	if top > 0 && len(groups) > top {
+		others := sumPlanGroups(groups[top:])
+		groups = append(groups[:top], others)
+	}
+
+	total := len(groups)
+	start, end := page.Bounds(total)
+	return total, fillPlanText(groups[start:end], fill)
+}
+
+func groupByPlanDigest(results []metricRespDataResult) []*planGroup {
+	m := make(map[string]*planGroup)
+	var groups []*planGroup
+	for _, r := range results {
+		group, ok := m[r.Metric.PlanDigest]
+		if !ok {
+			group = &planGroup{planDigest: r.Metric.PlanDigest, sums: make(map[uint64]uint64)}
+			m[r.Metric.PlanDigest] = group
+			groups = append(groups, group)
+		}
+		group.sqlDigests = append(group.sqlDigests, r.Metric.SQLDigest)
+
+		for _, value := range r.Values {
+			if len(value) != 2 {
+				continue
+			}
+			ts := uint64(value[0].(float64))
+			cpu, err := strconv.ParseFloat(value[1].(string), 64)
+			if err != nil {
+				continue
+			}
+			group.sums[ts] += uint64(cpu)
+			group.cpuTimeSum += uint64(cpu)
+		}
+	}
+	return groups
+}
+
+// sumPlanGroups sums up the groups into the others group, which lists no
+// sql digests.
+func sumPlanGroups(groups []*planGroup) *planGroup {
+	others := &planGroup{isOther: true, sums: make(map[uint64]uint64)}
+	for _, group := range groups {
+		others.cpuTimeSum += group.cpuTimeSum
+		for ts, cpu := range group.sums {
+			others.sums[ts] += cpu
+		}
+	}
+	return others
+}
+
+func fillPlanText(groups []*planGroup, fill *[]TopPlanItem) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		for _, group := range groups {
+			var planText string
+			if len(group.planDigest) != 0 {
+				r, err := tx.QueryDocument("SELECT plan_text FROM plan_digest WHERE digest = ?", group.planDigest)
+				if err == nil {
+					_ = document.Scan(r, &planText)
+					planText = masking.MaskOnQuery(planText)
+				}
+			}
+
+			item := TopPlanItem{
+				PlanDigest:    group.planDigest,
+				PlanText:      planText,
+				IsOther:       group.isOther,
+				SQLDigests:    append([]string{}, group.sqlDigests...),
+				TimestampSecs: make([]uint64, 0, len(group.sums)),
+				CPUTimeMillis: make([]uint64, 0, len(group.sums)),
+			}
+			sort.Strings(item.SQLDigests)
+			for ts := range group.sums {
+				item.TimestampSecs = append(item.TimestampSecs, ts)
+			}
+			sort.Slice(item.TimestampSecs, func(i, j int) bool {
+				return item.TimestampSecs[i] < item.TimestampSecs[j]
+			})
+			for _, ts := range item.TimestampSecs {
+				item.CPUTimeMillis = append(item.CPUTimeMillis, group.sums[ts])
+			}
+			*fill = append(*fill, item)
+		}
+		return nil
+	})
+}
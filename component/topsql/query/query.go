@@ -1,15 +1,21 @@
 package query
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
 	"github.com/zhongzc/ng_monitoring/utils"
 
 	"github.com/genjidb/genji"
 	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
 	"github.com/genjidb/genji/types"
 	"github.com/pingcap/log"
 	"github.com/wangjohn/quickselect"
@@ -37,22 +43,244 @@ func Stop() {
 
 }
 
-func TopSQL(startSecs, endSecs, windowSecs, top int, instance string, fill *[]TopSQLItem) error {
+// Aggregations to fold raw cpu time points into one window.
+const (
+	AggregationSum = "sum"
+	AggregationMax = "max"
+	AggregationAvg = "avg"
+	AggregationP99 = "p99"
+)
+
+func IsValidAggregation(aggregation string) bool {
+	switch aggregation {
+	case AggregationSum, AggregationMax, AggregationAvg, AggregationP99:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsValidDigest tells if the digest is hex encoded as stored.
+func IsValidDigest(digest string) bool {
+	_, err := hex.DecodeString(digest)
+	return len(digest) != 0 && err == nil
+}
+
+// maxTimelinePoints bounds the number of points per timeline when the window
+// is chosen by DownsampleWindowSecs.
+const maxTimelinePoints = 1200
+
+// downsampleWindowSecs are candidate windows in ascending order.
+var downsampleWindowSecs = []int{60, 5 * 60, 10 * 60, 30 * 60, 60 * 60, 6 * 60 * 60, 24 * 60 * 60}
+
+// DownsampleWindowSecs returns the smallest candidate window which keeps the
+// timelines of [startSecs, endSecs] within maxTimelinePoints, e.g. 10 minutes
+// for 7 days.
+func DownsampleWindowSecs(startSecs, endSecs int) int {
+	for _, window := range downsampleWindowSecs {
+		if (endSecs-startSecs)/window <= maxTimelinePoints {
+			return window
+		}
+	}
+	return downsampleWindowSecs[len(downsampleWindowSecs)-1]
+}
+
+// Page selects [Offset, Offset+Limit) of sorted results. A non-positive
+// Limit means no limit.
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// Bounds returns the range of the page within total results.
+func (p Page) Bounds(total int) (start, end int) {
+	start, end = p.Offset, total
+	if start > total {
+		start = total
+	}
+	if p.Limit > 0 && start+p.Limit < end {
+		end = start + p.Limit
+	}
+	return
+}
+
+// TopSQL fills the page of top SQLs ordered by cpu time descending, followed
+// by the others item summing up the rest, and returns the total number of
+// items. SQLs not matched by the text filter are left out, others included.
+func TopSQL(startSecs, endSecs, windowSecs, top int, instance, aggregation string, text TextFilter, page Page, fill *[]TopSQLItem) (int, error) {
+	return topSQLByMetric(store.MetricCPUTime, startSecs, endSecs, windowSecs, top, instance, aggregation, text, page, fill)
+}
+
+// topSQLByMetric is like TopSQL, but orders by the metric, whose values are
+// filled as cpu time.
+func topSQLByMetric(metric string, startSecs, endSecs, windowSecs, top int, instance, aggregation string, text TextFilter, page Page, fill *[]TopSQLItem) (int, error) {
 	metricResponse := metricRespP.Get()
 	defer metricRespP.Put(metricResponse)
-	if err := fetchTimeseriesDB(startSecs, endSecs, windowSecs, instance, metricResponse); err != nil {
-		return err
+	query, err := buildQuery(metric, instance, "", aggregation, windowSecs)
+	if err != nil {
+		return 0, err
+	}
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return 0, err
+	}
+	if err := filterByText(&metricResponse.Data.Results, text); err != nil {
+		return 0, err
 	}
 
 	sqlGroups := sqlGroupSliceP.Get()
 	defer sqlGroupSliceP.Put(sqlGroups)
-	if err := topK(metricResponse.Data.Results, top, sqlGroups); err != nil {
+	others, err := topK(metricResponse.Data.Results, top, sqlGroups)
+	if err != nil {
+		return 0, err
+	}
+
+	// sort to make pages stable across requests
+	sort.Sort(TopKSlice{s: *sqlGroups})
+	// Others always comes last. It's only meaningful for sums, since maximums
+	// or percentiles of different SQLs don't add up.
+	if others != nil && aggregation == AggregationSum {
+		*sqlGroups = append(*sqlGroups, *others)
+	}
+	total := len(*sqlGroups)
+	start, end := page.Bounds(total)
+	pageGroups := (*sqlGroups)[start:end]
+
+	return total, fillText(&pageGroups, fill)
+}
+
+// SQLPlans fills the cpu time of the sql digest broken down by plan digest.
+// An empty instance means all instances.
+func SQLPlans(startSecs, endSecs, windowSecs int, instance, sqlDigest, aggregation string, fill *[]TopSQLItem) error {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	query, err := buildQuery(store.MetricCPUTime, instance, sqlDigest, aggregation, windowSecs)
+	if err != nil {
+		return err
+	}
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
 		return err
 	}
 
+	sqlGroups := sqlGroupSliceP.Get()
+	defer sqlGroupSliceP.Put(sqlGroups)
+	groupBySQLDigest(metricResponse.Data.Results, sqlGroups)
+
 	return fillText(sqlGroups, fill)
 }
 
+// SQLInstances fills the cpu time of the sql digest on every instance, summed
+// up across plans, ordered by cpu time descending.
+func SQLInstances(startSecs, endSecs, windowSecs int, sqlDigest, aggregation string, fill *[]SQLInstanceItem) error {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	query, err := buildRollupQuery(store.MetricCPUTime, "", sqlDigest, aggregation, windowSecs)
+	if err != nil {
+		return err
+	}
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return err
+	}
+
+	type instanceSeries struct {
+		item       SQLInstanceItem
+		plans      map[string]struct{}
+		cpuTime    map[uint64]uint64
+		cpuTimeSum uint64
+	}
+	byInstance := make(map[string]*instanceSeries)
+	for _, r := range metricResponse.Data.Results {
+		series, ok := byInstance[r.Metric.Instance]
+		if !ok {
+			series = &instanceSeries{
+				item:    SQLInstanceItem{Instance: r.Metric.Instance, InstanceType: r.Metric.InstanceType},
+				plans:   make(map[string]struct{}),
+				cpuTime: make(map[uint64]uint64),
+			}
+			byInstance[r.Metric.Instance] = series
+		}
+		if len(r.Metric.PlanDigest) != 0 {
+			series.plans[r.Metric.PlanDigest] = struct{}{}
+		}
+
+		for _, value := range r.Values {
+			if len(value) != 2 {
+				continue
+			}
+			ts := uint64(value[0].(float64))
+			cpu, err := strconv.ParseFloat(value[1].(string), 64)
+			if err != nil {
+				continue
+			}
+			series.cpuTime[ts] += uint64(cpu)
+			series.cpuTimeSum += uint64(cpu)
+		}
+	}
+
+	all := make([]*instanceSeries, 0, len(byInstance))
+	for _, series := range byInstance {
+		item := &series.item
+		item.PlanDigests = make([]string, 0, len(series.plans))
+		for plan := range series.plans {
+			item.PlanDigests = append(item.PlanDigests, plan)
+		}
+		sort.Strings(item.PlanDigests)
+
+		for ts := range series.cpuTime {
+			item.TimestampSecs = append(item.TimestampSecs, ts)
+		}
+		sort.Slice(item.TimestampSecs, func(i, j int) bool {
+			return item.TimestampSecs[i] < item.TimestampSecs[j]
+		})
+		for _, ts := range item.TimestampSecs {
+			item.CPUTimeMillis = append(item.CPUTimeMillis, series.cpuTime[ts])
+		}
+		all = append(all, series)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].cpuTimeSum != all[j].cpuTimeSum {
+			return all[i].cpuTimeSum > all[j].cpuTimeSum
+		}
+		return all[i].item.Instance < all[j].item.Instance
+	})
+
+	for _, series := range all {
+		*fill = append(*fill, series.item)
+	}
+	return nil
+}
+
+// CPUTimeRecords fills the cpu time of every instance within [startSecs, endSecs]
+// summed up by windowSecs, one record per window.
+func CPUTimeRecords(startSecs, endSecs, windowSecs int, fill *[]CPUTimeRecord) error {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	query := fmt.Sprintf("sum_over_time(cpu_time[%d])", windowSecs)
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return err
+	}
+
+	for _, r := range metricResponse.Data.Results {
+		for _, value := range r.Values {
+			if len(value) != 2 {
+				continue
+			}
+			cpu, err := strconv.ParseFloat(value[1].(string), 64)
+			if err != nil {
+				continue
+			}
+			*fill = append(*fill, CPUTimeRecord{
+				Instance:      r.Metric.Instance,
+				InstanceType:  r.Metric.InstanceType,
+				SQLDigest:     r.Metric.SQLDigest,
+				PlanDigest:    r.Metric.PlanDigest,
+				TimestampSecs: int64(value[0].(float64)),
+				CPUTimeMillis: int64(cpu),
+			})
+		}
+	}
+	return nil
+}
+
 func AllInstances(fill *[]InstanceItem) error {
 	doc, err := documentDB.Query("SELECT instance, instance_type FROM instance")
 	if err != nil {
@@ -68,24 +296,198 @@ func AllInstances(fill *[]InstanceItem) error {
 			return err
 		}
 
+		item.Alive = store.IsAlive(item.Instance)
+		item.Decommission = decommissionOf(item.Instance)
 		*fill = append(*fill, item)
 		return nil
 	})
 }
 
+// PlanCPUTime fills the total cpu time of every (sql digest, plan digest) pair
+// across all instances within (endSecs-windowSecs, endSecs].
+func PlanCPUTime(endSecs, windowSecs int, fill *[]PlanCPUTimeItem) error {
+	var resp vectorResp
+	query := fmt.Sprintf("sum by (sql_digest, plan_digest) (sum_over_time(cpu_time[%d]))", windowSecs)
+	if err := fetchInstantTimeseriesDB(query, endSecs, &resp); err != nil {
+		return err
+	}
+
+	for _, r := range resp.Data.Results {
+		if len(r.Value) != 2 {
+			continue
+		}
+		cpu, err := strconv.ParseFloat(r.Value[1].(string), 64)
+		if err != nil {
+			continue
+		}
+		*fill = append(*fill, PlanCPUTimeItem{
+			SQLDigest:     r.Metric.SQLDigest,
+			PlanDigest:    r.Metric.PlanDigest,
+			CPUTimeMillis: uint64(cpu),
+		})
+	}
+	return nil
+}
+
+// PlanSamples fills the number of points reported of every (sql digest,
+// plan digest) pair across all instances within (endSecs-windowSecs,
+// endSecs], i.e. the instance-seconds in which the plan ran.
+func PlanSamples(endSecs, windowSecs int, fill *[]PlanSamplesItem) error {
+	var resp vectorResp
+	query := fmt.Sprintf("sum by (sql_digest, plan_digest) (count_over_time(cpu_time[%d]))", windowSecs)
+	if err := fetchInstantTimeseriesDB(query, endSecs, &resp); err != nil {
+		return err
+	}
+
+	for _, r := range resp.Data.Results {
+		if len(r.Value) != 2 {
+			continue
+		}
+		samples, err := strconv.ParseFloat(r.Value[1].(string), 64)
+		if err != nil {
+			continue
+		}
+		*fill = append(*fill, PlanSamplesItem{
+			SQLDigest:  r.Metric.SQLDigest,
+			PlanDigest: r.Metric.PlanDigest,
+			Samples:    uint64(samples),
+		})
+	}
+	return nil
+}
+
+// InstancesInRange fills instances having data within [startSecs, endSecs],
+// including those which are no longer alive.
+func InstancesInRange(startSecs, endSecs int, fill *[]InstanceItem) error {
+	doc, err := documentDB.Query(
+		"SELECT instance, instance_type FROM instance_activity WHERE ts >= ? AND ts <= ?",
+		startSecs-startSecs%store.ActivityBucketSecs, endSecs,
+	)
+	if err != nil {
+		return err
+	}
+	defer doc.Close()
+
+	seen := make(map[string]struct{})
+	return doc.Iterate(func(d types.Document) error {
+		item := InstanceItem{}
+
+		err := document.Scan(d, &item.Instance, &item.InstanceType)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := seen[item.Instance]; ok {
+			return nil
+		}
+		seen[item.Instance] = struct{}{}
+		item.Alive = store.IsAlive(item.Instance)
+		item.Decommission = decommissionOf(item.Instance)
+		*fill = append(*fill, item)
+		return nil
+	})
+}
+
+func decommissionOf(instance string) *store.Decommission {
+	if dc, ok := store.DecommissionOf(instance); ok {
+		return &dc
+	}
+	return nil
+}
+
+// SQLTexts resolves sql digests to their normalized sql texts. Unknown digests are skipped.
+func SQLTexts(digests []string, fill *[]SQLTextItem) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		for _, digest := range digests {
+			r, err := tx.QueryDocument("SELECT sql_text, is_internal FROM sql_digest WHERE digest = ?", digest)
+			if err == errs.ErrDocumentNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			item := SQLTextItem{SQLDigest: digest}
+			if err = document.Scan(r, &item.SQLText, &item.IsInternal); err != nil {
+				return err
+			}
+			item.SQLText = masking.MaskOnQuery(item.SQLText)
+			*fill = append(*fill, item)
+		}
+		return nil
+	})
+}
+
+// PlanTexts resolves plan digests to their normalized plan texts. Unknown digests are skipped.
+func PlanTexts(digests []string, fill *[]PlanTextItem) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		for _, digest := range digests {
+			r, err := tx.QueryDocument("SELECT plan_text FROM plan_digest WHERE digest = ?", digest)
+			if err == errs.ErrDocumentNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			item := PlanTextItem{PlanDigest: digest}
+			if err = document.Scan(r, &item.PlanText); err != nil {
+				return err
+			}
+			item.PlanText = masking.MaskOnQuery(item.PlanText)
+			*fill = append(*fill, item)
+		}
+		return nil
+	})
+}
+
 type planSeries struct {
 	planDigest    string
 	timestampSecs []uint64
-	cpuTimeMillis []uint32
+	cpuTimeMillis []uint64
 }
 
 type sqlGroup struct {
 	sqlDigest  string
 	planSeries []planSeries
-	cpuTimeSum uint32
+	cpuTimeSum uint64
+	isOther    bool
 }
 
-func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance string, metricResponse *metricResp) error {
+// fetchInstantTimeseriesDB evaluates the query at timeSecs.
+func fetchInstantTimeseriesDB(query string, timeSecs int, resp *vectorResp) error {
+	if vmselectHandler == nil {
+		return fmt.Errorf("empty query handler")
+	}
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	req, err := http.NewRequest("GET", "/api/v1/query", nil)
+	if err != nil {
+		return err
+	}
+	reqQuery := req.URL.Query()
+	reqQuery.Set("query", query)
+	reqQuery.Set("time", strconv.Itoa(timeSecs))
+	req.URL.RawQuery = reqQuery.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	respR := utils.NewRespWriter(bufResp, header)
+	vmselectHandler(&respR, req)
+
+	// Callers rely on the result being complete, so don't treat failures as empty results.
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return fmt.Errorf("failed to fetch timeseries db: %s", respR.Body.String())
+	}
+
+	return json.Unmarshal(respR.Body.Bytes(), resp)
+}
+
+func fetchTimeseriesDB(query string, startSecs int, endSecs int, windowSecs int, metricResponse *metricResp) error {
 	if vmselectHandler == nil {
 		return fmt.Errorf("empty query handler")
 	}
@@ -96,7 +498,6 @@ func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance stri
 	defer bytesP.Put(bufResp)
 	defer headerP.Put(header)
 
-	query := fmt.Sprintf("sum_over_time(cpu_time{instance=\"%s\"}[%d])", instance, windowSecs)
 	start := strconv.Itoa(startSecs - startSecs%windowSecs)
 	end := strconv.Itoa(endSecs - endSecs%windowSecs + windowSecs)
 
@@ -122,12 +523,56 @@ func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance stri
 	return json.Unmarshal(respR.Body.Bytes(), metricResponse)
 }
 
-func topK(results []metricRespDataResult, top int, sqlGroups *[]sqlGroup) error {
-	groupBySQLDigest(results, sqlGroups)
-	if err := keepTopK(sqlGroups, top); err != nil {
-		return err
+// buildQuery builds the MetricsQL of the metric for the instance. An empty
+// instance means all instances, in which case series are summed up across
+// instances. A non-empty sqlDigest restricts the series to that sql digest.
+func buildQuery(metric, instance, sqlDigest, aggregation string, windowSecs int) (string, error) {
+	query, err := buildRollupQuery(metric, instance, sqlDigest, aggregation, windowSecs)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	if len(instance) == 0 {
+		query = fmt.Sprintf("sum by (sql_digest, plan_digest) (%s)", query)
+	}
+	return query, nil
+}
+
+// buildRollupQuery aggregates every series within the window without merging
+// series.
+func buildRollupQuery(metric, instance, sqlDigest, aggregation string, windowSecs int) (string, error) {
+	var matchers []string
+	if len(instance) != 0 {
+		matchers = append(matchers, fmt.Sprintf("instance=%q", instance))
+	}
+	if len(sqlDigest) != 0 {
+		matchers = append(matchers, fmt.Sprintf("sql_digest=%q", sqlDigest))
+	}
+	selector := fmt.Sprintf("%s[%d]", metric, windowSecs)
+	if len(matchers) != 0 {
+		selector = fmt.Sprintf("%s{%s}[%d]", metric, strings.Join(matchers, ","), windowSecs)
+	}
+
+	var query string
+	switch aggregation {
+	case AggregationSum, "":
+		query = fmt.Sprintf("sum_over_time(%s)", selector)
+	case AggregationMax:
+		query = fmt.Sprintf("max_over_time(%s)", selector)
+	case AggregationAvg:
+		query = fmt.Sprintf("avg_over_time(%s)", selector)
+	case AggregationP99:
+		query = fmt.Sprintf("quantile_over_time(0.99, %s)", selector)
+	default:
+		return "", fmt.Errorf("unknown aggregation: %s", aggregation)
+	}
+	return query, nil
+}
+
+// topK keeps the top k SQLs and returns the rest summed up, or nil if no SQL
+// is left out.
+func topK(results []metricRespDataResult, top int, sqlGroups *[]sqlGroup) (*sqlGroup, error) {
+	groupBySQLDigest(results, sqlGroups)
+	return keepTopK(sqlGroups, top)
 }
 
 func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
@@ -160,14 +605,15 @@ func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
 			}
 
 			ts := uint64(value[0].(float64))
-			cpu, err := strconv.ParseUint(value[1].(string), 10, 64)
+			// avg and p99 aggregations may produce fractional values
+			cpu, err := strconv.ParseFloat(value[1].(string), 64)
 			if err != nil {
 				continue
 			}
 
-			group.cpuTimeSum += uint32(cpu)
+			group.cpuTimeSum += uint64(cpu)
 			ps.timestampSecs = append(ps.timestampSecs, ts)
-			ps.cpuTimeMillis = append(ps.cpuTimeMillis, uint32(cpu))
+			ps.cpuTimeMillis = append(ps.cpuTimeMillis, uint64(cpu))
 		}
 
 		m[r.Metric.SQLDigest] = group
@@ -182,18 +628,50 @@ func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
 	}
 }
 
-func keepTopK(groups *[]sqlGroup, top int) error {
+func keepTopK(groups *[]sqlGroup, top int) (*sqlGroup, error) {
 	if top <= 0 || len(*groups) <= top {
-		return nil
+		return nil, nil
 	}
 
 	if err := quickselect.QuickSelect(TopKSlice{s: *groups}, top); err != nil {
-		return err
+		return nil, err
 	}
 
+	others := sumGroups((*groups)[top:])
 	*groups = (*groups)[:top]
 
-	return nil
+	return others, nil
+}
+
+// sumGroups sums up all series of the groups by timestamp into one series.
+func sumGroups(groups []sqlGroup) *sqlGroup {
+	sums := make(map[uint64]uint64)
+	others := &sqlGroup{isOther: true}
+	for _, group := range groups {
+		others.cpuTimeSum += group.cpuTimeSum
+		for _, series := range group.planSeries {
+			for i, ts := range series.timestampSecs {
+				sums[ts] += series.cpuTimeMillis[i]
+			}
+		}
+	}
+
+	series := planSeries{
+		timestampSecs: make([]uint64, 0, len(sums)),
+		cpuTimeMillis: make([]uint64, 0, len(sums)),
+	}
+	for ts := range sums {
+		series.timestampSecs = append(series.timestampSecs, ts)
+	}
+	sort.Slice(series.timestampSecs, func(i, j int) bool {
+		return series.timestampSecs[i] < series.timestampSecs[j]
+	})
+	for _, ts := range series.timestampSecs {
+		series.cpuTimeMillis = append(series.cpuTimeMillis, sums[ts])
+	}
+	others.planSeries = []planSeries{series}
+
+	return others
 }
 
 func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
@@ -209,12 +687,14 @@ func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
 				)
 				if err == nil {
 					_ = document.Scan(r, &sqlText)
+					sqlText = masking.MaskOnQuery(sqlText)
 				}
 			}
 
 			item := TopSQLItem{
 				SQLDigest: sqlDigest,
 				SQLText:   sqlText,
+				IsOther:   group.isOther,
 			}
 
 			for _, series := range group.planSeries {
@@ -228,6 +708,7 @@ func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
 					)
 					if err == nil {
 						_ = document.Scan(r, &planText)
+						planText = masking.MaskOnQuery(planText)
 					}
 				}
 
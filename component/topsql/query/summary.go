@@ -0,0 +1,86 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+)
+
+// InstanceSummaries fills the load of every instance having data within
+// [startSecs, endSecs], heaviest first.
+func InstanceSummaries(startSecs, endSecs int, fill *[]InstanceSummaryItem) error {
+	rangeSecs := endSecs - startSecs
+	if rangeSecs < 1 {
+		rangeSecs = 1
+	}
+
+	instances := make([]InstanceItem, 0)
+	if err := InstancesInRange(startSecs, endSecs, &instances); err != nil {
+		return err
+	}
+	summaries := make(map[string]*InstanceSummaryItem, len(instances))
+	for _, instance := range instances {
+		summaries[instance.Instance] = &InstanceSummaryItem{
+			Instance:     instance.Instance,
+			InstanceType: instance.InstanceType,
+			Alive:        instance.Alive,
+			Decommission: instance.Decommission,
+		}
+	}
+
+	queries := []struct {
+		query string
+		apply func(item *InstanceSummaryItem, value float64)
+	}{{
+		query: fmt.Sprintf("sum by (instance, instance_type) (sum_over_time(cpu_time[%d]))", rangeSecs),
+		apply: func(item *InstanceSummaryItem, value float64) { item.CPUTimeMillis = uint64(value) },
+	}, {
+		query: fmt.Sprintf("count by (instance, instance_type) (sum by (instance, instance_type, sql_digest) (count_over_time(cpu_time[%d])))", rangeSecs),
+		apply: func(item *InstanceSummaryItem, value float64) { item.SQLDigests = int(value) },
+	}, {
+		query: fmt.Sprintf("max by (instance, instance_type) (tlast_over_time(cpu_time[%d]))", rangeSecs),
+		apply: func(item *InstanceSummaryItem, value float64) { item.LastTimestampSecs = int64(value) },
+	}}
+	for _, q := range queries {
+		var resp vectorResp
+		if err := fetchInstantTimeseriesDB(q.query, endSecs, &resp); err != nil {
+			return err
+		}
+
+		for _, r := range resp.Data.Results {
+			if len(r.Value) != 2 {
+				continue
+			}
+			value, err := strconv.ParseFloat(r.Value[1].(string), 64)
+			if err != nil {
+				continue
+			}
+
+			item, ok := summaries[r.Metric.Instance]
+			if !ok {
+				item = &InstanceSummaryItem{
+					Instance:     r.Metric.Instance,
+					InstanceType: r.Metric.InstanceType,
+					Alive:        store.IsAlive(r.Metric.Instance),
+					Decommission: decommissionOf(r.Metric.Instance),
+				}
+				summaries[r.Metric.Instance] = item
+			}
+			q.apply(item, value)
+		}
+	}
+
+	for _, item := range summaries {
+		*fill = append(*fill, *item)
+	}
+	sort.Slice(*fill, func(i, j int) bool {
+		a, b := (*fill)[i], (*fill)[j]
+		if a.CPUTimeMillis != b.CPUTimeMillis {
+			return a.CPUTimeMillis > b.CPUTimeMillis
+		}
+		return a.Instance < b.Instance
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+package query
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
+
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+)
+
+// TextFilter keeps SQLs whose normalized texts match. The zero value keeps
+// all SQLs.
+type TextFilter struct {
+	// Contains matches a substring case-insensitively, ignoring backquotes
+	// around identifiers, e.g. `delete from orders` matches
+	// "delete from `orders` where `id` = ?".
+	Contains string
+	Regex    *regexp.Regexp
+}
+
+func (f TextFilter) IsEmpty() bool {
+	return len(f.Contains) == 0 && f.Regex == nil
+}
+
+func (f TextFilter) match(text string) bool {
+	if len(f.Contains) != 0 && !strings.Contains(normalizeText(text), normalizeText(f.Contains)) {
+		return false
+	}
+	return f.Regex == nil || f.Regex.MatchString(text)
+}
+
+func normalizeText(text string) string {
+	return strings.ToLower(strings.ReplaceAll(text, "`", ""))
+}
+
+// matchedDigests returns sql digests whose texts match. Texts are masked as
+// they are shown, so that masked literals can't be probed by filtering.
+func matchedDigests(f TextFilter) (map[string]struct{}, error) {
+	res, err := documentDB.Query("SELECT digest, sql_text FROM sql_digest")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	digests := make(map[string]struct{})
+	err = res.Iterate(func(d types.Document) error {
+		var digest, text string
+		if err := document.Scan(d, &digest, &text); err != nil {
+			return err
+		}
+		if f.match(masking.MaskForFilter(text)) {
+			digests[digest] = struct{}{}
+		}
+		return nil
+	})
+	return digests, err
+}
+
+// filterByText drops results of sql digests whose texts don't match.
+func filterByText(results *[]metricRespDataResult, f TextFilter) error {
+	if f.IsEmpty() {
+		return nil
+	}
+	digests, err := matchedDigests(f)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, r := range *results {
+		if _, ok := digests[r.Metric.SQLDigest]; ok {
+			(*results)[n] = r
+			n++
+		}
+	}
+	*results = (*results)[:n]
+	return nil
+}
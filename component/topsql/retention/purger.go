@@ -0,0 +1,149 @@
+package retention
+
+import (
+	"errors"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/database/table"
+)
+
+// Stages of a purge in order. A purge interrupted halfway resumes from the
+// stage it's interrupted at, since the stages before it have nothing left.
+const (
+	stageDocuments      = "documents"
+	stageDecommissioned = "decommissioned"
+	stageColdSeries     = "cold_series"
+	stageSQLMeta        = "sql_meta"
+	stagePlanMeta       = "plan_meta"
+	stageOrphans        = "orphans"
+)
+
+// errInterrupted stops a purge once it's stopped or its window ends.
+var errInterrupted = errors.New("purge interrupted")
+
+// Checkpoint is the progress of the latest purge.
+type Checkpoint struct {
+	StartSecs     int64 `json:"start_secs"`
+	UpdatedSecs   int64 `json:"updated_secs"`
+	SafePointSecs int64 `json:"safe_point_secs"`
+	// Stage is the stage being run, or to resume from if the purge is
+	// interrupted. It's empty once the purge finishes.
+	Stage string `json:"stage"`
+	// Deleted is the number of digests deleted so far.
+	Deleted int `json:"deleted"`
+
+	// id is the primary key of the only row.
+	id string
+}
+
+const checkpointID = "latest"
+
+var checkpointTable = table.New("purge_checkpoint", []string{"id", "start_ts", "ts", "safe_point", "stage", "deleted"}, func(c *Checkpoint) []interface{} {
+	return []interface{}{&c.id, &c.StartSecs, &c.UpdatedSecs, &c.SafePointSecs, &c.Stage, &c.Deleted}
+})
+
+// LatestCheckpoint returns the progress of the latest purge, and false if
+// there has been no purge.
+func LatestCheckpoint() (Checkpoint, bool, error) {
+	var cps []Checkpoint
+	if err := checkpointTable.Select(documentDB, &cps, "WHERE id = ?", checkpointID); err != nil {
+		return Checkpoint{}, false, err
+	}
+	if len(cps) == 0 {
+		return Checkpoint{}, false, nil
+	}
+	return cps[0], true, nil
+}
+
+func saveCheckpoint(cp Checkpoint, now time.Time) error {
+	cp.id = checkpointID
+	cp.UpdatedSecs = now.Unix()
+	return checkpointTable.Upsert(documentDB, cp)
+}
+
+// purger deletes digests in batches at a limited rate, so that writes and
+// queries are served between batches.
+type purger struct {
+	batchSize     int
+	rowsPerSecond int
+	stopCh        <-chan struct{}
+	// deadline is when the purge window ends, zero without a window.
+	deadline time.Time
+	deleted  int
+}
+
+func newPurger(cfg config.Purge, deadline time.Time, stopCh <-chan struct{}) *purger {
+	return &purger{
+		batchSize:     cfg.BatchSize,
+		rowsPerSecond: cfg.RowsPerSecond,
+		stopCh:        stopCh,
+		deadline:      deadline,
+	}
+}
+
+// each calls fn with batches of the digests, and waits between batches to
+// keep the rate. It returns errInterrupted once the purge is stopped or its
+// window ends.
+func (p *purger) each(digests []string, fn func(batch []string) error) error {
+	for i := 0; i < len(digests); i += p.batchSize {
+		if p.interrupted() {
+			return errInterrupted
+		}
+
+		j := i + p.batchSize
+		if j > len(digests) {
+			j = len(digests)
+		}
+		start := time.Now()
+		if err := fn(digests[i:j]); err != nil {
+			return err
+		}
+		p.deleted += j - i
+
+		if p.rowsPerSecond > 0 {
+			wait := time.Duration(j-i)*time.Second/time.Duration(p.rowsPerSecond) - time.Since(start)
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-p.stopCh:
+					timer.Stop()
+					return errInterrupted
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *purger) interrupted() bool {
+	select {
+	case <-p.stopCh:
+		return true
+	default:
+	}
+	return !p.deadline.IsZero() && !time.Now().Before(p.deadline)
+}
+
+// windowEnd returns when the purge window containing now ends, or false if
+// now is out of the window. It returns a zero time without a window.
+func windowEnd(cfg config.Purge, now time.Time) (time.Time, bool) {
+	start, end, err := cfg.ParseWindow()
+	if err != nil || start == end {
+		return time.Time{}, err == nil
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	switch {
+	case start < end && offset >= start && offset < end:
+		return midnight.Add(end), true
+	case start > end && offset >= start:
+		return midnight.AddDate(0, 0, 1).Add(end), true
+	case start > end && offset < end:
+		return midnight.Add(end), true
+	default:
+		return time.Time{}, false
+	}
+}
@@ -0,0 +1,117 @@
+package retention
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/annotation"
+	"github.com/zhongzc/ng_monitoring/component/topsql/clocksync"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowEnd(t *testing.T) {
+	day := time.Date(2021, 11, 1, 0, 0, 0, 0, time.Local)
+	at := func(hour, min int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+
+	for _, c := range []struct {
+		window string
+		now    time.Time
+		end    time.Time
+		ok     bool
+	}{
+		{window: "", now: at(12, 0), ok: true},
+		{window: "02:00-06:00", now: at(2, 0), end: at(6, 0), ok: true},
+		{window: "02:00-06:00", now: at(5, 59), end: at(6, 0), ok: true},
+		{window: "02:00-06:00", now: at(6, 0)},
+		{window: "02:00-06:00", now: at(1, 0)},
+		{window: "22:00-04:00", now: at(23, 0), end: at(28, 0), ok: true},
+		{window: "22:00-04:00", now: at(3, 0), end: at(4, 0), ok: true},
+		{window: "22:00-04:00", now: at(12, 0)},
+	} {
+		end, ok := windowEnd(config.Purge{Window: c.window}, c.now)
+		require.Equal(t, c.ok, ok, "%s at %s", c.window, c.now)
+		require.True(t, c.end.Equal(end), "%s at %s: %s", c.window, c.now, end)
+	}
+}
+
+func TestPurgeResume(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{TopSQL: config.TopSQL{
+		RetentionDays: 1,
+		Purge:         config.Purge{BatchSize: 3},
+	}})
+
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	documentDB = db
+	query.Init(emptyVectorHandler, db)
+	require.NoError(t, clocksync.Init(db))
+	clocksync.Stop()
+	require.NoError(t, annotation.Init(db))
+	for _, stmt := range []string{
+		"CREATE TABLE purge_checkpoint (id VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE sql_digest (digest VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE sql_digest_history (ts INTEGER)",
+		"CREATE TABLE plan_digest (digest VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE instance_activity (id VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE plan_regression (ts INTEGER)",
+		"CREATE TABLE digest_heat (digest VARCHAR(255) PRIMARY KEY)",
+	} {
+		require.NoError(t, db.Exec(stmt))
+	}
+	for d := 0; d < 10; d++ {
+		digest := fmt.Sprintf("%08d", d)
+		require.NoError(t, db.Exec("INSERT INTO sql_digest(digest, sql_text, ts) VALUES (?, ?, ?)", digest, "select ?", 0))
+		require.NoError(t, db.Exec("INSERT INTO plan_digest(digest, plan_text, ts) VALUES (?, ?, ?)", digest, "TableReader", 0))
+	}
+
+	_, ok, err := LatestCheckpoint()
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// a stopped purge is interrupted before deleting any batch
+	stopped := make(chan struct{})
+	close(stopped)
+	require.NoError(t, purge(time.Now(), stopped))
+	cp, ok, err := LatestCheckpoint()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, stageSQLMeta, cp.Stage)
+	require.Equal(t, 0, cp.Deleted)
+	require.Equal(t, 10, countRows(t, "sql_digest"))
+
+	// out of the window
+	config.GetGlobalConfig().TopSQL.Purge.Window = windowAround(time.Now().Add(12 * time.Hour))
+	require.NoError(t, purge(time.Now(), nil))
+	require.Equal(t, 10, countRows(t, "sql_digest"))
+
+	config.GetGlobalConfig().TopSQL.Purge.Window = windowAround(time.Now())
+	require.NoError(t, purge(time.Now(), nil))
+	cp, _, err = LatestCheckpoint()
+	require.NoError(t, err)
+	require.Empty(t, cp.Stage)
+	require.Equal(t, 30, cp.Deleted)
+	require.Equal(t, 0, countRows(t, "sql_digest"))
+	require.Equal(t, 0, countRows(t, "plan_digest"))
+}
+
+// windowAround returns a two-hour window around the time.
+func windowAround(t time.Time) string {
+	return fmt.Sprintf("%s-%s", t.Add(-time.Hour).Format("15:04"), t.Add(time.Hour).Format("15:04"))
+}
+
+func countRows(t *testing.T, table string) int {
+	n := 0
+	err := documentDB.View(func(tx *genji.Tx) error {
+		return scanDigests(tx, fmt.Sprintf("SELECT digest FROM %s", table), func(string) { n++ })
+	})
+	require.NoError(t, err)
+	return n
+}
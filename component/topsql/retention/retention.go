@@ -0,0 +1,483 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql/annotation"
+	"github.com/zhongzc/ng_monitoring/component/topsql/clocksync"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const purgeInterval = time.Hour
+
+// The timeseries data is purged by the timeseries database itself, whose
+// retention follows the retention of hot digests. Here purges the documents,
+// and the timeseries of cold digests if hot retention is enabled.
+
+var (
+	documentDB *genji.DB
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+func Init(db *genji.DB) error {
+	documentDB = db
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS purge_checkpoint (id VARCHAR(255) PRIMARY KEY)"); err != nil {
+		return err
+	}
+	Start()
+	return nil
+}
+
+// Start starts the background purge. It's a no-op if it's already running.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh != nil {
+		return
+	}
+
+	stopCh = make(chan struct{})
+	wg.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer wg.Done()
+		run(stopCh)
+	}, nil)
+}
+
+// Stop stops the background purge. It's a no-op if it's not running.
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh == nil {
+		return
+	}
+
+	close(stopCh)
+	wg.Wait()
+	stopCh = nil
+}
+
+func run(stopCh chan struct{}) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := purge(time.Now(), stopCh); err != nil {
+				log.Warn("failed to purge expired topsql data", zap.Error(err))
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func retentionDays() int {
+	return config.GetGlobalConfig().TopSQL.RetentionDays
+}
+
+// purge deletes expired data if now is within the purge window. It resumes
+// the latest purge if it's interrupted.
+func purge(now time.Time, stopCh <-chan struct{}) error {
+	cfg := config.GetGlobalConfig().TopSQL.Purge
+	deadline, ok := windowEnd(cfg, now)
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	retentionSecs := retentionDays() * 24 * 60 * 60
+	safePointSecs := now.Unix() - int64(retentionSecs)
+
+	cp, ok, err := LatestCheckpoint()
+	if err != nil {
+		return err
+	}
+	if ok && len(cp.Stage) != 0 {
+		log.Info("resume interrupted purge", zap.String("stage", cp.Stage), zap.Int("deleted", cp.Deleted))
+	} else {
+		cp = Checkpoint{StartSecs: now.Unix()}
+	}
+	cp.SafePointSecs = safePointSecs
+	p := newPurger(cfg, deadline, stopCh)
+	p.deleted = cp.Deleted
+
+	// Digests still having cpu time within the retention are kept even if their
+	// meta is older than the retention, since the meta is reported only once.
+	var items []query.PlanCPUTimeItem
+	if err := query.PlanCPUTime(int(now.Unix()), retentionSecs, &items); err != nil {
+		return err
+	}
+	activeSQLs := make(map[string]struct{})
+	activePlans := make(map[string]struct{})
+	for _, item := range items {
+		activeSQLs[item.SQLDigest] = struct{}{}
+		activePlans[item.PlanDigest] = struct{}{}
+	}
+	multiplier := config.GetGlobalConfig().TopSQL.HotRetentionMultiplier
+	hotRetentionSecs := retentionSecs * multiplier
+	var cold []string
+	if multiplier > 1 {
+		// hot digests are marked active even if purging cold series is done
+		if cold, err = coldSQLDigests(now, hotRetentionSecs, activeSQLs, activePlans); err != nil {
+			return err
+		}
+	}
+
+	var sqlPurged, planPurged []string
+	orphans, decommissioned := 0, 0
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{name: stageDocuments, run: func() error {
+			if err := documentDB.Exec("DELETE FROM instance_activity WHERE ts < ?", safePointSecs); err != nil {
+				return err
+			}
+			if err := documentDB.Exec("DELETE FROM plan_regression WHERE ts < ?", safePointSecs); err != nil {
+				return err
+			}
+			if err := clocksync.Purge(safePointSecs); err != nil {
+				return err
+			}
+			if err := topology.PurgeChanges(safePointSecs); err != nil {
+				return err
+			}
+			return annotation.Purge(now, safePointSecs)
+		}},
+		{name: stageDecommissioned, run: func() (err error) {
+			decommissioned, err = purgeDecommissioned(now)
+			return
+		}},
+		{name: stageColdSeries, run: func() error {
+			if multiplier <= 1 {
+				return nil
+			}
+			if err := p.each(cold, query.DeleteSQLSeries); err != nil {
+				return err
+			}
+			return documentDB.Exec("DELETE FROM digest_heat WHERE ts < ?", now.Unix()-int64(hotRetentionSecs))
+		}},
+		{name: stageSQLMeta, run: func() error {
+			expired, err := expiredMeta("sql_digest", safePointSecs, activeSQLs)
+			if err != nil {
+				return err
+			}
+			// forgotten meta is written again once reported, so it's fine to
+			// forget those left by an interruption
+			defer store.ForgetSQLMeta(expired)
+			if err = p.deleteDigests("sql_digest", expired); err != nil {
+				return err
+			}
+			sqlPurged = expired
+			// history left by an interruption is swept as orphans
+			return p.deleteDigests("sql_digest_history", expired)
+		}},
+		{name: stagePlanMeta, run: func() error {
+			expired, err := expiredMeta("plan_digest", safePointSecs, activePlans)
+			if err != nil {
+				return err
+			}
+			defer store.ForgetPlanMeta(expired)
+			if err = p.deleteDigests("plan_digest", expired); err != nil {
+				return err
+			}
+			planPurged = expired
+			return nil
+		}},
+		{name: stageOrphans, run: func() (err error) {
+			orphans, err = p.sweepOrphans(safePointSecs)
+			return
+		}},
+	}
+
+	resuming := len(cp.Stage) != 0
+	for _, stage := range stages {
+		if resuming {
+			if stage.name != cp.Stage {
+				continue
+			}
+			resuming = false
+		}
+
+		cp.Stage = stage.name
+		if err := saveCheckpoint(cp, time.Now()); err != nil {
+			return err
+		}
+		if err := stage.run(); err != nil {
+			cp.Deleted = p.deleted
+			if saveErr := saveCheckpoint(cp, time.Now()); saveErr != nil {
+				log.Warn("failed to save purge checkpoint", zap.Error(saveErr))
+			}
+			if err == errInterrupted {
+				log.Info("purge expired topsql data interrupted",
+					zap.String("stage", cp.Stage),
+					zap.Int("deleted", cp.Deleted),
+					zap.Duration("cost", time.Since(start)))
+				return nil
+			}
+			return err
+		}
+	}
+	cp.Stage = ""
+	cp.Deleted = p.deleted
+	if err := saveCheckpoint(cp, time.Now()); err != nil {
+		return err
+	}
+
+	log.Info("purge expired topsql data finished",
+		zap.Int64("safe-point", safePointSecs),
+		zap.Int("sql-digests", len(sqlPurged)),
+		zap.Int("plan-digests", len(planPurged)),
+		zap.Int("orphans", orphans),
+		zap.Int("cold-sql-series", len(cold)),
+		zap.Int("decommissioned-instances", decommissioned),
+		zap.Duration("cost", time.Since(start)))
+	return nil
+}
+
+// purgeDecommissioned deletes all data of decommissioned instances whose
+// retention after the cutoff ends, along with their marks, and returns the
+// number of purged instances.
+func purgeDecommissioned(now time.Time) (int, error) {
+	purged := 0
+	for _, dc := range store.Decommissions() {
+		days := dc.RetentionDays
+		if days == 0 {
+			days = retentionDays()
+		}
+		if now.Unix() < dc.CutoffSecs+int64(days*24*60*60) {
+			continue
+		}
+
+		if err := query.DeleteInstanceSeries(dc.Instance); err != nil {
+			return purged, err
+		}
+		for _, table := range []string{"instance", "instance_activity"} {
+			if err := documentDB.Exec(fmt.Sprintf("DELETE FROM %s WHERE instance = ?", table), dc.Instance); err != nil {
+				return purged, err
+			}
+		}
+		if err := store.UnmarkDecommission(dc.Instance); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// coldSQLDigests returns the sql digests which are neither hot nor active
+// within the retention, whose timeseries are to be deleted. Hot digests are
+// marked active, so that their meta is kept as well.
+func coldSQLDigests(now time.Time, hotRetentionSecs int, activeSQLs, activePlans map[string]struct{}) ([]string, error) {
+	var items []query.PlanCPUTimeItem
+	if err := query.PlanCPUTime(int(now.Unix()), hotRetentionSecs, &items); err != nil {
+		return nil, err
+	}
+	hot, err := hotSQLDigests(items)
+	if err != nil {
+		return nil, err
+	}
+
+	coldSet := make(map[string]struct{})
+	for _, item := range items {
+		if _, ok := hot[item.SQLDigest]; ok {
+			activeSQLs[item.SQLDigest] = struct{}{}
+			activePlans[item.PlanDigest] = struct{}{}
+		} else if _, ok := activeSQLs[item.SQLDigest]; !ok {
+			coldSet[item.SQLDigest] = struct{}{}
+		}
+	}
+
+	cold := make([]string, 0, len(coldSet))
+	for digest := range coldSet {
+		cold = append(cold, digest)
+	}
+	return cold, nil
+}
+
+// hotSQLDigests returns the sql digests with the most cpu time among the
+// items, along with the frequently queried ones.
+func hotSQLDigests(items []query.PlanCPUTimeItem) (map[string]struct{}, error) {
+	cfg := config.GetGlobalConfig().TopSQL
+	hot := make(map[string]struct{})
+
+	if cfg.HotTopCPU > 0 {
+		cpuTime := make(map[string]uint64)
+		for _, item := range items {
+			cpuTime[item.SQLDigest] += item.CPUTimeMillis
+		}
+		digests := make([]string, 0, len(cpuTime))
+		for digest := range cpuTime {
+			digests = append(digests, digest)
+		}
+		sort.Slice(digests, func(i, j int) bool {
+			return cpuTime[digests[i]] > cpuTime[digests[j]]
+		})
+		if len(digests) > cfg.HotTopCPU {
+			digests = digests[:cfg.HotTopCPU]
+		}
+		for _, digest := range digests {
+			hot[digest] = struct{}{}
+		}
+	}
+
+	if cfg.HotMinQueries > 0 {
+		var queried []string
+		if err := query.QueriedDigests(cfg.HotMinQueries, &queried); err != nil {
+			return nil, err
+		}
+		for _, digest := range queried {
+			hot[digest] = struct{}{}
+		}
+	}
+
+	return hot, nil
+}
+
+// expiredMeta returns digests whose meta is reported before the safe point
+// and no longer active. Meta without a report time is written by older
+// versions.
+func expiredMeta(table string, safePointSecs int64, active map[string]struct{}) ([]string, error) {
+	res, err := documentDB.Query(fmt.Sprintf("SELECT digest FROM %s WHERE ts IS NULL OR ts < ?", table), safePointSecs)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var expired []string
+	err = res.Iterate(func(d types.Document) error {
+		var digest string
+		if err := document.Scan(d, &digest); err != nil {
+			return err
+		}
+		if _, ok := active[digest]; !ok {
+			expired = append(expired, digest)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// sweepOrphans deletes rows referring to sql digests without meta, and returns
+// the number of swept digests. They are left by purges interrupted halfway, or
+// by queries on digests whose meta is never reported. Heat is kept until the
+// safe point, since the meta may be reported later.
+func (p *purger) sweepOrphans(safePointSecs int64) (int, error) {
+	var live map[string]struct{}
+	orphans := make(map[string][]string)
+	err := documentDB.View(func(tx *genji.Tx) error {
+		live = make(map[string]struct{})
+		if err := scanDigests(tx, "SELECT digest FROM sql_digest", func(digest string) {
+			live[digest] = struct{}{}
+		}); err != nil {
+			return err
+		}
+
+		for _, stmt := range []struct {
+			query string
+			args  []interface{}
+			table string
+		}{
+			{query: "SELECT digest FROM sql_digest_history", table: "sql_digest_history"},
+			{query: "SELECT digest FROM digest_heat WHERE ts < ?", args: []interface{}{safePointSecs}, table: "digest_heat"},
+		} {
+			seen := make(map[string]struct{})
+			if err := scanDigests(tx, stmt.query, func(digest string) {
+				if _, ok := live[digest]; ok {
+					return
+				}
+				if _, ok := seen[digest]; !ok {
+					seen[digest] = struct{}{}
+					orphans[stmt.table] = append(orphans[stmt.table], digest)
+				}
+			}, stmt.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, table := range []string{"sql_digest_history", "digest_heat"} {
+		stmt := fmt.Sprintf("DELETE FROM %s WHERE digest = ?", table)
+		err := p.each(orphans[table], func(batch []string) error {
+			return documentDB.Update(func(tx *genji.Tx) error {
+				for _, digest := range batch {
+					// rows written along with their meta since the scan are
+					// not orphans
+					_, err := tx.QueryDocument("SELECT digest FROM sql_digest WHERE digest = ?", digest)
+					if err == nil {
+						continue
+					}
+					if err != errs.ErrDocumentNotFound {
+						return err
+					}
+					if err = tx.Exec(stmt, digest); err != nil {
+						return err
+					}
+					swept++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return swept, err
+		}
+	}
+	return swept, nil
+}
+
+func scanDigests(tx *genji.Tx, query string, fn func(digest string), args ...interface{}) error {
+	res, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		var digest string
+		if err := document.Scan(d, &digest); err != nil {
+			return err
+		}
+		fn(digest)
+		return nil
+	})
+}
+
+// deleteDigests deletes rows of the digests in batches, each in its own
+// transaction.
+func (p *purger) deleteDigests(table string, digests []string) error {
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE digest = ?", table)
+	return p.each(digests, func(batch []string) error {
+		return documentDB.Update(func(tx *genji.Tx) error {
+			for _, digest := range batch {
+				if err := tx.Exec(stmt, digest); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
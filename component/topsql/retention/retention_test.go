@@ -0,0 +1,119 @@
+package retention
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/annotation"
+	"github.com/zhongzc/ng_monitoring/component/topsql/clocksync"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+// emptyVectorHandler responds no active digests, so all meta is expired.
+func emptyVectorHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+}
+
+func BenchmarkPurge(b *testing.B) {
+	config.StoreGlobalConfig(&config.Config{TopSQL: config.TopSQL{RetentionDays: 1}})
+
+	for _, digests := range []int{1000, 10000} {
+		digests := digests
+		b.Run(fmt.Sprintf("digests-%d", digests), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db, err := genji.Open(":memory:")
+				if err != nil {
+					b.Fatal(err)
+				}
+				documentDB = db
+				query.Init(emptyVectorHandler, db)
+				if err = clocksync.Init(db); err != nil {
+					b.Fatal(err)
+				}
+				clocksync.Stop()
+				if err = annotation.Init(db); err != nil {
+					b.Fatal(err)
+				}
+				for _, stmt := range []string{
+					"CREATE TABLE purge_checkpoint (id VARCHAR(255) PRIMARY KEY)",
+					"CREATE TABLE sql_digest (digest VARCHAR(255) PRIMARY KEY)",
+					"CREATE TABLE sql_digest_history (ts INTEGER)",
+					"CREATE INDEX sql_digest_history_digest ON sql_digest_history (digest)",
+					"CREATE TABLE plan_digest (digest VARCHAR(255) PRIMARY KEY)",
+					"CREATE TABLE instance_activity (id VARCHAR(255) PRIMARY KEY)",
+					"CREATE TABLE plan_regression (ts INTEGER)",
+					"CREATE TABLE digest_heat (digest VARCHAR(255) PRIMARY KEY)",
+				} {
+					if err = db.Exec(stmt); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for d := 0; d < digests; d++ {
+					digest := fmt.Sprintf("%08d", d)
+					_ = db.Exec("INSERT INTO sql_digest(digest, sql_text, ts) VALUES (?, ?, ?)", digest, "select ?", 0)
+					_ = db.Exec("INSERT INTO sql_digest_history(digest, sql_text, ts) VALUES (?, ?, ?)", digest, "select ?", 0)
+					_ = db.Exec("INSERT INTO plan_digest(digest, plan_text, ts) VALUES (?, ?, ?)", digest, "TableReader", 0)
+				}
+				b.StartTimer()
+
+				if err = purge(time.Now(), nil); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				_ = db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestSweepOrphans(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	documentDB = db
+
+	for _, stmt := range []string{
+		"CREATE TABLE sql_digest (digest VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE sql_digest_history (ts INTEGER)",
+		"CREATE TABLE digest_heat (digest VARCHAR(255) PRIMARY KEY)",
+		"INSERT INTO sql_digest(digest, sql_text, ts) VALUES ('live', 'select ?', 1)",
+		"INSERT INTO sql_digest_history(digest, sql_text, ts) VALUES ('live', 'select ?', 1)",
+		"INSERT INTO sql_digest_history(digest, sql_text, ts) VALUES ('gone', 'select ?', 1), ('gone', 'select 1', 2)",
+		"INSERT INTO digest_heat(digest, queries, ts) VALUES ('live', 1, 1), ('gone', 1, 1), ('new', 1, 100)",
+	} {
+		require.NoError(t, db.Exec(stmt))
+	}
+
+	p := newPurger(config.Purge{BatchSize: 1}, time.Time{}, make(chan struct{}))
+	swept, err := p.sweepOrphans(10)
+	require.NoError(t, err)
+	require.Equal(t, 2, swept)
+
+	var digests []string
+	err = documentDB.View(func(tx *genji.Tx) error {
+		return scanDigests(tx, "SELECT digest FROM sql_digest_history", func(digest string) {
+			digests = append(digests, digest)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"live"}, digests)
+
+	digests = nil
+	err = documentDB.View(func(tx *genji.Tx) error {
+		return scanDigests(tx, "SELECT digest FROM digest_heat", func(digest string) {
+			digests = append(digests, digest)
+		})
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"live", "new"}, digests)
+}
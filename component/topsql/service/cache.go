@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dashboards refreshing periodically issue identical queries, so responses of
+// read-only queries are cached for a short while. The cache is bounded by
+// both the number of entries and their total size, evicting the least
+// recently used ones.
+const (
+	queryCacheTTL        = 5 * time.Second
+	queryCacheMaxEntries = 256
+	queryCacheMaxBytes   = 64 << 20
+	// larger responses are not cached, so that they don't evict everything
+	queryCacheMaxEntryBytes = 4 << 20
+)
+
+type cachedResponse struct {
+	key      string
+	header   http.Header
+	body     []byte
+	expireAt time.Time
+}
+
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cachedResponse
+	lru     *list.List
+	bytes   int
+}
+
+var respCache = newQueryCache()
+
+func newQueryCache() *queryCache {
+	return &queryCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (qc *queryCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	e, ok := qc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	resp := e.Value.(*cachedResponse)
+	if now.After(resp.expireAt) {
+		qc.remove(e)
+		return nil, false
+	}
+	qc.lru.MoveToFront(e)
+	return resp, true
+}
+
+func (qc *queryCache) put(resp *cachedResponse) {
+	if len(resp.body) > queryCacheMaxEntryBytes {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if e, ok := qc.entries[resp.key]; ok {
+		qc.remove(e)
+	}
+	qc.entries[resp.key] = qc.lru.PushFront(resp)
+	qc.bytes += len(resp.body)
+	for qc.lru.Len() > queryCacheMaxEntries || qc.bytes > queryCacheMaxBytes {
+		qc.remove(qc.lru.Back())
+	}
+}
+
+func (qc *queryCache) remove(e *list.Element) {
+	resp := qc.lru.Remove(e).(*cachedResponse)
+	delete(qc.entries, resp.key)
+	qc.bytes -= len(resp.body)
+}
+
+// purge drops all entries, since responses are stale once the data they are
+// derived from is changed by operators.
+func (qc *queryCache) purge() {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	qc.entries = make(map[string]*list.Element)
+	qc.lru.Init()
+	qc.bytes = 0
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// cached serves the handler from the cache keyed by the path and the
+// normalized query parameters. Only successful responses are cached.
+func cached(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Encode sorts parameters by key
+		key := c.Request.URL.Path + "?" + c.Request.URL.Query().Encode()
+		now := time.Now()
+
+		if resp, ok := respCache.get(key, now); ok {
+			for k, v := range resp.header {
+				c.Writer.Header()[k] = append([]string(nil), v...)
+			}
+			c.Data(http.StatusOK, resp.header.Get("Content-Type"), resp.body)
+			return
+		}
+
+		// only keep headers set by the handler, not those by middlewares such
+		// as gzip which depend on the request
+		before := c.Writer.Header().Clone()
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		handler(c)
+		c.Writer = w.ResponseWriter
+
+		if w.Status() != http.StatusOK {
+			return
+		}
+		header := make(http.Header)
+		for k, v := range w.Header() {
+			if _, ok := before[k]; !ok {
+				header[k] = v
+			}
+		}
+		respCache.put(&cachedResponse{
+			key:      key,
+			header:   header,
+			body:     w.body.Bytes(),
+			expireAt: now.Add(queryCacheTTL),
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// An export responds at most one chunk bounded by the caps below, which can
+// be lowered per request. The rest is exported by following requests carrying
+// the continuation token of the previous chunk.
+const (
+	maxExportRows     = 1000000
+	maxExportBytes    = 128 << 20
+	maxExportDuration = time.Minute
+
+	// ContinuationHeader carries the token to export the next chunk, absent
+	// for the last chunk.
+	ContinuationHeader = "X-Continuation-Token"
+
+	// records are fetched by slices of windows
+	exportSliceWindows = 60
+	// bytes are only counted once a row group is flushed
+	exportRowGroupSize = 8 << 20
+)
+
+// exportCursor is where the next chunk starts, i.e. the slice and the number
+// of its records already exported.
+type exportCursor struct {
+	SliceSecs int `json:"slice_secs"`
+	Offset    int `json:"offset"`
+}
+
+type exportQuota struct {
+	rows     int
+	bytes    int
+	duration time.Duration
+}
+
+// exportParquet writes cpu time records of all instances within the time
+// range into a parquet file, e.g. `?start=1636000000&end=1636600000&window=1m`,
+// for offline analytics. A chunk is capped by `max_rows`, `max_bytes` and
+// `max_duration`, and the next chunk is exported with the same parameters
+// plus `continuation` set to the token in the ContinuationHeader.
+func exportParquet(c *gin.Context) {
+	begin := time.Now()
+
+	params, err := parseTopSQLParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	quota, err := parseExportQuota(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// the timestamps responded for the time range, see query.CPUTimeRecords
+	windowSecs := params.windowSecs
+	firstSecs := params.startSecs - params.startSecs%windowSecs
+	lastSecs := params.endSecs - params.endSecs%windowSecs + windowSecs
+
+	cursor := exportCursor{SliceSecs: firstSecs}
+	if token := c.Query("continuation"); len(token) != 0 {
+		if cursor, err = decodeExportCursor(token); err != nil || cursor.SliceSecs < firstSecs || cursor.SliceSecs > lastSecs {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("invalid continuation token: %s", token),
+			})
+			return
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	pw, err := writer.NewParquetWriterFromWriter(buf, new(query.CPUTimeRecord), 1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	pw.RowGroupSize = exportRowGroupSize
+
+	sliceSecs := windowSecs * exportSliceWindows
+	rows := 0
+	var next *exportCursor
+	var records []query.CPUTimeRecord
+	for next == nil && cursor.SliceSecs <= lastSecs {
+		records = records[:0]
+		if err := sliceCPUTimeRecords(cursor.SliceSecs, sliceSecs, windowSecs, lastSecs, &records); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		for i := cursor.Offset; i < len(records); i++ {
+			// at least one row is exported, so that every chunk makes progress
+			if rows > 0 && (rows >= quota.rows || buf.Len() >= quota.bytes || time.Since(begin) >= quota.duration) {
+				next = &exportCursor{SliceSecs: cursor.SliceSecs, Offset: i}
+				break
+			}
+			if err = pw.Write(records[i]); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status":  "error",
+					"message": err.Error(),
+				})
+				return
+			}
+			rows++
+		}
+		cursor = exportCursor{SliceSecs: cursor.SliceSecs + sliceSecs}
+	}
+	if err = pw.WriteStop(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if next != nil {
+		c.Header(ContinuationHeader, encodeExportCursor(*next))
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"topsql_%d_%d.parquet\"", params.startSecs, params.endSecs))
+	c.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+}
+
+// sliceCPUTimeRecords fills records with timestamps within
+// [sliceSecs, sliceSecs+lenSecs) and not after lastSecs, in a stable order so
+// that offsets within the slice stay valid across requests.
+func sliceCPUTimeRecords(sliceSecs, lenSecs, windowSecs, lastSecs int, fill *[]query.CPUTimeRecord) error {
+	var records []query.CPUTimeRecord
+	if err := query.CPUTimeRecords(sliceSecs, sliceSecs+lenSecs-windowSecs, windowSecs, &records); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if r.TimestampSecs < int64(sliceSecs) || r.TimestampSecs >= int64(sliceSecs+lenSecs) || r.TimestampSecs > int64(lastSecs) {
+			continue
+		}
+		*fill = append(*fill, r)
+	}
+	sort.Slice(*fill, func(i, j int) bool {
+		a, b := (*fill)[i], (*fill)[j]
+		if a.TimestampSecs != b.TimestampSecs {
+			return a.TimestampSecs < b.TimestampSecs
+		}
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		if a.SQLDigest != b.SQLDigest {
+			return a.SQLDigest < b.SQLDigest
+		}
+		return a.PlanDigest < b.PlanDigest
+	})
+	return nil
+}
+
+// parseExportQuota parses `max_rows`, `max_bytes` and `max_duration`. Missing
+// or too large ones are capped to the maximums.
+func parseExportQuota(c *gin.Context) (exportQuota, error) {
+	quota := exportQuota{rows: maxExportRows, bytes: maxExportBytes, duration: maxExportDuration}
+
+	if raw := c.Query("max_rows"); len(raw) != 0 {
+		rows, err := strconv.Atoi(raw)
+		if err != nil {
+			return quota, err
+		}
+		if rows <= 0 {
+			return quota, fmt.Errorf("non-positive max_rows: %d", rows)
+		}
+		if rows < quota.rows {
+			quota.rows = rows
+		}
+	}
+
+	if raw := c.Query("max_bytes"); len(raw) != 0 {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return quota, err
+		}
+		if n <= 0 {
+			return quota, fmt.Errorf("non-positive max_bytes: %d", n)
+		}
+		if n < quota.bytes {
+			quota.bytes = n
+		}
+	}
+
+	if raw := c.Query("max_duration"); len(raw) != 0 {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return quota, err
+		}
+		if duration <= 0 {
+			return quota, fmt.Errorf("non-positive max_duration: %s", raw)
+		}
+		if duration < quota.duration {
+			quota.duration = duration
+		}
+	}
+
+	return quota, nil
+}
+
+func encodeExportCursor(cursor exportCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeExportCursor(token string) (exportCursor, error) {
+	var cursor exportCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(b, &cursor)
+	return cursor, err
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/annotation"
+	"github.com/zhongzc/ng_monitoring/component/topsql/clocksync"
+	"github.com/zhongzc/ng_monitoring/component/topsql/detector"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Response formats selected by `format`.
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// respondData responds data as JSON, or as CSV if `format=csv`.
+func respondData(c *gin.Context, data interface{}) {
+	respond(c, data, gin.H{
+		"status": "ok",
+		"data":   data,
+	})
+}
+
+// respondPage is like respondData, but also responds the total number of
+// items. For CSV, the total is put into the `X-Total-Count` header.
+func respondPage(c *gin.Context, data interface{}, total int) {
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	respond(c, data, gin.H{
+		"status": "ok",
+		"data":   data,
+		"total":  total,
+	})
+}
+
+// respondTimeline is like respondPage, but also responds periods within
+// [startSecs, endSecs] in which the host clock is not reliable, and
+// annotations to overlay. For CSV, the number of them is put into the
+// `X-Clock-Issues` and `X-Annotations` headers. Timelines are filled by
+// params.fill.
+func respondTimeline(c *gin.Context, data interface{}, total int, params topSQLParams) {
+	startSecs, endSecs := params.startSecs, params.endSecs
+	if params.fill != query.FillNone {
+		fillTimelines(data, query.WindowTimestamps(startSecs, endSecs, params.windowSecs), params.fill)
+	}
+
+	// overlays are best effort
+	issues := make([]clocksync.Issue, 0)
+	if err := clocksync.Issues(startSecs, endSecs, &issues); err != nil {
+		log.Warn("failed to query clock issues", zap.Error(err))
+	}
+	annotations := make([]annotation.Annotation, 0)
+	if err := annotation.Annotations(startSecs, endSecs, &annotations); err != nil {
+		log.Warn("failed to query annotations", zap.Error(err))
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Header("X-Clock-Issues", strconv.Itoa(len(issues)))
+	c.Header("X-Annotations", strconv.Itoa(len(annotations)))
+	respond(c, data, gin.H{
+		"status":       "ok",
+		"data":         data,
+		"total":        total,
+		"clock_issues": issues,
+		"annotations":  annotations,
+	})
+}
+
+// fillTimelines fills windows without points in timelines of the items.
+func fillTimelines(data interface{}, windowTimestamps []uint64, fill string) {
+	switch items := data.(type) {
+	case *[]query.TopSQLItem:
+		fillTimelines(*items, windowTimestamps, fill)
+	case []query.TopSQLItem:
+		for _, item := range items {
+			for i := range item.Plans {
+				plan := &item.Plans[i]
+				plan.TimestampSecs, plan.CPUTimeMillis = query.FillTimeline(plan.TimestampSecs, plan.CPUTimeMillis, windowTimestamps, fill)
+			}
+		}
+	case []query.TopKeysItem:
+		for _, item := range items {
+			for i := range item.Plans {
+				plan := &item.Plans[i]
+				plan.TimestampSecs, plan.Keys = query.FillTimeline(plan.TimestampSecs, plan.Keys, windowTimestamps, fill)
+			}
+		}
+	case []query.TopPlanItem:
+		for i := range items {
+			item := &items[i]
+			item.TimestampSecs, item.CPUTimeMillis = query.FillTimeline(item.TimestampSecs, item.CPUTimeMillis, windowTimestamps, fill)
+		}
+	case []query.SQLInstanceItem:
+		for i := range items {
+			item := &items[i]
+			item.TimestampSecs, item.CPUTimeMillis = query.FillTimeline(item.TimestampSecs, item.CPUTimeMillis, windowTimestamps, fill)
+		}
+	}
+}
+
+// formatValue formats a value of a timeline, in which query.Missing is empty.
+func formatValue(value uint64) string {
+	if value == query.Missing {
+		return ""
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+func respond(c *gin.Context, data interface{}, obj gin.H) {
+	switch format := c.DefaultQuery("format", formatJSON); format {
+	case formatJSON, "":
+		c.JSON(http.StatusOK, obj)
+	case formatCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		writeCSV(w, data)
+		w.Flush()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("unknown format: %s", format),
+		})
+	}
+}
+
+// writeCSV writes a header row and then one row per item. Timelines of
+// top SQLs are flattened into one row per point.
+func writeCSV(w *csv.Writer, data interface{}) {
+	switch items := data.(type) {
+	case *[]query.TopSQLItem:
+		writeCSV(w, *items)
+	case []query.TopSQLItem:
+		_ = w.Write([]string{"sql_digest", "sql_text", "plan_digest", "plan_text", "timestamp_secs", "cpu_time_millis", "is_other"})
+		for _, item := range items {
+			for _, plan := range item.Plans {
+				for i := range plan.TimestampSecs {
+					_ = w.Write([]string{
+						item.SQLDigest, item.SQLText, plan.PlanDigest, plan.PlanText,
+						strconv.FormatUint(plan.TimestampSecs[i], 10),
+						formatValue(plan.CPUTimeMillis[i]),
+						strconv.FormatBool(item.IsOther),
+					})
+				}
+			}
+		}
+	case []query.TopKeysItem:
+		_ = w.Write([]string{"sql_digest", "sql_text", "plan_digest", "plan_text", "timestamp_secs", "keys", "is_other"})
+		for _, item := range items {
+			for _, plan := range item.Plans {
+				for i := range plan.TimestampSecs {
+					_ = w.Write([]string{
+						item.SQLDigest, item.SQLText, plan.PlanDigest, plan.PlanText,
+						strconv.FormatUint(plan.TimestampSecs[i], 10),
+						formatValue(plan.Keys[i]),
+						strconv.FormatBool(item.IsOther),
+					})
+				}
+			}
+		}
+	case []query.TopPlanItem:
+		_ = w.Write([]string{"plan_digest", "plan_text", "sql_digests", "timestamp_secs", "cpu_time_millis", "is_other"})
+		for _, item := range items {
+			sqlDigests := strings.Join(item.SQLDigests, ";")
+			for i := range item.TimestampSecs {
+				_ = w.Write([]string{
+					item.PlanDigest, item.PlanText, sqlDigests,
+					strconv.FormatUint(item.TimestampSecs[i], 10),
+					formatValue(item.CPUTimeMillis[i]),
+					strconv.FormatBool(item.IsOther),
+				})
+			}
+		}
+	case []query.SQLInstanceItem:
+		_ = w.Write([]string{"instance", "instance_type", "plan_digests", "timestamp_secs", "cpu_time_millis"})
+		for _, item := range items {
+			planDigests := strings.Join(item.PlanDigests, ";")
+			for i := range item.TimestampSecs {
+				_ = w.Write([]string{
+					item.Instance, item.InstanceType, planDigests,
+					strconv.FormatUint(item.TimestampSecs[i], 10),
+					formatValue(item.CPUTimeMillis[i]),
+				})
+			}
+		}
+	case []query.InstanceItem:
+		_ = w.Write([]string{"instance", "instance_type", "decommission_cutoff_secs"})
+		for _, item := range items {
+			_ = w.Write([]string{item.Instance, item.InstanceType, decommissionCutoff(item.Decommission)})
+		}
+	case []query.InstanceSummaryItem:
+		_ = w.Write([]string{"instance", "instance_type", "cpu_time_millis", "sql_digests", "last_timestamp_secs", "decommission_cutoff_secs"})
+		for _, item := range items {
+			_ = w.Write([]string{
+				item.Instance, item.InstanceType, strconv.FormatUint(item.CPUTimeMillis, 10),
+				strconv.Itoa(item.SQLDigests), strconv.FormatInt(item.LastTimestampSecs, 10),
+				decommissionCutoff(item.Decommission),
+			})
+		}
+	case []query.SQLTextItem:
+		_ = w.Write([]string{"sql_digest", "sql_text", "is_internal"})
+		for _, item := range items {
+			_ = w.Write([]string{item.SQLDigest, item.SQLText, strconv.FormatBool(item.IsInternal)})
+		}
+	case []query.PlanTextItem:
+		_ = w.Write([]string{"plan_digest", "plan_text"})
+		for _, item := range items {
+			_ = w.Write([]string{item.PlanDigest, item.PlanText})
+		}
+	case []query.SQLTextVersion:
+		_ = w.Write([]string{"ts", "sql_text"})
+		for _, item := range items {
+			_ = w.Write([]string{strconv.FormatInt(item.Ts, 10), item.SQLText})
+		}
+	case []query.DigestDiffItem:
+		_ = w.Write([]string{"sql_digest", "sql_text", "change", "base_cpu_time_millis", "target_cpu_time_millis", "delta_cpu_time_millis"})
+		for _, item := range items {
+			_ = w.Write([]string{
+				item.SQLDigest, item.SQLText, item.Change,
+				strconv.FormatUint(item.BaseCPUTimeMillis, 10), strconv.FormatUint(item.TargetCPUTimeMillis, 10),
+				strconv.FormatInt(item.DeltaCPUTimeMillis, 10),
+			})
+		}
+	case []annotation.Annotation:
+		_ = w.Write([]string{"id", "name", "start_secs", "end_secs", "source", "deleted_secs"})
+		for _, a := range items {
+			_ = w.Write([]string{
+				a.ID, a.Name, strconv.FormatInt(a.StartSecs, 10), strconv.FormatInt(a.EndSecs, 10), a.Source,
+				strconv.FormatInt(a.DeletedSecs, 10),
+			})
+		}
+	case []detector.PlanRegressionEvent:
+		_ = w.Write([]string{"ts", "sql_digest", "old_plan_digest", "new_plan_digest", "old_cpu_time_millis", "new_cpu_time_millis", "old_cpu_time_millis_per_sample", "new_cpu_time_millis_per_sample"})
+		for _, e := range items {
+			_ = w.Write([]string{
+				strconv.FormatInt(e.Ts, 10), e.SQLDigest, e.OldPlanDigest, e.NewPlanDigest,
+				strconv.FormatUint(e.OldCPUTimeMillis, 10), strconv.FormatUint(e.NewCPUTimeMillis, 10),
+				strconv.FormatFloat(e.OldCPUTimeMillisPerSample, 'f', -1, 64), strconv.FormatFloat(e.NewCPUTimeMillisPerSample, 'f', -1, 64),
+			})
+		}
+	}
+}
+
+// decommissionCutoff is empty for instances not being decommissioned.
+func decommissionCutoff(dc *store.Decommission) string {
+	if dc == nil {
+		return ""
+	}
+	return strconv.FormatInt(dc.CutoffSecs, 10)
+}
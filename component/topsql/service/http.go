@@ -1,12 +1,24 @@
 package service
 
 import (
+	"fmt"
+	"github.com/zhongzc/ng_monitoring/component/topsql/annotation"
+	"github.com/zhongzc/ng_monitoring/component/topsql/detector"
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
 	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/component/topsql/retention"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/config"
+	"io"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
 )
 
 var (
@@ -15,8 +27,39 @@ var (
 )
 
 func HTTPService(g *gin.RouterGroup) {
-	g.GET("/v1/cpu_time", cpuTime)
+	g.GET("/v1/cpu_time", cached(cpuTime))
+	g.GET("/v1/global_cpu_time", cached(globalCPUTime))
+	g.GET("/v1/top_read_keys", cached(topReadKeys))
+	g.GET("/v1/top_write_keys", cached(topWriteKeys))
+	g.GET("/v1/top_plans", cached(topPlans))
 	g.GET("/v1/instances", instances)
+	g.GET("/v1/instance_summaries", cached(instanceSummaries))
+	g.GET("/v1/sql_texts", sqlTexts)
+	g.GET("/v1/plan_texts", planTexts)
+	g.GET("/v1/sql_plans", cached(sqlPlans))
+	g.GET("/v1/sql_instances", cached(sqlInstances))
+	g.GET("/v1/live", live)
+	g.GET("/v1/sql_text_history", sqlTextHistory)
+	g.GET("/v1/export/parquet", exportParquet)
+	g.GET("/v1/plan_regressions", planRegressions)
+	g.GET("/v1/digest_diff", cached(digestDiff))
+	g.GET("/v1/instance_correlation", cached(instanceCorrelation))
+	g.GET("/v1/masking_rules", maskingRules)
+	g.POST("/v1/masking_rules", saveMaskingRule)
+	g.DELETE("/v1/masking_rules/:name", deleteMaskingRule)
+	g.GET("/v1/annotations", annotations)
+	g.POST("/v1/annotations", saveAnnotation)
+	g.DELETE("/v1/annotations/:id", deleteAnnotation)
+	g.GET("/v1/annotations/deleted", deletedAnnotations)
+	g.POST("/v1/annotations/:id/undelete", undeleteAnnotation)
+	g.GET("/v1/decommissions", decommissions)
+	g.POST("/v1/decommissions", markDecommission)
+	g.DELETE("/v1/decommissions/:instance", unmarkDecommission)
+	g.GET("/v1/paused_instances", pausedInstances)
+	g.GET("/v1/freshness", freshness)
+	g.GET("/v1/purge_progress", purgeProgress)
+	g.POST("/v1/paused_instances", pauseInstance)
+	g.DELETE("/v1/paused_instances/:instance", resumeInstance)
 }
 
 func cpuTime(c *gin.Context) {
@@ -29,25 +72,19 @@ func cpuTime(c *gin.Context) {
 		return
 	}
 
-	var err error
-	now := time.Now().Unix()
-
-	var startSecs float64
-	var endSecs float64
-	var top int64
-	var windowSecs int64
+	queryTopSQL(c, instance)
+}
 
-	const weekSecs = 7 * 24 * 60 * 60
-	defaultStart := strconv.Itoa(int(now - 2*weekSecs))
-	defaultEnd := strconv.Itoa(int(now))
-	defaultTop := "-1"
-	defaultWindow := "1m"
+// globalCPUTime returns top SQLs by cpu time aggregated across all instances.
+func globalCPUTime(c *gin.Context) {
+	queryTopSQL(c, "")
+}
 
-	raw := c.DefaultQuery("start", defaultStart)
-	if len(raw) == 0 {
-		raw = defaultStart
-	}
-	startSecs, err = strconv.ParseFloat(raw, 64)
+// queryTopSQL responds top SQLs by cpu time. SQLs can be filtered by their
+// normalized texts, e.g. `?text_contains=delete from orders` or
+// `?text_regex=^select .* for update$`.
+func queryTopSQL(c *gin.Context, instance string) {
+	params, err := parseTopSQLParams(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -56,11 +93,35 @@ func cpuTime(c *gin.Context) {
 		return
 	}
 
-	raw = c.DefaultQuery("end", strconv.Itoa(int(now)))
-	if len(raw) == 0 {
-		raw = defaultEnd
+	items := topSQLItemsP.Get()
+	defer topSQLItemsP.Put(items)
+
+	total, err := query.TopSQL(params.startSecs, params.endSecs, params.windowSecs, params.top, instance, params.aggregation, params.text, params.page, items)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
 	}
-	endSecs, err = strconv.ParseFloat(raw, 64)
+
+	respondTimeline(c, items, total, params)
+}
+
+// topReadKeys returns top SQLs by keys read, e.g. `?instance=127.0.0.1:20160`
+// for a TiKV instance. Without an instance, keys are aggregated across all
+// instances.
+func topReadKeys(c *gin.Context) {
+	queryTopKeys(c, store.MetricReadKeys)
+}
+
+// topWriteKeys is like topReadKeys, but by keys written.
+func topWriteKeys(c *gin.Context) {
+	queryTopKeys(c, store.MetricWriteKeys)
+}
+
+func queryTopKeys(c *gin.Context, metric string) {
+	params, err := parseTopSQLParams(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -69,11 +130,24 @@ func cpuTime(c *gin.Context) {
 		return
 	}
 
-	raw = c.DefaultQuery("top", "-1")
-	if len(raw) == 0 {
-		raw = defaultTop
+	items := make([]query.TopKeysItem, 0)
+	total, err := query.TopKeys(metric, params.startSecs, params.endSecs, params.windowSecs, params.top, c.Query("instance"), params.aggregation, params.text, params.page, &items)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
 	}
-	top, err = strconv.ParseInt(raw, 10, 64)
+
+	respondTimeline(c, items, total, params)
+}
+
+// topPlans returns top plans by cpu time summed up across the SQLs sharing
+// them. Without an instance, cpu time is aggregated across all instances.
+// The aggregation is always sum.
+func topPlans(c *gin.Context) {
+	params, err := parseTopSQLParams(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -82,11 +156,40 @@ func cpuTime(c *gin.Context) {
 		return
 	}
 
-	raw = c.DefaultQuery("window", "1m")
-	if len(raw) == 0 {
-		raw = defaultWindow
+	items := make([]query.TopPlanItem, 0)
+	total, err := query.TopPlans(params.startSecs, params.endSecs, params.windowSecs, params.top, c.Query("instance"), params.text, params.page, &items)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respondTimeline(c, items, total, params)
+}
+
+// sqlPlans returns the cpu time of a sql digest broken down by plan digest,
+// e.g. `?sql_digest=digest1&instance=127.0.0.1:10080`. Without an instance,
+// the cpu time is aggregated across all instances.
+func sqlPlans(c *gin.Context) {
+	sqlDigest := c.Query("sql_digest")
+	if len(sqlDigest) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no sql_digest",
+		})
+		return
+	}
+	if !query.IsValidDigest(sqlDigest) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("invalid sql_digest: %s", sqlDigest),
+		})
+		return
 	}
-	duration, err := time.ParseDuration(raw)
+
+	params, err := parseTopSQLParams(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
@@ -94,12 +197,11 @@ func cpuTime(c *gin.Context) {
 		})
 		return
 	}
-	windowSecs = int64(duration.Seconds())
 
 	items := topSQLItemsP.Get()
 	defer topSQLItemsP.Put(items)
 
-	err = query.TopSQL(int(startSecs), int(endSecs), int(windowSecs), int(top), instance, items)
+	err = query.SQLPlans(params.startSecs, params.endSecs, params.windowSecs, c.Query("instance"), sqlDigest, params.aggregation, items)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"status":  "error",
@@ -108,17 +210,311 @@ func cpuTime(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"data":   items,
+	recordDigestQuery(sqlDigest)
+	start, end := params.page.Bounds(len(*items))
+	respondTimeline(c, (*items)[start:end], len(*items), params)
+}
+
+// sqlInstances returns the cpu time of a sql digest on every instance along
+// with its plan digests, e.g. `?sql_digest=digest1`.
+func sqlInstances(c *gin.Context) {
+	sqlDigest := c.Query("sql_digest")
+	if len(sqlDigest) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no sql_digest",
+		})
+		return
+	}
+	if !query.IsValidDigest(sqlDigest) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("invalid sql_digest: %s", sqlDigest),
+		})
+		return
+	}
+
+	params, err := parseTopSQLParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := make([]query.SQLInstanceItem, 0)
+	err = query.SQLInstances(params.startSecs, params.endSecs, params.windowSecs, sqlDigest, params.aggregation, &items)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	recordDigestQuery(sqlDigest)
+	start, end := params.page.Bounds(len(items))
+	respondTimeline(c, items[start:end], len(items), params)
+}
+
+// liveHeartbeatInterval keeps idle streams from being closed by proxies.
+const liveHeartbeatInterval = 15 * time.Second
+
+// live streams newly written records as server-sent events, e.g.
+// `?instance=127.0.0.1:10080&sql_digest=digest1`. Every record is a `record`
+// event, and records dropped for a slow client are reported by `dropped`
+// events.
+func live(c *gin.Context) {
+	s := store.SubscribeLive(store.LiveFilter{
+		Instance:  c.Query("instance"),
+		SQLDigest: c.Query("sql_digest"),
+	})
+	defer store.UnsubscribeLive(s)
+
+	// respond headers at once, so that clients know the stream is ready
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(liveHeartbeatInterval)
+	defer ticker.Stop()
+
+	var reported uint64
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case record := <-s.Records():
+			c.SSEvent("record", record)
+		case <-ticker.C:
+			c.SSEvent("heartbeat", time.Now().Unix())
+		case <-c.Request.Context().Done():
+			return false
+		}
+
+		if dropped := s.Dropped.Load(); dropped != reported {
+			c.SSEvent("dropped", dropped-reported)
+			reported = dropped
+		}
+		return true
 	})
 }
 
+// recordDigestQuery counts queries on a single digest, which keeps the digest
+// longer if hot retention is enabled.
+func recordDigestQuery(sqlDigest string) {
+	if err := query.RecordDigestQuery(sqlDigest); err != nil {
+		log.Warn("failed to record digest query", zap.String("digest", sqlDigest), zap.Error(err))
+	}
+}
+
+type topSQLParams struct {
+	startSecs   int
+	endSecs     int
+	windowSecs  int
+	top         int
+	aggregation string
+	// text only applies to top SQLs, keys and plans.
+	text query.TextFilter
+	// fill is how windows without points are filled in timelines.
+	fill string
+	page query.Page
+}
+
+func parseTopSQLParams(c *gin.Context) (topSQLParams, error) {
+	var params topSQLParams
+	now := time.Now().Unix()
+
+	const weekSecs = 7 * 24 * 60 * 60
+	defaultStart := strconv.Itoa(int(now - 2*weekSecs))
+	defaultEnd := strconv.Itoa(int(now))
+	cfg := config.GetGlobalConfig().TopSQL
+	defaultTop := strconv.Itoa(cfg.DefaultTop)
+	defaultAggregation := cfg.DefaultAggregation
+
+	raw := c.DefaultQuery("start", defaultStart)
+	if len(raw) == 0 {
+		raw = defaultStart
+	}
+	startSecs, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return params, err
+	}
+
+	raw = c.DefaultQuery("end", defaultEnd)
+	if len(raw) == 0 {
+		raw = defaultEnd
+	}
+	endSecs, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return params, err
+	}
+
+	raw = c.DefaultQuery("top", defaultTop)
+	if len(raw) == 0 {
+		raw = defaultTop
+	}
+	top, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return params, err
+	}
+
+	// Without a window, timelines are downsampled according to the time range.
+	windowSecs := query.DownsampleWindowSecs(int(startSecs), int(endSecs))
+	if raw = c.Query("window"); len(raw) != 0 {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return params, err
+		}
+		if duration < time.Second {
+			return params, fmt.Errorf("window should be at least 1s: %s", raw)
+		}
+		windowSecs = int(duration.Seconds())
+	}
+
+	aggregation := c.DefaultQuery("aggregation", defaultAggregation)
+	if len(aggregation) == 0 {
+		aggregation = defaultAggregation
+	}
+	if !query.IsValidAggregation(aggregation) {
+		return params, fmt.Errorf("unknown aggregation: %s", aggregation)
+	}
+
+	params.fill = c.Query("fill")
+	if !query.IsValidFill(params.fill) {
+		return params, fmt.Errorf("unknown fill: %s", params.fill)
+	}
+
+	params.text.Contains = c.Query("text_contains")
+	if raw = c.Query("text_regex"); len(raw) != 0 {
+		if params.text.Regex, err = regexp.Compile(raw); err != nil {
+			return params, err
+		}
+	}
+
+	params.startSecs = int(startSecs)
+	params.endSecs = int(endSecs)
+	params.windowSecs = windowSecs
+	params.top = int(top)
+	params.aggregation = aggregation
+	params.page, err = parsePage(c)
+	return params, err
+}
+
+// maxPageLimit is the maximum number of items returned by a single query,
+// to keep responses of large time ranges over many instances reasonable.
+const maxPageLimit = 1000
+
+// parsePage parses `offset` and `limit`. A missing or too large limit is
+// capped to maxPageLimit.
+func parsePage(c *gin.Context) (query.Page, error) {
+	page := query.Page{Limit: maxPageLimit}
+
+	if raw := c.Query("offset"); len(raw) != 0 {
+		offset, err := strconv.Atoi(raw)
+		if err != nil {
+			return page, err
+		}
+		if offset < 0 {
+			return page, fmt.Errorf("negative offset: %d", offset)
+		}
+		page.Offset = offset
+	}
+
+	if raw := c.Query("limit"); len(raw) != 0 {
+		limit, err := strconv.Atoi(raw)
+		if err != nil {
+			return page, err
+		}
+		if limit <= 0 {
+			return page, fmt.Errorf("non-positive limit: %d", limit)
+		}
+		if limit < maxPageLimit {
+			page.Limit = limit
+		}
+	}
+
+	return page, nil
+}
+
 func instances(c *gin.Context) {
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
 	instances := instanceItemsP.Get()
 	defer instanceItemsP.Put(instances)
 
-	if err := query.AllInstances(instances); err != nil {
+	// Without a time range, return all instances ever seen.
+	rawStart, rawEnd := c.Query("start"), c.Query("end")
+	if len(rawStart) == 0 && len(rawEnd) == 0 {
+		if err := query.AllInstances(instances); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+		start, end := page.Bounds(len(*instances))
+		respondPage(c, (*instances)[start:end], len(*instances))
+		return
+	}
+
+	now := time.Now().Unix()
+	if len(rawStart) == 0 {
+		rawStart = "0"
+	}
+	if len(rawEnd) == 0 {
+		rawEnd = strconv.Itoa(int(now))
+	}
+	startSecs, err := strconv.ParseFloat(rawStart, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	endSecs, err := strconv.ParseFloat(rawEnd, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := query.InstancesInRange(int(startSecs), int(endSecs), instances); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	start, end := page.Bounds(len(*instances))
+	respondPage(c, (*instances)[start:end], len(*instances))
+}
+
+// instanceSummaries returns the total cpu time, the number of distinct sql
+// digests and the latest timestamp of every instance within the time range.
+func instanceSummaries(c *gin.Context) {
+	params, err := parseTopSQLParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := make([]query.InstanceSummaryItem, 0)
+	if err := query.InstanceSummaries(params.startSecs, params.endSecs, &items); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"status":  "error",
 			"message": err.Error(),
@@ -126,8 +522,592 @@ func instances(c *gin.Context) {
 		return
 	}
 
+	start, end := params.page.Bounds(len(items))
+	respondPage(c, items[start:end], len(items))
+}
+
+// instanceCorrelation returns top SQLs of the instance along with its timeline
+// of cpu usage and QPS, e.g. `?instance=127.0.0.1:10080&start=...&end=...`,
+// for drilling down into an instance in a single call.
+func instanceCorrelation(c *gin.Context) {
+	instance := c.Query("instance")
+	if len(instance) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no instance",
+		})
+		return
+	}
+	params, err := parseTopSQLParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var item query.InstanceCorrelationItem
+	if err := query.InstanceCorrelation(params.startSecs, params.endSecs, params.windowSecs, params.top, instance, &item); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
-		"data":   instances,
+		"data":   item,
 	})
 }
+
+func planRegressions(c *gin.Context) {
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now().Unix()
+
+	startSecs, err := strconv.ParseInt(c.DefaultQuery("start", strconv.Itoa(int(now-24*60*60))), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	endSecs, err := strconv.ParseInt(c.DefaultQuery("end", strconv.Itoa(int(now))), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	events := make([]detector.PlanRegressionEvent, 0)
+	if err := detector.PlanRegressions(int(startSecs), int(endSecs), &events); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	start, end := page.Bounds(len(events))
+	respondPage(c, events[start:end], len(events))
+}
+
+// digestDiff returns sql digests whose cpu time changed the most from the
+// base range to the target range, e.g. `?base_start=1636000000&base_end=1636086400&target_start=1636086400&target_end=1636172800`.
+// The target range defaults to the last day and the base range to the day
+// before the target range. The result can be narrowed by `instance` and by
+// `change`, one of new, vanished, regressed and improved.
+func digestDiff(c *gin.Context) {
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	const daySecs = 24 * 60 * 60
+	now := int(time.Now().Unix())
+	var targetStart, targetEnd, baseStart, baseEnd int
+	for _, p := range []struct {
+		name   string
+		target *int
+		def    func() int
+	}{
+		{"target_end", &targetEnd, func() int { return now }},
+		{"target_start", &targetStart, func() int { return targetEnd - daySecs }},
+		{"base_end", &baseEnd, func() int { return targetStart }},
+		{"base_start", &baseStart, func() int { return baseEnd - (targetEnd - targetStart) }},
+	} {
+		*p.target = p.def()
+		if raw := c.Query(p.name); len(raw) != 0 {
+			if *p.target, err = strconv.Atoi(raw); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  "error",
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+	}
+	if baseStart >= baseEnd || targetStart >= targetEnd {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "empty time range",
+		})
+		return
+	}
+
+	change := c.Query("change")
+	switch change {
+	case "", query.DiffNew, query.DiffVanished, query.DiffRegressed, query.DiffImproved:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("unknown change: %s", change),
+		})
+		return
+	}
+
+	items := make([]query.DigestDiffItem, 0)
+	if err = query.DigestDiffs(baseStart, baseEnd, targetStart, targetEnd, c.Query("instance"), &items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(change) != 0 {
+		kept := items[:0]
+		for _, item := range items {
+			if item.Change == change {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+
+	start, end := page.Bounds(len(items))
+	paged := items[start:end]
+	if err = fillDiffTexts(paged); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	respondPage(c, paged, len(items))
+}
+
+// fillDiffTexts resolves sql texts of the responded items only.
+func fillDiffTexts(items []query.DigestDiffItem) error {
+	digests := make([]string, 0, len(items))
+	for _, item := range items {
+		digests = append(digests, item.SQLDigest)
+	}
+	texts := make([]query.SQLTextItem, 0, len(digests))
+	if err := query.SQLTexts(digests, &texts); err != nil {
+		return err
+	}
+
+	byDigest := make(map[string]string, len(texts))
+	for _, t := range texts {
+		byDigest[t.SQLDigest] = t.SQLText
+	}
+	for i := range items {
+		items[i].SQLText = byDigest[items[i].SQLDigest]
+	}
+	return nil
+}
+
+func maskingRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   masking.Rules(),
+	})
+}
+
+func saveMaskingRule(c *gin.Context) {
+	var rule masking.Rule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(rule.ApplyOn) == 0 {
+		rule.ApplyOn = masking.ApplyOnBoth
+	}
+
+	if err := masking.SaveRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func deleteMaskingRule(c *gin.Context) {
+	if err := masking.DeleteRule(c.Param("name")); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// annotations returns annotations overlapping the time range, e.g.
+// `?start=1636000000&end=1636600000`.
+func annotations(c *gin.Context) {
+	params, err := parseTopSQLParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := make([]annotation.Annotation, 0)
+	if err = annotation.Annotations(params.startSecs, params.endSecs, &items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	start, end := params.page.Bounds(len(items))
+	respondPage(c, items[start:end], len(items))
+}
+
+// saveAnnotation writes an annotation and responds it with its id, e.g.
+// `{"name": "release 6.1 deployed", "start_secs": 1636000000, "source": "ci"}`.
+// Without a start, the annotation marks now.
+func saveAnnotation(c *gin.Context) {
+	var a annotation.Annotation
+	if err := c.ShouldBindJSON(&a); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if a.StartSecs == 0 {
+		a.StartSecs = time.Now().Unix()
+	}
+
+	a, err := annotation.Save(a)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   a,
+	})
+}
+
+// deleteAnnotation deletes an annotation, which can be undeleted within
+// annotation.UndeleteWindow.
+func deleteAnnotation(c *gin.Context) {
+	if err := annotation.Delete(c.Param("id")); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// deletedAnnotations returns annotations which can be undeleted.
+func deletedAnnotations(c *gin.Context) {
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := make([]annotation.Annotation, 0)
+	if err = annotation.DeletedAnnotations(&items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	start, end := page.Bounds(len(items))
+	respondPage(c, items[start:end], len(items))
+}
+
+func undeleteAnnotation(c *gin.Context) {
+	if err := annotation.Undelete(c.Param("id")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func decommissions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   store.Decommissions(),
+	})
+}
+
+// markDecommission marks an instance as decommissioning, e.g.
+// `{"instance": "127.0.0.1:10080", "cutoff_secs": 1636000000, "retention_days": 3}`.
+// Without a cutoff, data stops being collected from now on.
+func markDecommission(c *gin.Context) {
+	var dc store.Decommission
+	if err := c.ShouldBindJSON(&dc); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if dc.CutoffSecs == 0 {
+		dc.CutoffSecs = time.Now().Unix()
+	}
+
+	if err := store.MarkDecommission(dc); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func unmarkDecommission(c *gin.Context) {
+	if err := store.UnmarkDecommission(c.Param("instance")); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respCache.purge()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// freshness returns the delay from the end of reported windows to their data
+// being queryable per instance, along with the SLO it's measured against.
+func freshness(c *gin.Context) {
+	slo := config.GetGlobalConfig().TopSQL.FreshnessSLOSeconds
+	if slo <= 0 {
+		slo = config.DefTopSQLFreshnessSLOSeconds
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "ok",
+		"data":        store.InstanceFreshness(),
+		"slo_seconds": slo,
+	})
+}
+
+// purgeProgress responds the checkpoint of the latest purge, whose stage is
+// empty once it finishes, or null if there has been no purge.
+func purgeProgress(c *gin.Context) {
+	cp, ok, err := retention.LatestCheckpoint()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	var data interface{}
+	if ok {
+		data = cp
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   data,
+	})
+}
+
+func pausedInstances(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   store.PausedInstances(),
+	})
+}
+
+// pauseInstance stops collecting data of an instance until it's resumed, e.g.
+// `{"instance": "127.0.0.1:10080"}`. The pause survives restarts.
+func pauseInstance(c *gin.Context) {
+	var p store.PausedInstance
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := store.PauseInstance(p.Instance); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func resumeInstance(c *gin.Context) {
+	if err := store.ResumeInstance(c.Param("instance")); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// sqlTexts resolves sql digests, e.g. `?digests=digest1,digest2`
+func sqlTexts(c *gin.Context) {
+	digests := parseDigests(c)
+	if len(digests) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no digests",
+		})
+		return
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	start, end := page.Bounds(len(digests))
+	digests = digests[start:end]
+
+	items := make([]query.SQLTextItem, 0, len(digests))
+	if err := query.SQLTexts(digests, &items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respondData(c, items)
+}
+
+// planTexts resolves plan digests, e.g. `?digests=digest1,digest2`
+func planTexts(c *gin.Context) {
+	digests := parseDigests(c)
+	if len(digests) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no digests",
+		})
+		return
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	start, end := page.Bounds(len(digests))
+	digests = digests[start:end]
+
+	items := make([]query.PlanTextItem, 0, len(digests))
+	if err := query.PlanTexts(digests, &items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respondData(c, items)
+}
+
+// sqlTextHistory returns every version of the sql text of a digest and how it
+// changed, e.g. `?digest=digest1`
+func sqlTextHistory(c *gin.Context) {
+	digest := c.Query("digest")
+	if len(digest) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no digest",
+		})
+		return
+	}
+
+	versions := make([]query.SQLTextVersion, 0)
+	if err := query.SQLTextHistory(digest, &versions); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	recordDigestQuery(digest)
+	respondData(c, versions)
+}
+
+func parseDigests(c *gin.Context) []string {
+	var digests []string
+	for _, raw := range c.QueryArray("digests") {
+		for _, digest := range strings.Split(raw, ",") {
+			if digest = strings.TrimSpace(digest); len(digest) != 0 {
+				digests = append(digests, digest)
+			}
+		}
+	}
+	return digests
+}
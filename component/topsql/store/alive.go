@@ -0,0 +1,32 @@
+package store
+
+import (
+	"go.uber.org/atomic"
+)
+
+var aliveInstances atomic.Value // map[string]struct{}
+
+// SetAliveInstances replaces the instances in the latest topology.
+func SetAliveInstances(instances []string) {
+	alive := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		alive[instance] = struct{}{}
+	}
+	aliveInstances.Store(alive)
+}
+
+// IsAlive returns whether the instance is in the latest topology. Instances
+// are not alive until the topology is known.
+func IsAlive(instance string) bool {
+	alive, _ := aliveInstances.Load().(map[string]struct{})
+	_, ok := alive[instance]
+	return ok
+}
+
+// ForgetInstance drops the in-memory states of an instance removed from the
+// topology. Its stored data is kept until it expires.
+func ForgetInstance(instance string) {
+	forgetFreshness(instance)
+	forgetIngestLimiter(instance)
+	forgetIngestionMetrics(instance)
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/zhongzc/ng_monitoring/database/table"
+
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Decommission marks an instance being removed by operators. Its points after
+// the cutoff are dropped, and all of its data is purged once its retention
+// after the cutoff ends.
+type Decommission struct {
+	Instance   string `json:"instance"`
+	CutoffSecs int64  `json:"cutoff_secs"`
+	// RetentionDays is the number of days its data is kept after the cutoff,
+	// 0 to follow the global retention. It can't extend the global retention.
+	RetentionDays int `json:"retention_days"`
+}
+
+var decommissionTable = table.New("decommission", []string{"instance", "cutoff_ts", "retention_days"}, func(dc *Decommission) []interface{} {
+	return []interface{}{&dc.Instance, &dc.CutoffSecs, &dc.RetentionDays}
+})
+
+var (
+	decommissionMu sync.Mutex
+	decommissions  atomic.Value // map[string]Decommission
+)
+
+func loadDecommissions() error {
+	loaded := make(map[string]Decommission)
+	err := decommissionTable.Iterate(documentDB, func(dc Decommission) error {
+		loaded[dc.Instance] = dc
+		return nil
+	}, "")
+	if err != nil {
+		return err
+	}
+
+	decommissions.Store(loaded)
+	return nil
+}
+
+func currentDecommissions() map[string]Decommission {
+	dcs, _ := decommissions.Load().(map[string]Decommission)
+	return dcs
+}
+
+// DecommissionOf returns the decommission of the instance, if it's marked.
+func DecommissionOf(instance string) (Decommission, bool) {
+	dc, ok := currentDecommissions()[instance]
+	return dc, ok
+}
+
+// Decommissions returns all marked instances ordered by instance.
+func Decommissions() []Decommission {
+	dcs := currentDecommissions()
+	res := make([]Decommission, 0, len(dcs))
+	for _, dc := range dcs {
+		res = append(res, dc)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res
+}
+
+// MarkDecommission marks the instance or replaces its existing mark.
+func MarkDecommission(dc Decommission) error {
+	if len(dc.Instance) == 0 {
+		return fmt.Errorf("empty instance")
+	}
+	if dc.CutoffSecs <= 0 {
+		return fmt.Errorf("non-positive cutoff: %d", dc.CutoffSecs)
+	}
+	if dc.RetentionDays < 0 {
+		return fmt.Errorf("negative retention days: %d", dc.RetentionDays)
+	}
+
+	decommissionMu.Lock()
+	defer decommissionMu.Unlock()
+
+	if err := decommissionTable.Upsert(documentDB, dc); err != nil {
+		return err
+	}
+
+	old := currentDecommissions()
+	updated := make(map[string]Decommission, len(old)+1)
+	for instance, o := range old {
+		updated[instance] = o
+	}
+	updated[dc.Instance] = dc
+	decommissions.Store(updated)
+	log.Info("mark instance decommissioning",
+		zap.String("instance", dc.Instance),
+		zap.Int64("cutoff", dc.CutoffSecs),
+		zap.Int("retention-days", dc.RetentionDays))
+	return nil
+}
+
+// UnmarkDecommission resumes collecting data of the instance.
+func UnmarkDecommission(instance string) error {
+	decommissionMu.Lock()
+	defer decommissionMu.Unlock()
+
+	if err := documentDB.Exec("DELETE FROM decommission WHERE instance = ?", instance); err != nil {
+		return err
+	}
+
+	old := currentDecommissions()
+	updated := make(map[string]Decommission, len(old))
+	for i, o := range old {
+		if i != instance {
+			updated[i] = o
+		}
+	}
+	decommissions.Store(updated)
+	log.Info("unmark instance decommissioning", zap.String("instance", instance))
+	return nil
+}
+
+// dropDecommissioned drops points of the metric after the cutoff of its
+// instance.
+func dropDecommissioned(m *Metric) {
+	dc, ok := DecommissionOf(m.Metric.Instance)
+	if !ok {
+		return
+	}
+
+	cutoffMillis := uint64(dc.CutoffSecs) * 1000
+	kept := 0
+	for i := range m.Timestamps {
+		if m.Timestamps[i] <= cutoffMillis {
+			m.Timestamps[kept] = m.Timestamps[i]
+			m.Values[kept] = m.Values[i]
+			kept++
+		}
+	}
+	m.Timestamps = m.Timestamps[:kept]
+	m.Values = m.Values[:kept]
+}
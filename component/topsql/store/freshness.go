@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Freshness is the delay from the end of a reported window to the moment its
+// data is written into the timeseries database, after which it's queryable
+// within the flush interval of the timeseries database, i.e. a second.
+type Freshness struct {
+	Instance string `json:"instance"`
+	// Records is the number of records written since startup.
+	Records uint64 `json:"records"`
+	// WithinSLO is the number of records written within the freshness SLO.
+	WithinSLO       uint64 `json:"within_slo"`
+	LastDelayMillis int64  `json:"last_delay_millis"`
+	// Delays below are of the latest freshnessSamples records.
+	P50DelayMillis int64 `json:"p50_delay_millis"`
+	P99DelayMillis int64 `json:"p99_delay_millis"`
+	MaxDelayMillis int64 `json:"max_delay_millis"`
+}
+
+// freshnessSamples is the number of latest delays kept per instance.
+const freshnessSamples = 256
+
+type freshnessTracker struct {
+	records   uint64
+	withinSLO uint64
+	// delays is a ring of the latest delays in milliseconds
+	delays    []int64
+	next      int
+	histogram *metrics.Histogram
+}
+
+func freshnessHistogram(instance string) string {
+	return fmt.Sprintf(`ng_monitoring_topsql_freshness_seconds{instance=%q}`, instance)
+}
+
+var (
+	freshnessMu sync.Mutex
+	freshness   = make(map[string]*freshnessTracker)
+)
+
+// observeFreshness records the delay of the written metric, whose window ends
+// one second after its last timestamp.
+func observeFreshness(instance string, timestampsMillis []uint64, now time.Time) {
+	if len(timestampsMillis) == 0 {
+		return
+	}
+	var lastMillis uint64
+	for _, ts := range timestampsMillis {
+		if ts > lastMillis {
+			lastMillis = ts
+		}
+	}
+	delayMillis := now.UnixNano()/int64(time.Millisecond) - int64(lastMillis) - 1000
+	if delayMillis < 0 {
+		delayMillis = 0
+	}
+
+	freshnessMu.Lock()
+	defer freshnessMu.Unlock()
+
+	t, ok := freshness[instance]
+	if !ok {
+		t = &freshnessTracker{
+			delays:    make([]int64, 0, freshnessSamples),
+			histogram: metrics.GetOrCreateHistogram(freshnessHistogram(instance)),
+		}
+		freshness[instance] = t
+	}
+	t.records++
+	if delayMillis <= freshnessSLOMillis() {
+		t.withinSLO++
+	}
+	if len(t.delays) < freshnessSamples {
+		t.delays = append(t.delays, delayMillis)
+	} else {
+		t.delays[t.next] = delayMillis
+	}
+	t.next = (t.next + 1) % freshnessSamples
+	t.histogram.Update(float64(delayMillis) / 1000)
+}
+
+func freshnessSLOMillis() int64 {
+	return int64(config.GetGlobalConfig().TopSQL.FreshnessSLOSeconds) * 1000
+}
+
+// InstanceFreshness returns the freshness of every instance written since startup,
+// ordered by instance.
+func InstanceFreshness() []Freshness {
+	freshnessMu.Lock()
+	defer freshnessMu.Unlock()
+
+	res := make([]Freshness, 0, len(freshness))
+	for instance, t := range freshness {
+		f := Freshness{
+			Instance:  instance,
+			Records:   t.records,
+			WithinSLO: t.withinSLO,
+		}
+		if len(t.delays) != 0 {
+			last := (t.next + len(t.delays) - 1) % len(t.delays)
+			f.LastDelayMillis = t.delays[last]
+
+			sorted := append([]int64(nil), t.delays...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			f.P50DelayMillis = sorted[len(sorted)*50/100]
+			f.P99DelayMillis = sorted[len(sorted)*99/100]
+			f.MaxDelayMillis = sorted[len(sorted)-1]
+		}
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res
+}
+
+func forgetFreshness(instance string) {
+	freshnessMu.Lock()
+	defer freshnessMu.Unlock()
+
+	if _, ok := freshness[instance]; !ok {
+		return
+	}
+	delete(freshness, instance)
+	metrics.UnregisterMetric(freshnessHistogram(instance))
+}
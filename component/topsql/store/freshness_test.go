@@ -0,0 +1,58 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveFreshness(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{TopSQL: config.TopSQL{FreshnessSLOSeconds: config.DefTopSQLFreshnessSLOSeconds}})
+	now := time.Unix(1636000100, 0)
+	// windows end at 1636000100, i.e. written at once
+	observeFreshness("127.0.0.1:10080", []uint64{1636000098000, 1636000099000}, now)
+	for i := 0; i < freshnessSamples; i++ {
+		observeFreshness("127.0.0.1:10081", []uint64{uint64(1636000099000 - i*1000)}, now)
+	}
+
+	f := InstanceFreshness()
+	require.Len(t, f, 2)
+	require.Equal(t, Freshness{Instance: "127.0.0.1:10080", Records: 1, WithinSLO: 1}, f[0])
+
+	require.Equal(t, uint64(freshnessSamples), f[1].Records)
+	require.Equal(t, uint64(31), f[1].WithinSLO)
+	require.Equal(t, int64(255000), f[1].LastDelayMillis)
+	require.Equal(t, int64(128000), f[1].P50DelayMillis)
+	require.Equal(t, int64(253000), f[1].P99DelayMillis)
+	require.Equal(t, int64(255000), f[1].MaxDelayMillis)
+
+	// the oldest delay is replaced
+	observeFreshness("127.0.0.1:10081", []uint64{1636000099000}, now)
+	f = InstanceFreshness()
+	require.Equal(t, int64(0), f[1].LastDelayMillis)
+	require.Equal(t, int64(255000), f[1].MaxDelayMillis)
+}
+
+func TestForgetInstance(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{TopSQL: config.TopSQL{FreshnessSLOSeconds: config.DefTopSQLFreshnessSLOSeconds}})
+	now := time.Unix(1636000100, 0)
+	observeFreshness("127.0.0.1:20160", []uint64{1636000099000}, now)
+	observeFreshness("127.0.0.1:20161", []uint64{1636000099000}, now)
+
+	SetAliveInstances([]string{"127.0.0.1:20161"})
+	require.False(t, IsAlive("127.0.0.1:20160"))
+	require.True(t, IsAlive("127.0.0.1:20161"))
+
+	ForgetInstance("127.0.0.1:20160")
+	ForgetInstance("127.0.0.1:20162")
+	var instances []string
+	for _, f := range InstanceFreshness() {
+		instances = append(instances, f.Instance)
+	}
+	require.NotContains(t, instances, "127.0.0.1:20160")
+	require.Contains(t, instances, "127.0.0.1:20161")
+	ForgetInstance("127.0.0.1:20161")
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Reasons of dropped records and points.
+const (
+	reasonPaused      = "paused"
+	reasonRateLimited = "rate_limited"
+	reasonShed        = "shed"
+	// reasonDecommissioned drops points after the cutoff of decommissioning.
+	reasonDecommissioned = "decommissioned"
+	// ReasonOutOfOrder drops points behind the tolerance or delivered again.
+	ReasonOutOfOrder = "out_of_order"
+)
+
+// Targets of writes.
+const (
+	targetTimeseries = "timeseries"
+	targetDocument   = "document"
+)
+
+var (
+	ingestionMu sync.Mutex
+	// ingestionMetrics are names of metrics by instances, to be unregistered
+	// once instances are forgotten.
+	ingestionMetrics = make(map[string]map[string]struct{})
+)
+
+// ingestionMetric returns the name of the metric labeled by the instance and
+// extra label pairs, and tracks it.
+func ingestionMetric(name, instance, instanceType string, labels ...string) string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%s{instance=%q,instance_type=%q", name, instance, instanceType)
+	for i := 0; i+1 < len(labels); i += 2 {
+		_, _ = fmt.Fprintf(&b, ",%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	metric := b.String()
+
+	ingestionMu.Lock()
+	defer ingestionMu.Unlock()
+	names, ok := ingestionMetrics[instance]
+	if !ok {
+		names = make(map[string]struct{})
+		ingestionMetrics[instance] = names
+	}
+	names[metric] = struct{}{}
+	return metric
+}
+
+func observeReceived(instance, instanceType string) {
+	metrics.GetOrCreateCounter(ingestionMetric("ng_monitoring_topsql_received_records_total", instance, instanceType)).Inc()
+}
+
+func observeWritten(instance, instanceType string) {
+	metrics.GetOrCreateCounter(ingestionMetric("ng_monitoring_topsql_written_records_total", instance, instanceType)).Inc()
+}
+
+func observeDropped(instance, instanceType, reason string) {
+	metrics.GetOrCreateCounter(ingestionMetric("ng_monitoring_topsql_dropped_records_total", instance, instanceType, "reason", reason)).Inc()
+}
+
+// ObserveDroppedPoints counts points dropped from records of the instance.
+func ObserveDroppedPoints(instance, instanceType, reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	metrics.GetOrCreateCounter(ingestionMetric("ng_monitoring_topsql_dropped_points_total", instance, instanceType, "reason", reason)).Add(n)
+}
+
+// ObserveDecodeError counts records of the instance which can't be decoded.
+func ObserveDecodeError(instance, instanceType string) {
+	metrics.GetOrCreateCounter(ingestionMetric("ng_monitoring_topsql_decode_errors_total", instance, instanceType)).Inc()
+}
+
+func observeWrite(instance, instanceType, target string, start time.Time) {
+	metrics.GetOrCreateHistogram(ingestionMetric("ng_monitoring_topsql_write_duration_seconds", instance, instanceType, "target", target)).UpdateDuration(start)
+}
+
+func forgetIngestionMetrics(instance string) {
+	ingestionMu.Lock()
+	defer ingestionMu.Unlock()
+
+	for metric := range ingestionMetrics[instance] {
+		metrics.UnregisterMetric(metric)
+	}
+	delete(ingestionMetrics, instance)
+}
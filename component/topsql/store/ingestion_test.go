@@ -0,0 +1,70 @@
+package store
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+// ingestionMetricsOf returns the ingestion metrics of the instance without
+// the write durations.
+func ingestionMetricsOf(instance string) string {
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "ng_monitoring_topsql_") &&
+			!strings.HasPrefix(line, "ng_monitoring_topsql_write_duration_seconds") &&
+			!strings.HasPrefix(line, "ng_monitoring_topsql_freshness_seconds") &&
+			strings.Contains(line, `instance="`+instance+`"`) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestIngestionMetrics(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{TopSQL: config.TopSQL{
+		MaxInflightWrites:   1,
+		WriteQueueSize:      16,
+		FreshnessSLOSeconds: config.DefTopSQLFreshnessSLOSeconds,
+	}})
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, initDocumentDB(db))
+	vminsertHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	defer func() { vminsertHandler = nil }()
+	startWriters()
+	defer stopWriters()
+
+	const instance = "127.0.0.1:10090"
+	require.NoError(t, TopSQLRecord(instance, "tidb", genCPUTimeRecord(3)))
+	require.NoError(t, PauseInstance(instance))
+	<-PauseChanged()
+	require.NoError(t, TopSQLRecord(instance, "tidb", genCPUTimeRecord(3)))
+	require.NoError(t, ResumeInstance(instance))
+	<-PauseChanged()
+	FlushWrites()
+	ObserveDroppedPoints(instance, "tidb", ReasonOutOfOrder, 2)
+	ObserveDroppedPoints(instance, "tidb", ReasonOutOfOrder, 0)
+
+	require.Equal(t, strings.Join([]string{
+		`ng_monitoring_topsql_dropped_points_total{instance="127.0.0.1:10090",instance_type="tidb",reason="out_of_order"} 2`,
+		`ng_monitoring_topsql_dropped_records_total{instance="127.0.0.1:10090",instance_type="tidb",reason="paused"} 1`,
+		`ng_monitoring_topsql_received_records_total{instance="127.0.0.1:10090",instance_type="tidb"} 2`,
+		`ng_monitoring_topsql_written_records_total{instance="127.0.0.1:10090",instance_type="tidb"} 1`,
+	}, "\n"), ingestionMetricsOf(instance))
+
+	ForgetInstance(instance)
+	require.Empty(t, ingestionMetricsOf(instance))
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+// liveBufferSize is the number of records buffered for a subscriber. Records
+// are dropped for subscribers too slow to keep up, rather than blocking
+// ingestion.
+const liveBufferSize = 1024
+
+// LiveRecord is a record written by the store.
+type LiveRecord struct {
+	Instance      string   `json:"instance"`
+	InstanceType  string   `json:"instance_type"`
+	SQLDigest     string   `json:"sql_digest"`
+	PlanDigest    string   `json:"plan_digest"`
+	TimestampSecs []uint64 `json:"timestamp_secs"`
+	CPUTimeMillis []uint32 `json:"cpu_time_millis"`
+}
+
+// LiveFilter selects records by instance and sql digest. Empty fields match
+// everything.
+type LiveFilter struct {
+	Instance  string
+	SQLDigest string
+}
+
+func (f LiveFilter) match(m *Metric) bool {
+	return (len(f.Instance) == 0 || f.Instance == m.Metric.Instance) &&
+		(len(f.SQLDigest) == 0 || f.SQLDigest == m.Metric.SQLDigest)
+}
+
+// LiveSubscriber receives records written after it subscribes.
+type LiveSubscriber struct {
+	filter LiveFilter
+	ch     chan LiveRecord
+	// Dropped counts records dropped since the subscriber can't keep up.
+	Dropped *atomic.Uint64
+}
+
+func (s *LiveSubscriber) Records() <-chan LiveRecord {
+	return s.ch
+}
+
+var (
+	liveMu          sync.RWMutex
+	liveSubscribers = make(map[*LiveSubscriber]struct{})
+	liveCount       atomic.Int32
+)
+
+// SubscribeLive subscribes records matching the filter. The subscriber must
+// be unsubscribed once it's done.
+func SubscribeLive(filter LiveFilter) *LiveSubscriber {
+	s := &LiveSubscriber{
+		filter:  filter,
+		ch:      make(chan LiveRecord, liveBufferSize),
+		Dropped: atomic.NewUint64(0),
+	}
+
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	liveSubscribers[s] = struct{}{}
+	liveCount.Inc()
+	return s
+}
+
+func UnsubscribeLive(s *LiveSubscriber) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	if _, ok := liveSubscribers[s]; ok {
+		delete(liveSubscribers, s)
+		liveCount.Dec()
+	}
+}
+
+// publishLive sends the written metric to matched subscribers.
+func publishLive(m *Metric) {
+	if liveCount.Load() == 0 {
+		return
+	}
+
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+
+	var record *LiveRecord
+	for s := range liveSubscribers {
+		if !s.filter.match(m) {
+			continue
+		}
+
+		// the metric is pooled, so it's copied once for all subscribers
+		if record == nil {
+			record = &LiveRecord{
+				Instance:      m.Metric.Instance,
+				InstanceType:  m.Metric.InstanceType,
+				SQLDigest:     m.Metric.SQLDigest,
+				PlanDigest:    m.Metric.PlanDigest,
+				TimestampSecs: make([]uint64, 0, len(m.Timestamps)),
+				CPUTimeMillis: append([]uint32(nil), m.Values...),
+			}
+			for _, tsMillis := range m.Timestamps {
+				record.TimestampSecs = append(record.TimestampSecs, tsMillis/1000)
+			}
+		}
+
+		select {
+		case s.ch <- *record:
+		default:
+			s.Dropped.Inc()
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishLive(t *testing.T) {
+	s := SubscribeLive(LiveFilter{SQLDigest: "01"})
+	defer UnsubscribeLive(s)
+
+	m := &Metric{Timestamps: []uint64{1000, 2000}, Values: []uint32{3, 4}}
+	m.Metric.Instance = "127.0.0.1:10080"
+	m.Metric.SQLDigest = "02"
+	publishLive(m)
+	m.Metric.SQLDigest = "01"
+	publishLive(m)
+
+	record := <-s.Records()
+	require.Equal(t, "01", record.SQLDigest)
+	require.Equal(t, []uint64{1, 2}, record.TimestampSecs)
+	require.Equal(t, []uint32{3, 4}, record.CPUTimeMillis)
+	require.Empty(t, s.Records())
+
+	for i := 0; i < liveBufferSize+1; i++ {
+		publishLive(m)
+	}
+	require.Equal(t, uint64(1), s.Dropped.Load())
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Meta is queued and written in batches, rather than a write per report, which
+// is costly for the document database under heavy traffic. A batch is flushed
+// once it reaches metaBatchSize digests or has waited for metaFlushInterval.
+const (
+	metaBatchSize     = 512
+	metaFlushInterval = time.Second
+)
+
+type pendingSQL struct {
+	text       string
+	isInternal bool
+	ts         int64
+}
+
+type pendingPlan struct {
+	text string
+	ts   int64
+}
+
+var (
+	pendingMu    sync.Mutex
+	pendingSQLs  = make(map[string]pendingSQL)  // digest -> the latest reported meta
+	pendingPlans = make(map[string]pendingPlan) // digest -> the first reported meta
+	batchFullCh  = make(chan struct{}, 1)
+
+	// flushMu keeps batches written in order.
+	flushMu sync.Mutex
+
+	flusherMu     sync.Mutex
+	flusherStopCh chan struct{}
+	flusherWG     sync.WaitGroup
+)
+
+func queueSQLMeta(digest string, meta pendingSQL) {
+	pendingMu.Lock()
+	pendingSQLs[digest] = meta
+	full := len(pendingSQLs)+len(pendingPlans) >= metaBatchSize
+	pendingMu.Unlock()
+
+	if full {
+		notifyBatchFull()
+	}
+}
+
+func queuePlanMeta(digest string, meta pendingPlan) {
+	pendingMu.Lock()
+	if _, ok := pendingPlans[digest]; !ok {
+		pendingPlans[digest] = meta
+	}
+	full := len(pendingSQLs)+len(pendingPlans) >= metaBatchSize
+	pendingMu.Unlock()
+
+	if full {
+		notifyBatchFull()
+	}
+}
+
+func notifyBatchFull() {
+	select {
+	case batchFullCh <- struct{}{}:
+	default:
+	}
+}
+
+// FlushMeta writes all queued meta.
+func FlushMeta() error {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	pendingMu.Lock()
+	sqls, plans := pendingSQLs, pendingPlans
+	if len(sqls) != 0 {
+		pendingSQLs = make(map[string]pendingSQL)
+	}
+	if len(plans) != 0 {
+		pendingPlans = make(map[string]pendingPlan)
+	}
+	pendingMu.Unlock()
+
+	if len(sqls) != 0 {
+		err := documentDB.Update(func(tx *genji.Tx) error {
+			for digest, meta := range sqls {
+				if err := writeSQLMeta(tx, digest, meta); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for digest, meta := range sqls {
+			sqlMetaCache.add(digest, meta.text)
+		}
+	}
+
+	if len(plans) != 0 {
+		err := insert(
+			"INSERT INTO plan_digest(digest, plan_text, ts) VALUES ",
+			"(?, ?, ?)", len(plans),
+			" ON CONFLICT DO NOTHING",
+			func(target *[]interface{}) {
+				for digest, meta := range plans {
+					*target = append(*target, digest, meta.text, meta.ts)
+				}
+			},
+		)
+		if err != nil {
+			return err
+		}
+		for digest := range plans {
+			planMetaCache.add(digest, "")
+		}
+	}
+
+	return nil
+}
+
+func startFlusher() {
+	flusherMu.Lock()
+	defer flusherMu.Unlock()
+	if flusherStopCh != nil {
+		return
+	}
+
+	flusherStopCh = make(chan struct{})
+	stopCh := flusherStopCh
+	flusherWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer flusherWG.Done()
+		runFlusher(stopCh)
+	}, nil)
+}
+
+func stopFlusher() {
+	flusherMu.Lock()
+	defer flusherMu.Unlock()
+	if flusherStopCh == nil {
+		return
+	}
+
+	close(flusherStopCh)
+	flusherWG.Wait()
+	flusherStopCh = nil
+}
+
+func runFlusher(stopCh chan struct{}) {
+	ticker := time.NewTicker(metaFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-batchFullCh:
+		}
+
+		// failed meta is dropped, agents report it again in following windows
+		if err := FlushMeta(); err != nil {
+			log.Warn("failed to flush meta", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// metaCacheSize is the number of digests remembered per kind of meta. Agents
+// report the meta of every digest in each report window, while the number of
+// distinct digests of a cluster is usually far below this.
+const metaCacheSize = 65536
+
+var (
+	sqlMetaCache  = newMetaCache(metaCacheSize)
+	planMetaCache = newMetaCache(metaCacheSize)
+)
+
+// metaCache remembers meta which is known to be stored, so that meta reported
+// again doesn't cost a document write.
+type metaCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache // digest -> stored text
+}
+
+func newMetaCache(size int) *metaCache {
+	return &metaCache{cache: lru.New(size)}
+}
+
+func (c *metaCache) get(digest string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	text, ok := c.cache.Get(digest)
+	if !ok {
+		return "", false
+	}
+	return text.(string), true
+}
+
+func (c *metaCache) add(digest, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cache.Add(digest, text)
+}
+
+func (c *metaCache) remove(digests []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, digest := range digests {
+		c.cache.Remove(digest)
+	}
+}
+
+// ForgetSQLMeta should be called after the meta of the sql digests is deleted,
+// so that it's written again once reported.
+func ForgetSQLMeta(digests []string) {
+	sqlMetaCache.remove(digests)
+}
+
+// ForgetPlanMeta is like ForgetSQLMeta, but for plan digests.
+func ForgetPlanMeta(digests []string) {
+	planMetaCache.remove(digests)
+}
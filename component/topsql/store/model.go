@@ -1,5 +1,18 @@
 package store
 
+// Names of the metrics written into the timeseries database.
+const (
+	MetricCPUTime = "cpu_time"
+	// MetricReadKeys and MetricWriteKeys are only reported by TiKV.
+	MetricReadKeys  = "read_keys"
+	MetricWriteKeys = "write_keys"
+	// MetricInstanceCPUSeconds and MetricInstanceQueries are counters of
+	// instances, whose rates are the cpu usage in cores and the QPS. Queries
+	// are only collected from TiDB.
+	MetricInstanceCPUSeconds = "instance_cpu_seconds_total"
+	MetricInstanceQueries    = "instance_queries_total"
+)
+
 type Metric struct {
 	Metric     topSQLTags `json:"metric"`
 	Timestamps []uint64   `json:"timestamps"` // in millisecond
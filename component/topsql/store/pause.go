@@ -0,0 +1,135 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/database/table"
+
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// PausedInstance is an instance whose data is not collected, e.g. while it's
+// under maintenance and producing garbage data. Unlike decommissioning, its
+// existing data is kept.
+type PausedInstance struct {
+	Instance  string `json:"instance"`
+	SinceSecs int64  `json:"since_secs"`
+}
+
+var pausedTable = table.New("paused_instance", []string{"instance", "ts"}, func(p *PausedInstance) []interface{} {
+	return []interface{}{&p.Instance, &p.SinceSecs}
+})
+
+var (
+	pauseMu sync.Mutex
+	paused  atomic.Value // map[string]PausedInstance
+	// pauseChangedCh is notified once paused instances change.
+	pauseChangedCh = make(chan struct{}, 1)
+)
+
+func loadPausedInstances() error {
+	loaded := make(map[string]PausedInstance)
+	err := pausedTable.Iterate(documentDB, func(p PausedInstance) error {
+		loaded[p.Instance] = p
+		return nil
+	}, "")
+	if err != nil {
+		return err
+	}
+
+	paused.Store(loaded)
+	return nil
+}
+
+func currentPaused() map[string]PausedInstance {
+	p, _ := paused.Load().(map[string]PausedInstance)
+	return p
+}
+
+// IsPaused tells if collecting data of the instance is paused.
+func IsPaused(instance string) bool {
+	_, ok := currentPaused()[instance]
+	return ok
+}
+
+// PausedInstances returns all paused instances ordered by instance.
+func PausedInstances() []PausedInstance {
+	p := currentPaused()
+	res := make([]PausedInstance, 0, len(p))
+	for _, i := range p {
+		res = append(res, i)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res
+}
+
+// PauseChanged is notified once instances are paused or resumed. It's meant
+// for a single receiver, i.e. the subscriber.
+func PauseChanged() <-chan struct{} {
+	return pauseChangedCh
+}
+
+// PauseInstance stops collecting data of the instance until it's resumed.
+func PauseInstance(instance string) error {
+	if len(instance) == 0 {
+		return fmt.Errorf("empty instance")
+	}
+
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	old := currentPaused()
+	if _, ok := old[instance]; ok {
+		return nil
+	}
+	p := PausedInstance{Instance: instance, SinceSecs: time.Now().Unix()}
+	if err := pausedTable.Upsert(documentDB, p); err != nil {
+		return err
+	}
+
+	updated := make(map[string]PausedInstance, len(old)+1)
+	for i, o := range old {
+		updated[i] = o
+	}
+	updated[instance] = p
+	paused.Store(updated)
+	notifyPauseChanged()
+	log.Info("pause collecting instance", zap.String("instance", instance))
+	return nil
+}
+
+// ResumeInstance resumes collecting data of the instance.
+func ResumeInstance(instance string) error {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	if err := documentDB.Exec("DELETE FROM paused_instance WHERE instance = ?", instance); err != nil {
+		return err
+	}
+
+	old := currentPaused()
+	updated := make(map[string]PausedInstance, len(old))
+	for i, o := range old {
+		if i != instance {
+			updated[i] = o
+		}
+	}
+	paused.Store(updated)
+	notifyPauseChanged()
+	log.Info("resume collecting instance", zap.String("instance", instance))
+	return nil
+}
+
+func notifyPauseChanged() {
+	select {
+	case pauseChangedCh <- struct{}{}:
+	default:
+	}
+}
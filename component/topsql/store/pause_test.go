@@ -0,0 +1,34 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseInstance(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, initDocumentDB(db))
+
+	require.NoError(t, PauseInstance("127.0.0.1:10080"))
+	require.True(t, IsPaused("127.0.0.1:10080"))
+	require.False(t, IsPaused("127.0.0.1:10081"))
+	<-PauseChanged()
+
+	// records of paused instances are dropped before written
+	require.NoError(t, TopSQLRecord("127.0.0.1:10080", "tidb", genCPUTimeRecord(1)))
+
+	// pauses are loaded on restart
+	require.NoError(t, initDocumentDB(db))
+	paused := PausedInstances()
+	require.Len(t, paused, 1)
+	require.Equal(t, "127.0.0.1:10080", paused[0].Instance)
+
+	require.NoError(t, ResumeInstance("127.0.0.1:10080"))
+	require.False(t, IsPaused("127.0.0.1:10080"))
+	require.Empty(t, PausedInstances())
+	<-PauseChanged()
+}
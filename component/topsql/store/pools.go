@@ -38,3 +38,22 @@ func (psp *PrepareSlicePool) Put(ps *[]interface{}) {
 	*ps = (*ps)[:0]
 	psp.p.Put(ps)
 }
+
+type MetricPool struct {
+	p sync.Pool
+}
+
+func (mp *MetricPool) Get() *Metric {
+	mv := mp.p.Get()
+	if mv == nil {
+		return &Metric{}
+	}
+	return mv.(*Metric)
+}
+
+func (mp *MetricPool) Put(m *Metric) {
+	m.Metric = topSQLTags{}
+	m.Timestamps = m.Timestamps[:0]
+	m.Values = m.Values[:0]
+	mp.p.Put(m)
+}
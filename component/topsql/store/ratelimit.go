@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/VictoriaMetrics/metrics"
+	"golang.org/x/time/rate"
+)
+
+// Limits of ingestion, which label dropped records.
+const (
+	limitRecords = "records"
+	limitBytes   = "bytes"
+)
+
+// ingestLimiter limits records ingested from an instance.
+type ingestLimiter struct {
+	records limiter
+	bytes   limiter
+}
+
+// limiter allows a burst of a second.
+type limiter struct {
+	perSecond int
+	*rate.Limiter
+}
+
+// allow tells if n is allowed within the limit per second. The limiter is
+// rebuilt with a full burst once the limit is changed.
+func (l *limiter) allow(perSecond, n int, now time.Time) bool {
+	if perSecond <= 0 {
+		return true
+	}
+	if l.Limiter == nil || l.perSecond != perSecond {
+		l.perSecond = perSecond
+		l.Limiter = rate.NewLimiter(rate.Limit(perSecond), perSecond)
+	}
+	return l.AllowN(now, n)
+}
+
+var (
+	ingestMu       sync.Mutex
+	ingestLimiters = make(map[string]*ingestLimiter)
+)
+
+// allowIngest tells if a record of the size from the instance is within the
+// limits, and counts it as dropped otherwise.
+func allowIngest(instance string, size int, now time.Time) bool {
+	cfg := config.GetGlobalConfig().TopSQL
+	if cfg.InstanceRecordsPerSecond <= 0 && cfg.InstanceBytesPerSecond <= 0 {
+		return true
+	}
+
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+
+	l, ok := ingestLimiters[instance]
+	if !ok {
+		l = &ingestLimiter{}
+		ingestLimiters[instance] = l
+	}
+	if !l.records.allow(cfg.InstanceRecordsPerSecond, 1, now) {
+		dropIngest(instance, limitRecords, size)
+		return false
+	}
+	if !l.bytes.allow(cfg.InstanceBytesPerSecond, size, now) {
+		dropIngest(instance, limitBytes, size)
+		return false
+	}
+	return true
+}
+
+func droppedRecordsCounter(instance, limit string) string {
+	return fmt.Sprintf(`ng_monitoring_topsql_rate_limited_records_total{instance=%q,limit=%q}`, instance, limit)
+}
+
+func droppedBytesCounter(instance, limit string) string {
+	return fmt.Sprintf(`ng_monitoring_topsql_rate_limited_bytes_total{instance=%q,limit=%q}`, instance, limit)
+}
+
+func dropIngest(instance, limit string, size int) {
+	metrics.GetOrCreateCounter(droppedRecordsCounter(instance, limit)).Inc()
+	metrics.GetOrCreateCounter(droppedBytesCounter(instance, limit)).Add(size)
+}
+
+func forgetIngestLimiter(instance string) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+
+	delete(ingestLimiters, instance)
+	for _, limit := range []string{limitRecords, limitBytes} {
+		metrics.UnregisterMetric(droppedRecordsCounter(instance, limit))
+		metrics.UnregisterMetric(droppedBytesCounter(instance, limit))
+	}
+}
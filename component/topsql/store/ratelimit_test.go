@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowIngest(t *testing.T) {
+	cfg := &config.Config{}
+	config.StoreGlobalConfig(cfg)
+	const instance = "127.0.0.1:10080"
+	now := time.Unix(1636000000, 0)
+
+	// unlimited
+	for i := 0; i < 100; i++ {
+		require.True(t, allowIngest(instance, 1000, now))
+	}
+
+	cfg.TopSQL.InstanceRecordsPerSecond = 3
+	cfg.TopSQL.InstanceBytesPerSecond = 250
+	for i := 0; i < 2; i++ {
+		require.True(t, allowIngest(instance, 100, now))
+	}
+	// beyond bytes
+	require.False(t, allowIngest(instance, 100, now))
+	// beyond records, the last record consumed its token
+	require.False(t, allowIngest(instance, 10, now))
+	require.Equal(t, uint64(1), metrics.GetOrCreateCounter(droppedRecordsCounter(instance, limitBytes)).Get())
+	require.Equal(t, uint64(100), metrics.GetOrCreateCounter(droppedBytesCounter(instance, limitBytes)).Get())
+	require.Equal(t, uint64(1), metrics.GetOrCreateCounter(droppedRecordsCounter(instance, limitRecords)).Get())
+
+	// refilled after a second
+	now = now.Add(time.Second)
+	require.True(t, allowIngest(instance, 100, now))
+	// other instances are limited separately
+	require.True(t, allowIngest("127.0.0.1:10081", 100, now))
+
+	// reloaded limits take effect at once
+	cfg.TopSQL.InstanceBytesPerSecond = 50
+	require.False(t, allowIngest(instance, 100, now))
+
+	forgetIngestLimiter(instance)
+	forgetIngestLimiter("127.0.0.1:10081")
+	require.Equal(t, uint64(0), metrics.GetOrCreateCounter(droppedRecordsCounter(instance, limitBytes)).Get())
+}
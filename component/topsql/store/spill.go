@@ -0,0 +1,309 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// With the spill policy, records beyond the full write queue are appended to
+// segment files under the storage path, e.g. while the timeseries database
+// stalls on compactions or disk pressure, and replayed once the queue has
+// room again. Segments survive restarts. Records are dropped once spilled
+// ones reach SpillMaxMB.
+
+const (
+	spillDir            = "topsql-spill"
+	spillSegmentBytes   = 16 << 20
+	spillReplayInterval = time.Second
+)
+
+// spilledJob is a line of segments.
+type spilledJob struct {
+	Instance     string    `json:"instance"`
+	InstanceType string    `json:"instance_type"`
+	CPU          *Metric   `json:"cpu"`
+	Keys         []*Metric `json:"keys,omitempty"`
+}
+
+var (
+	spilledRecords  = metrics.NewCounter("ng_monitoring_topsql_spilled_records_total")
+	replayedRecords = metrics.NewCounter("ng_monitoring_topsql_replayed_records_total")
+	_               = metrics.NewGauge("ng_monitoring_topsql_spilled_bytes", func() float64 {
+		spillMu.Lock()
+		defer spillMu.Unlock()
+		return float64(spilledBytes)
+	})
+)
+
+var (
+	spillMu sync.Mutex
+	// spillPath is empty until segments are opened.
+	spillPath    string
+	spilledBytes int64
+	// active is the segment being appended, which is rotated once it reaches
+	// spillSegmentBytes or it's replayed.
+	active      *os.File
+	activeBytes int64
+	nextSegment uint64
+
+	replayerStopCh chan struct{}
+	replayerWG     sync.WaitGroup
+)
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d.jsonl", seq)
+}
+
+// segments returns sequences of segments in order.
+func segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(spillPath)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".jsonl"), 10, 64)
+		if err != nil || f.IsDir() {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// openSpill loads segments left by the last run. It's a no-op without the
+// storage path, e.g. in tests.
+func openSpill() error {
+	spillMu.Lock()
+	defer spillMu.Unlock()
+	storagePath := config.GetGlobalConfig().Storage.Path
+	if len(spillPath) != 0 || len(storagePath) == 0 {
+		return nil
+	}
+
+	dir := path.Join(storagePath, spillDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	spillPath = dir
+	seqs, err := segments()
+	if err != nil {
+		spillPath = ""
+		return err
+	}
+	spilledBytes = 0
+	for _, seq := range seqs {
+		if info, err := os.Stat(path.Join(spillPath, segmentName(seq))); err == nil {
+			spilledBytes += info.Size()
+		}
+		nextSegment = seq + 1
+	}
+	if len(seqs) != 0 {
+		log.Info("found spilled topsql records", zap.Int("segments", len(seqs)), zap.Int64("bytes", spilledBytes))
+	}
+	return nil
+}
+
+func spillMaxBytes() int64 {
+	return int64(config.GetGlobalConfig().TopSQL.SpillMaxMB) << 20
+}
+
+// spill appends the job to the active segment, and tells if it's spilled.
+func spill(job writeJob) bool {
+	line, err := json.Marshal(spilledJob{Instance: job.instance, InstanceType: job.instanceType, CPU: job.cpu, Keys: job.keys})
+	if err != nil {
+		log.Warn("failed to encode spilled records", zap.Error(err))
+		return false
+	}
+	line = append(line, '\n')
+
+	spillMu.Lock()
+	defer spillMu.Unlock()
+	if len(spillPath) == 0 || spilledBytes+int64(len(line)) > spillMaxBytes() {
+		return false
+	}
+
+	if active != nil && activeBytes >= spillSegmentBytes {
+		closeActive()
+	}
+	if active == nil {
+		f, err := os.OpenFile(path.Join(spillPath, segmentName(nextSegment)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Warn("failed to create spill segment", zap.Error(err))
+			return false
+		}
+		nextSegment++
+		active, activeBytes = f, 0
+	}
+	n, err := active.Write(line)
+	activeBytes += int64(n)
+	spilledBytes += int64(n)
+	if err != nil {
+		log.Warn("failed to spill records", zap.Error(err))
+		return false
+	}
+	spilledRecords.Inc()
+	return true
+}
+
+// closeActive must be called with spillMu held.
+func closeActive() {
+	if err := active.Close(); err != nil {
+		log.Warn("failed to close spill segment", zap.Error(err))
+	}
+	active = nil
+}
+
+// startReplayer replays segments into ch. It must be stopped before ch is
+// closed.
+func startReplayer(ch chan writeJob) {
+	spillMu.Lock()
+	opened := len(spillPath) != 0
+	spillMu.Unlock()
+	if !opened {
+		return
+	}
+
+	replayerStopCh = make(chan struct{})
+	stopCh := replayerStopCh
+	replayerWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer replayerWG.Done()
+		ticker := time.NewTicker(spillReplayInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			// leave room for incoming records
+			for len(ch) < cap(ch)/2 {
+				if replayed, err := replayOldest(ch, stopCh); err != nil {
+					log.Warn("failed to replay spilled records", zap.Error(err))
+					break
+				} else if !replayed {
+					break
+				}
+			}
+		}
+	}, nil)
+}
+
+func stopReplayer() {
+	if replayerStopCh == nil {
+		return
+	}
+	close(replayerStopCh)
+	replayerWG.Wait()
+	replayerStopCh = nil
+}
+
+// replayOldest queues records of the oldest segment and removes it, and
+// tells if it should go on with the next one. Records not queued before
+// stopping are kept in the segment.
+func replayOldest(ch chan writeJob, stopCh chan struct{}) (bool, error) {
+	spillMu.Lock()
+	seqs, err := segments()
+	if err != nil || len(seqs) == 0 {
+		spillMu.Unlock()
+		return false, err
+	}
+	name := path.Join(spillPath, segmentName(seqs[0]))
+	// appending goes on with a new segment
+	if active != nil && path.Base(active.Name()) == segmentName(seqs[0]) {
+		closeActive()
+	}
+	spillMu.Unlock()
+
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	r := bufio.NewReader(f)
+	var replayed int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+
+		var job spilledJob
+		if err := json.Unmarshal(line, &job); err != nil || job.CPU == nil {
+			// skip a line torn by a crash
+			log.Warn("skip a malformed spilled record", zap.String("segment", name))
+			replayed += int64(len(line))
+			continue
+		}
+		pendingWrites.Add(1)
+		select {
+		case ch <- writeJob{instance: job.Instance, instanceType: job.InstanceType, cpu: job.CPU, keys: job.Keys}:
+			replayedRecords.Inc()
+			replayed += int64(len(line))
+		case <-stopCh:
+			pendingWrites.Done()
+			return false, keepRemaining(f, name, replayed)
+		}
+	}
+
+	if err := os.Remove(name); err != nil {
+		return false, err
+	}
+	spillMu.Lock()
+	spilledBytes -= info.Size()
+	spillMu.Unlock()
+	return true, nil
+}
+
+// keepRemaining rewrites the segment with records after offset.
+func keepRemaining(f *os.File, name string, offset int64) error {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	spillMu.Lock()
+	spilledBytes -= offset
+	spillMu.Unlock()
+	return nil
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topsql-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.StoreGlobalConfig(&config.Config{
+		Storage: config.Storage{Path: dir},
+		TopSQL:  config.TopSQL{MaxInflightWrites: 1, WriteQueueSize: 2, ShedPolicy: config.ShedPolicySpill, SpillMaxMB: 1},
+	})
+	defer func() {
+		spillPath = ""
+	}()
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, initDocumentDB(db))
+
+	// the timeseries database stalls until unblocked
+	unblock := make(chan struct{})
+	var writes atomic.Int32
+	vminsertHandler = func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		writes.Inc()
+		w.WriteHeader(http.StatusNoContent)
+	}
+	defer func() { vminsertHandler = nil }()
+	startWriters()
+
+	// a record is held by the worker, two are queued, and the others are spilled
+	spilled := spilledRecords.Get()
+	for i := 0; i < 6; i++ {
+		require.NoError(t, TopSQLRecord("127.0.0.1:10080", "tidb", genCPUTimeRecord(1)))
+		if i == 0 {
+			require.Eventually(t, func() bool { return len(writeCh) == 0 }, time.Second, time.Millisecond)
+		}
+	}
+	require.Equal(t, spilled+3, spilledRecords.Get())
+	seqs, err := segments()
+	require.NoError(t, err)
+	require.Len(t, seqs, 1)
+
+	// spilled records are kept across restarts
+	close(unblock)
+	stopWriters()
+	require.Equal(t, int32(3), writes.Load())
+	spillMu.Lock()
+	spillPath, spilledBytes = "", 0
+	spillMu.Unlock()
+	startWriters()
+	defer stopWriters()
+	require.NotZero(t, loadSpilledBytes())
+
+	require.Eventually(t, func() bool { return writes.Load() == 6 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		files, _ := ioutil.ReadDir(path.Join(dir, spillDir))
+		return len(files) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Zero(t, loadSpilledBytes())
+}
+
+func loadSpilledBytes() int64 {
+	spillMu.Lock()
+	defer spillMu.Unlock()
+	return spilledBytes
+}
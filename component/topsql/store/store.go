@@ -4,17 +4,29 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/database/migration"
 	"github.com/zhongzc/ng_monitoring/utils"
 
 	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
 	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
+var ErrStoreIsStopped = errors.New("topsql store is stopped")
+
 var (
 	vminsertHandler http.HandlerFunc
 	documentDB      *genji.DB
@@ -23,38 +35,82 @@ var (
 	headerP        = utils.HeaderPool{}
 	stringBuilderP = StringBuilderPool{}
 	prepareSliceP  = PrepareSlicePool{}
+	metricP        = MetricPool{}
+
+	stopped atomic.Bool
+
+	activityMu   sync.Mutex
+	lastActivity = make(map[string]uint64) // instance -> last recorded activity bucket
 )
 
+// ActivityBucketSecs is the granularity of the instance activity index.
+const ActivityBucketSecs = 60 * 60
+
+// migrations upgrade tables of topsql in order. Changes to the format of
+// tables and indexes are appended, rather than editing the released ones.
+var migrations = []migration.Migration{{
+	Version:     1,
+	Description: "create tables",
+	// tables may already exist before versioning, hence IF NOT EXISTS
+	Up: migration.Statements(
+		"CREATE TABLE IF NOT EXISTS sql_digest (digest VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS sql_digest_history (ts INTEGER)",
+		"CREATE INDEX IF NOT EXISTS sql_digest_history_digest ON sql_digest_history (digest)",
+		"CREATE TABLE IF NOT EXISTS plan_digest (digest VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS instance (instance VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS instance_activity (id VARCHAR(255) PRIMARY KEY)",
+		"CREATE INDEX IF NOT EXISTS instance_activity_ts ON instance_activity (ts)",
+		"CREATE TABLE IF NOT EXISTS digest_heat (digest VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS decommission (instance VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS paused_instance (instance VARCHAR(255) PRIMARY KEY)",
+	),
+}}
+
 func Init(vminsertHandler_ http.HandlerFunc, documentDB *genji.DB) {
 	vminsertHandler = vminsertHandler_
 	if err := initDocumentDB(documentDB); err != nil {
 		log.Fatal("failed to create tables", zap.Error(err))
 	}
+	startWriters()
+	startFlusher()
 }
 
 func initDocumentDB(db *genji.DB) error {
 	documentDB = db
 
-	createTableStmts := []string{
-		"CREATE TABLE IF NOT EXISTS sql_digest (digest VARCHAR(255) PRIMARY KEY)",
-		"CREATE TABLE IF NOT EXISTS plan_digest (digest VARCHAR(255) PRIMARY KEY)",
-		"CREATE TABLE IF NOT EXISTS instance (instance VARCHAR(255) PRIMARY KEY)",
+	if err := migration.Migrate(db, "topsql", migrations); err != nil {
+		return err
 	}
 
-	for _, stmt := range createTableStmts {
-		if err := db.Exec(stmt); err != nil {
-			return err
-		}
+	if err := loadDecommissions(); err != nil {
+		return err
 	}
+	return loadPausedInstances()
+}
 
-	return nil
+// Start resumes accepting records after Stop.
+func Start() {
+	stopped.Store(false)
+	startWriters()
+	startFlusher()
 }
 
+// Stop rejects all incoming records with ErrStoreIsStopped, and flushes the
+// queued records and meta.
 func Stop() {
-
+	stopped.Store(true)
+	stopWriters()
+	stopFlusher()
+	if err := FlushMeta(); err != nil {
+		log.Warn("failed to flush meta", zap.Error(err))
+	}
 }
 
 func Instance(instance, instanceType string) error {
+	if stopped.Load() {
+		return ErrStoreIsStopped
+	}
+
 	prepareStmt := "INSERT INTO instance(instance, instance_type) VALUES (?, ?) ON CONFLICT DO NOTHING"
 	prepare, err := documentDB.Prepare(prepareStmt)
 	if err != nil {
@@ -65,39 +121,176 @@ func Instance(instance, instanceType string) error {
 }
 
 func TopSQLRecord(instance, instanceType string, record *tipb.CPUTimeRecord) error {
-	m := topSQLProtoToMetric(instance, instanceType, record)
-	return writeTimeseriesDB(m)
+	if stopped.Load() {
+		return ErrStoreIsStopped
+	}
+
+	observeReceived(instance, instanceType)
+
+	// drop records pushed by agents or in flight after pausing
+	if IsPaused(instance) {
+		observeDropped(instance, instanceType, reasonPaused)
+		return nil
+	}
+	// dropped records are counted rather than returned as errors, so that
+	// a flooding agent doesn't flood logs as well
+	if !allowIngest(instance, record.Size(), time.Now()) {
+		observeDropped(instance, instanceType, reasonRateLimited)
+		return nil
+	}
+
+	m := metricP.Get()
+	topSQLProtoToMetric(instance, instanceType, record, m)
+	if !dropDecommissionedPoints(instance, instanceType, m) {
+		metricP.Put(m)
+		return nil
+	}
+	return enqueueWrite(writeJob{instance: instance, instanceType: instanceType, cpu: m})
 }
 
 func ResourceMeteringRecord(
 	instance, instanceType string,
 	record *rsmetering.ResourceUsageRecord,
 ) error {
-	m, err := rsMeteringProtoToMetric(instance, instanceType, record)
-	if err != nil {
+	if stopped.Load() {
+		return ErrStoreIsStopped
+	}
+
+	observeReceived(instance, instanceType)
+
+	// drop records pushed by agents or in flight after pausing
+	if IsPaused(instance) {
+		observeDropped(instance, instanceType, reasonPaused)
+		return nil
+	}
+	if !allowIngest(instance, record.Size(), time.Now()) {
+		observeDropped(instance, instanceType, reasonRateLimited)
+		return nil
+	}
+
+	m := metricP.Get()
+	if err := rsMeteringProtoToMetric(instance, instanceType, record, m); err != nil {
+		metricP.Put(m)
+		ObserveDecodeError(instance, instanceType)
 		return err
 	}
-	return writeTimeseriesDB(m)
+	if !dropDecommissionedPoints(instance, instanceType, m) {
+		metricP.Put(m)
+		return nil
+	}
+	return enqueueWrite(writeJob{instance: instance, instanceType: instanceType, cpu: m, keys: keyMetrics(m, record)})
+}
+
+// dropDecommissionedPoints drops and counts points after the cutoff of
+// decommissioning, and tells if any point is left.
+func dropDecommissionedPoints(instance, instanceType string, m *Metric) bool {
+	n := len(m.Timestamps)
+	dropDecommissioned(m)
+	ObserveDroppedPoints(instance, instanceType, reasonDecommissioned, n-len(m.Timestamps))
+	return len(m.Timestamps) != 0
+}
+
+// markActivity records the buckets in which the instance has data, so that
+// instances can be looked up by time range even after they are gone.
+func markActivity(instance, instanceType string, timestampsMillis []uint64) error {
+	for _, tsMillis := range timestampsMillis {
+		ts := tsMillis / 1000
+		bucket := ts - ts%ActivityBucketSecs
+
+		activityMu.Lock()
+		marked := lastActivity[instance] == bucket
+		activityMu.Unlock()
+		if marked {
+			continue
+		}
+
+		err := documentDB.Exec(
+			"INSERT INTO instance_activity(id, instance, instance_type, ts) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			fmt.Sprintf("%s_%d", instance, bucket), instance, instanceType, bucket,
+		)
+		if err != nil {
+			return err
+		}
+
+		activityMu.Lock()
+		lastActivity[instance] = bucket
+		activityMu.Unlock()
+	}
+	return nil
 }
 
+// SQLMeta queues the sql text of the digest to be stored by the next flush.
+// Every distinct text ever reported for the digest is kept in
+// sql_digest_history, since the normalized text of a digest may differ across
+// TiDB versions.
 func SQLMeta(meta *tipb.SQLMeta) error {
-	prepareStmt := "INSERT INTO sql_digest(digest, sql_text, is_internal) VALUES (?, ?, ?) ON CONFLICT DO NOTHING"
-	prepare, err := documentDB.Prepare(prepareStmt)
-	if err != nil {
-		return err
+	if stopped.Load() {
+		return ErrStoreIsStopped
+	}
+
+	digest := hex.EncodeToString(meta.SqlDigest)
+	sqlText := meta.NormalizedSql
+	if config.GetGlobalConfig().TopSQL.RedactSQLLiterals {
+		sqlText = masking.RedactLiterals(sqlText)
+	}
+	sqlText = masking.MaskOnIngest(sqlText)
+	if stored, ok := sqlMetaCache.get(digest); ok && stored == sqlText {
+		return nil
 	}
 
-	return prepare.Exec(hex.EncodeToString(meta.SqlDigest), meta.NormalizedSql, meta.IsInternalSql)
+	queueSQLMeta(digest, pendingSQL{text: sqlText, isInternal: meta.IsInternalSql, ts: time.Now().Unix()})
+	return nil
 }
 
+// PlanMeta queues the plan text of the digest to be stored by the next flush.
 func PlanMeta(meta *tipb.PlanMeta) error {
-	prepareStmt := "INSERT INTO plan_digest(digest, plan_text) VALUES (?, ?) ON CONFLICT DO NOTHING"
-	prepare, err := documentDB.Prepare(prepareStmt)
-	if err != nil {
+	if stopped.Load() {
+		return ErrStoreIsStopped
+	}
+
+	// the first reported plan text is kept, so the text needn't be compared
+	digest := hex.EncodeToString(meta.PlanDigest)
+	if _, ok := planMetaCache.get(digest); ok {
+		return nil
+	}
+
+	queuePlanMeta(digest, pendingPlan{text: masking.MaskOnIngest(meta.NormalizedPlan), ts: time.Now().Unix()})
+	return nil
+}
+
+// writeSQLMeta stores the sql text of the digest along with its history.
+func writeSQLMeta(tx *genji.Tx, digest string, meta pendingSQL) error {
+	r, err := tx.QueryDocument("SELECT sql_text, ts FROM sql_digest WHERE digest = ?", digest)
+	switch {
+	case err == errs.ErrDocumentNotFound:
+	case err != nil:
 		return err
+	default:
+		var oldText string
+		var oldTs int64
+		_ = document.Scan(r, &oldText, &oldTs)
+		if oldText == meta.text {
+			return nil
+		}
+
+		// Digests stored by older versions don't have any history yet.
+		_, err = tx.QueryDocument("SELECT ts FROM sql_digest_history WHERE digest = ?", digest)
+		if err == errs.ErrDocumentNotFound {
+			err = tx.Exec("INSERT INTO sql_digest_history(digest, sql_text, ts) VALUES (?, ?, ?)", digest, oldText, oldTs)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	return prepare.Exec(hex.EncodeToString(meta.PlanDigest), meta.NormalizedPlan)
+	err = tx.Exec(
+		"INSERT INTO sql_digest(digest, sql_text, is_internal, ts) VALUES (?, ?, ?, ?) ON CONFLICT DO REPLACE",
+		digest, meta.text, meta.isInternal, meta.ts,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Exec("INSERT INTO sql_digest_history(digest, sql_text, ts) VALUES (?, ?, ?)", digest, meta.text, meta.ts)
 }
 
 func insert(
@@ -146,8 +339,9 @@ func execStmt(prepareStmt string, fill func(target *[]interface{})) error {
 func topSQLProtoToMetric(
 	instance, instanceType string,
 	record *tipb.CPUTimeRecord,
-) (m Metric) {
-	m.Metric.Name = "cpu_time"
+	m *Metric,
+) {
+	m.Metric.Name = MetricCPUTime
 	m.Metric.Instance = instance
 	m.Metric.InstanceType = instanceType
 	m.Metric.SQLDigest = hex.EncodeToString(record.SqlDigest)
@@ -160,24 +354,23 @@ func topSQLProtoToMetric(
 		m.Timestamps = append(m.Timestamps, tsMillis)
 		m.Values = append(m.Values, cpuTime)
 	}
-
-	return
 }
 
 // transform resource_usage_agent.CPUTimeRecord to util.Metric
 func rsMeteringProtoToMetric(
 	instance, instance_type string,
 	record *rsmetering.ResourceUsageRecord,
-) (m Metric, err error) {
+	m *Metric,
+) error {
 	tag := tipb.ResourceGroupTag{}
 
-	m.Metric.Name = "cpu_time"
+	m.Metric.Name = MetricCPUTime
 	m.Metric.Instance = instance
 	m.Metric.InstanceType = instance_type
 
 	tag.Reset()
-	if err = tag.Unmarshal(record.ResourceGroupTag); err != nil {
-		return
+	if err := tag.Unmarshal(record.ResourceGroupTag); err != nil {
+		return err
 	}
 
 	m.Metric.SQLDigest = hex.EncodeToString(tag.SqlDigest)
@@ -191,10 +384,46 @@ func rsMeteringProtoToMetric(
 		m.Values = append(m.Values, cpuTime)
 	}
 
-	return
+	return nil
+}
+
+// keyMetrics converts keys read and written by the tag of the cpu time
+// metric. Zero points are skipped, since most tags don't touch keys at all.
+func keyMetrics(cpu *Metric, record *rsmetering.ResourceUsageRecord) []*Metric {
+	var res []*Metric
+	dims := []struct {
+		name   string
+		values []uint32
+	}{
+		{MetricReadKeys, record.RecordListReadKeys},
+		{MetricWriteKeys, record.RecordListWriteKeys},
+	}
+	for _, dim := range dims {
+		if len(dim.values) != len(record.RecordListTimestampSec) {
+			continue
+		}
+
+		m := metricP.Get()
+		m.Metric = cpu.Metric
+		m.Metric.Name = dim.name
+		for i, v := range dim.values {
+			if v != 0 {
+				m.Timestamps = append(m.Timestamps, record.RecordListTimestampSec[i]*1000)
+				m.Values = append(m.Values, v)
+			}
+		}
+		dropDecommissioned(m)
+
+		if len(m.Timestamps) == 0 {
+			metricP.Put(m)
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
 }
 
-func writeTimeseriesDB(metric Metric) error {
+func writeTimeseriesDB(metric *Metric) error {
 	bufReq := bytesP.Get()
 	bufResp := bytesP.Get()
 	header := headerP.Get()
@@ -220,7 +449,7 @@ func writeTimeseriesDB(metric Metric) error {
 	return nil
 }
 
-func encodeMetric(buf *bytes.Buffer, metric Metric) error {
+func encodeMetric(buf *bytes.Buffer, metric *Metric) error {
 	encoder := json.NewEncoder(buf)
 	return encoder.Encode(metric)
 }
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/dataset"
+
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+// a single record of a single sql
+var singleRecord = dataset.Shape{Name: "single", Instances: 1, SQLs: 1, PlansPerSQL: 1}
+
+func genCPUTimeRecord(points int) *tipb.CPUTimeRecord {
+	shape := singleRecord
+	shape.Points = points
+	return shape.CPUTimeRecords(1636000000)[0]
+}
+
+func genResourceUsageRecord(points int) *rsmetering.ResourceUsageRecord {
+	shape := singleRecord
+	shape.Points = points
+	return shape.ResourceUsageRecords(1636000000)[0]
+}
+
+func TestMetricReuse(t *testing.T) {
+	m := metricP.Get()
+	topSQLProtoToMetric("127.0.0.1:10080", "tidb", genCPUTimeRecord(60), m)
+	require.Len(t, m.Timestamps, 60)
+	metricP.Put(m)
+
+	m = metricP.Get()
+	require.NoError(t, rsMeteringProtoToMetric("127.0.0.1:20160", "tikv", genResourceUsageRecord(3), m))
+	require.Equal(t, "tikv", m.Metric.InstanceType)
+	require.Equal(t, []uint64{1636000000000, 1636000001000, 1636000002000}, m.Timestamps)
+	require.Equal(t, []uint32{0, 1, 2}, m.Values)
+	metricP.Put(m)
+}
+
+func BenchmarkTopSQLProtoToMetric(b *testing.B) {
+	record := genCPUTimeRecord(60)
+	buf := &bytes.Buffer{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := metricP.Get()
+		topSQLProtoToMetric("127.0.0.1:10080", "tidb", record, m)
+		_ = encodeMetric(buf, m)
+		buf.Reset()
+		metricP.Put(m)
+	}
+}
+
+func BenchmarkRsMeteringProtoToMetric(b *testing.B) {
+	record := genResourceUsageRecord(60)
+	buf := &bytes.Buffer{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := metricP.Get()
+		_ = rsMeteringProtoToMetric("127.0.0.1:20160", "tikv", record, m)
+		_ = encodeMetric(buf, m)
+		buf.Reset()
+		metricP.Put(m)
+	}
+}
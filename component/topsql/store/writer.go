@@ -0,0 +1,163 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Records are converted to metrics where they are received, and queued to be
+// written by a pool of workers, so that a slow write doesn't hold up
+// receiving from the instance, nor serialize writes of other instances.
+
+// ErrStoreIsBusy is returned for records shed by the drop policy, or beyond
+// the limit of the spill policy.
+var ErrStoreIsBusy = errors.New("topsql store is busy")
+
+// ShedRecords counts records dropped for the full write queue.
+var ShedRecords = atomic.NewUint64(0)
+
+// writeJob is the metrics of a record to be written.
+type writeJob struct {
+	instance     string
+	instanceType string
+	cpu          *Metric
+	// keys are metrics of keys read and written along with cpu.
+	keys []*Metric
+}
+
+func (j *writeJob) release() {
+	metricP.Put(j.cpu)
+	for _, m := range j.keys {
+		metricP.Put(m)
+	}
+}
+
+var (
+	// writersMu guards writeCh against being closed while records are queued.
+	writersMu sync.RWMutex
+	writeCh   chan writeJob
+	writersWG sync.WaitGroup
+	// pendingWrites are queued or being written.
+	pendingWrites sync.WaitGroup
+)
+
+// startWriters starts MaxInflightWrites workers. It's a no-op if they are
+// already running.
+func startWriters() {
+	writersMu.Lock()
+	defer writersMu.Unlock()
+	if writeCh != nil {
+		return
+	}
+
+	cfg := config.GetGlobalConfig().TopSQL
+	writeCh = make(chan writeJob, cfg.WriteQueueSize)
+	ch := writeCh
+	for i := 0; i < cfg.MaxInflightWrites; i++ {
+		writersWG.Add(1)
+		go utils.GoWithRecovery(func() {
+			defer writersWG.Done()
+			for job := range ch {
+				write(job)
+			}
+		}, nil)
+	}
+
+	if err := openSpill(); err != nil {
+		log.Warn("failed to open spilled records", zap.Error(err))
+	}
+	startReplayer(ch)
+}
+
+// stopWriters waits for queued records to be written. It's a no-op if
+// workers are not running.
+func stopWriters() {
+	writersMu.Lock()
+	defer writersMu.Unlock()
+	if writeCh == nil {
+		return
+	}
+
+	stopReplayer()
+	close(writeCh)
+	writersWG.Wait()
+	writeCh = nil
+
+	spillMu.Lock()
+	if active != nil {
+		closeActive()
+	}
+	spillMu.Unlock()
+}
+
+// enqueueWrite queues the job, following the shed policy if the queue is
+// full. The job is released if it's not queued.
+func enqueueWrite(job writeJob) error {
+	writersMu.RLock()
+	defer writersMu.RUnlock()
+	if writeCh == nil {
+		job.release()
+		return ErrStoreIsStopped
+	}
+
+	pendingWrites.Add(1)
+	policy := config.GetGlobalConfig().TopSQL.ShedPolicy
+	if policy != config.ShedPolicyDrop && policy != config.ShedPolicySpill {
+		writeCh <- job
+		return nil
+	}
+
+	select {
+	case writeCh <- job:
+		return nil
+	default:
+	}
+	pendingWrites.Done()
+	defer job.release()
+	if policy == config.ShedPolicySpill && spill(job) {
+		return nil
+	}
+	ShedRecords.Inc()
+	observeDropped(job.instance, job.instanceType, reasonShed)
+	return ErrStoreIsBusy
+}
+
+// FlushWrites waits for queued records to be written.
+func FlushWrites() {
+	pendingWrites.Wait()
+}
+
+func write(job writeJob) {
+	defer pendingWrites.Done()
+	defer job.release()
+
+	start := time.Now()
+	if err := writeTimeseriesDB(job.cpu); err != nil {
+		log.Warn("failed to write records", zap.String("instance", job.instance), zap.Error(err))
+		return
+	}
+	for _, m := range job.keys {
+		if err := writeTimeseriesDB(m); err != nil {
+			log.Warn("failed to write keys", zap.String("instance", job.instance), zap.Error(err))
+			return
+		}
+	}
+	observeWrite(job.instance, job.instanceType, targetTimeseries, start)
+	observeWritten(job.instance, job.instanceType)
+	observeFreshness(job.instance, job.cpu.Timestamps, time.Now())
+	publishLive(job.cpu)
+
+	start = time.Now()
+	if err := markActivity(job.instance, job.instanceType, job.cpu.Timestamps); err != nil {
+		log.Warn("failed to mark instance activity", zap.String("instance", job.instance), zap.Error(err))
+	}
+	observeWrite(job.instance, job.instanceType, targetDocument, start)
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteQueueDrop(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{TopSQL: config.TopSQL{MaxInflightWrites: 1, WriteQueueSize: 1, ShedPolicy: config.ShedPolicyDrop}})
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, initDocumentDB(db))
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	writes := 0
+	vminsertHandler = func(w http.ResponseWriter, r *http.Request) {
+		writes++
+		if writes == 1 {
+			close(entered)
+			<-unblock
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	defer func() { vminsertHandler = nil }()
+	startWriters()
+	defer stopWriters()
+
+	// the only worker is held by the first record, and the second one is queued
+	require.NoError(t, TopSQLRecord("127.0.0.1:10080", "tidb", genCPUTimeRecord(1)))
+	<-entered
+	require.NoError(t, TopSQLRecord("127.0.0.1:10081", "tidb", genCPUTimeRecord(1)))
+	shed := ShedRecords.Load()
+	require.Equal(t, ErrStoreIsBusy, TopSQLRecord("127.0.0.1:10082", "tidb", genCPUTimeRecord(1)))
+	require.Equal(t, shed+1, ShedRecords.Load())
+
+	close(unblock)
+	FlushWrites()
+	require.Equal(t, 2, writes)
+
+	// queued records are written before workers stop
+	require.NoError(t, TopSQLRecord("127.0.0.1:10080", "tidb", genCPUTimeRecord(1)))
+	stopWriters()
+	require.Equal(t, 3, writes)
+	require.Equal(t, ErrStoreIsStopped, TopSQLRecord("127.0.0.1:10080", "tidb", genCPUTimeRecord(1)))
+}
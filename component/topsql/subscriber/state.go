@@ -0,0 +1,90 @@
+package subscriber
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// States of a subscriber, exported by the
+// `ng_monitoring_topsql_subscriber_state{instance, component}` gauge as the
+// values in parentheses.
+const (
+	// StateBackoff (0) waits to reconnect after a failure.
+	StateBackoff = "backoff"
+	// StateConnecting (1) dials and subscribes.
+	StateConnecting = "connecting"
+	// StateConnected (2) receives data.
+	StateConnected = "connected"
+)
+
+var stateValues = map[string]float64{
+	StateBackoff:    0,
+	StateConnecting: 1,
+	StateConnected:  2,
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// healthyDuration resets the backoff once a subscription lasts that long.
+	healthyDuration = time.Minute
+)
+
+var (
+	statesMu sync.Mutex
+	// states are the states of subscribers by instance. The latest subscriber
+	// of an instance owns its gauge.
+	states = make(map[string]*Subscriber)
+)
+
+func (s *Subscriber) gaugeName() string {
+	return fmt.Sprintf(`ng_monitoring_topsql_subscriber_state{instance=%q,component=%q}`, InstanceOf(s.component), s.component.Name)
+}
+
+// setState records and logs the transition.
+func (s *Subscriber) setState(state string) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	if s.state == state {
+		return
+	}
+	log.Info("topsql subscriber state changed",
+		zap.String("instance", InstanceOf(s.component)),
+		zap.String("component", s.component.Name),
+		zap.String("from", s.state),
+		zap.String("to", state))
+	s.state = state
+
+	instance := InstanceOf(s.component)
+	if states[instance] != s {
+		states[instance] = s
+		metrics.GetOrCreateGauge(s.gaugeName(), func() float64 {
+			statesMu.Lock()
+			defer statesMu.Unlock()
+			if owner, ok := states[instance]; ok {
+				return stateValues[owner.state]
+			}
+			return 0
+		})
+	}
+}
+
+// untrack removes the state once the subscriber exits, unless a newer
+// subscriber of the same instance has taken over.
+func (s *Subscriber) untrack() {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	instance := InstanceOf(s.component)
+	if states[instance] != s {
+		return
+	}
+	delete(states, instance)
+	metrics.UnregisterMetric(s.gaugeName())
+}
@@ -0,0 +1,45 @@
+package subscriber
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/ng_monitoring/component/topology"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func stateGauges() string {
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "ng_monitoring_topsql_subscriber_state") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestSubscriberState(t *testing.T) {
+	component := topology.Component{Name: topology.ComponentTiKV, IP: "127.0.0.1", Port: 20160}
+	const gauge = `ng_monitoring_topsql_subscriber_state{instance="127.0.0.1:20160",component="tikv"}`
+
+	old := NewSubscriber(component)
+	old.setState(StateConnecting)
+	require.Equal(t, gauge+" 1", stateGauges())
+	old.setState(StateConnected)
+	require.Equal(t, gauge+" 2", stateGauges())
+
+	// a newer subscriber of the same instance takes over the gauge
+	newer := NewSubscriber(component)
+	newer.setState(StateBackoff)
+	require.Equal(t, gauge+" 0", stateGauges())
+	old.untrack()
+	require.Equal(t, gauge+" 0", stateGauges())
+
+	newer.untrack()
+	require.Empty(t, stateGauges())
+}
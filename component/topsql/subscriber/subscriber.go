@@ -2,6 +2,7 @@ package subscriber
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -19,7 +20,9 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -27,11 +30,26 @@ var (
 )
 
 var (
+	topoSubscriber topology.Subscriber
+
+	mu           sync.Mutex
 	globalStopCh chan struct{}
 	scraperWG    sync.WaitGroup
 )
 
-func Init(topoSubscriber topology.Subscriber) {
+func Init(topoSubscriber_ topology.Subscriber) {
+	topoSubscriber = topoSubscriber_
+	Start()
+}
+
+// Start subscribes to the components. It's a no-op if subscribers are already running.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	if globalStopCh != nil {
+		return
+	}
+
 	globalStopCh = make(chan struct{})
 
 	scraperWG.Add(1)
@@ -42,16 +60,26 @@ func Init(topoSubscriber topology.Subscriber) {
 	}, nil)
 }
 
+// Stop closes all subscribers. It's a no-op if subscribers are not running.
 func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	if globalStopCh == nil {
+		return
+	}
+
 	log.Info("stopping subscribers")
 	close(globalStopCh)
 	scraperWG.Wait()
+	globalStopCh = nil
 	log.Info("stop subscribers successfully")
 }
 
 type Manager struct {
 	topoSubscriber topology.Subscriber
 	components     map[topology.Component]*Subscriber
+	// latest is the latest topology, kept to apply pausing and resuming
+	latest []topology.Component
 }
 
 func (m *Manager) run() {
@@ -80,24 +108,12 @@ out:
 				continue
 			}
 
-			in, out := m.getTopoChange(coms)
-
-			// clean up stale components
-			for i := range out {
-				m.components[out[i]].Close()
-				delete(m.components, out[i])
-			}
-
-			// set up incoming components
-			for i := range in {
-				subscriber := NewSubscriber(in[i])
-				m.components[in[i]] = subscriber
-
-				scraperWG.Add(1)
-				go utils.GoWithRecovery(func() {
-					defer scraperWG.Done()
-					subscriber.run()
-				}, nil)
+			m.latest = coms
+			store.SetAliveInstances(aliveInstances(coms))
+			m.apply(coms)
+		case <-store.PauseChanged():
+			if m.latest != nil {
+				m.apply(m.latest)
 			}
 		case <-globalStopCh:
 			break out
@@ -105,16 +121,48 @@ out:
 	}
 }
 
+func (m *Manager) apply(coms []topology.Component) {
+	in, out := m.getTopoChange(coms)
+
+	// clean up stale components
+	for i := range out {
+		m.components[out[i]].Close()
+		delete(m.components, out[i])
+	}
+
+	// set up incoming components
+	for i := range in {
+		subscriber := NewSubscriber(in[i])
+		m.components[in[i]] = subscriber
+
+		scraperWG.Add(1)
+		go utils.GoWithRecovery(func() {
+			defer scraperWG.Done()
+			subscriber.run()
+		}, nil)
+	}
+}
+
+// getTopoChange returns components to subscribe and to unsubscribe. Paused
+// instances are unsubscribed as if they were gone.
 func (m *Manager) getTopoChange(current []topology.Component) (in, out []topology.Component) {
 	curMap := make(map[topology.Component]struct{})
 
 	for i := range current {
+		if !current[i].IsUp() {
+			continue
+		}
+
 		switch current[i].Name {
 		case topology.ComponentTiDB:
 		case topology.ComponentTiKV:
+		case topology.ComponentTiFlash:
 		default:
 			continue
 		}
+		if store.IsPaused(InstanceOf(current[i])) {
+			continue
+		}
 
 		curMap[current[i]] = struct{}{}
 		if _, contains := m.components[current[i]]; !contains {
@@ -131,17 +179,47 @@ func (m *Manager) getTopoChange(current []topology.Component) (in, out []topolog
 	return
 }
 
+// aliveInstances returns the up instances in the topology, paused or not.
+func aliveInstances(coms []topology.Component) []string {
+	var instances []string
+	for _, c := range coms {
+		if c.IsUp() {
+			instances = append(instances, InstanceOf(c))
+		}
+	}
+	return instances
+}
+
+// InstanceOf is the address data of the component is stored by.
+func InstanceOf(c topology.Component) string {
+	if c.Name == topology.ComponentTiDB {
+		return fmt.Sprintf("%s:%d", c.IP, c.StatusPort)
+	}
+	return fmt.Sprintf("%s:%d", c.IP, c.Port)
+}
+
 type Subscriber struct {
 	isDown    *atomic.Bool
 	component topology.Component
 	closeCh   chan struct{}
+	// ctx is canceled on closing, to abort ongoing dials.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// state is guarded by statesMu.
+	state string
 }
 
+// errUnsupported stops resubscribing to components which don't report.
+var errUnsupported = errors.New("the component doesn't support top SQL")
+
 func NewSubscriber(component topology.Component) *Subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Subscriber{
 		isDown:    atomic.NewBool(false),
 		component: component,
 		closeCh:   make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
@@ -150,146 +228,246 @@ func (s *Subscriber) IsDown() bool {
 }
 
 func (s *Subscriber) Close() {
+	s.cancel()
 	close(s.closeCh)
 }
 
+// run subscribes to the component, and resubscribes with exponential backoff
+// once the subscription breaks, until it's closed.
 func (s *Subscriber) run() {
 	defer s.isDown.Store(true)
+	defer s.cleanup()
 	log.Info("starting to scrape top SQL from the component", zap.Any("component", s.component))
 
-	switch s.component.Name {
-	case topology.ComponentTiDB:
-		s.scrapeTiDB()
-	case topology.ComponentTiKV:
-		s.scrapeTiKV()
+	backoff := minBackoff
+	for {
+		s.setState(StateConnecting)
+		start := time.Now()
+		var err error
+		switch s.component.Name {
+		case topology.ComponentTiDB:
+			err = s.scrapeTiDB()
+		case topology.ComponentTiKV, topology.ComponentTiFlash:
+			err = s.scrapeResourceMetering()
+		default:
+			log.Error("unexpected scrape target", zap.String("component", s.component.Name))
+			return
+		}
+		if s.closed() {
+			return
+		}
+		if err == errUnsupported {
+			log.Info("the component doesn't support top SQL", zap.Any("component", s.component))
+			return
+		}
+
+		if time.Since(start) >= healthyDuration {
+			backoff = minBackoff
+		}
+		s.setState(StateBackoff)
+		log.Warn("topsql subscription is broken, resubscribe later", zap.Any("component", s.component), zap.Duration("backoff", backoff), zap.Error(err))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-s.closeCh:
+			timer.Stop()
+			return
+		case <-globalStopCh:
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// cleanup drops the states of the instance once it's removed from the
+// topology. A newer subscriber of the same instance, e.g. after upgrading,
+// keeps them.
+func (s *Subscriber) cleanup() {
+	s.untrack()
+	instance := InstanceOf(s.component)
+	if !store.IsAlive(instance) {
+		store.ForgetInstance(instance)
+		log.Info("cleaned up the instance removed from the topology", zap.String("instance", instance))
+	}
+}
+
+func (s *Subscriber) closed() bool {
+	select {
+	case <-s.closeCh:
+		return true
+	case <-globalStopCh:
+		return true
 	default:
-		log.Error("unexpected scrape target", zap.String("component", s.component.Name))
+		return false
 	}
 }
 
-func (s *Subscriber) scrapeTiDB() {
-	addr := fmt.Sprintf("%s:%d", s.component.IP, s.component.StatusPort)
-	conn, err := dial(addr)
+// scrapeTiDB subscribes to TiDB, and returns why the subscription ends.
+func (s *Subscriber) scrapeTiDB() error {
+	addr := InstanceOf(s.component)
+	conn, err := dial(s.ctx, addr)
 	if err != nil {
-		log.Error("failed to dial scrape target", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to dial: %w", err)
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(s.ctx)
 	defer cancel()
 
 	client := tipb.NewTopSQLPubSubClient(conn)
 	stream, err := client.Subscribe(ctx, &tipb.TopSQLSubRequest{})
 	if err != nil {
-		log.Error("failed to call Subscribe", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to subscribe: %w", err)
 	}
+	if err := store.Instance(addr, topology.ComponentTiDB); err != nil {
+		return fmt.Errorf("failed to store instance: %w", err)
+	}
+	s.setState(StateConnected)
 
 	stopCh := make(chan struct{})
+	var recvErr error
 	go utils.GoWithRecovery(func() {
 		defer close(stopCh)
 
-		if err := store.Instance(addr, topology.ComponentTiDB); err != nil {
-			log.Warn("failed to store instance", zap.Error(err))
-			return
-		}
+		guard := newWindowGuard()
 
 		for {
 			r, err := stream.Recv()
 			if err == io.EOF {
-				break
+				recvErr = errors.New("stream closed by the component")
+				return
 			}
 			if err != nil {
-				log.Warn("failed to receive records from stream", zap.Error(err))
-				break
+				recvErr = fmt.Errorf("failed to receive records from stream: %w", err)
+				return
 			}
 
-			if record := r.GetRecord(); record != nil {
-				err = store.TopSQLRecord(addr, topology.ComponentTiDB, record)
-				if err != nil {
-					log.Warn("failed to store top SQL records", zap.Error(err))
-				}
-				continue
-			}
-
-			if meta := r.GetSqlMeta(); meta != nil {
-				err = store.SQLMeta(meta)
-				if err != nil {
-					log.Warn("failed to store SQL meta", zap.Error(err))
-				}
-				continue
-			}
-
-			if meta := r.GetPlanMeta(); meta != nil {
-				err = store.PlanMeta(meta)
-				if err != nil {
-					log.Warn("failed to store SQL meta", zap.Error(err))
-				}
-			}
+			s.storeTopSQL(addr, guard, r)
 		}
 	}, nil)
 
 	select {
 	case <-globalStopCh:
 	case <-stopCh:
+		return recvErr
 	case <-s.closeCh:
 	}
+	return nil
 }
 
-func (s *Subscriber) scrapeTiKV() {
-	addr := fmt.Sprintf("%s:%d", s.component.IP, s.component.Port)
-	conn, err := dial(addr)
+// scrapeResourceMetering subscribes to TiKV and TiFlash, which report cpu time
+// by resource group tags, and returns why the subscription ends.
+func (s *Subscriber) scrapeResourceMetering() error {
+	addr := InstanceOf(s.component)
+	conn, err := dial(s.ctx, addr)
 	if err != nil {
-		log.Error("failed to dial scrape target", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to dial: %w", err)
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(s.ctx)
 	defer cancel()
 
 	client := resource_usage_agent.NewResourceMeteringPubSubClient(conn)
 	records, err := client.Subscribe(ctx, &resource_usage_agent.ResourceMeteringRequest{})
 	if err != nil {
-		log.Error("failed to call SubCPUTimeRecord", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	if err := store.Instance(addr, s.component.Name); err != nil {
+		return fmt.Errorf("failed to store instance: %w", err)
 	}
+	s.setState(StateConnected)
 
 	stopCh := make(chan struct{})
+	var recvErr error
 	go utils.GoWithRecovery(func() {
 		defer close(stopCh)
 
-		if err := store.Instance(addr, topology.ComponentTiKV); err != nil {
-			log.Warn("failed to store instance", zap.Error(err))
-			return
-		}
+		guard := newWindowGuard()
 
 		for {
 			r, err := records.Recv()
 			if err == io.EOF {
-				break
+				recvErr = errors.New("stream closed by the component")
+				return
 			}
-			if err != nil {
-				log.Warn("failed to receive records from stream", zap.Error(err))
-				break
+			if status.Code(err) == codes.Unimplemented {
+				// TiFlash of older versions doesn't report
+				recvErr = errUnsupported
+				return
 			}
-
-			err = store.ResourceMeteringRecord(addr, topology.ComponentTiKV, r)
 			if err != nil {
-				log.Warn("failed to store resource metering records", zap.Error(err))
+				recvErr = fmt.Errorf("failed to receive records from stream: %w", err)
+				return
 			}
+
+			s.storeResourceUsage(addr, guard, r)
 		}
 	}, nil)
 
 	select {
 	case <-globalStopCh:
 	case <-stopCh:
+		return recvErr
 	case <-s.closeCh:
 	}
+	return nil
+}
+
+// storeTopSQL stores a response subscribed from TiDB.
+func (s *Subscriber) storeTopSQL(addr string, guard *windowGuard, r *tipb.TopSQLSubResponse) {
+	if record := r.GetRecord(); record != nil {
+		if dropped := guard.filterTopSQL(record); dropped != 0 {
+			store.ObserveDroppedPoints(addr, topology.ComponentTiDB, store.ReasonOutOfOrder, dropped)
+			log.Warn("drop out-of-order or duplicated top SQL points", zap.Any("component", s.component), zap.Int("count", dropped))
+		}
+		if len(record.RecordListTimestampSec) == 0 {
+			return
+		}
+
+		// shed records are counted rather than logged one by one
+		err := store.TopSQLRecord(addr, topology.ComponentTiDB, record)
+		if err != nil && err != store.ErrStoreIsBusy {
+			log.Warn("failed to store top SQL records", zap.Error(err))
+		}
+		return
+	}
+
+	if meta := r.GetSqlMeta(); meta != nil {
+		if err := store.SQLMeta(meta); err != nil {
+			log.Warn("failed to store SQL meta", zap.Error(err))
+		}
+		return
+	}
+
+	if meta := r.GetPlanMeta(); meta != nil {
+		if err := store.PlanMeta(meta); err != nil {
+			log.Warn("failed to store SQL meta", zap.Error(err))
+		}
+	}
+}
+
+// storeResourceUsage stores a record subscribed from TiKV or TiFlash.
+func (s *Subscriber) storeResourceUsage(addr string, guard *windowGuard, r *resource_usage_agent.ResourceUsageRecord) {
+	if dropped := guard.filterResourceUsage(r); dropped != 0 {
+		store.ObserveDroppedPoints(addr, s.component.Name, store.ReasonOutOfOrder, dropped)
+		log.Warn("drop out-of-order or duplicated resource metering points", zap.Any("component", s.component), zap.Int("count", dropped))
+	}
+	if len(r.RecordListTimestampSec) == 0 {
+		return
+	}
+
+	err := store.ResourceMeteringRecord(addr, s.component.Name, r)
+	if err != nil && err != store.ErrStoreIsBusy {
+		log.Warn("failed to store resource metering records", zap.Error(err))
+	}
 }
 
-func dial(addr string) (*grpc.ClientConn, error) {
+func dial(ctx context.Context, addr string) (*grpc.ClientConn, error) {
 	tlsConfig := config.GetGlobalConfig().Security.GetTLSConfig()
 
 	var tlsOption grpc.DialOption
@@ -299,7 +477,7 @@ func dial(addr string) (*grpc.ClientConn, error) {
 		tlsOption = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
 	}
 
-	dialCtx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
 	defer cancel()
 
 	return grpc.DialContext(
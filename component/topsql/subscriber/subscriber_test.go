@@ -0,0 +1,44 @@
+package subscriber
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseWhileDialing(t *testing.T) {
+	config.StoreGlobalConfig(&config.Config{})
+	store.SetAliveInstances(nil)
+
+	// nothing listens on the port, so it keeps dialing until the timeout
+	s := NewSubscriber(topology.Component{Name: topology.ComponentTiKV, IP: "127.0.0.1", Port: 1})
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the subscriber is not torn down promptly")
+	}
+	require.True(t, s.IsDown())
+	require.Empty(t, stateGauges())
+}
+
+func TestAliveInstances(t *testing.T) {
+	coms := []topology.Component{
+		{Name: topology.ComponentTiDB, IP: "127.0.0.1", Port: 4000, StatusPort: 10080, Status: topology.ComponentStatusUp},
+		{Name: topology.ComponentTiKV, IP: "127.0.0.1", Port: 20160, StatusPort: 20180, Status: topology.ComponentStatusUp},
+		{Name: topology.ComponentTiKV, IP: "127.0.0.1", Port: 20161, StatusPort: 20181, Status: topology.ComponentStatusOffline},
+	}
+	require.Equal(t, []string{"127.0.0.1:10080", "127.0.0.1:20160"}, aliveInstances(coms))
+}
@@ -0,0 +1,132 @@
+package subscriber
+
+import (
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+)
+
+var (
+	// LateRecordPoints counts points dropped for falling behind the tolerance.
+	LateRecordPoints = atomic.NewUint64(0)
+	// DuplicatedRecordPoints counts points dropped for being delivered again.
+	DuplicatedRecordPoints = atomic.NewUint64(0)
+)
+
+type pointKey struct {
+	series string
+	ts     uint64
+}
+
+// windowGuard keeps the timestamps reported by a stream increasing. Points
+// within the tolerance behind the latest timestamp are accepted as is, since
+// the timeseries database orders samples itself. Points delivered again, e.g.
+// on retries, are dropped so that aggregations don't count them twice. Points
+// further behind are dropped and counted as violations.
+type windowGuard struct {
+	toleranceSecs uint64
+	watermark     uint64
+	lastEvict     uint64
+	recent        map[pointKey]struct{}
+}
+
+func newWindowGuard() *windowGuard {
+	toleranceSecs := config.GetGlobalConfig().TopSQL.OutOfOrderToleranceSeconds
+	return &windowGuard{
+		toleranceSecs: uint64(toleranceSecs),
+		recent:        make(map[pointKey]struct{}),
+	}
+}
+
+// admit reports whether the point should be stored.
+func (g *windowGuard) admit(series string, ts uint64) bool {
+	if ts+g.toleranceSecs < g.watermark {
+		LateRecordPoints.Inc()
+		return false
+	}
+
+	key := pointKey{series: series, ts: ts}
+	if _, ok := g.recent[key]; ok {
+		DuplicatedRecordPoints.Inc()
+		return false
+	}
+	g.recent[key] = struct{}{}
+
+	if ts > g.watermark {
+		g.watermark = ts
+		g.evict()
+	}
+	return true
+}
+
+// evict forgets points which can no longer be admitted. It's amortized by
+// evicting once per tolerance.
+func (g *windowGuard) evict() {
+	if g.watermark < g.lastEvict+g.toleranceSecs {
+		return
+	}
+	for key := range g.recent {
+		if key.ts+g.toleranceSecs < g.watermark {
+			delete(g.recent, key)
+		}
+	}
+	g.lastEvict = g.watermark
+}
+
+// filterTopSQL drops unadmitted points of the record in place, and returns
+// the number of dropped points.
+func (g *windowGuard) filterTopSQL(record *tipb.CPUTimeRecord) int {
+	if len(record.RecordListTimestampSec) != len(record.RecordListCpuTimeMs) {
+		return 0
+	}
+
+	series := string(record.SqlDigest) + "/" + string(record.PlanDigest)
+	n := 0
+	for i, ts := range record.RecordListTimestampSec {
+		if !g.admit(series, ts) {
+			continue
+		}
+		record.RecordListTimestampSec[n] = ts
+		record.RecordListCpuTimeMs[n] = record.RecordListCpuTimeMs[i]
+		n++
+	}
+
+	dropped := len(record.RecordListTimestampSec) - n
+	record.RecordListTimestampSec = record.RecordListTimestampSec[:n]
+	record.RecordListCpuTimeMs = record.RecordListCpuTimeMs[:n]
+	return dropped
+}
+
+// filterResourceUsage is like filterTopSQL, but for records from TiKV.
+func (g *windowGuard) filterResourceUsage(record *resource_usage_agent.ResourceUsageRecord) int {
+	total := len(record.RecordListTimestampSec)
+	if len(record.RecordListCpuTimeMs) != total {
+		return 0
+	}
+	withKeys := len(record.RecordListReadKeys) == total && len(record.RecordListWriteKeys) == total
+
+	series := string(record.ResourceGroupTag)
+	n := 0
+	for i, ts := range record.RecordListTimestampSec {
+		if !g.admit(series, ts) {
+			continue
+		}
+		record.RecordListTimestampSec[n] = ts
+		record.RecordListCpuTimeMs[n] = record.RecordListCpuTimeMs[i]
+		if withKeys {
+			record.RecordListReadKeys[n] = record.RecordListReadKeys[i]
+			record.RecordListWriteKeys[n] = record.RecordListWriteKeys[i]
+		}
+		n++
+	}
+
+	record.RecordListTimestampSec = record.RecordListTimestampSec[:n]
+	record.RecordListCpuTimeMs = record.RecordListCpuTimeMs[:n]
+	if withKeys {
+		record.RecordListReadKeys = record.RecordListReadKeys[:n]
+		record.RecordListWriteKeys = record.RecordListWriteKeys[:n]
+	}
+	return total - n
+}
@@ -0,0 +1,49 @@
+package subscriber
+
+import (
+	"testing"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowGuard(t *testing.T) {
+	g := &windowGuard{toleranceSecs: 10, recent: make(map[pointKey]struct{})}
+
+	record := &tipb.CPUTimeRecord{
+		SqlDigest:              []byte("sql"),
+		RecordListTimestampSec: []uint64{100, 101, 102},
+		RecordListCpuTimeMs:    []uint32{1, 2, 3},
+	}
+	require.Equal(t, 0, g.filterTopSQL(record))
+
+	// re-delivered and slightly out-of-order points
+	record = &tipb.CPUTimeRecord{
+		SqlDigest:              []byte("sql"),
+		RecordListTimestampSec: []uint64{101, 102, 99, 103},
+		RecordListCpuTimeMs:    []uint32{2, 3, 4, 5},
+	}
+	require.Equal(t, 2, g.filterTopSQL(record))
+	require.Equal(t, []uint64{99, 103}, record.RecordListTimestampSec)
+	require.Equal(t, []uint32{4, 5}, record.RecordListCpuTimeMs)
+
+	// the same timestamp of another series is not a duplicate
+	record = &tipb.CPUTimeRecord{
+		SqlDigest:              []byte("sql2"),
+		RecordListTimestampSec: []uint64{103, 200},
+		RecordListCpuTimeMs:    []uint32{1, 1},
+	}
+	require.Equal(t, 0, g.filterTopSQL(record))
+
+	// beyond the tolerance
+	record = &tipb.CPUTimeRecord{
+		SqlDigest:              []byte("sql"),
+		RecordListTimestampSec: []uint64{189, 190},
+		RecordListCpuTimeMs:    []uint32{1, 1},
+	}
+	require.Equal(t, 1, g.filterTopSQL(record))
+	require.Equal(t, []uint64{190}, record.RecordListTimestampSec)
+	for key := range g.recent {
+		require.GreaterOrEqual(t, key.ts+g.toleranceSecs, uint64(190))
+	}
+}
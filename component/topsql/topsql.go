@@ -3,22 +3,110 @@ package topsql
 import (
 	"net/http"
 
+	"github.com/zhongzc/ng_monitoring/component/admin"
 	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql/annotation"
+	"github.com/zhongzc/ng_monitoring/component/topsql/clocksync"
+	"github.com/zhongzc/ng_monitoring/component/topsql/detector"
+	"github.com/zhongzc/ng_monitoring/component/topsql/instancemetrics"
+	"github.com/zhongzc/ng_monitoring/component/topsql/masking"
 	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/component/topsql/retention"
 	"github.com/zhongzc/ng_monitoring/component/topsql/store"
 	"github.com/zhongzc/ng_monitoring/component/topsql/subscriber"
+	"github.com/zhongzc/ng_monitoring/component/topsql/webhook"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
 
 	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
 )
 
 func Init(gj *genji.DB, insertHdr, selectHdr http.HandlerFunc, subsbr topology.Subscriber) {
+	masking.Init(gj)
 	store.Init(insertHdr, gj)
 	query.Init(selectHdr, gj)
 	subscriber.Init(subsbr)
+	detector.Init(gj)
+	if err := retention.Init(gj); err != nil {
+		log.Fatal("failed to initialize retention", zap.Error(err))
+	}
+	webhook.Init()
+	instancemetrics.Init(insertHdr, topology.Subscribe())
+	if err := clocksync.Init(gj); err != nil {
+		log.Fatal("failed to initialize clock sync", zap.Error(err))
+	}
+	if err := annotation.Init(gj); err != nil {
+		log.Fatal("failed to initialize annotations", zap.Error(err))
+	}
+
+	if config.NeedsPresetDecision() {
+		components := topology.Subscribe()
+		go utils.GoWithRecovery(func() { decidePreset(components) }, nil)
+	}
+
+	admin.Register(admin.Subsystem{
+		Name:  "topsql-store",
+		Start: func() error { store.Start(); return nil },
+		Stop:  func() error { store.Stop(); return nil },
+	})
+	admin.Register(admin.Subsystem{
+		Name:      "topsql-subscriber",
+		DependsOn: []string{"topsql-store"},
+		Start:     func() error { subscriber.Start(); return nil },
+		Stop:      func() error { subscriber.Stop(); return nil },
+	})
+	admin.Register(admin.Subsystem{
+		Name:  "topsql-retention",
+		Start: func() error { retention.Start(); return nil },
+		Stop:  func() error { retention.Stop(); return nil },
+	})
+	admin.Register(admin.Subsystem{
+		Name:  "topsql-clock-sync",
+		Start: func() error { clocksync.Start(); return nil },
+		Stop:  func() error { clocksync.Stop(); return nil },
+	})
+	admin.Register(admin.Subsystem{
+		Name:  "topsql-webhook",
+		Start: func() error { webhook.Start(); return nil },
+		Stop:  func() error { webhook.Stop(); return nil },
+	})
+	admin.Register(admin.Subsystem{
+		Name:  "topsql-instance-metrics",
+		Start: func() error { instancemetrics.Start(); return nil },
+		Stop:  func() error { instancemetrics.Stop(); return nil },
+	})
 }
 
 func Stop() {
+	clocksync.Stop()
+	instancemetrics.Stop()
+	webhook.Stop()
+	retention.Stop()
+	detector.Stop()
 	subscriber.Stop()
 	store.Stop()
 	query.Stop()
 }
+
+// decidePreset decides the preset by the number of instances first discovered.
+func decidePreset(components topology.Subscriber) {
+	for coms := range components {
+		instances := 0
+		for _, com := range coms {
+			switch com.Name {
+			case topology.ComponentTiDB, topology.ComponentTiKV, topology.ComponentTiFlash:
+				instances++
+			}
+		}
+		if instances == 0 {
+			continue
+		}
+
+		if err := config.DecidePreset(instances); err != nil {
+			log.Warn("failed to decide topsql preset", zap.Error(err))
+		}
+		return
+	}
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// SignatureHeader carries `sha256=<hex encoded HMAC-SHA256 of the body>` if a
+// secret is configured.
+const SignatureHeader = "X-Signature"
+
+const (
+	windowSecs     = 60
+	checkInterval  = 10 * time.Second
+	requestTimeout = 10 * time.Second
+)
+
+// Payload is the body of a webhook request. Records are the cpu time of every
+// (instance, sql digest, plan digest) within (WindowStartSecs, WindowEndSecs].
+// A window with more records than the batch size is split into requests.
+type Payload struct {
+	WindowStartSecs int64                 `json:"window_start_secs"`
+	WindowEndSecs   int64                 `json:"window_end_secs"`
+	Records         []query.CPUTimeRecord `json:"records"`
+}
+
+var (
+	httpClient     = &http.Client{Timeout: requestTimeout}
+	retryBaseDelay = time.Second
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+func Init() {
+	Start()
+}
+
+// Start delivers windows finalized from now on. It's a no-op if it's already
+// running.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh != nil {
+		return
+	}
+
+	stopCh = make(chan struct{})
+	ch := stopCh
+	wg.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer wg.Done()
+		run(ch)
+	}, nil)
+}
+
+// Stop waits for the ongoing delivery to be given up. It's a no-op if it's not
+// running.
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh == nil {
+		return
+	}
+
+	close(stopCh)
+	wg.Wait()
+	stopCh = nil
+}
+
+func run(stopCh chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	// the end of the next window to deliver
+	var next int64
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		cfg := config.GetGlobalConfig().TopSQL
+		if len(cfg.Webhook.URL) == 0 {
+			next = 0
+			continue
+		}
+
+		// Points within the out-of-order tolerance may still arrive, so a
+		// window is final only after that.
+		toleranceSecs := cfg.OutOfOrderToleranceSeconds
+		if toleranceSecs <= 0 {
+			toleranceSecs = config.DefTopSQLOutOfOrderToleranceSecs
+		}
+		finalized := time.Now().Unix() - int64(toleranceSecs)
+		if next == 0 {
+			next = finalized - finalized%windowSecs
+		}
+
+		for ; next <= finalized; next += windowSecs {
+			if err := deliver(next, cfg.Webhook, stopCh); err != nil {
+				log.Warn("failed to deliver topsql window, retry later", zap.Int64("window-end", next), zap.Error(err))
+				break
+			}
+		}
+	}
+}
+
+// deliver posts the window ending at windowEnd. Only failures to read the
+// window are returned, batches failed to post are given up after retries.
+func deliver(windowEnd int64, cfg config.Webhook, stopCh chan struct{}) error {
+	var fetched []query.CPUTimeRecord
+	if err := query.CPUTimeRecords(int(windowEnd), int(windowEnd), windowSecs, &fetched); err != nil {
+		return err
+	}
+
+	// the following window is fetched as well, which is not final yet
+	records := fetched[:0]
+	for _, r := range fetched {
+		if r.TimestampSecs == windowEnd {
+			records = append(records, r)
+		}
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = config.DefTopSQLWebhookBatchSize
+	}
+	for i := 0; i < len(records); i += batchSize {
+		j := i + batchSize
+		if j > len(records) {
+			j = len(records)
+		}
+
+		body, err := json.Marshal(Payload{
+			WindowStartSecs: windowEnd - windowSecs,
+			WindowEndSecs:   windowEnd,
+			Records:         records[i:j],
+		})
+		if err != nil {
+			return err
+		}
+		if err = post(body, cfg, stopCh); err != nil {
+			log.Warn("give up posting topsql records to webhook",
+				zap.Int64("window-end", windowEnd),
+				zap.Int("records", j-i),
+				zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// post sends the body, retrying with exponential backoff on failures.
+func post(body []byte, cfg config.Webhook, stopCh chan struct{}) error {
+	var signature string
+	if len(cfg.Secret) != 0 {
+		mac := hmac.New(sha256.New, []byte(cfg.Secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	var err error
+	delay := retryBaseDelay
+	for retry := 0; ; retry++ {
+		if err = postOnce(cfg.URL, body, signature); err == nil {
+			return nil
+		}
+		if retry >= cfg.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-stopCh:
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func postOnce(url string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(signature) != 0 {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPost(t *testing.T) {
+	retryBaseDelay = 0
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(SignatureHeader))
+
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.Webhook{URL: server.URL, Secret: "secret", MaxRetries: 1}
+	require.Error(t, post([]byte(`{}`), cfg, nil))
+	require.Equal(t, 2, requests)
+
+	require.NoError(t, post([]byte(`{}`), cfg, nil))
+	require.Equal(t, 3, requests)
+}
@@ -25,6 +25,25 @@ const (
 	DefProfileSeconds                = 10
 	DefProfilingTimeoutSeconds       = 120
 	DefProfilingDataRetentionSeconds = 3 * 24 * 60 * 60 // 3 days
+	DefProfilingScrapeConcurrency    = 64
+	DefDocDBBlockCacheMinMB          = 64
+	DefDocDBBlockCacheMaxMB          = 1024
+	DefTopSQLRetentionDays           = 30
+	DefTopSQLOutOfOrderToleranceSecs = 120
+	DefTopSQLHotRetentionMultiplier  = 1
+	DefTopSQLHotMinQueries           = 3
+	DefTopSQLHotTopCPU               = 100
+	DefTopSQLMaxInflightWrites       = 16
+	DefTopSQLWriteQueueSize          = 1024
+	DefTopSQLSpillMaxMB              = 1024
+	DefTopSQLFreshnessSLOSeconds     = 30
+	DefTopSQLWebhookBatchSize        = 1000
+	DefTopSQLWebhookMaxRetries       = 3
+	DefTopSQLPurgeBatchSize          = 500
+	DefTopSQLPurgeRowsPerSecond      = 5000
+	DefTopSQLInstanceMetricsSeconds  = 15
+	DefTopSQLDefaultTop              = -1
+	DefTopSQLDefaultAggregation      = "sum"
 )
 
 type Config struct {
@@ -33,6 +52,8 @@ type Config struct {
 	PD                PD                      `toml:"pd" json:"pd"`
 	Log               Log                     `toml:"log" json:"log"`
 	Storage           Storage                 `toml:"storage" json:"storage"`
+	TopSQL            TopSQL                  `toml:"topsql" json:"topsql"`
+	Debug             Debug                   `toml:"debug" json:"debug"`
 	ContinueProfiling ContinueProfilingConfig `toml:"-" json:"continuous-profiling"`
 	Security          Security                `toml:"security" json:"security"`
 }
@@ -47,7 +68,33 @@ var defaultConfig = Config{
 		Level: "INFO",
 	},
 	Storage: Storage{
-		Path: "data",
+		Path:                 "data",
+		DocDBBlockCacheMinMB: DefDocDBBlockCacheMinMB,
+		DocDBBlockCacheMaxMB: DefDocDBBlockCacheMaxMB,
+	},
+	TopSQL: TopSQL{
+		RetentionDays:              DefTopSQLRetentionDays,
+		OutOfOrderToleranceSeconds: DefTopSQLOutOfOrderToleranceSecs,
+		HotRetentionMultiplier:     DefTopSQLHotRetentionMultiplier,
+		HotMinQueries:              DefTopSQLHotMinQueries,
+		HotTopCPU:                  DefTopSQLHotTopCPU,
+		MaxInflightWrites:          DefTopSQLMaxInflightWrites,
+		WriteQueueSize:             DefTopSQLWriteQueueSize,
+		SpillMaxMB:                 DefTopSQLSpillMaxMB,
+		ShedPolicy:                 ShedPolicyBlock,
+		FreshnessSLOSeconds:        DefTopSQLFreshnessSLOSeconds,
+		InstanceMetricsSeconds:     DefTopSQLInstanceMetricsSeconds,
+		Preset:                     PresetNone,
+		DefaultTop:                 DefTopSQLDefaultTop,
+		DefaultAggregation:         DefTopSQLDefaultAggregation,
+		Webhook: Webhook{
+			BatchSize:  DefTopSQLWebhookBatchSize,
+			MaxRetries: DefTopSQLWebhookMaxRetries,
+		},
+		Purge: Purge{
+			BatchSize:     DefTopSQLPurgeBatchSize,
+			RowsPerSecond: DefTopSQLPurgeRowsPerSecond,
+		},
 	},
 	ContinueProfiling: ContinueProfilingConfig{
 		Enable:               DefProfilingEnable,
@@ -55,6 +102,7 @@ var defaultConfig = Config{
 		IntervalSeconds:      DefProfilingIntervalSeconds,
 		TimeoutSeconds:       DefProfilingTimeoutSeconds,
 		DataRetentionSeconds: DefProfilingDataRetentionSeconds,
+		ScrapeConcurrency:    DefProfilingScrapeConcurrency,
 	},
 }
 
@@ -103,13 +151,21 @@ func InitConfig(configPath string, override func(config *Config)) (*Config, erro
 	if err := config.valid(); err != nil {
 		return nil, err
 	}
+	initPreset(&config)
 	StoreGlobalConfig(&config)
 	return &config, nil
 }
 
 func (c *Config) Load(fileName string) error {
-	_, err := toml.DecodeFile(fileName, c)
-	return err
+	md, err := toml.DecodeFile(fileName, c)
+	if err != nil {
+		return err
+	}
+	c.TopSQL.configured = presetOptions{
+		retentionDays: md.IsDefined("topsql", "retention-days"),
+		defaultTop:    md.IsDefined("topsql", "default-top"),
+	}
+	return nil
 }
 
 func (c *Config) valid() error {
@@ -131,6 +187,10 @@ func (c *Config) valid() error {
 		return err
 	}
 
+	if err = c.TopSQL.valid(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -148,6 +208,10 @@ func (p *PD) valid() error {
 
 type Storage struct {
 	Path string `toml:"path" json:"path"`
+	// DocDBBlockCacheMinMB and DocDBBlockCacheMaxMB bound the block cache of
+	// the document database, which is sized by the observed hit rate.
+	DocDBBlockCacheMinMB int `toml:"docdb-block-cache-min-mb" json:"docdb-block-cache-min-mb"`
+	DocDBBlockCacheMaxMB int `toml:"docdb-block-cache-max-mb" json:"docdb-block-cache-max-mb"`
 }
 
 func (s *Storage) valid() error {
@@ -155,9 +219,253 @@ func (s *Storage) valid() error {
 		return fmt.Errorf("unexpected empty storage path")
 	}
 
+	if s.DocDBBlockCacheMinMB <= 0 || s.DocDBBlockCacheMaxMB < s.DocDBBlockCacheMinMB {
+		return fmt.Errorf("docdb block cache size should be within a positive range")
+	}
+
 	return nil
 }
 
+const (
+	// ShedPolicyBlock stops receiving until a write finishes, which pushes
+	// back to the agents.
+	ShedPolicyBlock = "block"
+	// ShedPolicyDrop drops the records.
+	ShedPolicyDrop = "drop"
+	// ShedPolicySpill spills the records to disk to be written later, and
+	// drops them beyond SpillMaxMB.
+	ShedPolicySpill = "spill"
+)
+
+type TopSQL struct {
+	// RetentionDays is how long topsql data is kept before being purged.
+	RetentionDays int `toml:"retention-days" json:"retention-days"`
+	// HotRetentionMultiplier keeps hot digests for RetentionDays times it,
+	// while others are purged after RetentionDays. It's disabled if not
+	// greater than 1.
+	HotRetentionMultiplier int `toml:"hot-retention-multiplier" json:"hot-retention-multiplier"`
+	// HotMinQueries is how many times a digest is queried to be hot.
+	HotMinQueries int `toml:"hot-min-queries" json:"hot-min-queries"`
+	// HotTopCPU is the number of sql digests with the most cpu time to be hot.
+	HotTopCPU int `toml:"hot-top-cpu" json:"hot-top-cpu"`
+	// OutOfOrderToleranceSeconds is how far behind the latest reported
+	// timestamp of a stream a record is still accepted.
+	OutOfOrderToleranceSeconds int `toml:"out-of-order-tolerance-seconds" json:"out-of-order-tolerance-seconds"`
+	// RedactSQLLiterals strips literals from sql texts before they are stored.
+	RedactSQLLiterals bool `toml:"redact-sql-literals" json:"redact-sql-literals"`
+	// MaxInflightWrites is the number of workers writing records at the same
+	// time, so that a slow write doesn't serialize writes of other instances,
+	// while a slow storage doesn't pile up records of all instances.
+	MaxInflightWrites int `toml:"max-inflight-writes" json:"max-inflight-writes"`
+	// WriteQueueSize is the number of records queued for the workers.
+	WriteQueueSize int `toml:"write-queue-size" json:"write-queue-size"`
+	// ShedPolicy is what to do with records once the write queue is full.
+	ShedPolicy string `toml:"shed-policy" json:"shed-policy"`
+	// SpillMaxMB limits records spilled by ShedPolicySpill.
+	SpillMaxMB int `toml:"spill-max-mb" json:"spill-max-mb"`
+	// InstanceRecordsPerSecond limits the records ingested from an instance,
+	// so that a misbehaving agent can't flood the storage. Records beyond it
+	// are dropped. It's unlimited if 0.
+	InstanceRecordsPerSecond int `toml:"instance-records-per-second" json:"instance-records-per-second"`
+	// InstanceBytesPerSecond limits the encoded size of records ingested from
+	// an instance like InstanceRecordsPerSecond.
+	InstanceBytesPerSecond int `toml:"instance-bytes-per-second" json:"instance-bytes-per-second"`
+	// FreshnessSLOSeconds is the expected delay from the end of a reported
+	// window to its data being queryable.
+	FreshnessSLOSeconds int `toml:"freshness-slo-seconds" json:"freshness-slo-seconds"`
+	// InstanceMetricsSeconds is how often cpu usage and QPS of instances are
+	// collected from their status ports, to be correlated with top SQL. It's
+	// disabled if 0.
+	InstanceMetricsSeconds int `toml:"instance-metrics-seconds" json:"instance-metrics-seconds"`
+	// Preset tunes the defaults to the cluster size, see PresetAuto. It's
+	// PresetNone by default.
+	Preset string `toml:"preset" json:"preset"`
+	// AppliedPreset is the preset in effect.
+	AppliedPreset string `toml:"-" json:"applied-preset"`
+	// DefaultTop is the number of top SQLs queried without `top`, -1 for all.
+	DefaultTop int `toml:"default-top" json:"default-top"`
+	// DefaultAggregation is the aggregation queried without `aggregation`.
+	DefaultAggregation string `toml:"default-aggregation" json:"default-aggregation"`
+	// Webhook streams finalized aggregates to users.
+	Webhook Webhook `toml:"webhook" json:"webhook"`
+	// Purge throttles the background purge of expired data.
+	Purge Purge `toml:"purge" json:"purge"`
+
+	// configured tells options tuned by presets which the file configures.
+	configured presetOptions
+}
+
+func (t *TopSQL) valid() error {
+	if t.RetentionDays <= 0 {
+		return fmt.Errorf("topsql retention days should be positive")
+	}
+
+	if t.HotRetentionMultiplier < 0 || t.HotMinQueries < 0 || t.HotTopCPU < 0 {
+		return fmt.Errorf("topsql hot retention options should not be negative")
+	}
+
+	if t.OutOfOrderToleranceSeconds <= 0 {
+		return fmt.Errorf("topsql out-of-order tolerance seconds should be positive")
+	}
+
+	if t.MaxInflightWrites <= 0 {
+		return fmt.Errorf("topsql max inflight writes should be positive")
+	}
+
+	if t.WriteQueueSize <= 0 {
+		return fmt.Errorf("topsql write queue size should be positive")
+	}
+
+	switch t.ShedPolicy {
+	case ShedPolicyBlock, ShedPolicyDrop, ShedPolicySpill:
+	default:
+		return fmt.Errorf("topsql shed policy should be %s, %s or %s", ShedPolicyBlock, ShedPolicyDrop, ShedPolicySpill)
+	}
+
+	if t.SpillMaxMB <= 0 {
+		return fmt.Errorf("topsql spill max mb should be positive")
+	}
+
+	if t.InstanceRecordsPerSecond < 0 {
+		return fmt.Errorf("topsql instance records per second should not be negative")
+	}
+
+	if t.InstanceBytesPerSecond < 0 {
+		return fmt.Errorf("topsql instance bytes per second should not be negative")
+	}
+
+	if t.FreshnessSLOSeconds <= 0 {
+		return fmt.Errorf("topsql freshness slo seconds should be positive")
+	}
+
+	if t.InstanceMetricsSeconds < 0 {
+		return fmt.Errorf("topsql instance metrics seconds should not be negative")
+	}
+
+	if t.DefaultTop == 0 || t.DefaultTop < -1 {
+		return fmt.Errorf("topsql default top should be positive, or -1 for all")
+	}
+
+	switch t.DefaultAggregation {
+	case "sum", "max", "avg", "p99":
+	default:
+		return fmt.Errorf("topsql default aggregation should be sum, max, avg or p99")
+	}
+
+	if err := validPreset(t.Preset); err != nil {
+		return err
+	}
+
+	if err := t.Webhook.valid(); err != nil {
+		return err
+	}
+
+	if err := t.Purge.valid(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MaxRetentionDays is the retention of hot digests.
+func (t *TopSQL) MaxRetentionDays() int {
+	if t.HotRetentionMultiplier > 1 {
+		return t.RetentionDays * t.HotRetentionMultiplier
+	}
+	return t.RetentionDays
+}
+
+type Webhook struct {
+	// URL receives the cpu time aggregated per instance and per minute by
+	// POST, once the minute can no longer change. It's disabled if empty.
+	URL string `toml:"url" json:"url"`
+	// Secret signs request bodies with HMAC-SHA256 if not empty.
+	Secret string `toml:"secret" json:"-"`
+	// BatchSize is the max number of records per request.
+	BatchSize int `toml:"batch-size" json:"batch-size"`
+	// MaxRetries is the number of retries before a batch is given up.
+	MaxRetries int `toml:"max-retries" json:"max-retries"`
+}
+
+func (w *Webhook) valid() error {
+	if len(w.URL) == 0 {
+		return nil
+	}
+
+	if w.BatchSize <= 0 {
+		return fmt.Errorf("topsql webhook batch size should be positive")
+	}
+
+	if w.MaxRetries < 0 {
+		return fmt.Errorf("topsql webhook max retries should not be negative")
+	}
+
+	return nil
+}
+
+type Purge struct {
+	// BatchSize is the number of digests deleted per transaction. Writes are
+	// blocked during a transaction, so it's kept small.
+	BatchSize int `toml:"batch-size" json:"batch-size"`
+	// RowsPerSecond limits the digests deleted per second, so that a purge
+	// catching up doesn't starve queries. 0 means no limit.
+	RowsPerSecond int `toml:"rows-per-second" json:"rows-per-second"`
+	// Window is the local time of day when purges run, e.g. `02:00-06:00`,
+	// which may wrap around midnight. Purges run at any time if it's empty,
+	// and a purge still running when the window ends resumes in the next one.
+	Window string `toml:"window" json:"window"`
+}
+
+func (p *Purge) valid() error {
+	if p.BatchSize <= 0 {
+		return fmt.Errorf("topsql purge batch size should be positive")
+	}
+
+	if p.RowsPerSecond < 0 {
+		return fmt.Errorf("topsql purge rows per second should not be negative")
+	}
+
+	if _, _, err := p.ParseWindow(); err != nil {
+		return fmt.Errorf("invalid topsql purge window %q: %v", p.Window, err)
+	}
+
+	return nil
+}
+
+// ParseWindow parses Window into offsets since midnight. Both are 0 if Window
+// is empty.
+func (p *Purge) ParseWindow() (start, end time.Duration, err error) {
+	if len(p.Window) == 0 {
+		return 0, 0, nil
+	}
+
+	parts := strings.Split(p.Window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expect HH:MM-HH:MM")
+	}
+	var offsets [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, err
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if offsets[0] == offsets[1] {
+		return 0, 0, fmt.Errorf("empty window")
+	}
+	return offsets[0], offsets[1], nil
+}
+
+type Debug struct {
+	// EnableGops starts a gops agent, so that stacks, memory stats and gc traces
+	// can be inspected by the gops command without restarting.
+	EnableGops bool `toml:"enable-gops" json:"enable-gops"`
+	// GopsAddress is the address the gops agent listens on, a random local
+	// port is used if empty.
+	GopsAddress string `toml:"gops-address" json:"gops-address"`
+}
+
 type Log struct {
 	Path  string `toml:"path" json:"path"`
 	Level string `toml:"level" json:"level"`
@@ -211,32 +519,47 @@ func ReloadRoutine(ctx context.Context, configPath string, cfg *Config) {
 		case <-sighupCh:
 			log.Info("received SIGHUP and ready to reload config")
 		}
-		config := new(Config)
-
 		if len(configPath) == 0 {
 			log.Warn("failed to reload config due to empty config path. Please specify the command line argument \"--config <path>\"")
 			continue
 		}
 
-		if err := config.Load(configPath); err != nil {
+		config, err := reloadConfig(configPath)
+		if err != nil {
 			log.Warn("failed to reload config", zap.Error(err))
 			continue
 		}
 
-		if len(config.PD.Endpoints) == 0 {
-			log.Warn("unexpected empty PD endpoints")
-			continue
-		}
-
 		if !configsEqual(cfg, config) {
 			log.Info("PD endpoints changed", zap.Strings("endpoints", config.PD.Endpoints))
 		}
 
+		reapplyPreset(config)
 		cfg = config
 		StoreGlobalConfig(config)
 	}
 }
 
+// reloadConfig loads the config file on top of the defaults as on startup,
+// and rejects it if invalid.
+func reloadConfig(configPath string) (*Config, error) {
+	config := defaultConfig
+	if err := config.Load(configPath); err != nil {
+		return nil, err
+	}
+
+	if config.AdvertiseAddress == "" {
+		config.AdvertiseAddress = config.Address
+	}
+	// continuous profiling isn't configured by the file, but by the API
+	config.ContinueProfiling = GetGlobalConfig().ContinueProfiling
+
+	if err := config.valid(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
 func configsEqual(a, b *Config) bool {
 	sort.Strings(a.PD.Endpoints)
 	sort.Strings(b.PD.Endpoints)
@@ -307,10 +630,50 @@ type ContinueProfilingConfig struct {
 	IntervalSeconds      int  `json:"interval-seconds"`
 	TimeoutSeconds       int  `json:"timeout-seconds"`
 	DataRetentionSeconds int  `json:"data-retention-seconds"`
+	// ScrapeConcurrency bounds scrapes running at the same time, so that
+	// scraping many instances at once doesn't exhaust resources.
+	ScrapeConcurrency int `json:"scrape-concurrency"`
+	// BlockProfile enables scraping block profiles of TiDB and PD, which
+	// are only meaningful if they set a block profile rate.
+	BlockProfile bool `json:"block-profile"`
+	// Schedules override the schedule of profile kinds by component, e.g.
+	// {"tikv": {"profile": {"interval-seconds": 60}}}.
+	Schedules map[string]map[string]ProfilingSchedule `json:"schedules"`
+}
+
+// ProfilingSchedule overrides the schedule of a profile kind of a component,
+// in which zero values are the global ones.
+type ProfilingSchedule struct {
+	// Disable stops scraping the profile kind of the component.
+	Disable         bool `json:"disable,omitempty"`
+	IntervalSeconds int  `json:"interval-seconds,omitempty"`
+	// ProfileSeconds only applies to profile kinds lasting for a duration,
+	// e.g. CPU profiles.
+	ProfileSeconds int `json:"profile-seconds,omitempty"`
+}
+
+// Schedule returns the schedule of the profile kind of the component.
+func (c ContinueProfilingConfig) Schedule(component, kind string) ProfilingSchedule {
+	schedule := c.Schedules[component][kind]
+	if schedule.IntervalSeconds == 0 {
+		schedule.IntervalSeconds = c.IntervalSeconds
+	}
+	if schedule.ProfileSeconds == 0 {
+		schedule.ProfileSeconds = c.ProfileSeconds
+	}
+	return schedule
 }
 
 func (c ContinueProfilingConfig) Valid() bool {
-	return c.ProfileSeconds > 0 &&
+	for _, schedules := range c.Schedules {
+		for _, schedule := range schedules {
+			if schedule.IntervalSeconds < 0 || schedule.ProfileSeconds < 0 {
+				return false
+			}
+		}
+	}
+	return c.ScrapeConcurrency > 0 &&
+		c.ProfileSeconds > 0 &&
 		c.IntervalSeconds > 0 &&
 		c.TimeoutSeconds > 0 &&
 		c.DataRetentionSeconds > 0
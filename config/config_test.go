@@ -1,6 +1,7 @@
 package config
 
 import (
+	"io/ioutil"
 	"path"
 	"runtime"
 	"testing"
@@ -20,5 +21,107 @@ func TestConfig(t *testing.T) {
 	require.Equal(t, config.Address, "0.0.0.0:8428")
 	require.Equal(t, config.PD, PD{Endpoints: []string{"127.0.0.1:2379"}})
 	require.Equal(t, config.Log, Log{Path: "log", Level: "INFO"})
-	require.Equal(t, config.Storage, Storage{Path: "data"})
+	require.Equal(t, config.Storage, Storage{Path: "data", DocDBBlockCacheMinMB: 64, DocDBBlockCacheMaxMB: 1024})
+}
+
+func TestPreset(t *testing.T) {
+	// presets are opt-in
+	require.Equal(t, PresetNone, defaultConfig.TopSQL.Preset)
+
+	config := defaultConfig
+	config.Storage.Path = t.TempDir()
+	config.TopSQL.Preset = PresetAuto
+	initPreset(&config)
+	StoreGlobalConfig(&config)
+	require.True(t, NeedsPresetDecision())
+
+	require.NoError(t, DecidePreset(200))
+	require.False(t, NeedsPresetDecision())
+	decided := GetGlobalConfig().TopSQL
+	require.Equal(t, PresetLarge, decided.AppliedPreset)
+	require.Equal(t, 7, decided.RetentionDays)
+	require.Equal(t, 20, decided.DefaultTop)
+	require.Equal(t, DefTopSQLDefaultAggregation, decided.DefaultAggregation)
+
+	// the decision is kept on restart, while options configured by the file
+	// win even if they're the defaults
+	configFile := path.Join(t.TempDir(), "config.toml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("[topsql]\npreset = \"auto\"\nretention-days = 30\n"), 0644))
+	restarted := defaultConfig
+	require.NoError(t, restarted.Load(configFile))
+	restarted.Storage.Path = config.Storage.Path
+	initPreset(&restarted)
+	require.Equal(t, PresetLarge, restarted.TopSQL.AppliedPreset)
+	require.Equal(t, DefTopSQLRetentionDays, restarted.TopSQL.RetentionDays)
+	require.Equal(t, 20, restarted.TopSQL.DefaultTop)
+}
+
+func TestPresetOfStoredData(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "stored"), nil, 0644))
+
+	// auto isn't decided once data is stored
+	config := defaultConfig
+	config.Storage.Path = dir
+	config.TopSQL.Preset = PresetAuto
+	initPreset(&config)
+	StoreGlobalConfig(&config)
+	require.False(t, NeedsPresetDecision())
+	require.Empty(t, config.TopSQL.AppliedPreset)
+
+	// presets don't shorten the retention of stored data
+	config.TopSQL.Preset = PresetLarge
+	initPreset(&config)
+	require.Equal(t, PresetLarge, config.TopSQL.AppliedPreset)
+	require.Equal(t, DefTopSQLRetentionDays, config.TopSQL.RetentionDays)
+	require.Equal(t, 20, config.TopSQL.DefaultTop)
+
+	// but do on a fresh data dir, and keep it on restart
+	config = defaultConfig
+	config.Storage.Path = t.TempDir()
+	config.TopSQL.Preset = PresetMedium
+	initPreset(&config)
+	require.Equal(t, 14, config.TopSQL.RetentionDays)
+	restarted := defaultConfig
+	restarted.Storage.Path = config.Storage.Path
+	restarted.TopSQL.Preset = PresetMedium
+	initPreset(&restarted)
+	require.Equal(t, 14, restarted.TopSQL.RetentionDays)
+}
+
+func TestProfilingSchedule(t *testing.T) {
+	cfg := defaultConfig.ContinueProfiling
+	cfg.Schedules = map[string]map[string]ProfilingSchedule{
+		"tikv": {"profile": {IntervalSeconds: 60}},
+		"tidb": {"heap": {IntervalSeconds: 600}, "goroutine": {Disable: true}},
+	}
+	require.True(t, cfg.Valid())
+	require.Equal(t, ProfilingSchedule{IntervalSeconds: 60, ProfileSeconds: DefProfileSeconds}, cfg.Schedule("tikv", "profile"))
+	require.Equal(t, ProfilingSchedule{IntervalSeconds: 600, ProfileSeconds: DefProfileSeconds}, cfg.Schedule("tidb", "heap"))
+	require.True(t, cfg.Schedule("tidb", "goroutine").Disable)
+	require.Equal(t, ProfilingSchedule{IntervalSeconds: DefProfilingIntervalSeconds, ProfileSeconds: DefProfileSeconds}, cfg.Schedule("pd", "heap"))
+
+	cfg.Schedules["tikv"]["profile"] = ProfilingSchedule{IntervalSeconds: -1}
+	require.False(t, cfg.Valid())
+}
+
+func TestReloadConfig(t *testing.T) {
+	StoreGlobalConfig(&defaultConfig)
+	dir := t.TempDir()
+	configFile := path.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("[pd]\nendpoints = [\"127.0.0.1:2379\"]\n[topsql]\nretention-days = 7\n"), 0644))
+	config, err := reloadConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, 7, config.TopSQL.RetentionDays)
+	// options absent from the file are defaults
+	require.Equal(t, DefTopSQLMaxInflightWrites, config.TopSQL.MaxInflightWrites)
+	require.Equal(t, DefTopSQLPurgeBatchSize, config.TopSQL.Purge.BatchSize)
+	require.Equal(t, defaultConfig.ContinueProfiling, config.ContinueProfiling)
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("[pd]\nendpoints = [\"127.0.0.1:2379\"]\n[topsql]\nretention-days = -1\n"), 0644))
+	_, err = reloadConfig(configFile)
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("[topsql]\nretention-days = 7\n"), 0644))
+	_, err = reloadConfig(configFile)
+	require.Error(t, err)
 }
@@ -57,7 +57,8 @@ func LoadConfigFromStorage(getDB func() *genji.DB) error {
 	for module, cfgStr := range cfgMap {
 		switch module {
 		case continuousProfilingModule:
-			var newCfg ContinueProfilingConfig
+			// options absent from configs stored by older versions are kept
+			newCfg := globalCfg.ContinueProfiling
 			if err := json.NewDecoder(bytes.NewReader([]byte(cfgStr))).Decode(&newCfg); err != nil {
 				return err
 			}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// A topsql preset tunes the defaults to the cluster size. It's opt-in: with
+// the auto preset, it's decided by the number of instances on the first
+// startup of a fresh data dir and kept afterwards. Options configured by the
+// file always win, and a preset never shortens the retention of data stored
+// before it's applied.
+
+const (
+	PresetAuto   = "auto"
+	PresetNone   = "none"
+	PresetSmall  = "small"
+	PresetMedium = "medium"
+	PresetLarge  = "large"
+)
+
+type Preset struct {
+	Name string `json:"name"`
+	// MaxInstances is the largest cluster the preset is decided for, 0 for
+	// no limit.
+	MaxInstances  int `json:"max-instances"`
+	RetentionDays int `json:"retention-days"`
+	DefaultTop    int `json:"default-top"`
+}
+
+// presets are ordered by MaxInstances.
+var presets = []Preset{
+	{Name: PresetSmall, MaxInstances: 10, RetentionDays: 30, DefaultTop: 100},
+	{Name: PresetMedium, MaxInstances: 100, RetentionDays: 14, DefaultTop: 50},
+	{Name: PresetLarge, RetentionDays: 7, DefaultTop: 20},
+}
+
+// presetOptions are options tuned by presets.
+type presetOptions struct {
+	retentionDays bool
+	defaultTop    bool
+}
+
+// PresetDecision is the preset applied on the first startup of the data dir,
+// whose retention the stored data is kept by.
+type PresetDecision struct {
+	Preset    string `json:"preset"`
+	Instances int    `json:"instances"`
+	Ts        int64  `json:"ts"`
+}
+
+// presetInEffect is applied to configs on reload as well.
+type presetInEffect struct {
+	preset Preset
+	// minRetentionDays keeps the retention of data stored before the preset
+	// is applied.
+	minRetentionDays int
+}
+
+var (
+	appliedPreset atomic.Value // presetInEffect
+	// presetDecidable tells if the auto preset is to be decided, i.e. it's
+	// not decided yet and the data dir was fresh on startup.
+	presetDecidable atomic.Bool
+)
+
+func findPreset(name string) (Preset, bool) {
+	for _, p := range presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+func presetFor(instances int) Preset {
+	for _, p := range presets {
+		if p.MaxInstances == 0 || instances <= p.MaxInstances {
+			return p
+		}
+	}
+	return presets[len(presets)-1]
+}
+
+func presetDecisionPath(cfg *Config) string {
+	return path.Join(cfg.Storage.Path, "topsql-preset")
+}
+
+// freshDataDir tells if nothing has been stored in the data dir yet.
+func freshDataDir(cfg *Config) bool {
+	entries, err := ioutil.ReadDir(cfg.Storage.Path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return len(entries) == 0
+}
+
+func validPreset(name string) error {
+	switch name {
+	case PresetAuto, PresetNone:
+		return nil
+	}
+	if _, ok := findPreset(name); !ok {
+		return fmt.Errorf("topsql preset should be %s, %s, %s, %s or %s", PresetAuto, PresetNone, PresetSmall, PresetMedium, PresetLarge)
+	}
+	return nil
+}
+
+// initPreset applies the configured preset, or the one decided by an earlier
+// startup if it's auto.
+func initPreset(cfg *Config) {
+	presetDecidable.Store(false)
+	if cfg.TopSQL.Preset == PresetNone {
+		return
+	}
+
+	decision, err := loadPresetDecision(cfg)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("failed to load the topsql preset decision", zap.Error(err))
+	}
+	decided, hasDecided := findPreset(decision.Preset)
+	fresh := !hasDecided && freshDataDir(cfg)
+
+	if cfg.TopSQL.Preset == PresetAuto {
+		if hasDecided {
+			applyPreset(cfg, decided, decided.RetentionDays)
+		} else {
+			presetDecidable.Store(fresh)
+		}
+		return
+	}
+
+	p, _ := findPreset(cfg.TopSQL.Preset)
+	switch {
+	case hasDecided:
+		// data is kept by the retention of the preset first applied
+		applyPreset(cfg, p, decided.RetentionDays)
+	case fresh:
+		if err := savePresetDecision(cfg, PresetDecision{Preset: p.Name, Ts: time.Now().Unix()}); err != nil {
+			log.Warn("failed to save the topsql preset decision", zap.Error(err))
+		}
+		applyPreset(cfg, p, 0)
+	default:
+		// data is kept by the configured retention
+		applyPreset(cfg, p, cfg.TopSQL.RetentionDays)
+	}
+}
+
+func loadPresetDecision(cfg *Config) (PresetDecision, error) {
+	var decision PresetDecision
+	b, err := ioutil.ReadFile(presetDecisionPath(cfg))
+	if err != nil {
+		return decision, err
+	}
+	err = json.Unmarshal(b, &decision)
+	return decision, err
+}
+
+func savePresetDecision(cfg *Config, decision PresetDecision) error {
+	if err := os.MkdirAll(cfg.Storage.Path, os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(presetDecisionPath(cfg), b, 0644)
+}
+
+// NeedsPresetDecision tells if a preset should be decided by the cluster size.
+func NeedsPresetDecision() bool {
+	return GetGlobalConfig().TopSQL.Preset == PresetAuto && presetDecidable.Load()
+}
+
+// DecidePreset decides the preset by the number of instances, records the
+// decision and applies it. The retention of the timeseries database takes
+// effect after restart.
+func DecidePreset(instances int) error {
+	cfg := *GetGlobalConfig()
+	p := presetFor(instances)
+
+	decision := PresetDecision{Preset: p.Name, Instances: instances, Ts: time.Now().Unix()}
+	if err := savePresetDecision(&cfg, decision); err != nil {
+		return err
+	}
+	presetDecidable.Store(false)
+
+	// the data dir was fresh on startup, so there is hardly any data to keep
+	applyPreset(&cfg, p, 0)
+	StoreGlobalConfig(&cfg)
+	log.Info("topsql preset is decided by the cluster size",
+		zap.String("preset", p.Name),
+		zap.Int("instances", instances))
+	return nil
+}
+
+// applyPreset overrides options not configured by the file, but doesn't
+// shorten the retention below minRetentionDays.
+func applyPreset(cfg *Config, p Preset, minRetentionDays int) {
+	t := &cfg.TopSQL
+	if !t.configured.retentionDays {
+		t.RetentionDays = p.RetentionDays
+		if t.RetentionDays < minRetentionDays {
+			log.Warn("topsql preset doesn't shorten the retention of stored data",
+				zap.String("preset", p.Name),
+				zap.Int("preset-retention-days", p.RetentionDays),
+				zap.Int("retention-days", minRetentionDays))
+			t.RetentionDays = minRetentionDays
+		}
+	}
+	if !t.configured.defaultTop {
+		t.DefaultTop = p.DefaultTop
+	}
+	t.AppliedPreset = p.Name
+	appliedPreset.Store(presetInEffect{preset: p, minRetentionDays: minRetentionDays})
+}
+
+// reapplyPreset applies the preset in effect to a reloaded config.
+func reapplyPreset(cfg *Config) {
+	if p, ok := appliedPreset.Load().(presetInEffect); ok {
+		applyPreset(cfg, p.preset, p.minRetentionDays)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 	"net/http"
+	"reflect"
 )
 
 func HTTPService(g *gin.RouterGroup) {
@@ -71,7 +72,8 @@ func handleContinueProfilingConfigModify(reqNested map[string]interface{}) error
 		if !ok {
 			return fmt.Errorf("unknow config `%v`", k)
 		}
-		if oldValue == newValue {
+		// values may be maps, e.g. schedules, which aren't comparable
+		if reflect.DeepEqual(oldValue, newValue) {
 			continue
 		}
 		currentNested[k] = newValue
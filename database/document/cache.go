@@ -0,0 +1,122 @@
+package document
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Badger can't resize its block cache once opened. So the hit rate is sampled
+// at runtime, and the size it suggests is saved and applied on the next open.
+
+const (
+	defBlockCacheSize     = 256 << 20
+	cacheSamplingInterval = 10 * time.Minute
+	// below it a sample is too small to tell anything
+	minCacheLookups = 1000
+	// below it the cache grows if it's full
+	targetHitRatio = 0.9
+)
+
+func blockCacheSizePath(cfg *config.Config) string {
+	return path.Join(cfg.Storage.Path, "docdb-block-cache-size")
+}
+
+// loadBlockCacheSize returns the size suggested by the last run, bounded by
+// the config.
+func loadBlockCacheSize(cfg *config.Config) int64 {
+	size := int64(defBlockCacheSize)
+	if b, err := ioutil.ReadFile(blockCacheSizePath(cfg)); err == nil {
+		if saved, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			size = saved
+		}
+	} else if !os.IsNotExist(err) {
+		log.Warn("failed to read the saved block cache size", zap.Error(err))
+	}
+	return boundBlockCacheSize(cfg, size)
+}
+
+func boundBlockCacheSize(cfg *config.Config, size int64) int64 {
+	minSize := int64(cfg.Storage.DocDBBlockCacheMinMB) << 20
+	maxSize := int64(cfg.Storage.DocDBBlockCacheMaxMB) << 20
+	if size < minSize {
+		return minSize
+	}
+	if size > maxSize {
+		return maxSize
+	}
+	return size
+}
+
+type cacheSample struct {
+	hits, misses, keysEvicted uint64
+}
+
+// suggestBlockCacheSize doubles the cache if it's full and misses too much,
+// and halves it if the working set fits in half of it.
+func suggestBlockCacheSize(size int64, used uint64, prev, cur cacheSample) int64 {
+	lookups := (cur.hits - prev.hits) + (cur.misses - prev.misses)
+	if lookups < minCacheLookups {
+		return size
+	}
+
+	hitRatio := float64(cur.hits-prev.hits) / float64(lookups)
+	switch {
+	case hitRatio < targetHitRatio && cur.keysEvicted > prev.keysEvicted:
+		return size * 2
+	case used < uint64(size)/2:
+		return size / 2
+	}
+	return size
+}
+
+// doCacheSizingLoop saves the size suggested by the latest sample. The
+// suggestion is relative to the opened size, so the cache moves at most one
+// step per restart.
+func doCacheSizingLoop(db *badger.DB, cfg *config.Config, size int64, closed chan struct{}) {
+	ticker := time.NewTicker(cacheSamplingInterval)
+	defer ticker.Stop()
+
+	var prev cacheSample
+	saved := size
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		metrics := db.BlockCacheMetrics()
+		if metrics == nil {
+			return
+		}
+		cur := cacheSample{hits: metrics.Hits(), misses: metrics.Misses(), keysEvicted: metrics.KeysEvicted()}
+		used := metrics.CostAdded() - metrics.CostEvicted()
+
+		next := boundBlockCacheSize(cfg, suggestBlockCacheSize(size, used, prev, cur))
+		prev = cur
+		if next == saved {
+			continue
+		}
+
+		err := ioutil.WriteFile(blockCacheSizePath(cfg), []byte(strconv.FormatInt(next, 10)), 0644)
+		if err != nil {
+			log.Warn("failed to save the block cache size", zap.Error(err))
+			continue
+		}
+		log.Info("docdb block cache size is adjusted, which takes effect after restart",
+			zap.Int64("current", size),
+			zap.Int64("next", next),
+			zap.Float64("hit-ratio", metrics.Ratio()))
+		saved = next
+	}
+}
@@ -0,0 +1,29 @@
+package document
+
+import (
+	"testing"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCacheSize(t *testing.T) {
+	cfg := &config.Config{Storage: config.Storage{Path: t.TempDir(), DocDBBlockCacheMinMB: 64, DocDBBlockCacheMaxMB: 1024}}
+	require.Equal(t, int64(defBlockCacheSize), loadBlockCacheSize(cfg))
+
+	size := int64(256 << 20)
+	prev := cacheSample{hits: 100, misses: 100, keysEvicted: 10}
+
+	// too few lookups
+	require.Equal(t, size, suggestBlockCacheSize(size, 0, prev, cacheSample{hits: 110, misses: 110, keysEvicted: 10}))
+	// full and missing
+	require.Equal(t, 2*size, suggestBlockCacheSize(size, uint64(size), prev, cacheSample{hits: 1100, misses: 1100, keysEvicted: 20}))
+	// hitting
+	require.Equal(t, size, suggestBlockCacheSize(size, uint64(size), prev, cacheSample{hits: 10100, misses: 200, keysEvicted: 20}))
+	// oversized
+	require.Equal(t, size/2, suggestBlockCacheSize(size, uint64(size)/4, prev, cacheSample{hits: 10100, misses: 200, keysEvicted: 10}))
+
+	require.Equal(t, int64(64<<20), boundBlockCacheSize(cfg, 1))
+	require.Equal(t, int64(1024<<20), boundBlockCacheSize(cfg, 1<<40))
+}
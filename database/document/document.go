@@ -21,7 +21,9 @@ var closeCh chan struct{}
 func Init(cfg *config.Config) {
 	dataPath := path.Join(cfg.Storage.Path, "docdb")
 	l, _ := simpleLogger(&cfg.Log)
+	blockCacheSize := loadBlockCacheSize(cfg)
 	opts := badger.DefaultOptions(dataPath).
+		WithBlockCacheSize(blockCacheSize).
 		WithCompression(options.ZSTD).
 		WithZSTDCompressionLevel(3).
 		WithBlockSize(8 * 1024).
@@ -37,6 +39,9 @@ func Init(cfg *config.Config) {
 	go utils.GoWithRecovery(func() {
 		doGCLoop(engine.DB, closeCh)
 	}, nil)
+	go utils.GoWithRecovery(func() {
+		doCacheSizingLoop(engine.DB, cfg, blockCacheSize, closeCh)
+	}, nil)
 
 	db, err := genji.New(context.Background(), engine)
 	if err != nil {
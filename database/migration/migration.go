@@ -0,0 +1,98 @@
+// Package migration upgrades tables and indexes of the document database on
+// startup, so that their format can change without wiping data.
+//
+// Each component lists its migrations in order, and the version of the last
+// applied one is recorded in the schema_version table. Rows of a table can
+// also evolve lazily, see table.Versioned.
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Migration upgrades the schema of a component to Version.
+type Migration struct {
+	Version     int
+	Description string
+	// Up is applied in a transaction along with recording Version, so that
+	// a failed migration is retried on the next startup.
+	Up func(tx *genji.Tx) error
+}
+
+// Statements returns an Up executing the statements in order.
+func Statements(stmts ...string) func(tx *genji.Tx) error {
+	return func(tx *genji.Tx) error {
+		for _, stmt := range stmts {
+			if err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return nil
+	}
+}
+
+// Migrate applies migrations of the component newer than its recorded
+// version. Versions must start from 1 and increase by 1. It fails if the
+// recorded version is newer than the last migration, i.e. the data is
+// written by a newer release.
+func Migrate(db *genji.DB, component string, migrations []Migration) error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("migration %d of %s has version %d", i+1, component, m.Version)
+		}
+	}
+
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (component VARCHAR(255) PRIMARY KEY)"); err != nil {
+		return err
+	}
+	current, err := Version(db, component)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema of %s has version %d, newer than %d supported", component, current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		start := time.Now()
+		err := db.Update(func(tx *genji.Tx) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO schema_version(component, version, updated_ts) VALUES (?, ?, ?) ON CONFLICT DO REPLACE",
+				component, m.Version, time.Now().Unix())
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s to version %d (%s): %w", component, m.Version, m.Description, err)
+		}
+		log.Info("migrated schema",
+			zap.String("component", component),
+			zap.Int("version", m.Version),
+			zap.String("description", m.Description),
+			zap.Duration("duration", time.Since(start)))
+	}
+	return nil
+}
+
+// Version returns the recorded schema version of the component, 0 if it's
+// never migrated.
+func Version(db *genji.DB, component string) (int, error) {
+	res, err := db.Query("SELECT version FROM schema_version WHERE component = ?", component)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var version int
+	err = res.Iterate(func(d types.Document) error {
+		return document.Scan(d, &version)
+	})
+	return version, err
+}
@@ -0,0 +1,63 @@
+package migration
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	migrations := []Migration{{
+		Version:     1,
+		Description: "create tables",
+		Up:          Statements("CREATE TABLE IF NOT EXISTS point (id VARCHAR(255) PRIMARY KEY)"),
+	}}
+	require.NoError(t, Migrate(db, "test", migrations))
+	version, err := Version(db, "test")
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	require.NoError(t, db.Exec("INSERT INTO point(id, ts) VALUES ('a', 1)"))
+
+	// a failed migration is rolled back and retried
+	applied := 0
+	migrations = append(migrations, Migration{
+		Version:     2,
+		Description: "index ts",
+		Up: func(tx *genji.Tx) error {
+			applied++
+			if err := tx.Exec("CREATE INDEX point_ts ON point (ts)"); err != nil {
+				return err
+			}
+			if applied == 1 {
+				return errors.New("interrupted")
+			}
+			return nil
+		},
+	})
+	require.Error(t, Migrate(db, "test", migrations))
+	version, err = Version(db, "test")
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	require.NoError(t, Migrate(db, "test", migrations))
+	require.NoError(t, Migrate(db, "test", migrations))
+	require.Equal(t, 2, applied)
+	version, err = Version(db, "test")
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	// other components are versioned separately
+	version, err = Version(db, "other")
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	// data written by a newer release
+	require.Error(t, Migrate(db, "test", migrations[:1]))
+	// versions out of order
+	require.Error(t, Migrate(db, "other", migrations[1:]))
+}
@@ -0,0 +1,236 @@
+// Package table maps rows of genji tables to typed records, so that the
+// columns are listed once per table rather than in every statement.
+package table
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// versionColumn tags rows of versioned tables with the version of their shape.
+// Rows without it are written before the table is versioned, i.e. version 0.
+const versionColumn = "schema_version"
+
+// DB is either *genji.DB or *genji.Tx.
+type DB interface {
+	Exec(q string, args ...interface{}) error
+	Query(q string, args ...interface{}) (*genji.Result, error)
+}
+
+var (
+	_ DB = &genji.DB{}
+	_ DB = &genji.Tx{}
+)
+
+// Table maps rows of a table to records of type T.
+type Table[T any] struct {
+	name    string
+	columns []string
+	fields  func(r *T) []interface{}
+
+	// version is the current shape of rows, 0 if the table is not versioned.
+	version int
+	upgrade func(r *T, from int)
+	// outdatedDB is the database whose outdated rows are exported.
+	outdatedDB atomic.Value // DB
+	exportOnce sync.Once
+
+	selectStmt string
+	insertStmt string
+}
+
+// New maps the columns to fields of T, which are returned in the same order
+// by fields, e.g. `func(r *Rule) []interface{} { return []interface{}{&r.Name, &r.Pattern} }`.
+// Fields are pointers so that they can be scanned into, and they are
+// dereferenced when written. It panics if the number of columns and fields
+// differ, so that a wrong mapping fails on startup.
+func New[T any](name string, columns []string, fields func(r *T) []interface{}) *Table[T] {
+	if n := len(fields(new(T))); n != len(columns) {
+		panic(fmt.Sprintf("table %s has %d columns but %d fields", name, len(columns), n))
+	}
+
+	// fails on unsupported field types
+	_ = (&Table[T]{fields: fields}).values(new(T))
+
+	t := &Table[T]{
+		name:    name,
+		columns: columns,
+		fields:  fields,
+	}
+	t.prepare()
+	return t
+}
+
+// Versioned tags rows written with the version, and upgrades rows of older
+// versions to the current shape when they are read by upgrade, so that the
+// shape can evolve without migrating existing rows. Columns missing in older
+// rows are read as zero values, upgrade only sets those whose defaults are
+// not zero. Rows are tagged the current version once they are written again.
+// It's meant to be called along with New.
+func (t *Table[T]) Versioned(version int, upgrade func(r *T, from int)) *Table[T] {
+	if version <= 0 {
+		panic(fmt.Sprintf("table %s has non-positive version %d", t.name, version))
+	}
+	t.version = version
+	t.upgrade = upgrade
+	t.prepare()
+	return t
+}
+
+func (t *Table[T]) prepare() {
+	columns := t.columns
+	if t.version > 0 {
+		columns = append(columns[:len(columns):len(columns)], versionColumn)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	t.selectStmt = fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), t.name)
+	t.insertStmt = fmt.Sprintf("INSERT INTO %s(%s) VALUES (%s)", t.name, strings.Join(columns, ", "), placeholders)
+}
+
+func (t *Table[T]) Name() string {
+	return t.name
+}
+
+// Insert inserts the record as a new row.
+func (t *Table[T]) Insert(db DB, r T) error {
+	return db.Exec(t.insertStmt, t.values(&r)...)
+}
+
+// Upsert inserts the record, or replaces the row having the same primary key.
+func (t *Table[T]) Upsert(db DB, r T) error {
+	return db.Exec(t.insertStmt+" ON CONFLICT DO REPLACE", t.values(&r)...)
+}
+
+// Iterate calls fn with every row matched by the clause following FROM, e.g.
+// `WHERE ts >= ? ORDER BY ts`. An error returned by fn stops the iteration.
+func (t *Table[T]) Iterate(db DB, fn func(r T) error, clause string, args ...interface{}) error {
+	res, err := db.Query(t.selectStmt+" "+clause, args...)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		var r T
+		fields := t.fields(&r)
+		var version int
+		if t.version > 0 {
+			fields = append(fields, &version)
+		}
+		if err := document.Scan(d, fields...); err != nil {
+			return err
+		}
+		if version < t.version {
+			if t.upgrade != nil {
+				t.upgrade(&r, version)
+			}
+			metrics.GetOrCreateCounter(fmt.Sprintf(`ng_monitoring_docdb_outdated_rows_read_total{table=%q,version="%d"}`, t.name, version)).Inc()
+		}
+		return fn(r)
+	})
+}
+
+// Select appends rows matched by the clause to fill, see Iterate.
+func (t *Table[T]) Select(db DB, fill *[]T, clause string, args ...interface{}) error {
+	return t.Iterate(db, func(r T) error {
+		*fill = append(*fill, r)
+		return nil
+	}, clause, args...)
+}
+
+// SelectPage is like Select, but skips offset rows and appends at most limit
+// rows. A non-positive limit means no limit.
+func (t *Table[T]) SelectPage(db DB, fill *[]T, offset, limit int, clause string, args ...interface{}) error {
+	if limit > 0 {
+		clause = fmt.Sprintf("%s LIMIT %d", clause, limit)
+	}
+	if offset > 0 {
+		clause = fmt.Sprintf("%s OFFSET %d", clause, offset)
+	}
+	return t.Select(db, fill, clause, args...)
+}
+
+// Outdated returns the number of rows of versions older than the current
+// version.
+func (t *Table[T]) Outdated(db DB) (int, error) {
+	if t.version == 0 {
+		return 0, nil
+	}
+
+	res, err := db.Query(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s IS NULL OR %s < ?", t.name, versionColumn, versionColumn), t.version)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var count int
+	err = res.Iterate(func(d types.Document) error {
+		return document.Scan(d, &count)
+	})
+	return count, err
+}
+
+// ExportOutdated exports the number of outdated rows in the database as the
+// `ng_monitoring_docdb_outdated_rows` gauge, which is counted once scraped.
+// Exporting again switches the database.
+func (t *Table[T]) ExportOutdated(db DB) {
+	t.outdatedDB.Store(&db)
+	t.exportOnce.Do(func() {
+		metrics.NewGauge(fmt.Sprintf(`ng_monitoring_docdb_outdated_rows{table=%q}`, t.name), func() float64 {
+			db := *t.outdatedDB.Load().(*DB)
+			count, err := t.Outdated(db)
+			if err != nil {
+				log.Warn("failed to count outdated rows", zap.String("table", t.name), zap.Error(err))
+				return 0
+			}
+			return float64(count)
+		})
+	})
+}
+
+func (t *Table[T]) values(r *T) []interface{} {
+	values := t.fields(r)
+	for i, f := range values {
+		values[i] = deref(f)
+	}
+	if t.version > 0 {
+		values = append(values, t.version)
+	}
+	return values
+}
+
+func deref(f interface{}) interface{} {
+	switch p := f.(type) {
+	case *string:
+		return *p
+	case *bool:
+		return *p
+	case *int:
+		return *p
+	case *int32:
+		return *p
+	case *int64:
+		return *p
+	case *uint:
+		return *p
+	case *uint32:
+		return *p
+	case *uint64:
+		return *p
+	case *float64:
+		return *p
+	case *[]byte:
+		return *p
+	default:
+		panic(fmt.Sprintf("unsupported field type %T", f))
+	}
+}
@@ -0,0 +1,98 @@
+package table
+
+import (
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/stretchr/testify/require"
+)
+
+type point struct {
+	ID    string
+	Ts    int64
+	Value uint64
+}
+
+var points = New("point", []string{"id", "ts", "val"}, func(p *point) []interface{} {
+	return []interface{}{&p.ID, &p.Ts, &p.Value}
+})
+
+func TestTable(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Exec("CREATE TABLE point (id VARCHAR(255) PRIMARY KEY)"))
+
+	for i, id := range []string{"c", "a", "b"} {
+		require.NoError(t, points.Insert(db, point{ID: id, Ts: int64(i), Value: uint64(i * 10)}))
+	}
+	require.Error(t, points.Insert(db, point{ID: "a"}))
+	require.NoError(t, points.Upsert(db, point{ID: "a", Ts: 1, Value: 100}))
+
+	var res []point
+	require.NoError(t, points.Select(db, &res, "WHERE ts >= ? ORDER BY ts", 1))
+	require.Equal(t, []point{{ID: "a", Ts: 1, Value: 100}, {ID: "b", Ts: 2, Value: 20}}, res)
+
+	res = nil
+	require.NoError(t, points.SelectPage(db, &res, 1, 1, "ORDER BY id"))
+	require.Equal(t, []point{{ID: "b", Ts: 2, Value: 20}}, res)
+	res = nil
+	require.NoError(t, points.SelectPage(db, &res, 2, 0, "ORDER BY id"))
+	require.Equal(t, []point{{ID: "c", Ts: 0, Value: 0}}, res)
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	require.NoError(t, points.Insert(tx, point{ID: "d"}))
+	res = nil
+	require.NoError(t, points.Select(tx, &res, "WHERE id = ?", "d"))
+	require.Len(t, res, 1)
+}
+
+func TestMismatchedFields(t *testing.T) {
+	require.Panics(t, func() {
+		New("point", []string{"id", "ts"}, func(p *point) []interface{} {
+			return []interface{}{&p.ID}
+		})
+	})
+	require.Panics(t, func() {
+		New("point", []string{"id"}, func(p *point) []interface{} {
+			return []interface{}{p}
+		})
+	})
+}
+
+func TestVersioned(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Exec("CREATE TABLE point (id VARCHAR(255) PRIMARY KEY)"))
+
+	// version 0 doesn't have val, which defaults to ts
+	require.NoError(t, db.Exec("INSERT INTO point(id, ts) VALUES ('a', 1), ('b', 2)"))
+	upgraded := New("point", []string{"id", "ts", "val"}, func(p *point) []interface{} {
+		return []interface{}{&p.ID, &p.Ts, &p.Value}
+	}).Versioned(1, func(p *point, from int) {
+		require.Equal(t, 0, from)
+		p.Value = uint64(p.Ts)
+	})
+	require.NoError(t, upgraded.Insert(db, point{ID: "c", Ts: 3, Value: 30}))
+
+	outdated, err := upgraded.Outdated(db)
+	require.NoError(t, err)
+	require.Equal(t, 2, outdated)
+
+	var res []point
+	require.NoError(t, upgraded.Select(db, &res, "ORDER BY id"))
+	require.Equal(t, []point{{ID: "a", Ts: 1, Value: 1}, {ID: "b", Ts: 2, Value: 2}, {ID: "c", Ts: 3, Value: 30}}, res)
+
+	// written again in the current version
+	require.NoError(t, upgraded.Upsert(db, res[0]))
+	outdated, err = upgraded.Outdated(db)
+	require.NoError(t, err)
+	require.Equal(t, 1, outdated)
+
+	outdated, err = points.Outdated(db)
+	require.NoError(t, err)
+	require.Equal(t, 0, outdated)
+}
@@ -2,6 +2,7 @@ package timeseries
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"path"
 	"syscall"
@@ -31,6 +32,12 @@ func Init(cfg *config.Config) {
 	}
 	initDataDir(path.Join(cfg.Storage.Path, "tsdb"))
 
+	// The timeseries database only stores topsql data, so follow the topsql
+	// retention of hot digests unless the retention period is explicitly
+	// given. Cold digests are deleted by the topsql retention.
+	if !pflag.CommandLine.Changed("retention-period") && cfg.TopSQL.RetentionDays > 0 {
+		*retentionPeriod = fmt.Sprintf("%dd", cfg.TopSQL.MaxRetentionDays())
+	}
 	_ = flag.Set("retentionPeriod", *retentionPeriod)
 
 	// Some components in VictoriaMetrics want parsed arguments, i.e. assert `flag.Parsed()`. Make them happy.
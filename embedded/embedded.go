@@ -0,0 +1,158 @@
+// Package embedded runs ng-monitoring within another process, e.g. TiDB
+// Dashboard for small deployments, and exposes its subsystems as Go APIs
+// besides HTTP.
+//
+// The subsystems are still backed by package level state, so at most one
+// server can run in a process.
+package embedded
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zhongzc/ng_monitoring/component/conprof"
+	"github.com/zhongzc/ng_monitoring/component/featureflag"
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/config/pdvariable"
+	"github.com/zhongzc/ng_monitoring/database"
+	"github.com/zhongzc/ng_monitoring/database/document"
+	"github.com/zhongzc/ng_monitoring/database/timeseries"
+	"github.com/zhongzc/ng_monitoring/service/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/atomic"
+)
+
+// TopSQL queries the stored top SQL data. See the query package for details.
+type TopSQL interface {
+	TopSQL(startSecs, endSecs, windowSecs, top int, instance, aggregation string, page query.Page, fill *[]query.TopSQLItem) (int, error)
+	SQLPlans(startSecs, endSecs, windowSecs int, instance, sqlDigest, aggregation string, fill *[]query.TopSQLItem) error
+	SQLInstances(startSecs, endSecs, windowSecs int, sqlDigest, aggregation string, fill *[]query.SQLInstanceItem) error
+	InstancesInRange(startSecs, endSecs int, fill *[]query.InstanceItem) error
+	InstanceSummaries(startSecs, endSecs int, fill *[]query.InstanceSummaryItem) error
+	SQLTexts(digests []string, fill *[]query.SQLTextItem) error
+	PlanTexts(digests []string, fill *[]query.PlanTextItem) error
+}
+
+// Topology provides the discovered components of the cluster.
+type Topology interface {
+	Components() []topology.Component
+	// Subscribe returns a channel receiving the components on every change.
+	Subscribe() topology.Subscriber
+}
+
+type Server struct {
+	topSQL   TopSQL
+	topology Topology
+}
+
+var started atomic.Bool
+
+// Start starts all subsystems except the HTTP service with the config, which
+// must be initialized by config.InitConfig.
+func Start(cfg *config.Config) (*Server, error) {
+	if !started.CAS(false, true) {
+		return nil, fmt.Errorf("ng monitoring is already started in the process")
+	}
+
+	if err := os.MkdirAll(cfg.Log.Path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Storage.Path, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	database.Init(cfg)
+	if err := config.LoadConfigFromStorage(document.Get); err != nil {
+		database.Stop()
+		return nil, err
+	}
+	if err := featureflag.Init(document.Get()); err != nil {
+		database.Stop()
+		return nil, err
+	}
+	if err := topology.Init(document.Get()); err != nil {
+		database.Stop()
+		return nil, err
+	}
+	pdvariable.Init(topology.GetEtcdClient())
+	topsql.Init(document.Get(), timeseries.InsertHandler, timeseries.SelectHandler, topology.Subscribe())
+	if err := conprof.Init(document.Get(), topology.Subscribe()); err != nil {
+		topsql.Stop()
+		pdvariable.Stop()
+		topology.Stop()
+		database.Stop()
+		return nil, err
+	}
+
+	return &Server{
+		topSQL:   topSQL{},
+		topology: topologyProvider{},
+	}, nil
+}
+
+// Stop stops all subsystems. The process can't start another server
+// afterwards.
+func (s *Server) Stop() {
+	conprof.Stop()
+	topsql.Stop()
+	pdvariable.Stop()
+	topology.Stop()
+	database.Stop()
+}
+
+func (s *Server) TopSQL() TopSQL {
+	return s.topSQL
+}
+
+func (s *Server) Topology() Topology {
+	return s.topology
+}
+
+// RegisterRoutes registers the HTTP APIs onto the router of the host process.
+func (s *Server) RegisterRoutes(r gin.IRouter) {
+	http.RegisterRoutes(r)
+}
+
+type topSQL struct{}
+
+func (topSQL) TopSQL(startSecs, endSecs, windowSecs, top int, instance, aggregation string, page query.Page, fill *[]query.TopSQLItem) (int, error) {
+	return query.TopSQL(startSecs, endSecs, windowSecs, top, instance, aggregation, query.TextFilter{}, page, fill)
+}
+
+func (topSQL) SQLPlans(startSecs, endSecs, windowSecs int, instance, sqlDigest, aggregation string, fill *[]query.TopSQLItem) error {
+	return query.SQLPlans(startSecs, endSecs, windowSecs, instance, sqlDigest, aggregation, fill)
+}
+
+func (topSQL) SQLInstances(startSecs, endSecs, windowSecs int, sqlDigest, aggregation string, fill *[]query.SQLInstanceItem) error {
+	return query.SQLInstances(startSecs, endSecs, windowSecs, sqlDigest, aggregation, fill)
+}
+
+func (topSQL) InstancesInRange(startSecs, endSecs int, fill *[]query.InstanceItem) error {
+	return query.InstancesInRange(startSecs, endSecs, fill)
+}
+
+func (topSQL) InstanceSummaries(startSecs, endSecs int, fill *[]query.InstanceSummaryItem) error {
+	return query.InstanceSummaries(startSecs, endSecs, fill)
+}
+
+func (topSQL) SQLTexts(digests []string, fill *[]query.SQLTextItem) error {
+	return query.SQLTexts(digests, fill)
+}
+
+func (topSQL) PlanTexts(digests []string, fill *[]query.PlanTextItem) error {
+	return query.PlanTexts(digests, fill)
+}
+
+type topologyProvider struct{}
+
+func (topologyProvider) Components() []topology.Component {
+	return topology.GetCurrentComponent()
+}
+
+func (topologyProvider) Subscribe() topology.Subscriber {
+	return topology.Subscribe()
+}
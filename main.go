@@ -3,19 +3,13 @@ package main
 import (
 	"context"
 	stdlog "log"
-	"os"
 
-	"github.com/zhongzc/ng_monitoring/component/conprof"
-	"github.com/zhongzc/ng_monitoring/component/topology"
-	"github.com/zhongzc/ng_monitoring/component/topsql"
 	"github.com/zhongzc/ng_monitoring/config"
-	"github.com/zhongzc/ng_monitoring/config/pdvariable"
-	"github.com/zhongzc/ng_monitoring/database"
-	"github.com/zhongzc/ng_monitoring/database/document"
-	"github.com/zhongzc/ng_monitoring/database/timeseries"
+	"github.com/zhongzc/ng_monitoring/embedded"
 	"github.com/zhongzc/ng_monitoring/service"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/google/gops/agent"
 	"github.com/pingcap/log"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
@@ -52,33 +46,16 @@ func main() {
 	cfg.Log.InitDefaultLogger()
 	log.Info("config", zap.Any("config", cfg))
 
-	mustCreateDirs(cfg)
-
-	database.Init(cfg)
-	defer database.Stop()
-
-	err = config.LoadConfigFromStorage(document.Get)
-	if err != nil {
-		stdlog.Fatalf("Failed to load config from storage, err: %s", err.Error())
-	}
-
-	err = topology.Init()
-	if err != nil {
-		log.Fatal("Failed to initialize topology", zap.Error(err))
+	if cfg.Debug.EnableGops {
+		startGops(cfg)
+		defer agent.Close()
 	}
-	defer topology.Stop()
-
-	pdvariable.Init(topology.GetEtcdClient())
-	defer pdvariable.Stop()
-
-	topsql.Init(document.Get(), timeseries.InsertHandler, timeseries.SelectHandler, topology.Subscribe())
-	defer topsql.Stop()
 
-	err = conprof.Init(document.Get(), topology.Subscribe())
+	server, err := embedded.Start(cfg)
 	if err != nil {
-		log.Fatal("Failed to initialize continuous profiling", zap.Error(err))
+		log.Fatal("Failed to start", zap.Error(err))
 	}
-	defer conprof.Stop()
+	defer server.Stop()
 
 	service.Init(cfg)
 	defer service.Stop()
@@ -108,12 +85,10 @@ func overrideConfig(config *config.Config) {
 	})
 }
 
-func mustCreateDirs(config *config.Config) {
-	if err := os.MkdirAll(config.Log.Path, os.ModePerm); err != nil {
-		log.Fatal("failed to init log path", zap.Error(err))
-	}
-
-	if err := os.MkdirAll(config.Storage.Path, os.ModePerm); err != nil {
-		log.Fatal("failed to init storage path", zap.Error(err))
+func startGops(config *config.Config) {
+	if err := agent.Listen(agent.Options{Addr: config.Debug.GopsAddress}); err != nil {
+		log.Warn("failed to start gops agent", zap.Error(err))
+		return
 	}
+	log.Info("gops agent started", zap.String("address", config.Debug.GopsAddress))
 }
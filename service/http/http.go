@@ -6,10 +6,13 @@ import (
 	"os"
 	"path"
 
+	"github.com/zhongzc/ng_monitoring/component/admin"
 	conprofhttp "github.com/zhongzc/ng_monitoring/component/conprof/http"
+	"github.com/zhongzc/ng_monitoring/component/topology"
 	topsqlsvc "github.com/zhongzc/ng_monitoring/component/topsql/service"
 	"github.com/zhongzc/ng_monitoring/config"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -35,26 +38,38 @@ func ServeHTTP(l *config.Log, listener net.Listener) {
 	// recovery
 	ng.Use(gin.Recovery())
 
-	// gzip
-	ng.Use(gzip.Gzip(gzip.DefaultCompression))
+	// gzip, except for streams which must be flushed as they go
+	ng.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/topsql/v1/live"})))
 
 	// route
-	configGroup := ng.Group("/config")
-	config.HTTPService(configGroup)
-	topSQLGroup := ng.Group("/topsql")
-	topsqlsvc.HTTPService(topSQLGroup)
+	RegisterRoutes(ng)
 	// register pprof http api
 	pprof.Register(ng)
 
-	continuousProfilingGroup := ng.Group("/continuous_profiling")
-	conprofhttp.HTTPService(continuousProfilingGroup)
-
 	httpServer = &http.Server{Handler: ng}
 	if err = httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 		log.Warn("failed to serve http service", zap.Error(err))
 	}
 }
 
+// RegisterRoutes registers the APIs of all components.
+func RegisterRoutes(r gin.IRouter) {
+	configGroup := r.Group("/config")
+	config.HTTPService(configGroup)
+	topSQLGroup := r.Group("/topsql")
+	topsqlsvc.HTTPService(topSQLGroup)
+	topologyGroup := r.Group("/topology")
+	topology.HTTPService(topologyGroup)
+	adminGroup := r.Group("/admin")
+	admin.HTTPService(adminGroup)
+	continuousProfilingGroup := r.Group("/continuous_profiling")
+	conprofhttp.HTTPService(continuousProfilingGroup)
+	// metrics of ng-monitoring itself, including the timeseries database
+	r.GET("/metrics", func(c *gin.Context) {
+		metrics.WritePrometheus(c.Writer, true)
+	})
+}
+
 func StopHTTP() {
 	if httpServer == nil {
 		return